@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/backup"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("authsvc backup", flag.ExitOnError)
+	var (
+		urn = fs.String("urn", "auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		dir = fs.String("dir", "backups", "directory to write the backup into")
+	)
+	fs.Usage = usage.For(fs, "authsvc backup [flags]")
+	fs.Parse(args)
+
+	repo, err := auth.NewRepository(*urn, auth.PoolConfig{})
+	if err != nil {
+		return err
+	}
+
+	filenames, err := backup.Run(context.Background(), *dir, backupSource(repo))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("auth DB backed up to %s\n", filenames[0])
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("authsvc restore", flag.ExitOnError)
+	var (
+		file = fs.String("file", "", "backup file to restore")
+		urn  = fs.String("urn", "auth.db", "URN for new auth DB (SQLite only)")
+	)
+	fs.Usage = usage.For(fs, "authsvc restore [flags]")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	if err := auth.RestoreBackup(context.Background(), *file, *urn); err != nil {
+		return err
+	}
+	fmt.Printf("auth DB restored from %s into %s\n", *file, *urn)
+	return nil
+}
+
+func backupSource(repo auth.Repository) backup.Source {
+	return backup.Source{Name: "auth", Backuper: repo, Verify: auth.VerifyBackup}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+// runLink links an identity at an external OpenID Connect provider to a
+// local user directly in the DB, so that the user can sign in with it.
+func runLink(args []string) error {
+	fs := flag.NewFlagSet("authsvc link", flag.ExitOnError)
+	var (
+		urn     = fs.String("urn", "auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		issuer  = fs.String("issuer", "", "issuer of the identity, as passed to -oidc-issuer")
+		subject = fs.String("subject", "", "subject of the identity, i.e. its sub claim")
+		user    = fs.String("user", "", "local user to link the identity to")
+	)
+	fs.Usage = usage.For(fs, "authsvc link [flags]")
+	fs.Parse(args)
+
+	if *issuer == "" || *subject == "" {
+		return errors.New("-issuer and -subject are required")
+	}
+
+	repo, err := auth.NewRepository(*urn, auth.PoolConfig{})
+	if err != nil {
+		return err
+	}
+
+	if err := repo.Link(context.Background(), auth.Identity{Issuer: *issuer, Subject: *subject}, *user); err != nil {
+		return errors.Wrapf(err, "user %q", *user)
+	}
+	fmt.Printf("%s at %s is now %s\n", *subject, *issuer, *user)
+	return nil
+}
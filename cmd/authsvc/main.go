@@ -3,52 +3,249 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
 	"github.com/oklog/run"
+	"github.com/peterbourgon/gattaca/pkg/audit"
 	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/backup"
+	"github.com/peterbourgon/gattaca/pkg/privacy"
+	"github.com/peterbourgon/gattaca/pkg/ratelimit"
 	"github.com/peterbourgon/usage"
 	"github.com/pkg/errors"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		for subcommand, run := range map[string]func([]string) error{
+			"backup":  runBackup,
+			"link":    runLink,
+			"migrate": runMigrate,
+			"restore": runRestore,
+			"role":    runRole,
+			"seed":    runSeed,
+		} {
+			if os.Args[1] == subcommand {
+				if err := run(os.Args[2:]); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", subcommand, err)
+					os.Exit(1)
+				}
+				return
+			}
+		}
+	}
+
 	fs := flag.NewFlagSet("authsvc", flag.ExitOnError)
 	var (
-		apiAddr = fs.String("api", "127.0.0.1:8081", "HTTP API listen address")
-		urn     = fs.String("urn", "auth.db", "URN for auth DB")
+		apiAddr         = fs.String("api", "127.0.0.1:8081", "HTTP API listen address")
+		adminAddr       = fs.String("admin", "", "HTTP admin API listen address (empty to disable)")
+		urn             = fs.String("urn", "auth.db", "URN for auth DB (SQLite file, postgres://..., or memory:)")
+		maxOpenConns    = fs.Int("max-open-conns", 0, "maximum open DB connections (0 for unlimited)")
+		maxIdleConns    = fs.Int("max-idle-conns", 0, "maximum idle DB connections (0 for default)")
+		connMaxLifetime = fs.Duration("conn-max-lifetime", 0, "maximum lifetime of a DB connection (0 for unlimited)")
+		queryTimeout    = fs.Duration("query-timeout", 0, "maximum duration of each DB operation (0 for unlimited)")
+		journalMode     = fs.String("sqlite-journal-mode", "WAL", "SQLite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)")
+		synchronous     = fs.String("sqlite-synchronous", "NORMAL", "SQLite synchronous level (OFF, NORMAL, FULL, EXTRA)")
+		busyTimeout     = fs.Duration("sqlite-busy-timeout", 5*time.Second, "how long SQLite waits for a locked DB before failing")
+		readPool        = fs.Bool("sqlite-read-pool", true, "use separate SQLite connection pools for reads and writes")
+		backupDir       = fs.String("backup-dir", "", "directory for auth DB backups (empty to disable backups)")
+		backupInterval  = fs.Duration("backup-interval", 24*time.Hour, "how often the auth DB is backed up")
+		backupKeep      = fs.Int("backup-keep", 7, "how many backups are kept")
+		erasureJournal  = fs.String("erasure-journal", "auth-erasures.jsonl", "file recording erasures of users, with their receipts")
+		devSeed         = fs.String("dev-seed", "", "seed file to load at startup (development only)")
+		oidcIssuer      = fs.String("oidc-issuer", "", "OpenID Connect issuer to sign users in with (empty to disable)")
+		oidcClientID    = fs.String("oidc-client-id", "", "OpenID Connect client ID")
+		oidcSecret      = fs.String("oidc-client-secret", "", "OpenID Connect client secret (empty for a public client)")
+		oidcRedirectURL = fs.String("oidc-redirect-url", "", "URL of /oidc/callback, as registered with the issuer")
+		oidcUserClaim   = fs.String("oidc-user-claim", "preferred_username", "ID token claim naming auto-provisioned users")
+		oidcProvision   = fs.Bool("oidc-auto-provision", false, "create local users for identities which aren't linked to one")
+		lockoutUser     = fs.Int("lockout-user-failures", 10, "failed logins after which a user is locked out (0 to disable)")
+		lockoutIP       = fs.Int("lockout-ip-failures", 100, "failed logins after which a client IP is locked out (0 to disable)")
+		lockoutDuration = fs.Duration("lockout-duration", 15*time.Minute, "how long lockouts last")
+		lockoutWindow   = fs.Duration("lockout-window", time.Hour, "how long failed logins are counted for")
+		loginDelay      = fs.Duration("login-delay", time.Second, "delay before retrying a failed login, doubling with each failure (0 to disable)")
+		loginMaxDelay   = fs.Duration("login-max-delay", time.Minute, "maximum delay before retrying a failed login")
+		minUserLength   = fs.Int("min-user-length", 1, "minimum length of user names")
+		maxUserLength   = fs.Int("max-user-length", 64, "maximum length of user names")
+		minPassLength   = fs.Int("min-pass-length", 8, "minimum length of passes")
+		maxPassLength   = fs.Int("max-pass-length", 1024, "maximum length of passes")
+		breachedPasses  = fs.String("breached-passes", "", "file of breached passes, or their SHA-1 hashes, which users may not choose")
+		resetNotify     = fs.String("reset-notify", "", "deliver pass reset tokens to log, or file:PATH (development only; empty disables resets)")
+		rateLimit       = fs.Float64("rate-limit", 0, "API requests per second allowed to each user, API key, or unauthenticated client IP (0 to disable)")
+		rateBurst       = fs.Int("rate-burst", 20, "API requests each client may make at once, beyond the rate limit")
+		auditSink       = fs.String("audit", "", "audit log of logins, validations, and changes to accounts: file:PATH for JSON lines, or sqlite:PATH (empty to disable)")
 	)
 	fs.Usage = usage.For(fs, "authsvc [flags]")
 	fs.Parse(os.Args[1:])
 
+	if *adminAddr != "" && *backupDir == "" {
+		fmt.Fprintf(os.Stderr, "-admin requires -backup-dir\n")
+		os.Exit(1)
+	}
+
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stdout)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 	}
 
+	var auditlog *audit.Log
+	if *auditSink != "" {
+		sink, err := audit.OpenSink(*auditSink)
+		if err != nil {
+			logger.Log("during", "-audit", "err", err)
+			os.Exit(1)
+		}
+		auditlog, err = audit.NewLog(context.Background(), sink)
+		if err != nil {
+			logger.Log("during", "audit.NewLog", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	var authrepo auth.Repository
 	{
-		var err error
-		authrepo, err = auth.NewSQLiteRepository(*urn)
+		var (
+			pool = auth.PoolConfig{
+				MaxOpenConns:    *maxOpenConns,
+				MaxIdleConns:    *maxIdleConns,
+				ConnMaxLifetime: *connMaxLifetime,
+				QueryTimeout:    *queryTimeout,
+			}
+			sqlite = []auth.SQLiteOption{
+				auth.WithJournalMode(*journalMode),
+				auth.WithSynchronous(*synchronous),
+				auth.WithBusyTimeout(*busyTimeout),
+				auth.WithReadPool(*readPool),
+			}
+			err error
+		)
+		authrepo, err = auth.NewRepository(*urn, pool, sqlite...)
 		if err != nil {
-			logger.Log("during", "auth.NewSQLiteRepository", "err", err)
+			logger.Log("during", "auth.NewRepository", "err", err)
 			os.Exit(1)
 		}
+		if *devSeed != "" {
+			created, _, err := loadSeedFile(context.Background(), authrepo, *devSeed)
+			if err != nil {
+				logger.Log("during", "loadSeedFile", "err", err)
+				os.Exit(1)
+			}
+			logger.Log("seed", *devSeed, "created", created)
+		}
 	}
 
 	var authsvc auth.Service
 	{
-		authsvc = auth.NewDefaultService(authrepo)
+		policy := auth.DefaultPolicy
+		policy.MinUserLength, policy.MaxUserLength = *minUserLength, *maxUserLength
+		policy.MinPassLength, policy.MaxPassLength = *minPassLength, *maxPassLength
+		if *breachedPasses != "" {
+			var err error
+			policy.Breached, err = auth.LoadBreachedList(*breachedPasses)
+			if err != nil {
+				logger.Log("during", "auth.LoadBreachedList", "err", err)
+				os.Exit(1)
+			}
+			logger.Log("breached_passes", policy.Breached.Len())
+		}
+		options := []auth.Option{
+			auth.WithPolicy(policy),
+			auth.WithLockout(auth.LockoutConfig{
+				MaxUserFailures: *lockoutUser,
+				MaxIPFailures:   *lockoutIP,
+				BaseDelay:       *loginDelay,
+				MaxDelay:        *loginMaxDelay,
+				LockoutDuration: *lockoutDuration,
+				Window:          *lockoutWindow,
+			}),
+		}
+		switch {
+		case *resetNotify == "log":
+			options = append(options, auth.WithNotifier(auth.LogNotifier{Logger: log.With(logger, "component", "reset")}))
+		case strings.HasPrefix(*resetNotify, "file:"):
+			options = append(options, auth.WithNotifier(auth.NewFileNotifier(strings.TrimPrefix(*resetNotify, "file:"))))
+		case *resetNotify != "":
+			logger.Log("during", "-reset-notify", "err", "want log or file:PATH")
+			os.Exit(1)
+		}
+		authsvc = auth.NewDefaultService(authrepo, options...)
+		if auditlog != nil {
+			authsvc = auth.NewAuditedService(authsvc, auditlog)
+		}
+	}
+
+	var authserver http.Handler
+	{
+		var options []auth.HTTPServerOption
+		if *oidcIssuer != "" {
+			o, err := auth.NewOIDC(context.Background(), authrepo, auth.OIDCConfig{
+				Issuer:        *oidcIssuer,
+				ClientID:      *oidcClientID,
+				ClientSecret:  *oidcSecret,
+				RedirectURL:   *oidcRedirectURL,
+				UserClaim:     *oidcUserClaim,
+				AutoProvision: *oidcProvision,
+			})
+			if err != nil {
+				logger.Log("during", "auth.NewOIDC", "err", err)
+				os.Exit(1)
+			}
+			options = append(options, auth.WithOIDC(o))
+			logger.Log("component", "OIDC", "issuer", *oidcIssuer)
+		}
+		if auditlog != nil {
+			options = append(options, auth.WithAuditLog(auditlog))
+		}
+		authserver = auth.NewHTTPServer(reuseValidation(authsvc), options...) // validated once per request
+	}
+
+	var journal *privacy.Journal
+	{
+		var err error
+		journal, err = privacy.NewJournal(*erasureJournal)
+		if err != nil {
+			logger.Log("during", "privacy.NewJournal", "err", err)
+			os.Exit(1)
+		}
+		resumed, err := journal.Resume(context.Background(), privacySource(authrepo))
+		if err != nil {
+			logger.Log("during", "Resume", "err", err)
+			os.Exit(1)
+		}
+		if len(resumed) > 0 {
+			logger.Log("component", "privacy", "resumed_erasures", len(resumed))
+		}
 	}
 
 	var api http.Handler
 	{
-		api = auth.NewHTTPServer(authsvc)
+		r := mux.NewRouter()
+		r.PathPrefix("/privacy/").Handler(http.StripPrefix("/privacy", privacy.NewHTTPServer(ratelimit.ReuseValidation(authsvc), journal, privacySource(authrepo))))
+		if auditlog != nil {
+			r.PathPrefix("/audit/").Handler(http.StripPrefix("/audit", audit.NewHTTPServer(ratelimit.ReuseValidation(authsvc), auditlog)))
+		}
+		r.PathPrefix("/").Handler(authserver)
+		api = r
+	}
+	if auditlog != nil {
+		api = audit.RecordClientIP(api)
+	}
+	if *rateLimit > 0 {
+		api = ratelimit.NewLimiter(*rateLimit, *rateBurst).Handler(authsvc, api)
+	}
+
+	var sources []backup.Source
+	{
+		sources = []backup.Source{backupSource(authrepo)}
 	}
 
 	var g run.Group
@@ -66,6 +263,28 @@ func main() {
 			server.Shutdown(ctx)
 		})
 	}
+	if *adminAddr != "" {
+		server := &http.Server{
+			Addr:    *adminAddr,
+			Handler: backup.NewHTTPServer(*backupDir, *backupKeep, sources...),
+		}
+		g.Add(func() error {
+			logger.Log("component", "admin", "addr", *adminAddr)
+			return server.ListenAndServe()
+		}, func(error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	}
+	if *backupDir != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return backup.Schedule(ctx, *backupDir, *backupInterval, *backupKeep, logger, sources...)
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
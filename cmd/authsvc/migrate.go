@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/usage"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("authsvc migrate", flag.ExitOnError)
+	var (
+		urn    = fs.String("urn", "auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		target = fs.Int("to", -1, "target schema version (-1 for latest)")
+		status = fs.Bool("status", false, "print the current schema version, and exit")
+	)
+	fs.Usage = usage.For(fs, "authsvc migrate [flags]")
+	fs.Parse(args)
+
+	if *status {
+		current, latest, err := auth.SchemaVersion(context.Background(), *urn)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("auth DB at schema version %d, latest is %d\n", current, latest)
+		return nil
+	}
+
+	from, to, err := auth.Migrate(context.Background(), *urn, *target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("auth DB migrated from schema version %d to %d\n", from, to)
+	return nil
+}
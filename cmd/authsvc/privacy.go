@@ -0,0 +1,16 @@
+package main
+
+import (
+	"context"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/privacy"
+)
+
+func privacySource(repo auth.Repository) privacy.Source {
+	return privacy.Source{
+		Name:   "auth",
+		Export: func(ctx context.Context, user string) (interface{}, error) { return repo.Export(ctx, user) },
+		Erase:  repo.Erase,
+	}
+}
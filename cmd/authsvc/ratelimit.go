@@ -0,0 +1,25 @@
+package main
+
+import (
+	"context"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/ratelimit"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+// reuseValidation returns the service, except that Validate returns the
+// principal the rate limiter validated for the request, if any, so that
+// each request is validated, and audited, once.
+func reuseValidation(s auth.Service) auth.Service {
+	return reusingService{s, ratelimit.ReuseValidation(s)}
+}
+
+type reusingService struct {
+	auth.Service
+	valid ratelimit.Validator
+}
+
+func (s reusingService) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	return s.valid.Validate(ctx, user, token)
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/usage"
+)
+
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("authsvc seed", flag.ExitOnError)
+	var (
+		urn  = fs.String("urn", "auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		file = fs.String("file", "dev/seed.json", "seed file to load")
+	)
+	fs.Usage = usage.For(fs, "authsvc seed [flags]")
+	fs.Parse(args)
+
+	repo, err := auth.NewRepository(*urn, auth.PoolConfig{})
+	if err != nil {
+		return err
+	}
+
+	created, skipped, err := loadSeedFile(context.Background(), repo, *file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("auth DB seeded from %s: %d user(s) created, %d already existed\n", *file, created, skipped)
+	return nil
+}
+
+func loadSeedFile(ctx context.Context, repo auth.Repository, filename string) (created, skipped int, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	return auth.LoadSeed(ctx, repo, f)
+}
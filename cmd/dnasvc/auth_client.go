@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
 
 	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
 	"github.com/pkg/errors"
 )
 
@@ -15,19 +18,26 @@ func newAuthClient(addr string) dna.Validator {
 
 type authClient string // base URL
 
-func (c authClient) Validate(ctx context.Context, user, token string) error {
-	url := fmt.Sprintf("%s/validate?user=%s&token=%s", c, user, token)
-	req, err := http.NewRequest("GET", url, nil)
+func (c authClient) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	// The token may be a long-lived API key, so keep it out of the URL,
+	// where it would end up in access logs.
+	u := fmt.Sprintf("%s/validate?user=%s", c, url.QueryEscape(user))
+	req, err := http.NewRequest("GET", u, nil)
 	if err != nil {
-		return errors.Wrap(err, "error constructing validate request")
+		return rbac.Principal{}, errors.Wrap(err, "error constructing validate request")
 	}
-	resp, err := http.DefaultClient.Do(req)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
 	if err != nil {
-		return errors.Wrap(err, "error making validate request")
+		return rbac.Principal{}, errors.Wrap(err, "error making validate request")
 	}
-	resp.Body.Close()
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return errors.Errorf("authsvc returned %s", resp.Status)
+		return rbac.Principal{}, errors.Errorf("authsvc returned %s", resp.Status)
 	}
-	return nil
+	var p rbac.Principal
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		return rbac.Principal{}, errors.Wrap(err, "error decoding principal")
+	}
+	return p, nil
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/backup"
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("dnasvc backup", flag.ExitOnError)
+	var (
+		urn = fs.String("urn", "dna.db", "URN for DNA DB (SQLite file, or postgres://...)")
+		dir = fs.String("dir", "backups", "directory to write the backup into")
+	)
+	fs.Usage = usage.For(fs, "dnasvc backup [flags]")
+	fs.Parse(args)
+
+	repo, err := dna.NewRepository(*urn, dna.PoolConfig{})
+	if err != nil {
+		return err
+	}
+
+	filenames, err := backup.Run(context.Background(), *dir, backupSource(repo))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DNA DB backed up to %s\n", filenames[0])
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("dnasvc restore", flag.ExitOnError)
+	var (
+		file = fs.String("file", "", "backup file to restore")
+		urn  = fs.String("urn", "dna.db", "URN for new DNA DB (SQLite only)")
+	)
+	fs.Usage = usage.For(fs, "dnasvc restore [flags]")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	if err := dna.RestoreBackup(context.Background(), *file, *urn); err != nil {
+		return err
+	}
+	fmt.Printf("DNA DB restored from %s into %s\n", *file, *urn)
+	return nil
+}
+
+func backupSource(repo dna.Repository) backup.Source {
+	return backup.Source{Name: "dna", Backuper: repo, Verify: dna.VerifyBackup}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+// runKeygen appends a new master key to the keyfile, where it becomes the
+// current key. To rotate keys: run keygen, restart the service so that it
+// can unwrap data keys with the new master key, run rotate-keys, and then
+// remove the old master key from the keyfile.
+func runKeygen(args []string) error {
+	fs := flag.NewFlagSet("dnasvc keygen", flag.ExitOnError)
+	var (
+		keyfile = fs.String("keyfile", "dna.keys", "keyfile to append the new master key to")
+	)
+	fs.Usage = usage.For(fs, "dnasvc keygen [flags]")
+	fs.Parse(args)
+
+	key, err := dna.GenerateMasterKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*keyfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintln(f, key); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("new master key appended to %s\n", *keyfile)
+	return nil
+}
+
+func runRotateKeys(args []string) error {
+	fs := flag.NewFlagSet("dnasvc rotate-keys", flag.ExitOnError)
+	var (
+		urn     = fs.String("urn", "dna.db", "URN for DNA DB (SQLite only)")
+		keyfile = fs.String("keyfile", "dna.keys", "keyfile with the old and new master keys")
+	)
+	fs.Usage = usage.For(fs, "dnasvc rotate-keys [flags]")
+	fs.Parse(args)
+
+	keyring, err := dna.LoadKeyring(*keyfile)
+	if err != nil {
+		return errors.Wrap(err, "error loading keyfile")
+	}
+	repo, err := dna.NewSQLiteRepository(*urn, dna.WithKeyring(keyring))
+	if err != nil {
+		return err
+	}
+
+	rewrapped, encrypted, err := repo.RotateKeys(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DNA DB keys rotated: %d data key(s) re-wrapped, %d sequence(s) encrypted\n", rewrapped, encrypted)
+	return nil
+}
@@ -3,58 +3,197 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/gorilla/mux"
 	"github.com/oklog/run"
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/backup"
 	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/gattaca/pkg/privacy"
+	"github.com/peterbourgon/gattaca/pkg/ratelimit"
 	"github.com/peterbourgon/usage"
 	"github.com/pkg/errors"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		for subcommand, run := range map[string]func([]string) error{
+			"backup":      runBackup,
+			"keygen":      runKeygen,
+			"migrate":     runMigrate,
+			"restore":     runRestore,
+			"rotate-keys": runRotateKeys,
+			"seed":        runSeed,
+		} {
+			if os.Args[1] == subcommand {
+				if err := run(os.Args[2:]); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", subcommand, err)
+					os.Exit(1)
+				}
+				return
+			}
+		}
+	}
+
 	fs := flag.NewFlagSet("dnasvc", flag.ExitOnError)
 	var (
-		apiAddr     = fs.String("api", "127.0.0.1:8082", "HTTP API listen address")
-		urn         = fs.String("urn", "dna.db", "URN for DNA DB")
-		authsvcAddr = fs.String("authsvc", "http://127.0.0.1:8081", "HTTP endpoint for authsvc")
+		apiAddr         = fs.String("api", "127.0.0.1:8082", "HTTP API listen address")
+		adminAddr       = fs.String("admin", "", "HTTP admin API listen address (empty to disable)")
+		urn             = fs.String("urn", "dna.db", "URN for DNA DB (SQLite file, postgres://..., or memory:)")
+		authsvcAddr     = fs.String("authsvc", "http://127.0.0.1:8081", "HTTP endpoint for authsvc")
+		retention       = fs.Duration("retention", 30*24*time.Hour, "how long deleted DNA sequences are kept")
+		purgeInterval   = fs.Duration("purge-interval", time.Hour, "how often deleted DNA sequences are purged")
+		references      = fs.String("references", "", "comma-separated names of DNA sequences available to all users as references")
+		maxOpenConns    = fs.Int("max-open-conns", 0, "maximum open DB connections (0 for unlimited)")
+		maxIdleConns    = fs.Int("max-idle-conns", 0, "maximum idle DB connections (0 for default)")
+		connMaxLifetime = fs.Duration("conn-max-lifetime", 0, "maximum lifetime of a DB connection (0 for unlimited)")
+		queryTimeout    = fs.Duration("query-timeout", 0, "maximum duration of each DB operation (0 for unlimited)")
+		journalMode     = fs.String("sqlite-journal-mode", "WAL", "SQLite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)")
+		synchronous     = fs.String("sqlite-synchronous", "NORMAL", "SQLite synchronous level (OFF, NORMAL, FULL, EXTRA)")
+		busyTimeout     = fs.Duration("sqlite-busy-timeout", 5*time.Second, "how long SQLite waits for a locked DB before failing")
+		readPool        = fs.Bool("sqlite-read-pool", true, "use separate SQLite connection pools for reads and writes")
+		keyfile         = fs.String("keyfile", "", "keyfile of master keys, to encrypt DNA sequences at rest (SQLite only; empty to disable)")
+		backupDir       = fs.String("backup-dir", "", "directory for DNA DB backups (empty to disable backups)")
+		backupInterval  = fs.Duration("backup-interval", 24*time.Hour, "how often the DNA DB is backed up")
+		backupKeep      = fs.Int("backup-keep", 7, "how many backups are kept")
+		erasureJournal  = fs.String("erasure-journal", "dna-erasures.jsonl", "file recording erasures of users, with their receipts")
+		devSeed         = fs.String("dev-seed", "", "seed file to load at startup (development only)")
+		rateLimit       = fs.Float64("rate-limit", 0, "API requests per second allowed to each user, API key, or unauthenticated client IP (0 to disable)")
+		rateBurst       = fs.Int("rate-burst", 20, "API requests each client may make at once, beyond the rate limit")
+		quotaBases      = fs.Int("quota-bases", 0, "most DNA bases each user may store (0 for unlimited)")
+		quotaSamples    = fs.Int("quota-samples", 0, "most DNA samples each user may store (0 for unlimited)")
+		auditSink       = fs.String("audit", "", "audit log of reads of and changes to DNA: file:PATH for JSON lines, or sqlite:PATH (empty to disable)")
 	)
 	fs.Usage = usage.For(fs, "dnasvc [flags]")
 	fs.Parse(os.Args[1:])
 
+	if *adminAddr != "" && *backupDir == "" {
+		fmt.Fprintf(os.Stderr, "-admin requires -backup-dir\n")
+		os.Exit(1)
+	}
+
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stdout)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 	}
 
+	var auditlog *audit.Log
+	if *auditSink != "" {
+		sink, err := audit.OpenSink(*auditSink)
+		if err != nil {
+			logger.Log("during", "-audit", "err", err)
+			os.Exit(1)
+		}
+		auditlog, err = audit.NewLog(context.Background(), sink)
+		if err != nil {
+			logger.Log("during", "audit.NewLog", "err", err)
+			os.Exit(1)
+		}
+	}
+
 	var dnarepo dna.Repository
 	{
-		var err error
-		dnarepo, err = dna.NewSQLiteRepository(*urn)
+		var (
+			pool = dna.PoolConfig{
+				MaxOpenConns:    *maxOpenConns,
+				MaxIdleConns:    *maxIdleConns,
+				ConnMaxLifetime: *connMaxLifetime,
+				QueryTimeout:    *queryTimeout,
+			}
+			sqlite = []dna.SQLiteOption{
+				dna.WithJournalMode(*journalMode),
+				dna.WithSynchronous(*synchronous),
+				dna.WithBusyTimeout(*busyTimeout),
+				dna.WithReadPool(*readPool),
+			}
+			err error
+		)
+		if *keyfile != "" {
+			keyring, err := dna.LoadKeyring(*keyfile)
+			if err != nil {
+				logger.Log("during", "dna.LoadKeyring", "err", err)
+				os.Exit(1)
+			}
+			sqlite = append(sqlite, dna.WithKeyring(keyring))
+		}
+		dnarepo, err = dna.NewRepository(*urn, pool, sqlite...)
 		if err != nil {
-			logger.Log("during", "dna.NewSQLiteRepository", "err", err)
+			logger.Log("during", "dna.NewRepository", "err", err)
 			os.Exit(1)
 		}
+		if *devSeed != "" {
+			created, _, err := loadSeedFile(context.Background(), dnarepo, *devSeed)
+			if err != nil {
+				logger.Log("during", "loadSeedFile", "err", err)
+				os.Exit(1)
+			}
+			logger.Log("seed", *devSeed, "created", created)
+		}
 	}
 
 	var validator dna.Validator
 	{
-		validator = authClient(*authsvcAddr)
+		validator = ratelimit.ReuseValidation(authClient(*authsvcAddr)) // validated once per request
 	}
 
 	var dnasvc dna.Service
 	{
-		dnasvc = dna.NewDefaultService(dnarepo, validator)
+		dnasvc = dna.NewDefaultService(dnarepo, validator,
+			dna.WithReferences(splitList(*references)...),
+			dna.WithQuota(dna.Quota{MaxBases: *quotaBases, MaxSamples: *quotaSamples}),
+		)
+		if auditlog != nil {
+			dnasvc = dna.NewAuditedService(dnasvc, auditlog)
+		}
+	}
+
+	var journal *privacy.Journal
+	{
+		var err error
+		journal, err = privacy.NewJournal(*erasureJournal)
+		if err != nil {
+			logger.Log("during", "privacy.NewJournal", "err", err)
+			os.Exit(1)
+		}
+		resumed, err := journal.Resume(context.Background(), privacySource(dnarepo, auditlog))
+		if err != nil {
+			logger.Log("during", "Resume", "err", err)
+			os.Exit(1)
+		}
+		if len(resumed) > 0 {
+			logger.Log("component", "privacy", "resumed_erasures", len(resumed))
+		}
 	}
 
 	var api http.Handler
 	{
-		api = dna.NewHTTPServer(dnasvc)
+		r := mux.NewRouter()
+		r.PathPrefix("/privacy/").Handler(http.StripPrefix("/privacy", privacy.NewHTTPServer(validator, journal, privacySource(dnarepo, auditlog))))
+		if auditlog != nil {
+			r.PathPrefix("/audit/").Handler(http.StripPrefix("/audit", audit.NewHTTPServer(validator, auditlog)))
+		}
+		r.PathPrefix("/").Handler(dna.NewHTTPServer(dnasvc))
+		api = r
+	}
+	if auditlog != nil {
+		api = audit.RecordClientIP(api)
+	}
+	if *rateLimit > 0 {
+		api = ratelimit.NewLimiter(*rateLimit, *rateBurst).Handler(validator, api)
+	}
+
+	var sources []backup.Source
+	{
+		sources = []backup.Source{backupSource(dnarepo)}
 	}
 
 	var g run.Group
@@ -72,6 +211,50 @@ func main() {
 			server.Shutdown(ctx)
 		})
 	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			ticker := time.NewTicker(*purgeInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					n, err := dnarepo.Purge(ctx, time.Now().Add(-*retention))
+					if err != nil {
+						logger.Log("during", "Purge", "err", err)
+						continue
+					}
+					logger.Log("component", "purge", "purged", n)
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+	if *adminAddr != "" {
+		server := &http.Server{
+			Addr:    *adminAddr,
+			Handler: backup.NewHTTPServer(*backupDir, *backupKeep, sources...),
+		}
+		g.Add(func() error {
+			logger.Log("component", "admin", "addr", *adminAddr)
+			return server.ListenAndServe()
+		}, func(error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	}
+	if *backupDir != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return backup.Schedule(ctx, *backupDir, *backupInterval, *backupKeep, logger, sources...)
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
@@ -89,3 +272,13 @@ func main() {
 	}
 	logger.Log("exit", g.Run())
 }
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
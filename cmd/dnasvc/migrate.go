@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("dnasvc migrate", flag.ExitOnError)
+	var (
+		urn    = fs.String("urn", "dna.db", "URN for DNA DB (SQLite file, or postgres://...)")
+		target = fs.Int("to", -1, "target schema version (-1 for latest)")
+		status = fs.Bool("status", false, "print the current schema version, and exit")
+	)
+	fs.Usage = usage.For(fs, "dnasvc migrate [flags]")
+	fs.Parse(args)
+
+	if *status {
+		current, latest, err := dna.SchemaVersion(context.Background(), *urn)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("DNA DB at schema version %d, latest is %d\n", current, latest)
+		return nil
+	}
+
+	from, to, err := dna.Migrate(context.Background(), *urn, *target)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DNA DB migrated from schema version %d to %d\n", from, to)
+	return nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/gattaca/pkg/privacy"
+)
+
+// privacySource returns the source for the repository. Exports are recorded
+// to the audit log, if there is one.
+func privacySource(repo dna.Repository, auditlog *audit.Log) privacy.Source {
+	export := repo.Export
+	if auditlog != nil {
+		export = dna.AuditedExport(repo, auditlog)
+	}
+	return privacy.Source{
+		Name:   "dna",
+		Export: func(ctx context.Context, user string) (interface{}, error) { return export(ctx, user) },
+		Erase:  repo.Erase,
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+)
+
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("dnasvc seed", flag.ExitOnError)
+	var (
+		urn  = fs.String("urn", "dna.db", "URN for DNA DB (SQLite file, or postgres://...)")
+		file = fs.String("file", "dev/seed.json", "seed file to load")
+	)
+	fs.Usage = usage.For(fs, "dnasvc seed [flags]")
+	fs.Parse(args)
+
+	repo, err := dna.NewRepository(*urn, dna.PoolConfig{})
+	if err != nil {
+		return err
+	}
+
+	created, skipped, err := loadSeedFile(context.Background(), repo, *file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("DNA DB seeded from %s: %d sequence(s) created, %d already existed\n", *file, created, skipped)
+	return nil
+}
+
+func loadSeedFile(ctx context.Context, repo dna.Repository, filename string) (created, skipped int, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	return dna.LoadSeed(ctx, repo, f)
+}
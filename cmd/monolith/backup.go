@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/backup"
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("monolith backup", flag.ExitOnError)
+	var (
+		authURN = fs.String("auth-urn", "file:auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		dnaURN  = fs.String("dna-urn", "file:dna.db", "URN for DNA DB (SQLite file, or postgres://...)")
+		dir     = fs.String("dir", "backups", "directory to write the backups into")
+	)
+	fs.Usage = usage.For(fs, "monolith backup [flags]")
+	fs.Parse(args)
+
+	authrepo, err := auth.NewRepository(*authURN, auth.PoolConfig{})
+	if err != nil {
+		return errors.Wrap(err, "auth DB")
+	}
+	dnarepo, err := dna.NewRepository(*dnaURN, dna.PoolConfig{})
+	if err != nil {
+		return errors.Wrap(err, "DNA DB")
+	}
+
+	filenames, err := backup.Run(context.Background(), *dir, backupSources(authrepo, dnarepo)...)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("auth DB backed up to %s\n", filenames[0])
+	fmt.Printf("DNA DB backed up to %s\n", filenames[1])
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("monolith restore", flag.ExitOnError)
+	var (
+		authFile = fs.String("auth-file", "", "auth DB backup file to restore")
+		dnaFile  = fs.String("dna-file", "", "DNA DB backup file to restore")
+		authURN  = fs.String("auth-urn", "file:auth.db", "URN for new auth DB (SQLite only)")
+		dnaURN   = fs.String("dna-urn", "file:dna.db", "URN for new DNA DB (SQLite only)")
+	)
+	fs.Usage = usage.For(fs, "monolith restore [flags]")
+	fs.Parse(args)
+
+	if *authFile == "" || *dnaFile == "" {
+		return errors.New("-auth-file and -dna-file are required")
+	}
+
+	// Verify both before restoring either, so we don't restore only one.
+	if err := auth.VerifyBackup(context.Background(), *authFile); err != nil {
+		return errors.Wrap(err, "auth DB")
+	}
+	if err := dna.VerifyBackup(context.Background(), *dnaFile); err != nil {
+		return errors.Wrap(err, "DNA DB")
+	}
+
+	if err := auth.RestoreBackup(context.Background(), *authFile, *authURN); err != nil {
+		return errors.Wrap(err, "auth DB")
+	}
+	fmt.Printf("auth DB restored from %s into %s\n", *authFile, *authURN)
+
+	if err := dna.RestoreBackup(context.Background(), *dnaFile, *dnaURN); err != nil {
+		return errors.Wrap(err, "DNA DB")
+	}
+	fmt.Printf("DNA DB restored from %s into %s\n", *dnaFile, *dnaURN)
+	return nil
+}
+
+func backupSources(authrepo auth.Repository, dnarepo dna.Repository) []backup.Source {
+	return []backup.Source{
+		{Name: "auth", Backuper: authrepo, Verify: auth.VerifyBackup},
+		{Name: "dna", Backuper: dnarepo, Verify: dna.VerifyBackup},
+	}
+}
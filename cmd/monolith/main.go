@@ -3,60 +3,263 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/gorilla/mux"
 	"github.com/oklog/run"
+	"github.com/peterbourgon/gattaca/pkg/audit"
 	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/backup"
 	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/gattaca/pkg/privacy"
+	"github.com/peterbourgon/gattaca/pkg/ratelimit"
 	"github.com/peterbourgon/usage"
 	"github.com/pkg/errors"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		for subcommand, run := range map[string]func([]string) error{
+			"backup":      runBackup,
+			"keygen":      runKeygen,
+			"link":        runLink,
+			"migrate":     runMigrate,
+			"restore":     runRestore,
+			"role":        runRole,
+			"rotate-keys": runRotateKeys,
+			"seed":        runSeed,
+		} {
+			if os.Args[1] == subcommand {
+				if err := run(os.Args[2:]); err != nil {
+					fmt.Fprintf(os.Stderr, "%s: %v\n", subcommand, err)
+					os.Exit(1)
+				}
+				return
+			}
+		}
+	}
+
 	fs := flag.NewFlagSet("monolith", flag.ExitOnError)
 	var (
-		apiAddr = fs.String("api", "127.0.0.1:8080", "HTTP API listen address")
-		authURN = fs.String("auth-urn", "file:auth.db", "URN for auth DB")
-		dnaURN  = fs.String("dna-urn", "file:dna.db", "URN for DNA DB")
+		apiAddr         = fs.String("api", "127.0.0.1:8080", "HTTP API listen address")
+		adminAddr       = fs.String("admin", "", "HTTP admin API listen address (empty to disable)")
+		authURN         = fs.String("auth-urn", "file:auth.db", "URN for auth DB (SQLite file, postgres://..., or memory:)")
+		dnaURN          = fs.String("dna-urn", "file:dna.db", "URN for DNA DB (SQLite file, postgres://..., or memory:)")
+		retention       = fs.Duration("retention", 30*24*time.Hour, "how long deleted DNA sequences are kept")
+		purgeInterval   = fs.Duration("purge-interval", time.Hour, "how often deleted DNA sequences are purged")
+		references      = fs.String("references", "", "comma-separated names of DNA sequences available to all users as references")
+		maxOpenConns    = fs.Int("max-open-conns", 0, "maximum open connections per DB (0 for unlimited)")
+		maxIdleConns    = fs.Int("max-idle-conns", 0, "maximum idle connections per DB (0 for default)")
+		connMaxLifetime = fs.Duration("conn-max-lifetime", 0, "maximum lifetime of DB connections (0 for unlimited)")
+		queryTimeout    = fs.Duration("query-timeout", 0, "maximum duration of each DB operation (0 for unlimited)")
+		journalMode     = fs.String("sqlite-journal-mode", "WAL", "SQLite journal mode (DELETE, TRUNCATE, PERSIST, MEMORY, WAL, OFF)")
+		synchronous     = fs.String("sqlite-synchronous", "NORMAL", "SQLite synchronous level (OFF, NORMAL, FULL, EXTRA)")
+		busyTimeout     = fs.Duration("sqlite-busy-timeout", 5*time.Second, "how long SQLite waits for a locked DB before failing")
+		readPool        = fs.Bool("sqlite-read-pool", true, "use separate SQLite connection pools for reads and writes")
+		keyfile         = fs.String("keyfile", "", "keyfile of master keys, to encrypt DNA sequences at rest (SQLite only; empty to disable)")
+		backupDir       = fs.String("backup-dir", "", "directory for backups of both DBs (empty to disable backups)")
+		backupInterval  = fs.Duration("backup-interval", 24*time.Hour, "how often both DBs are backed up")
+		backupKeep      = fs.Int("backup-keep", 7, "how many backups of each DB are kept")
+		erasureJournal  = fs.String("erasure-journal", "erasures.jsonl", "file recording erasures of users from both DBs, with their receipts")
+		devSeed         = fs.String("dev-seed", "", "seed file to load into both DBs at startup (development only)")
+		oidcIssuer      = fs.String("oidc-issuer", "", "OpenID Connect issuer to sign users in with (empty to disable)")
+		oidcClientID    = fs.String("oidc-client-id", "", "OpenID Connect client ID")
+		oidcSecret      = fs.String("oidc-client-secret", "", "OpenID Connect client secret (empty for a public client)")
+		oidcRedirectURL = fs.String("oidc-redirect-url", "", "URL of /auth/oidc/callback, as registered with the issuer")
+		oidcUserClaim   = fs.String("oidc-user-claim", "preferred_username", "ID token claim naming auto-provisioned users")
+		oidcProvision   = fs.Bool("oidc-auto-provision", false, "create local users for identities which aren't linked to one")
+		lockoutUser     = fs.Int("lockout-user-failures", 10, "failed logins after which a user is locked out (0 to disable)")
+		lockoutIP       = fs.Int("lockout-ip-failures", 100, "failed logins after which a client IP is locked out (0 to disable)")
+		lockoutDuration = fs.Duration("lockout-duration", 15*time.Minute, "how long lockouts last")
+		lockoutWindow   = fs.Duration("lockout-window", time.Hour, "how long failed logins are counted for")
+		loginDelay      = fs.Duration("login-delay", time.Second, "delay before retrying a failed login, doubling with each failure (0 to disable)")
+		loginMaxDelay   = fs.Duration("login-max-delay", time.Minute, "maximum delay before retrying a failed login")
+		minUserLength   = fs.Int("min-user-length", 1, "minimum length of user names")
+		maxUserLength   = fs.Int("max-user-length", 64, "maximum length of user names")
+		minPassLength   = fs.Int("min-pass-length", 8, "minimum length of passes")
+		maxPassLength   = fs.Int("max-pass-length", 1024, "maximum length of passes")
+		breachedPasses  = fs.String("breached-passes", "", "file of breached passes, or their SHA-1 hashes, which users may not choose")
+		resetNotify     = fs.String("reset-notify", "", "deliver pass reset tokens to log, or file:PATH (development only; empty disables resets)")
+		rateLimit       = fs.Float64("rate-limit", 0, "API requests per second allowed to each user, API key, or unauthenticated client IP (0 to disable)")
+		rateBurst       = fs.Int("rate-burst", 20, "API requests each client may make at once, beyond the rate limit")
+		quotaBases      = fs.Int("quota-bases", 0, "most DNA bases each user may store (0 for unlimited)")
+		quotaSamples    = fs.Int("quota-samples", 0, "most DNA samples each user may store (0 for unlimited)")
+		auditSink       = fs.String("audit", "", "audit log of logins, validations, changes to accounts, and reads of and changes to DNA: file:PATH for JSON lines, or sqlite:PATH (empty to disable)")
 	)
 	fs.Usage = usage.For(fs, "monolith [flags]")
 	fs.Parse(os.Args[1:])
 
+	if *adminAddr != "" && *backupDir == "" {
+		fmt.Fprintf(os.Stderr, "-admin requires -backup-dir\n")
+		os.Exit(1)
+	}
+
 	var logger log.Logger
 	{
 		logger = log.NewLogfmtLogger(os.Stdout)
 		logger = log.With(logger, "ts", log.DefaultTimestampUTC)
 	}
 
-	var authsvc auth.Service
+	var auditlog *audit.Log
+	if *auditSink != "" {
+		sink, err := audit.OpenSink(*auditSink)
+		if err != nil {
+			logger.Log("during", "-audit", "err", err)
+			os.Exit(1)
+		}
+		auditlog, err = audit.NewLog(context.Background(), sink)
+		if err != nil {
+			logger.Log("during", "audit.NewLog", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var authrepo auth.Repository
+	{
+		var (
+			pool = auth.PoolConfig{
+				MaxOpenConns:    *maxOpenConns,
+				MaxIdleConns:    *maxIdleConns,
+				ConnMaxLifetime: *connMaxLifetime,
+				QueryTimeout:    *queryTimeout,
+			}
+			sqlite = []auth.SQLiteOption{
+				auth.WithJournalMode(*journalMode),
+				auth.WithSynchronous(*synchronous),
+				auth.WithBusyTimeout(*busyTimeout),
+				auth.WithReadPool(*readPool),
+			}
+			err error
+		)
+		authrepo, err = auth.NewRepository(*authURN, pool, sqlite...)
+		if err != nil {
+			logger.Log("during", "auth.NewRepository", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	var dnarepo dna.Repository
 	{
-		authrepo, err := auth.NewSQLiteRepository(*authURN)
+		var (
+			pool = dna.PoolConfig{
+				MaxOpenConns:    *maxOpenConns,
+				MaxIdleConns:    *maxIdleConns,
+				ConnMaxLifetime: *connMaxLifetime,
+				QueryTimeout:    *queryTimeout,
+			}
+			sqlite = []dna.SQLiteOption{
+				dna.WithJournalMode(*journalMode),
+				dna.WithSynchronous(*synchronous),
+				dna.WithBusyTimeout(*busyTimeout),
+				dna.WithReadPool(*readPool),
+			}
+			err error
+		)
+		if *keyfile != "" {
+			keyring, err := dna.LoadKeyring(*keyfile)
+			if err != nil {
+				logger.Log("during", "dna.LoadKeyring", "err", err)
+				os.Exit(1)
+			}
+			sqlite = append(sqlite, dna.WithKeyring(keyring))
+		}
+		dnarepo, err = dna.NewRepository(*dnaURN, pool, sqlite...)
+		if err != nil {
+			logger.Log("during", "dna.NewRepository", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	if *devSeed != "" {
+		users, sequences, err := loadSeedFile(context.Background(), authrepo, dnarepo, *devSeed)
 		if err != nil {
-			logger.Log("during", "auth.NewSQLiteRepository", "err", err)
+			logger.Log("during", "loadSeedFile", "err", err)
 			os.Exit(1)
 		}
-		authsvc = auth.NewDefaultService(authrepo)
+		logger.Log("seed", *devSeed, "users", users, "sequences", sequences)
+	}
+
+	var authsvc auth.Service
+	{
+		policy := auth.DefaultPolicy
+		policy.MinUserLength, policy.MaxUserLength = *minUserLength, *maxUserLength
+		policy.MinPassLength, policy.MaxPassLength = *minPassLength, *maxPassLength
+		if *breachedPasses != "" {
+			var err error
+			policy.Breached, err = auth.LoadBreachedList(*breachedPasses)
+			if err != nil {
+				logger.Log("during", "auth.LoadBreachedList", "err", err)
+				os.Exit(1)
+			}
+			logger.Log("breached_passes", policy.Breached.Len())
+		}
+		options := []auth.Option{
+			auth.WithPolicy(policy),
+			auth.WithLockout(auth.LockoutConfig{
+				MaxUserFailures: *lockoutUser,
+				MaxIPFailures:   *lockoutIP,
+				BaseDelay:       *loginDelay,
+				MaxDelay:        *loginMaxDelay,
+				LockoutDuration: *lockoutDuration,
+				Window:          *lockoutWindow,
+			}),
+		}
+		switch {
+		case *resetNotify == "log":
+			options = append(options, auth.WithNotifier(auth.LogNotifier{Logger: log.With(logger, "component", "reset")}))
+		case strings.HasPrefix(*resetNotify, "file:"):
+			options = append(options, auth.WithNotifier(auth.NewFileNotifier(strings.TrimPrefix(*resetNotify, "file:"))))
+		case *resetNotify != "":
+			logger.Log("during", "-reset-notify", "err", "want log or file:PATH")
+			os.Exit(1)
+		}
+		authsvc = auth.NewDefaultService(authrepo, options...)
+		if auditlog != nil {
+			authsvc = auth.NewAuditedService(authsvc, auditlog)
+		}
 	}
 
 	var authserver http.Handler
 	{
-		authserver = auth.NewHTTPServer(authsvc)
+		var options []auth.HTTPServerOption
+		if *oidcIssuer != "" {
+			o, err := auth.NewOIDC(context.Background(), authrepo, auth.OIDCConfig{
+				Issuer:        *oidcIssuer,
+				ClientID:      *oidcClientID,
+				ClientSecret:  *oidcSecret,
+				RedirectURL:   *oidcRedirectURL,
+				UserClaim:     *oidcUserClaim,
+				AutoProvision: *oidcProvision,
+			})
+			if err != nil {
+				logger.Log("during", "auth.NewOIDC", "err", err)
+				os.Exit(1)
+			}
+			options = append(options, auth.WithOIDC(o))
+			logger.Log("component", "OIDC", "issuer", *oidcIssuer)
+		}
+		if auditlog != nil {
+			options = append(options, auth.WithAuditLog(auditlog))
+		}
+		authserver = auth.NewHTTPServer(reuseValidation(authsvc), options...) // validated once per request
 	}
 
 	var dnasvc dna.Service
 	{
-		dnarepo, err := dna.NewSQLiteRepository(*dnaURN)
-		if err != nil {
-			logger.Log("during", "dna.NewSQLiteRepository", "err", err)
-			os.Exit(1)
+		dnasvc = dna.NewDefaultService(dnarepo, ratelimit.ReuseValidation(authsvc), // don't need a client
+			dna.WithReferences(splitList(*references)...),
+			dna.WithQuota(dna.Quota{MaxBases: *quotaBases, MaxSamples: *quotaSamples}),
+		)
+		if auditlog != nil {
+			dnasvc = dna.NewAuditedService(dnasvc, auditlog)
 		}
-		dnasvc = dna.NewDefaultService(dnarepo, authsvc) // don't need a client
 	}
 
 	var dnaserver http.Handler
@@ -64,13 +267,46 @@ func main() {
 		dnaserver = dna.NewHTTPServer(dnasvc)
 	}
 
+	var journal *privacy.Journal
+	{
+		var err error
+		journal, err = privacy.NewJournal(*erasureJournal)
+		if err != nil {
+			logger.Log("during", "privacy.NewJournal", "err", err)
+			os.Exit(1)
+		}
+		resumed, err := journal.Resume(context.Background(), privacySources(authrepo, dnarepo, auditlog)...)
+		if err != nil {
+			logger.Log("during", "Resume", "err", err)
+			os.Exit(1)
+		}
+		if len(resumed) > 0 {
+			logger.Log("component", "privacy", "resumed_erasures", len(resumed))
+		}
+	}
+
 	var api http.Handler
 	{
 		r := mux.NewRouter()
 		r.PathPrefix("/auth/").Handler(http.StripPrefix("/auth", authserver))
 		r.PathPrefix("/dna/").Handler(http.StripPrefix("/dna", dnaserver))
+		r.PathPrefix("/privacy/").Handler(http.StripPrefix("/privacy", privacy.NewHTTPServer(ratelimit.ReuseValidation(authsvc), journal, privacySources(authrepo, dnarepo, auditlog)...)))
+		if auditlog != nil {
+			r.PathPrefix("/audit/").Handler(http.StripPrefix("/audit", audit.NewHTTPServer(ratelimit.ReuseValidation(authsvc), auditlog)))
+		}
 		api = r
 	}
+	if auditlog != nil {
+		api = audit.RecordClientIP(api)
+	}
+	if *rateLimit > 0 {
+		api = ratelimit.NewLimiter(*rateLimit, *rateBurst).Handler(authsvc, api)
+	}
+
+	var sources []backup.Source
+	{
+		sources = backupSources(authrepo, dnarepo)
+	}
 
 	var g run.Group
 	{
@@ -87,6 +323,50 @@ func main() {
 			server.Shutdown(ctx)
 		})
 	}
+	{
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			ticker := time.NewTicker(*purgeInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					n, err := dnarepo.Purge(ctx, time.Now().Add(-*retention))
+					if err != nil {
+						logger.Log("during", "Purge", "err", err)
+						continue
+					}
+					logger.Log("component", "purge", "purged", n)
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}, func(error) {
+			cancel()
+		})
+	}
+	if *adminAddr != "" {
+		server := &http.Server{
+			Addr:    *adminAddr,
+			Handler: backup.NewHTTPServer(*backupDir, *backupKeep, sources...),
+		}
+		g.Add(func() error {
+			logger.Log("component", "admin", "addr", *adminAddr)
+			return server.ListenAndServe()
+		}, func(error) {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			server.Shutdown(ctx)
+		})
+	}
+	if *backupDir != "" {
+		ctx, cancel := context.WithCancel(context.Background())
+		g.Add(func() error {
+			return backup.Schedule(ctx, *backupDir, *backupInterval, *backupKeep, logger, sources...)
+		}, func(error) {
+			cancel()
+		})
+	}
 	{
 		ctx, cancel := context.WithCancel(context.Background())
 		g.Add(func() error {
@@ -104,3 +384,13 @@ func main() {
 	}
 	logger.Log("exit", g.Run())
 }
+
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("monolith migrate", flag.ExitOnError)
+	var (
+		authURN = fs.String("auth-urn", "file:auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		dnaURN  = fs.String("dna-urn", "file:dna.db", "URN for DNA DB (SQLite file, or postgres://...)")
+		authTo  = fs.Int("auth-to", -1, "target auth DB schema version (-1 for latest)")
+		dnaTo   = fs.Int("dna-to", -1, "target DNA DB schema version (-1 for latest)")
+		status  = fs.Bool("status", false, "print the current schema versions, and exit")
+	)
+	fs.Usage = usage.For(fs, "monolith migrate [flags]")
+	fs.Parse(args)
+
+	if *status {
+		current, latest, err := auth.SchemaVersion(context.Background(), *authURN)
+		if err != nil {
+			return errors.Wrap(err, "auth DB")
+		}
+		fmt.Printf("auth DB at schema version %d, latest is %d\n", current, latest)
+
+		current, latest, err = dna.SchemaVersion(context.Background(), *dnaURN)
+		if err != nil {
+			return errors.Wrap(err, "DNA DB")
+		}
+		fmt.Printf("DNA DB at schema version %d, latest is %d\n", current, latest)
+		return nil
+	}
+
+	from, to, err := auth.Migrate(context.Background(), *authURN, *authTo)
+	if err != nil {
+		return errors.Wrap(err, "auth DB")
+	}
+	fmt.Printf("auth DB migrated from schema version %d to %d\n", from, to)
+
+	from, to, err = dna.Migrate(context.Background(), *dnaURN, *dnaTo)
+	if err != nil {
+		return errors.Wrap(err, "DNA DB")
+	}
+	fmt.Printf("DNA DB migrated from schema version %d to %d\n", from, to)
+	return nil
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/gattaca/pkg/privacy"
+)
+
+// privacySources returns the sources in the order they're erased: auth is
+// last, so that the user can still authenticate to retry if erasure fails.
+// Exports of DNA are recorded to the audit log, if there is one.
+func privacySources(authrepo auth.Repository, dnarepo dna.Repository, auditlog *audit.Log) []privacy.Source {
+	export := dnarepo.Export
+	if auditlog != nil {
+		export = dna.AuditedExport(dnarepo, auditlog)
+	}
+	return []privacy.Source{
+		{
+			Name:   "dna",
+			Export: func(ctx context.Context, user string) (interface{}, error) { return export(ctx, user) },
+			Erase:  dnarepo.Erase,
+		},
+		{
+			Name:   "auth",
+			Export: func(ctx context.Context, user string) (interface{}, error) { return authrepo.Export(ctx, user) },
+			Erase:  authrepo.Erase,
+		},
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+// runRole assigns a role directly in the DB, e.g. to create the first admin,
+// who can then assign roles via the API.
+func runRole(args []string) error {
+	fs := flag.NewFlagSet("monolith role", flag.ExitOnError)
+	var (
+		urn  = fs.String("auth-urn", "file:auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		user = fs.String("user", "", "user to assign the role to")
+		role = fs.String("role", "", "role to assign: user, analyst, or admin")
+	)
+	fs.Usage = usage.For(fs, "monolith role [flags]")
+	fs.Parse(args)
+
+	r, err := rbac.ParseRole(*role)
+	if err != nil {
+		return errors.Wrapf(err, "-role %q", *role)
+	}
+
+	repo, err := auth.NewRepository(*urn, auth.PoolConfig{})
+	if err != nil {
+		return err
+	}
+
+	if err := repo.SetRole(context.Background(), *user, r); err != nil {
+		return errors.Wrapf(err, "user %q", *user)
+	}
+	fmt.Printf("%s is now %s\n", *user, r)
+	return nil
+}
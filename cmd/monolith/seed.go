@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/usage"
+	"github.com/pkg/errors"
+)
+
+func runSeed(args []string) error {
+	fs := flag.NewFlagSet("monolith seed", flag.ExitOnError)
+	var (
+		authURN = fs.String("auth-urn", "file:auth.db", "URN for auth DB (SQLite file, or postgres://...)")
+		dnaURN  = fs.String("dna-urn", "file:dna.db", "URN for DNA DB (SQLite file, or postgres://...)")
+		file    = fs.String("file", "dev/seed.json", "seed file to load into both DBs")
+	)
+	fs.Usage = usage.For(fs, "monolith seed [flags]")
+	fs.Parse(args)
+
+	authrepo, err := auth.NewRepository(*authURN, auth.PoolConfig{})
+	if err != nil {
+		return errors.Wrap(err, "auth DB")
+	}
+	dnarepo, err := dna.NewRepository(*dnaURN, dna.PoolConfig{})
+	if err != nil {
+		return errors.Wrap(err, "DNA DB")
+	}
+
+	users, sequences, err := loadSeedFile(context.Background(), authrepo, dnarepo, *file)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("seeded from %s: %d user(s), %d sequence(s) created\n", *file, users, sequences)
+	return nil
+}
+
+// loadSeedFile loads the users and sequences from the file. Users and
+// sequences which already exist are skipped.
+func loadSeedFile(ctx context.Context, authrepo auth.Repository, dnarepo dna.Repository, filename string) (users, sequences int, err error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+
+	if users, _, err = auth.LoadSeed(ctx, authrepo, f); err != nil {
+		return 0, 0, errors.Wrap(err, "auth DB")
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return 0, 0, err
+	}
+
+	if sequences, _, err = dna.LoadSeed(ctx, dnarepo, f); err != nil {
+		return users, 0, errors.Wrap(err, "DNA DB")
+	}
+
+	return users, sequences, nil
+}
@@ -0,0 +1,305 @@
+// Package audit records security-relevant and data-access events, e.g.
+// logins and reads of DNA samples, in an append-only log. Each event
+// carries a hash of itself and of the event before it, so that altering or
+// removing any event, other than the latest, breaks the chain and is
+// detected by Verify.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrTampered is returned by Verify if the hash chain is broken.
+var ErrTampered = errors.New("audit log has been tampered with")
+
+// Outcomes of events.
+const (
+	Success = "success"
+	Failure = "failure"
+)
+
+// Event is a single entry in the audit log.
+type Event struct {
+	Seq      int64     `json:"seq"`
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`           // e.g. auth.login, dna.check
+	User     string    `json:"user"`             // who did it
+	Sample   string    `json:"sample,omitempty"` // owner of the DNA accessed
+	IP       string    `json:"ip,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"` // e.g. why it failed
+	PrevHash string    `json:"prev_hash"`
+	Hash     string    `json:"hash"`
+}
+
+// NewEvent returns an event for the action, whose outcome is a failure,
+// detailed by err, if err is non-nil.
+func NewEvent(action, user, sample string, err error) Event {
+	e := Event{Action: action, User: user, Sample: sample, Outcome: Success}
+	if err != nil {
+		e.Outcome, e.Detail = Failure, err.Error()
+	}
+	return e
+}
+
+// hash returns the hash of the event's fields, including the hash of the
+// previous event, but not its own hash. Each field is length-prefixed, so
+// that no two events hash the same input.
+func (e Event) hash() string {
+	h := sha256.New()
+	for _, field := range []string{
+		fmt.Sprint(e.Seq),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Action,
+		e.User,
+		e.Sample,
+		e.IP,
+		e.Outcome,
+		e.Detail,
+		e.PrevHash,
+	} {
+		fmt.Fprintf(h, "%d:%s", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Filter selects events from the log. Zero fields match every event.
+type Filter struct {
+	User    string
+	Sample  string
+	Action  string
+	Outcome string
+	Since   time.Time // inclusive
+	Until   time.Time // exclusive
+	After   int64     // sequence number
+	Limit   int
+}
+
+// matches returns true if the event is selected by the filter, ignoring
+// the limit.
+func (f Filter) matches(e Event) bool {
+	switch {
+	case f.User != "" && e.User != f.User:
+		return false
+	case f.Sample != "" && e.Sample != f.Sample:
+		return false
+	case f.Action != "" && e.Action != f.Action:
+		return false
+	case f.Outcome != "" && e.Outcome != f.Outcome:
+		return false
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case e.Seq <= f.After:
+		return false
+	}
+	return true
+}
+
+// Sink stores events, e.g. FileSink or SQLiteSink. Events are only ever
+// appended, in order of sequence number. Append stores all of the events,
+// or none of them.
+type Sink interface {
+	Append(ctx context.Context, events []Event) error
+	Events(ctx context.Context, f Filter) ([]Event, error)
+	Last(ctx context.Context) (e Event, ok bool, err error)
+}
+
+// OpenSink opens the sink described by spec: file:PATH for a FileSink, or
+// sqlite:PATH for a SQLiteSink.
+func OpenSink(spec string) (Sink, error) {
+	var (
+		sink Sink
+		err  error
+	)
+	switch {
+	case strings.HasPrefix(spec, "file:"):
+		sink, err = NewFileSink(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "sqlite:"):
+		sink, err = NewSQLiteSink("file:" + strings.TrimPrefix(spec, "sqlite:"))
+	default:
+		return nil, errors.Errorf("invalid audit sink %q: want file:PATH or sqlite:PATH", spec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+// Log records events to a sink, chaining each to the one before. Only one
+// log may append to a sink at a time. It's safe for concurrent use.
+//
+// Events recorded concurrently are appended to the sink in batches, so
+// that a sink which syncs each append to disk syncs once per batch, rather
+// than once per event. Only chaining an event takes the lock; a batch is
+// appended while the next one fills.
+type Log struct {
+	sink Sink
+
+	mtx      sync.Mutex
+	last     Event  // latest event chained
+	appended Event  // latest event appended to the sink
+	next     *batch // collects events until the batch before it is done
+}
+
+// batch is a group of events appended to the sink together. The first
+// event of a batch appends it.
+type batch struct {
+	events []Event
+	after  chan struct{} // closed when the batch before is done
+	done   chan struct{} // closed when this batch is done
+	err    error
+}
+
+// NewLog returns a log appending to the sink, continuing the chain of any
+// events already in it.
+func NewLog(ctx context.Context, sink Sink) (*Log, error) {
+	last, _, err := sink.Last(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading last audit event")
+	}
+	after := make(chan struct{})
+	close(after)
+	return &Log{
+		sink:     sink,
+		last:     last,
+		appended: last,
+		next:     &batch{after: after, done: make(chan struct{})},
+	}, nil
+}
+
+// Record appends the event to the log. Its sequence number, time, and
+// hashes are set by the log; its IP is taken from the context, if it isn't
+// set. Record returns once the event is stored by the sink.
+func (l *Log) Record(ctx context.Context, e Event) error {
+	if e.IP == "" {
+		e.IP = ClientIP(ctx)
+	}
+
+	l.mtx.Lock()
+	e.Seq = l.last.Seq + 1
+	e.Time = time.Now().UTC()
+	e.PrevHash = l.last.Hash
+	e.Hash = e.hash()
+	l.last = e
+	b := l.next
+	b.events = append(b.events, e)
+	first := len(b.events) == 1
+	l.mtx.Unlock()
+
+	if !first {
+		<-b.done
+		return b.err
+	}
+
+	// Events recorded while the batch before is appended join this batch.
+	<-b.after
+	l.mtx.Lock()
+	if l.next == b {
+		l.next = &batch{after: b.done, done: make(chan struct{})}
+	}
+	events, err := b.events, b.err
+	l.mtx.Unlock()
+
+	if err == nil {
+		// The batch carries others' events, which mustn't fail if this
+		// caller gives up.
+		err = l.sink.Append(context.WithoutCancel(ctx), events)
+
+		l.mtx.Lock()
+		if err != nil {
+			b.err = errors.Wrap(err, "error recording audit event")
+
+			// Events chained since were chained to these, so they fail
+			// too, and the chain continues from the latest event stored.
+			if next := l.next; len(next.events) > 0 {
+				next.err = b.err
+				l.next = &batch{after: next.done, done: make(chan struct{})}
+			}
+			l.last = l.appended
+		} else {
+			l.appended = events[len(events)-1]
+		}
+		l.mtx.Unlock()
+	}
+
+	close(b.done)
+	return b.err
+}
+
+// Events returns the events selected by the filter, in order.
+func (l *Log) Events(ctx context.Context, f Filter) ([]Event, error) {
+	events, err := l.sink.Events(ctx, f)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading audit events")
+	}
+	return events, nil
+}
+
+// Verify checks the hash chain of every event in the log. See Verify.
+func (l *Log) Verify(ctx context.Context) (last Event, err error) {
+	return Verify(ctx, l.sink)
+}
+
+// verifyPageSize is the number of events Verify reads at a time.
+const verifyPageSize = 10000
+
+// Verify checks the hash chain of every event in the sink, and returns the
+// latest event. Removing the latest events can't be detected by the chain
+// alone, so the latest hash should be kept elsewhere from time to time, and
+// compared with the event of the same sequence number.
+func Verify(ctx context.Context, sink Sink) (last Event, err error) {
+	for {
+		events, err := sink.Events(ctx, Filter{After: last.Seq, Limit: verifyPageSize})
+		if err != nil {
+			return Event{}, errors.Wrap(err, "error reading audit events")
+		}
+		for _, e := range events {
+			if e.Seq != last.Seq+1 || e.PrevHash != last.Hash || e.Hash != e.hash() {
+				return last, ErrTampered
+			}
+			last = e
+		}
+		if len(events) < verifyPageSize {
+			return last, nil
+		}
+	}
+}
+
+type clientIPKey struct{}
+
+// ContextWithClientIP returns a copy of ctx carrying the IP of the client
+// making the request, which Record adds to events.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+// ClientIP returns the IP carried by ctx, if any.
+func ClientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
+
+// RecordClientIP returns a handler which calls next with the IP of the
+// client in the request's context. Forwarding headers aren't trusted, as
+// clients can forge them.
+func RecordClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+		next.ServeHTTP(w, r.WithContext(ContextWithClientIP(r.Context(), ip)))
+	})
+}
@@ -0,0 +1,425 @@
+package audit
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "audit.jsonl")
+	open := func() Sink {
+		s, err := NewFileSink(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	testSink(t, open)
+
+	// Rewrite an event, as an attacker might.
+	p, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, bytes.Replace(p, []byte(`"user":"bob"`), []byte(`"user":"eve"`), 1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(context.Background(), open()); err != ErrTampered {
+		t.Errorf("Verify after rewrite: want %v, have %v", ErrTampered, err)
+	}
+}
+
+func TestFileSinkIncompleteLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	filename := filepath.Join(dir, "audit.jsonl")
+	l := newLog(t, ctx, filename)
+	if err := l.Record(ctx, NewEvent("auth.login", "ann", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash part way through writing an event.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"time":`)
+	f.Close()
+
+	l = newLog(t, ctx, filename)
+	if err := l.Record(ctx, NewEvent("auth.logout", "ann", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	last, err := l.Verify(ctx)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Verify: want %v, have %v", want, have)
+	}
+	if want, have := int64(2), last.Seq; want != have {
+		t.Errorf("Verify: want last event %d, have %d", want, have)
+	}
+}
+
+func newLog(t *testing.T, ctx context.Context, filename string) *Log {
+	t.Helper()
+	s, err := NewFileSink(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := NewLog(ctx, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestLogConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx = context.Background()
+		l   = newLog(t, ctx, filepath.Join(dir, "audit.jsonl"))
+		n   = 100
+		wg  sync.WaitGroup
+	)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.Record(ctx, NewEvent("auth.login", "ann", "", nil)); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	last, err := l.Verify(ctx)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Verify: want %v, have %v", want, have)
+	}
+	if want, have := int64(n), last.Seq; want != have {
+		t.Errorf("Verify: want last event %d, have %d", want, have)
+	}
+}
+
+// failingSink fails to append while fail is set.
+type failingSink struct {
+	Sink
+	fail bool
+}
+
+func (s *failingSink) Append(ctx context.Context, events []Event) error {
+	if s.fail {
+		return errors.New("disk full")
+	}
+	return s.Sink.Append(ctx, events)
+}
+
+func TestLogAppendFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	fs, err := NewFileSink(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	sink := &failingSink{Sink: fs}
+	l, err := NewLog(ctx, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Record(ctx, NewEvent("auth.login", "ann", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+	sink.fail = true
+	if err := l.Record(ctx, NewEvent("auth.login", "bob", "", nil)); err == nil {
+		t.Errorf("Record: want error, have none")
+	}
+	sink.fail = false
+	if err := l.Record(ctx, NewEvent("auth.login", "cat", "", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The chain continues from the latest event stored.
+	last, err := l.Verify(ctx)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Verify: want %v, have %v", want, have)
+	}
+	if want, have := "cat", last.User; want != have {
+		t.Errorf("Verify: want last event by %s, have %s", want, have)
+	}
+	if want, have := int64(2), last.Seq; want != have {
+		t.Errorf("Verify: want last event %d, have %d", want, have)
+	}
+}
+
+func TestSQLiteSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	urn := "file:" + filepath.Join(dir, "audit.db")
+	open := func() Sink {
+		s, err := NewSQLiteSink(urn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	testSink(t, open)
+
+	db, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Exec(`UPDATE audit_events SET user = 'eve' WHERE user = 'bob'`); err == nil {
+		t.Errorf("UPDATE: want error, have none")
+	}
+	if _, err := db.Exec(`DELETE FROM audit_events`); err == nil {
+		t.Errorf("DELETE: want error, have none")
+	}
+
+	// Anyone who can write the file can drop the triggers.
+	if _, err := db.Exec(`
+		DROP TRIGGER audit_events_no_delete;
+		DELETE FROM audit_events WHERE seq = 2;
+	`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Verify(context.Background(), open()); err != ErrTampered {
+		t.Errorf("Verify after delete: want %v, have %v", ErrTampered, err)
+	}
+}
+
+func TestOpenSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, testcase := range []struct {
+		spec string
+		want Sink
+	}{
+		{"file:" + filepath.Join(dir, "audit.jsonl"), &FileSink{}},
+		{"sqlite:" + filepath.Join(dir, "audit.db"), &SQLiteSink{}},
+		{filepath.Join(dir, "audit.jsonl"), nil},
+		{"file:" + filepath.Join(dir, "missing", "audit.jsonl"), nil},
+	} {
+		s, err := OpenSink(testcase.spec)
+		if want, have := testcase.want == nil, err != nil; want != have {
+			t.Errorf("%s: want error %v, have %v", testcase.spec, want, err)
+			continue
+		}
+		if want, have := reflect.TypeOf(testcase.want), reflect.TypeOf(s); want != have {
+			t.Errorf("%s: want %v, have %v", testcase.spec, want, have)
+		}
+	}
+}
+
+// testSink records events to a new sink returned by open, and checks that
+// they can be queried and verified, including after it's opened again.
+func testSink(t *testing.T, open func() Sink) {
+	t.Helper()
+
+	var (
+		ctx   = ContextWithClientIP(context.Background(), "192.0.2.1")
+		sink  = open()
+		fail  = errors.New("bad auth")
+		given = []Event{
+			NewEvent("auth.login", "ann", "", nil),
+			NewEvent("auth.login", "bob", "", fail),
+			NewEvent("dna.check", "ann", "bob", nil),
+			NewEvent("dna.sample", "bob", "bob", nil),
+		}
+	)
+	l, err := NewLog(ctx, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range given[:2] {
+		if err := l.Record(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A new log continues the chain.
+	if l, err = NewLog(ctx, open()); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range given[2:] {
+		if err := l.Record(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, err := l.Events(ctx, Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := len(given), len(all); want != have {
+		t.Fatalf("Events: want %d, have %d", want, have)
+	}
+	for i, e := range all {
+		if want, have := int64(i+1), e.Seq; want != have {
+			t.Errorf("event %d: want seq %d, have %d", i, want, have)
+		}
+		if want, have := given[i].Action+" "+given[i].User+" "+given[i].Outcome, e.Action+" "+e.User+" "+e.Outcome; want != have {
+			t.Errorf("event %d: want %s, have %s", i, want, have)
+		}
+		if want, have := "192.0.2.1", e.IP; want != have {
+			t.Errorf("event %d: want IP %s, have %s", i, want, have)
+		}
+	}
+
+	for _, testcase := range []struct {
+		name   string
+		filter Filter
+		want   []int64
+	}{
+		{"user", Filter{User: "bob"}, []int64{2, 4}},
+		{"sample", Filter{Sample: "bob"}, []int64{3, 4}},
+		{"action", Filter{Action: "auth.login"}, []int64{1, 2}},
+		{"outcome", Filter{Outcome: Failure}, []int64{2}},
+		{"after", Filter{After: 2, Limit: 1}, []int64{3}},
+		{"since", Filter{Since: all[2].Time}, []int64{3, 4}},
+		{"until", Filter{Until: all[2].Time}, []int64{1, 2}},
+	} {
+		events, err := l.Events(ctx, testcase.filter)
+		if err != nil {
+			t.Errorf("%s: %v", testcase.name, err)
+			continue
+		}
+		var have []int64
+		for _, e := range events {
+			have = append(have, e.Seq)
+		}
+		if want := testcase.want; !equal(want, have) {
+			t.Errorf("%s: want %v, have %v", testcase.name, want, have)
+		}
+	}
+
+	last, err := Verify(ctx, open())
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Verify: want %v, have %v", want, have)
+	}
+	if want, have := all[len(all)-1].Hash, last.Hash; want != have {
+		t.Errorf("Verify: want last hash %s, have %s", want, have)
+	}
+}
+
+func equal(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHTTPServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	l := newLog(t, ctx, filepath.Join(dir, "audit.jsonl"))
+	for _, user := range []string{"ann", "bob", "ann"} {
+		if err := l.Record(ctx, NewEvent("auth.login", user, "", nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	h := RecordClientIP(NewHTTPServer(mockValidator{"ada": rbac.Admin, "ann": rbac.User}, l))
+	for _, testcase := range []struct {
+		target string
+		want   int
+		events int
+		next   string
+	}{
+		{"/events?user=ann&token=t", http.StatusForbidden, 0, ""},
+		{"/events?user=nobody&token=t", http.StatusUnauthorized, 0, ""},
+		{"/events?user=ada&token=t", http.StatusOK, 3, ""},
+		{"/events?user=ada&token=t&subject=ann", http.StatusOK, 2, ""},
+		{"/events?user=ada&token=t&limit=2", http.StatusOK, 2, "2"},
+		{"/events?user=ada&token=t&after=2", http.StatusOK, 1, ""},
+		{"/events?user=ada&token=t&since=yesterday", http.StatusBadRequest, 0, ""},
+		{"/verify?user=ada&token=t", http.StatusOK, 0, ""},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", testcase.target, nil))
+		if want, have := testcase.want, rec.Code; want != have {
+			t.Errorf("%s: want %d, have %d", testcase.target, want, have)
+			continue
+		}
+		if rec.Code != http.StatusOK || testcase.target[:7] != "/events" {
+			continue
+		}
+		var response struct {
+			Events []Event `json:"events"`
+			Next   string  `json:"next"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Errorf("%s: %v", testcase.target, err)
+			continue
+		}
+		if want, have := testcase.events, len(response.Events); want != have {
+			t.Errorf("%s: want %d events, have %d", testcase.target, want, have)
+		}
+		if want, have := testcase.next, response.Next; want != have {
+			t.Errorf("%s: want next %q, have %q", testcase.target, want, have)
+		}
+	}
+}
+
+type mockValidator map[string]rbac.Role
+
+func (v mockValidator) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	role, ok := v[user]
+	if !ok {
+		return rbac.Principal{}, errors.New("bad auth")
+	}
+	return rbac.NewPrincipal(user, role), nil
+}
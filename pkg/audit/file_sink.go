@@ -0,0 +1,158 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// FileSink stores events in a file, one JSON object per line. The file is
+// kept open for appending until Close.
+type FileSink struct {
+	mtx      sync.Mutex
+	filename string
+	f        *os.File
+	size     int64 // of the complete lines in f
+}
+
+// NewFileSink returns a sink backed by the file, which is created if it
+// doesn't exist. An incomplete last line, which was never synced, and so
+// never acknowledged, is removed.
+func NewFileSink(filename string) (*FileSink, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening audit log")
+	}
+
+	var (
+		r        = bufio.NewReader(f)
+		complete int64
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, errors.Wrap(err, "error reading audit log")
+		}
+		complete += int64(len(line))
+	}
+	if err := f.Truncate(complete); err != nil {
+		f.Close()
+		return nil, errors.Wrap(err, "error truncating audit log")
+	}
+	return &FileSink{filename: filename, f: f, size: complete}, nil
+}
+
+// Append writes the events to the file, and syncs it to disk. If that
+// fails, the file is truncated to the events before.
+func (s *FileSink) Append(ctx context.Context, events []Event) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return errors.Wrap(err, "error encoding audit event")
+		}
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.f == nil {
+		return errors.New("audit log is closed")
+	}
+	if _, err := s.f.WriteAt(buf.Bytes(), s.size); err != nil {
+		s.f.Truncate(s.size)
+		return errors.Wrap(err, "error writing audit log")
+	}
+	if err := s.f.Sync(); err != nil {
+		s.f.Truncate(s.size)
+		return errors.Wrap(err, "error syncing audit log")
+	}
+	s.size += int64(buf.Len())
+	return nil
+}
+
+// Close closes the file. Events can still be read, but not appended.
+func (s *FileSink) Close() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return errors.Wrap(err, "error closing audit log")
+}
+
+// Events returns the events selected by the filter, in order.
+func (s *FileSink) Events(ctx context.Context, f Filter) ([]Event, error) {
+	var events []Event
+	err := s.read(ctx, func(e Event) bool {
+		if f.matches(e) {
+			events = append(events, e)
+		}
+		return f.Limit <= 0 || len(events) < f.Limit
+	})
+	return events, err
+}
+
+// Last returns the latest event, if there is one.
+func (s *FileSink) Last(ctx context.Context) (last Event, ok bool, err error) {
+	err = s.read(ctx, func(e Event) bool {
+		last, ok = e, true
+		return true
+	})
+	return last, ok, err
+}
+
+// read calls fn with each event in the file, in order, until it returns
+// false.
+func (s *FileSink) read(ctx context.Context, fn func(Event) bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Only events already appended are read, so that appends can continue
+	// meanwhile.
+	s.mtx.Lock()
+	size := s.size
+	s.mtx.Unlock()
+
+	f, err := os.Open(s.filename)
+	if err != nil {
+		return errors.Wrap(err, "error opening audit log")
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(io.LimitReader(f, size))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "error reading audit log")
+		}
+		var e Event
+		if err := json.Unmarshal(line, &e); err != nil {
+			return errors.Wrap(err, "error reading audit log")
+		}
+		if !fn(e) {
+			return nil
+		}
+	}
+}
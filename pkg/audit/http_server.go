@@ -0,0 +1,176 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+// Validator authenticates users, e.g. auth.Service.
+type Validator interface {
+	Validate(ctx context.Context, user, token string) (rbac.Principal, error)
+}
+
+const (
+	// defaultPageSize is the number of events returned by /events when the
+	// limit isn't given.
+	defaultPageSize = 100
+
+	// maxPageSize is the most events returned by /events at once.
+	maxPageSize = 1000
+)
+
+// HTTPServer lets admins query and verify the audit log. It requires the
+// rbac.ReadAudit permission.
+type HTTPServer struct {
+	router *mux.Router
+	valid  Validator
+	log    *Log
+}
+
+// NewHTTPServer returns an HTTPServer for the log, which authenticates
+// users with the validator.
+func NewHTTPServer(valid Validator, log *Log) *HTTPServer {
+	s := &HTTPServer{
+		valid: valid,
+		log:   log,
+	}
+	r := mux.NewRouter()
+	{
+		r.Methods("GET").Path("/events").HandlerFunc(s.handleEvents)
+		r.Methods("GET").Path("/verify").HandlerFunc(s.handleVerify)
+	}
+	s.router = r
+	return s
+}
+
+// ServeHTTP implements http.Handler, delegating to the mux.Router.
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// handleEvents writes the events selected by the subject (the user who did
+// them), sample, action, outcome, since, until, after, and limit parameters,
+// with the sequence number to pass as after for the next page, if there may
+// be one.
+func (s *HTTPServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+
+	q := r.URL.Query()
+	f := Filter{
+		User:    q.Get("subject"),
+		Sample:  q.Get("sample"),
+		Action:  q.Get("action"),
+		Outcome: q.Get("outcome"),
+		Limit:   defaultPageSize,
+	}
+	var err error
+	if v := q.Get("since"); v != "" {
+		if f.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid since", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("until"); v != "" {
+		if f.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			http.Error(w, "invalid until", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("after"); v != "" {
+		if f.After, err = strconv.ParseInt(v, 10, 64); err != nil || f.After < 0 {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		if f.Limit, err = strconv.Atoi(v); err != nil || f.Limit <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if f.Limit > maxPageSize {
+			f.Limit = maxPageSize
+		}
+	}
+
+	events, err := s.log.Events(r.Context(), f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var next string
+	if len(events) == f.Limit {
+		next = strconv.FormatInt(events[len(events)-1].Seq, 10)
+	}
+	if events == nil {
+		events = []Event{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Events []Event `json:"events"`
+		Next   string  `json:"next,omitempty"`
+	}{events, next})
+}
+
+// handleVerify checks the hash chain of the whole log, and writes the
+// latest event's sequence number and hash, which may be kept elsewhere to
+// detect the removal of later events.
+func (s *HTTPServer) handleVerify(w http.ResponseWriter, r *http.Request) {
+	if !s.authorize(w, r) {
+		return
+	}
+
+	last, err := s.log.Verify(r.Context())
+	if err == ErrTampered {
+		http.Error(w, err.Error()+" after event "+strconv.FormatInt(last.Seq, 10), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Seq  int64  `json:"seq"`
+		Hash string `json:"hash"`
+	}{last.Seq, last.Hash})
+}
+
+// authorize writes an error and returns false unless the user may read the
+// audit log.
+func (s *HTTPServer) authorize(w http.ResponseWriter, r *http.Request) bool {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	p, err := s.valid.Validate(r.Context(), user, token)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return false
+	}
+	if !p.Can(rbac.ReadAudit) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// extractToken returns the token from the token query parameter, or the
+// Authorization header as a bearer token.
+func extractToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
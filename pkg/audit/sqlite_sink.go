@@ -0,0 +1,168 @@
+package audit
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // driver
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
+	"github.com/pkg/errors"
+)
+
+// sqliteMigrations evolve the schema of SQLiteSink. Once released, a
+// migration must never be changed; add a new one instead.
+var sqliteMigrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create append-only audit_events table",
+		Up: `
+			CREATE TABLE audit_events (
+				seq       INTEGER NOT NULL PRIMARY KEY,
+				time      INTEGER NOT NULL,
+				action    TEXT NOT NULL,
+				user      TEXT NOT NULL,
+				sample    TEXT NOT NULL,
+				ip        TEXT NOT NULL,
+				outcome   TEXT NOT NULL,
+				detail    TEXT NOT NULL,
+				prev_hash TEXT NOT NULL,
+				hash      TEXT NOT NULL
+			);
+			CREATE INDEX audit_events_user ON audit_events (user);
+			CREATE INDEX audit_events_sample ON audit_events (sample);
+			CREATE TRIGGER audit_events_no_update BEFORE UPDATE ON audit_events
+				BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END;
+			CREATE TRIGGER audit_events_no_delete BEFORE DELETE ON audit_events
+				BEGIN SELECT RAISE(ABORT, 'audit events are append-only'); END;
+		`,
+		Down: `
+			DROP TABLE audit_events;
+		`,
+	},
+}
+
+// SQLiteSink stores events in a table of a SQLite DB. Triggers refuse
+// updates and deletes of the table, though anyone who can write the DB
+// file can drop them; the hash chain detects that.
+type SQLiteSink struct {
+	db *sql.DB
+}
+
+// NewSQLiteSink returns a sink backed by the SQLite DB at the URN.
+func NewSQLiteSink(urn string) (*SQLiteSink, error) {
+	db, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening DB")
+	}
+	db.SetMaxOpenConns(1) // SQLite allows one writer, and we mostly write
+
+	if _, _, err := migrate.Migrate(context.Background(), db, sqliteMigrations, -1); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error migrating DB")
+	}
+	return &SQLiteSink{db: db}, nil
+}
+
+// Append inserts the events into the table, in one transaction.
+func (s *SQLiteSink) Append(ctx context.Context, events []Event) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error beginning transaction")
+	}
+	defer tx.Rollback()
+
+	for _, e := range events {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO audit_events (seq, time, action, user, sample, ip, outcome, detail, prev_hash, hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, e.Seq, e.Time.UnixNano(), e.Action, e.User, e.Sample, e.IP, e.Outcome, e.Detail, e.PrevHash, e.Hash); err != nil {
+			return errors.Wrap(err, "error inserting audit event")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing transaction")
+}
+
+// Events returns the events selected by the filter, in order.
+func (s *SQLiteSink) Events(ctx context.Context, f Filter) ([]Event, error) {
+	var (
+		where = []string{"seq > ?"}
+		args  = []interface{}{f.After}
+	)
+	for _, c := range []struct {
+		column, value string
+	}{
+		{"user", f.User},
+		{"sample", f.Sample},
+		{"action", f.Action},
+		{"outcome", f.Outcome},
+	} {
+		if c.value != "" {
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if !f.Since.IsZero() {
+		where, args = append(where, "time >= ?"), append(args, f.Since.UnixNano())
+	}
+	if !f.Until.IsZero() {
+		where, args = append(where, "time < ?"), append(args, f.Until.UnixNano())
+	}
+	limit := -1 // no limit
+	if f.Limit > 0 {
+		limit = f.Limit
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT seq, time, action, user, sample, ip, outcome, detail, prev_hash, hash
+		FROM audit_events WHERE `+strings.Join(where, " AND ")+`
+		ORDER BY seq LIMIT ?
+	`, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading audit events")
+	}
+	defer rows.Close()
+
+	var events []Event
+	for rows.Next() {
+		e, err := scanEvent(rows)
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading audit events")
+		}
+		events = append(events, e)
+	}
+	return events, errors.Wrap(rows.Err(), "error reading audit events")
+}
+
+// Last returns the latest event, if there is one.
+func (s *SQLiteSink) Last(ctx context.Context) (e Event, ok bool, err error) {
+	e, err = scanEvent(s.db.QueryRowContext(ctx, `
+		SELECT seq, time, action, user, sample, ip, outcome, detail, prev_hash, hash
+		FROM audit_events ORDER BY seq DESC LIMIT 1
+	`))
+	switch {
+	case err == sql.ErrNoRows:
+		return Event{}, false, nil
+	case err != nil:
+		return Event{}, false, errors.Wrap(err, "error reading last audit event")
+	}
+	return e, true, nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanEvent(s scanner) (Event, error) {
+	var (
+		e    Event
+		nano int64
+	)
+	if err := s.Scan(&e.Seq, &nano, &e.Action, &e.User, &e.Sample, &e.IP, &e.Outcome, &e.Detail, &e.PrevHash, &e.Hash); err != nil {
+		return Event{}, err
+	}
+	e.Time = time.Unix(0, nano).UTC()
+	return e, nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+// NewAuditedService returns a service which records signups, logins,
+// logouts, validations, and every change to an account, its credentials, or
+// its role to the audit log, with their outcomes, and otherwise behaves like
+// next. Changes an admin makes to another account are detailed with the
+// account changed. If an event can't be recorded, the call fails, even
+// though next may have done it.
+func NewAuditedService(next Service, log *audit.Log) Service {
+	return auditedService{Service: next, log: log}
+}
+
+type auditedService struct {
+	Service
+	log *audit.Log
+}
+
+func (s auditedService) Signup(ctx context.Context, user, pass string) error {
+	err := s.Service.Signup(ctx, user, pass)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.signup", user, "", err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Login(ctx context.Context, user, pass string) (token, challenge string, err error) {
+	token, challenge, err = s.Service.Login(ctx, user, pass)
+	e := audit.NewEvent("auth.login", user, "", err)
+	if challenge != "" {
+		e.Detail = "two-factor code required"
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return "", "", rerr
+	}
+	return token, challenge, err
+}
+
+func (s auditedService) CompleteLogin(ctx context.Context, user, challenge, code string) (token string, err error) {
+	token, err = s.Service.CompleteLogin(ctx, user, challenge, code)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.login.two_factor", user, "", err)); rerr != nil {
+		return "", rerr
+	}
+	return token, err
+}
+
+func (s auditedService) Logout(ctx context.Context, user, token string) error {
+	err := s.Service.Logout(ctx, user, token)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.logout", user, "", err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	p, err := s.Service.Validate(ctx, user, token)
+	e := audit.NewEvent("auth.validate", user, "", err)
+	if p.Key != "" {
+		e.Detail = "API key " + p.Key
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rbac.Principal{}, rerr
+	}
+	return p, err
+}
+
+func (s auditedService) ChangePassword(ctx context.Context, user, token, oldPass, newPass string) (newToken string, err error) {
+	newToken, err = s.Service.ChangePassword(ctx, user, token, oldPass, newPass)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.change_password", user, "", err)); rerr != nil {
+		return "", rerr
+	}
+	return newToken, err
+}
+
+func (s auditedService) RequestReset(ctx context.Context, user string) error {
+	err := s.Service.RequestReset(ctx, user)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.request_reset", user, "", err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) ResetPassword(ctx context.Context, user, resetToken, newPass string) error {
+	err := s.Service.ResetPassword(ctx, user, resetToken, newPass)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.reset_password", user, "", err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) ConfirmTOTP(ctx context.Context, user, token, code string) (recoveryCodes []string, err error) {
+	recoveryCodes, err = s.Service.ConfirmTOTP(ctx, user, token, code)
+	if rerr := s.log.Record(ctx, audit.NewEvent("auth.enroll_two_factor", user, "", err)); rerr != nil {
+		return nil, rerr
+	}
+	return recoveryCodes, err
+}
+
+func (s auditedService) SetRole(ctx context.Context, user, token, subject string, role rbac.Role) error {
+	err := s.Service.SetRole(ctx, user, token, subject, role)
+	if rerr := s.log.Record(ctx, adminEvent("auth.set_role", user, fmt.Sprintf("user %s to role %s", subject, role), err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) CreateKey(ctx context.Context, user, token, subject, name string, scope []rbac.Permission) (key APIKey, secret string, err error) {
+	key, secret, err = s.Service.CreateKey(ctx, user, token, subject, name, scope)
+	detail := fmt.Sprintf("key %q for user %s", name, subject)
+	if err == nil {
+		detail = fmt.Sprintf("key %s (%q) for user %s", key.ID, name, subject)
+	}
+	if rerr := s.log.Record(ctx, adminEvent("auth.create_key", user, detail, err)); rerr != nil {
+		return APIKey{}, "", rerr
+	}
+	return key, secret, err
+}
+
+func (s auditedService) RevokeKey(ctx context.Context, user, token, subject, id string) error {
+	err := s.Service.RevokeKey(ctx, user, token, subject, id)
+	if rerr := s.log.Record(ctx, adminEvent("auth.revoke_key", user, fmt.Sprintf("key %s of user %s", id, subject), err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) ResetTwoFactor(ctx context.Context, user, token, subject string) error {
+	err := s.Service.ResetTwoFactor(ctx, user, token, subject)
+	if rerr := s.log.Record(ctx, adminEvent("auth.reset_two_factor", user, "user "+subject, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Unlock(ctx context.Context, user, token, subject string) error {
+	err := s.Service.Unlock(ctx, user, token, subject)
+	if rerr := s.log.Record(ctx, adminEvent("auth.unlock", user, "user "+subject, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) SetDisabled(ctx context.Context, user, token, subject string, disabled bool) error {
+	err := s.Service.SetDisabled(ctx, user, token, subject, disabled)
+	action := "auth.enable"
+	if disabled {
+		action = "auth.disable"
+	}
+	if rerr := s.log.Record(ctx, adminEvent(action, user, "user "+subject, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) ForceLogout(ctx context.Context, user, token, subject string) error {
+	err := s.Service.ForceLogout(ctx, user, token, subject)
+	if rerr := s.log.Record(ctx, adminEvent("auth.force_logout", user, "user "+subject, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) DeleteUser(ctx context.Context, user, token, subject string) error {
+	err := s.Service.DeleteUser(ctx, user, token, subject)
+	if rerr := s.log.Record(ctx, adminEvent("auth.delete_user", user, "user "+subject, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+// adminEvent returns an event for an action by user on an account, whose
+// detail says what was acted on, and why it failed, if err is non-nil.
+func adminEvent(action, user, detail string, err error) audit.Event {
+	e := audit.NewEvent(action, user, "", err)
+	e.Detail = detail
+	if err != nil {
+		e.Detail += ": " + err.Error()
+	}
+	return e
+}
@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestAuditedService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := audit.NewFileSink(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := audit.NewLog(context.Background(), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx = audit.ContextWithClientIP(context.Background(), "192.0.2.1")
+		r   = NewMemoryRepository()
+		s   = NewAuditedService(NewDefaultService(r), l)
+	)
+	if err := NewDefaultService(r).Signup(ctx, "ann", "battery staple"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Signup(ctx, "peter", "correct horse"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRole(ctx, "peter", rbac.Admin); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Login(ctx, "peter", "wrong"); err != ErrBadAuth {
+		t.Fatalf("Login with bad pass: want %v, have %v", ErrBadAuth, err)
+	}
+	token, _, err := s.Login(ctx, "peter", "correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Validate(ctx, "peter", token); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetRole(ctx, "peter", token, "ann", rbac.Analyst); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteUser(ctx, "peter", token, "nobody"); err != ErrUnknownUser {
+		t.Fatalf("DeleteUser of unknown user: want %v, have %v", ErrUnknownUser, err)
+	}
+	if err := s.Logout(ctx, "peter", token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Keys(ctx, "peter", token, "peter"); err != ErrBadAuth {
+		t.Fatalf("Keys after Logout: want %v, have %v", ErrBadAuth, err)
+	}
+
+	events, err := l.Events(ctx, audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have []string
+	for _, e := range events {
+		if e.User != "peter" || e.IP != "192.0.2.1" {
+			t.Errorf("event %d: want peter from 192.0.2.1, have %s from %s", e.Seq, e.User, e.IP)
+		}
+		have = append(have, e.Action+" "+e.Outcome)
+	}
+	want := []string{
+		"auth.signup success",
+		"auth.login failure",
+		"auth.login success",
+		"auth.validate success",
+		"auth.set_role success",
+		"auth.delete_user failure",
+		"auth.logout success",
+	}
+	if len(want) != len(have) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for i := range want {
+		if want[i] != have[i] {
+			t.Errorf("event %d: want %s, have %s", i+1, want[i], have[i])
+		}
+	}
+
+	for i, detail := range map[int]string{
+		4: "user ann to role analyst",
+		5: "user nobody: " + ErrUnknownUser.Error(),
+	} {
+		if want, have := detail, events[i].Detail; want != have {
+			t.Errorf("event %d: want detail %q, have %q", i+1, want, have)
+		}
+	}
+}
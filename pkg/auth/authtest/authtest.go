@@ -0,0 +1,787 @@
+// Package authtest provides a conformance suite for implementations of
+// auth.Repository, so that third-party backends can be checked against the
+// behavior of the built-in ones.
+package authtest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/pkg/errors"
+)
+
+// Concurrency is the number of goroutines used by the concurrent tests.
+// Implementations must tolerate at least this many simultaneous callers.
+var Concurrency = 8
+
+// TestRepository runs the conformance suite against r, which should be
+// empty, and usable only by the suite for the duration of the test.
+//
+//	func TestMyRepository(t *testing.T) {
+//		r := newMyRepository(t)
+//		authtest.TestRepository(t, r)
+//	}
+func TestRepository(t *testing.T, r auth.Repository) {
+	t.Run("Create", func(t *testing.T) { testCreate(t, r) })
+	t.Run("Auth", func(t *testing.T) { testAuth(t, r) })
+	t.Run("Tokens", func(t *testing.T) { testTokens(t, r) })
+	t.Run("ConcurrentCreate", func(t *testing.T) { testConcurrentCreate(t, r) })
+	t.Run("ConcurrentLogin", func(t *testing.T) { testConcurrentLogin(t, r) })
+	t.Run("Cancel", func(t *testing.T) { testCancel(t, r) })
+	t.Run("Roles", func(t *testing.T) { testRoles(t, r) })
+	t.Run("Keys", func(t *testing.T) { testKeys(t, r) })
+	t.Run("Identities", func(t *testing.T) { testIdentities(t, r) })
+	t.Run("TwoFactor", func(t *testing.T) { testTwoFactor(t, r) })
+	t.Run("Passes", func(t *testing.T) { testPasses(t, r) })
+	t.Run("Users", func(t *testing.T) { testUsers(t, r) })
+	t.Run("ExportAndErase", func(t *testing.T) { testExportAndErase(t, r) })
+}
+
+func testCreate(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if want, have := error(nil), r.Create(ctx, "create", "pass"); want != have {
+		t.Fatalf("Create: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrUserExists, r.Create(ctx, "create", "pass"); want != have {
+		t.Errorf("Create duplicate: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrUserExists, r.Create(ctx, "create", "other pass"); want != have {
+		t.Errorf("Create duplicate with other pass: want %v, have %v", want, have)
+	}
+
+	// The duplicate doesn't change the pass.
+	if _, err := r.Auth(ctx, "create", "other pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth with duplicate's pass: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if _, err := r.Auth(ctx, "create", "pass"); err != nil {
+		t.Errorf("Auth with original pass: %v", err)
+	}
+
+	// Users are case sensitive.
+	if want, have := error(nil), r.Create(ctx, "CREATE", "pass"); want != have {
+		t.Errorf("Create with different case: want %v, have %v", want, have)
+	}
+}
+
+func testAuth(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if _, err := r.Auth(ctx, "auth", "pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth missing user: want %v, have %v", auth.ErrBadAuth, err)
+	}
+
+	if err := r.Create(ctx, "auth", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Auth(ctx, "auth", "bad pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth with bad pass: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if _, err := r.Auth(ctx, "auth", ""); err != auth.ErrBadAuth {
+		t.Errorf("Auth with empty pass: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if _, err := r.Auth(ctx, "AUTH", "pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth with different case: want %v, have %v", auth.ErrBadAuth, err)
+	}
+
+	token, err := r.Auth(ctx, "auth", "pass")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	if token == "" {
+		t.Errorf("Auth: want token, have none")
+	}
+}
+
+func testTokens(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	for _, user := range []string{"alpha", "beta"} {
+		if err := r.Create(ctx, user, "pass"); err != nil {
+			t.Fatalf("Create(%s): %v", user, err)
+		}
+	}
+
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "alpha", "token"); want != have {
+		t.Errorf("Validate before Auth: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Deauth(ctx, "alpha", "token"); want != have {
+		t.Errorf("Deauth before Auth: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "nobody", "token"); want != have {
+		t.Errorf("Validate missing user: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Deauth(ctx, "nobody", "token"); want != have {
+		t.Errorf("Deauth missing user: want %v, have %v", want, have)
+	}
+
+	alpha, err := r.Auth(ctx, "alpha", "pass")
+	if err != nil {
+		t.Fatalf("Auth(alpha): %v", err)
+	}
+	beta, err := r.Auth(ctx, "beta", "pass")
+	if err != nil {
+		t.Fatalf("Auth(beta): %v", err)
+	}
+
+	if want, have := error(nil), r.Validate(ctx, "alpha", alpha); want != have {
+		t.Errorf("Validate: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "alpha", "bad token"); want != have {
+		t.Errorf("Validate with bad token: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "alpha", ""); want != have {
+		t.Errorf("Validate with empty token: want %v, have %v", want, have)
+	}
+	if alpha != beta {
+		if want, have := auth.ErrBadAuth, r.Validate(ctx, "alpha", beta); want != have {
+			t.Errorf("Validate with another user's token: want %v, have %v", want, have)
+		}
+		if want, have := auth.ErrBadAuth, r.Deauth(ctx, "alpha", beta); want != have {
+			t.Errorf("Deauth with another user's token: want %v, have %v", want, have)
+		}
+	}
+
+	// Logging in again starts another session, and the first remains.
+	again, err := r.Auth(ctx, "alpha", "pass")
+	if err != nil {
+		t.Fatalf("Auth again: %v", err)
+	}
+	if again == alpha {
+		t.Errorf("Auth again: want a new token, have the same")
+	}
+	if want, have := error(nil), r.Validate(ctx, "alpha", alpha); want != have {
+		t.Errorf("Validate first token: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.Validate(ctx, "alpha", again); want != have {
+		t.Errorf("Validate new token: want %v, have %v", want, have)
+	}
+
+	if want, have := auth.ErrBadAuth, r.Deauth(ctx, "alpha", "bad token"); want != have {
+		t.Errorf("Deauth with bad token: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.Deauth(ctx, "alpha", again); want != have {
+		t.Errorf("Deauth: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "alpha", again); want != have {
+		t.Errorf("Validate after Deauth: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Deauth(ctx, "alpha", again); want != have {
+		t.Errorf("Deauth again: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.Validate(ctx, "alpha", alpha); want != have {
+		t.Errorf("Validate other session after Deauth: want %v, have %v", want, have)
+	}
+
+	// Other users are unaffected.
+	if want, have := error(nil), r.Validate(ctx, "beta", beta); want != have {
+		t.Errorf("Validate other user after Deauth: want %v, have %v", want, have)
+	}
+}
+
+func testConcurrentCreate(t *testing.T, r auth.Repository) {
+	var (
+		ctx     = context.Background()
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		created int
+	)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Everyone creates a user of their own...
+			if err := r.Create(ctx, fmt.Sprintf("concurrent-%d", i), "pass"); err != nil {
+				t.Errorf("Create(concurrent-%d): %v", i, err)
+			}
+
+			// ...and competes to create a shared one.
+			switch err := r.Create(ctx, "concurrent", "pass"); err {
+			case nil:
+				mtx.Lock()
+				created++
+				mtx.Unlock()
+			case auth.ErrUserExists:
+			default:
+				t.Errorf("Create(concurrent): %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if want, have := 1, created; want != have {
+		t.Errorf("concurrent Create of the same user: want %d success, have %d", want, have)
+	}
+	for i := 0; i < Concurrency; i++ {
+		if _, err := r.Auth(ctx, fmt.Sprintf("concurrent-%d", i), "pass"); err != nil {
+			t.Errorf("Auth(concurrent-%d): %v", i, err)
+		}
+	}
+}
+
+func testConcurrentLogin(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if err := r.Create(ctx, "login", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+
+	var (
+		wg     sync.WaitGroup
+		tokens = make([]string, Concurrency)
+	)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			token, err := r.Auth(ctx, "login", "pass")
+			if err != nil {
+				t.Errorf("Auth: %v", err)
+				return
+			}
+			tokens[i] = token
+		}(i)
+	}
+	wg.Wait()
+
+	// Every login succeeds, with a session of its own.
+	valid := map[string]bool{}
+	for _, token := range tokens {
+		if token != "" && r.Validate(ctx, "login", token) == nil {
+			valid[token] = true
+		}
+	}
+	if want, have := Concurrency, len(valid); want != have {
+		t.Errorf("concurrent Auth: want %d valid tokens, have %d", want, have)
+	}
+}
+
+func testCancel(t *testing.T, r auth.Repository) {
+	if err := r.Create(context.Background(), "cancel", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	token, err := r.Auth(context.Background(), "cancel", "pass")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := r.Create(ctx, "canceled", "pass"); errors.Cause(err) != context.Canceled {
+		t.Errorf("Create with canceled context: want %v, have %v", context.Canceled, err)
+	}
+	if _, err := r.Auth(ctx, "cancel", "pass"); errors.Cause(err) != context.Canceled {
+		t.Errorf("Auth with canceled context: want %v, have %v", context.Canceled, err)
+	}
+	if err := r.Validate(ctx, "cancel", token); errors.Cause(err) != context.Canceled {
+		t.Errorf("Validate with canceled context: want %v, have %v", context.Canceled, err)
+	}
+	if err := r.Deauth(ctx, "cancel", token); errors.Cause(err) != context.Canceled {
+		t.Errorf("Deauth with canceled context: want %v, have %v", context.Canceled, err)
+	}
+
+	// None of it took effect.
+	if _, err := r.Auth(context.Background(), "canceled", "pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth after canceled Create: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if err := r.Validate(context.Background(), "cancel", token); err != nil {
+		t.Errorf("Validate after canceled Auth and Deauth: %v", err)
+	}
+}
+
+func testRoles(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if _, err := r.Role(ctx, "roles"); err != auth.ErrUnknownUser {
+		t.Errorf("Role missing user: want %v, have %v", auth.ErrUnknownUser, err)
+	}
+	if want, have := auth.ErrUnknownUser, r.SetRole(ctx, "roles", rbac.Admin); want != have {
+		t.Errorf("SetRole missing user: want %v, have %v", want, have)
+	}
+
+	if err := r.Create(ctx, "roles", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if role, err := r.Role(ctx, "roles"); err != nil || role != rbac.User {
+		t.Errorf("Role by default: want %q, have %q (%v)", rbac.User, role, err)
+	}
+	if want, have := rbac.ErrInvalidRole, r.SetRole(ctx, "roles", rbac.Role("root")); want != have {
+		t.Errorf("SetRole invalid role: want %v, have %v", want, have)
+	}
+	for _, role := range []rbac.Role{rbac.Admin, rbac.Analyst, rbac.User} {
+		if err := r.SetRole(ctx, "roles", role); err != nil {
+			t.Fatalf("SetRole(%s): %v", role, err)
+		}
+		if have, err := r.Role(ctx, "roles"); err != nil || have != role {
+			t.Errorf("Role after SetRole: want %q, have %q (%v)", role, have, err)
+		}
+	}
+
+	// Erasing the user erases their role.
+	if err := r.SetRole(ctx, "roles", rbac.Admin); err != nil {
+		t.Fatalf("SetRole: %v", err)
+	}
+	if err := r.Erase(ctx, "roles"); err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if err := r.Create(ctx, "roles", "pass"); err != nil {
+		t.Fatalf("Create after Erase: %v", err)
+	}
+	if role, err := r.Role(ctx, "roles"); err != nil || role != rbac.User {
+		t.Errorf("Role after Erase: want %q, have %q (%v)", rbac.User, role, err)
+	}
+}
+
+func testKeys(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	var (
+		created = time.Unix(1500000000, 0).UTC()
+		k1      = auth.APIKey{ID: "keys-1", User: "keys", Name: "pipeline", Scope: []rbac.Permission{rbac.SearchAll}, Created: created}
+		k2      = auth.APIKey{ID: "keys-2", User: "keys", Name: "backfill", Created: created.Add(time.Hour)}
+	)
+	if want, have := auth.ErrUnknownUser, r.CreateKey(ctx, k1, "hash-1"); want != have {
+		t.Errorf("CreateKey missing user: want %v, have %v", want, have)
+	}
+	if err := r.Create(ctx, "keys", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if err := r.CreateKey(ctx, k2, "hash-2"); err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	if err := r.CreateKey(ctx, k1, "hash-1"); err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	keys, err := r.Keys(ctx, "keys")
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+	if want, have := []auth.APIKey{k1, k2}, keys; !reflect.DeepEqual(want, have) {
+		t.Errorf("Keys: want %+v, have %+v", want, have)
+	}
+
+	// Auth checks the hash, and records the last use.
+	now := created.Add(24 * time.Hour)
+	if _, err := r.AuthKey(ctx, "keys-1", "hash-2", now); err != auth.ErrBadAuth {
+		t.Errorf("AuthKey with wrong hash: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if _, err := r.AuthKey(ctx, "keys-3", "hash-1", now); err != auth.ErrBadAuth {
+		t.Errorf("AuthKey missing key: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	key, err := r.AuthKey(ctx, "keys-1", "hash-1", now)
+	if err != nil {
+		t.Fatalf("AuthKey: %v", err)
+	}
+	k1.LastUsed = now
+	if want, have := k1, key; !reflect.DeepEqual(want, have) {
+		t.Errorf("AuthKey: want %+v, have %+v", want, have)
+	}
+	keys, err = r.Keys(ctx, "keys")
+	if err != nil {
+		t.Fatalf("Keys: %v", err)
+	}
+	if want, have := now, keys[0].LastUsed; !want.Equal(have) {
+		t.Errorf("Keys after AuthKey: want last use %s, have %s", want, have)
+	}
+
+	// Keys are revoked by their user only.
+	if want, have := auth.ErrUnknownKey, r.RevokeKey(ctx, "other", "keys-1"); want != have {
+		t.Errorf("RevokeKey by other user: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.RevokeKey(ctx, "keys", "keys-1"); want != have {
+		t.Errorf("RevokeKey: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrUnknownKey, r.RevokeKey(ctx, "keys", "keys-1"); want != have {
+		t.Errorf("RevokeKey again: want %v, have %v", want, have)
+	}
+	if _, err := r.AuthKey(ctx, "keys-1", "hash-1", now); err != auth.ErrBadAuth {
+		t.Errorf("AuthKey after RevokeKey: want %v, have %v", auth.ErrBadAuth, err)
+	}
+
+	// Erasing the user erases their keys.
+	data, err := r.Export(ctx, "keys")
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if want, have := []auth.APIKey{k2}, data.Keys; !reflect.DeepEqual(want, have) {
+		t.Errorf("Export: want keys %+v, have %+v", want, have)
+	}
+	if err := r.Erase(ctx, "keys"); err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if _, err := r.AuthKey(ctx, "keys-2", "hash-2", now); err != auth.ErrBadAuth {
+		t.Errorf("AuthKey after Erase: want %v, have %v", auth.ErrBadAuth, err)
+	}
+}
+
+func testIdentities(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	var (
+		id    = auth.Identity{Issuer: "https://idp", Subject: "s-1"}
+		other = auth.Identity{Issuer: "https://other", Subject: "s-1"}
+	)
+	if _, err := r.Identity(ctx, id); err != auth.ErrUnknownIdentity {
+		t.Errorf("Identity before Link: want %v, have %v", auth.ErrUnknownIdentity, err)
+	}
+	if want, have := auth.ErrUnknownUser, r.Link(ctx, id, "identities"); want != have {
+		t.Errorf("Link missing user: want %v, have %v", want, have)
+	}
+	if _, err := r.IssueToken(ctx, "identities"); err != auth.ErrUnknownUser {
+		t.Errorf("IssueToken missing user: want %v, have %v", auth.ErrUnknownUser, err)
+	}
+
+	for _, user := range []string{"identities", "identities-2"} {
+		if err := r.Create(ctx, user, "pass"); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+	for _, link := range []struct {
+		id   auth.Identity
+		user string
+	}{
+		{id, "identities-2"},
+		{id, "identities"}, // replaces the first link
+		{other, "identities"},
+	} {
+		if err := r.Link(ctx, link.id, link.user); err != nil {
+			t.Fatalf("Link: %v", err)
+		}
+	}
+	if user, err := r.Identity(ctx, id); err != nil || user != "identities" {
+		t.Errorf("Identity: want %q, have %q (%v)", "identities", user, err)
+	}
+	if _, err := r.Identity(ctx, auth.Identity{Issuer: "https://idp", Subject: "s-2"}); err != auth.ErrUnknownIdentity {
+		t.Errorf("Identity of other subject: want %v, have %v", auth.ErrUnknownIdentity, err)
+	}
+
+	token, err := r.IssueToken(ctx, "identities")
+	if err != nil {
+		t.Fatalf("IssueToken: %v", err)
+	}
+	if want, have := error(nil), r.Validate(ctx, "identities", token); want != have {
+		t.Errorf("Validate issued token: want %v, have %v", want, have)
+	}
+
+	data, err := r.Export(ctx, "identities")
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if want, have := []auth.Identity{id, other}, data.Identities; !reflect.DeepEqual(want, have) {
+		t.Errorf("Export: want identities %+v, have %+v", want, have)
+	}
+	if err := r.Erase(ctx, "identities"); err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if _, err := r.Identity(ctx, id); err != auth.ErrUnknownIdentity {
+		t.Errorf("Identity after Erase: want %v, have %v", auth.ErrUnknownIdentity, err)
+	}
+}
+
+func testTwoFactor(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if want, have := auth.ErrUnknownUser, r.SetTOTP(ctx, "2fa", auth.TOTP{Secret: "S"}); want != have {
+		t.Errorf("SetTOTP missing user: want %v, have %v", want, have)
+	}
+	if err := r.Create(ctx, "2fa", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if want, have := auth.ErrBadAuth, r.CheckPass(ctx, "2fa", "bad pass"); want != have {
+		t.Errorf("CheckPass with bad pass: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.CheckPass(ctx, "2fa", "pass"); want != have {
+		t.Errorf("CheckPass: want %v, have %v", want, have)
+	}
+	if tp, err := r.TOTP(ctx, "2fa"); err != nil || tp != nil {
+		t.Errorf("TOTP before SetTOTP: want nil, have %+v (%v)", tp, err)
+	}
+
+	// Steps are only used once, in order, and only when enabled.
+	if err := r.SetTOTP(ctx, "2fa", auth.TOTP{Secret: "S"}); err != nil {
+		t.Fatalf("SetTOTP: %v", err)
+	}
+	if want, have := auth.ErrBadAuth, r.UseTOTPStep(ctx, "2fa", 10); want != have {
+		t.Errorf("UseTOTPStep when not enabled: want %v, have %v", want, have)
+	}
+	if err := r.SetTOTP(ctx, "2fa", auth.TOTP{Secret: "S", Enabled: true, LastStep: 10}); err != nil {
+		t.Fatalf("SetTOTP: %v", err)
+	}
+	for _, testcase := range []struct {
+		step int64
+		want error
+	}{
+		{10, auth.ErrBadAuth},
+		{11, nil},
+		{11, auth.ErrBadAuth},
+		{9, auth.ErrBadAuth},
+	} {
+		if want, have := testcase.want, r.UseTOTPStep(ctx, "2fa", testcase.step); want != have {
+			t.Errorf("UseTOTPStep(%d): want %v, have %v", testcase.step, want, have)
+		}
+	}
+	if tp, err := r.TOTP(ctx, "2fa"); err != nil || tp == nil || *tp != (auth.TOTP{Secret: "S", Enabled: true, LastStep: 11}) {
+		t.Errorf("TOTP: want %+v, have %+v (%v)", auth.TOTP{Secret: "S", Enabled: true, LastStep: 11}, tp, err)
+	}
+
+	// Recovery codes are only used once, and replaced as a set.
+	if err := r.SetRecoveryCodes(ctx, "2fa", []string{"a", "b"}); err != nil {
+		t.Fatalf("SetRecoveryCodes: %v", err)
+	}
+	if err := r.SetRecoveryCodes(ctx, "2fa", []string{"c", "d"}); err != nil {
+		t.Fatalf("SetRecoveryCodes: %v", err)
+	}
+	for _, testcase := range []struct {
+		hash string
+		want error
+	}{
+		{"a", auth.ErrBadAuth},
+		{"c", nil},
+		{"c", auth.ErrBadAuth},
+	} {
+		if want, have := testcase.want, r.UseRecoveryCode(ctx, "2fa", testcase.hash); want != have {
+			t.Errorf("UseRecoveryCode(%s): want %v, have %v", testcase.hash, want, have)
+		}
+	}
+
+	// Challenges are consumed once, by their user, before they expire.
+	now := time.Now()
+	for _, c := range []auth.Challenge{
+		{ID: "c1", User: "2fa", Expires: now.Add(time.Minute)},
+		{ID: "c2", User: "2fa", Expires: now.Add(-time.Minute)},
+	} {
+		if err := r.CreateChallenge(ctx, c); err != nil {
+			t.Fatalf("CreateChallenge: %v", err)
+		}
+	}
+	for _, testcase := range []struct {
+		id, user string
+		want     error
+	}{
+		{"c1", "other", auth.ErrBadAuth},
+		{"c2", "2fa", auth.ErrBadAuth},
+		{"c1", "2fa", nil},
+		{"c1", "2fa", auth.ErrBadAuth},
+	} {
+		if want, have := testcase.want, r.ConsumeChallenge(ctx, testcase.id, testcase.user, now); want != have {
+			t.Errorf("ConsumeChallenge(%s, %s): want %v, have %v", testcase.id, testcase.user, want, have)
+		}
+	}
+
+	if data, err := r.Export(ctx, "2fa"); err != nil || !data.TwoFactor {
+		t.Errorf("Export: want two-factor enabled, have %+v (%v)", data, err)
+	}
+	if err := r.DeleteTOTP(ctx, "2fa"); err != nil {
+		t.Fatalf("DeleteTOTP: %v", err)
+	}
+	if tp, err := r.TOTP(ctx, "2fa"); err != nil || tp != nil {
+		t.Errorf("TOTP after DeleteTOTP: want nil, have %+v (%v)", tp, err)
+	}
+	if want, have := auth.ErrBadAuth, r.UseRecoveryCode(ctx, "2fa", "d"); want != have {
+		t.Errorf("UseRecoveryCode after DeleteTOTP: want %v, have %v", want, have)
+	}
+}
+
+func testPasses(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if want, have := auth.ErrUnknownUser, r.SetPass(ctx, "passes", "pass"); want != have {
+		t.Errorf("SetPass missing user: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrUnknownUser, r.CreateResetToken(ctx, "passes", "hash", time.Now().Add(time.Hour)); want != have {
+		t.Errorf("CreateResetToken missing user: want %v, have %v", want, have)
+	}
+	if err := r.Create(ctx, "passes", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	token, err := r.Auth(ctx, "passes", "pass")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+
+	// Setting the pass logs the user out.
+	if want, have := error(nil), r.SetPass(ctx, "passes", "new pass"); want != have {
+		t.Fatalf("SetPass: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "passes", token); want != have {
+		t.Errorf("Validate after SetPass: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.CheckPass(ctx, "passes", "pass"); want != have {
+		t.Errorf("CheckPass old pass: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.CheckPass(ctx, "passes", "new pass"); want != have {
+		t.Errorf("CheckPass new pass: want %v, have %v", want, have)
+	}
+
+	// Reset tokens are consumed once, before they expire, and replaced by
+	// newer ones.
+	now := time.Now()
+	for _, hash := range []string{"old", "new"} {
+		if err := r.CreateResetToken(ctx, "passes", hash, now.Add(time.Hour)); err != nil {
+			t.Fatalf("CreateResetToken: %v", err)
+		}
+	}
+	for _, testcase := range []struct {
+		hash string
+		want error
+	}{
+		{"old", auth.ErrBadAuth},
+		{"new", nil},
+		{"new", auth.ErrBadAuth},
+	} {
+		if want, have := testcase.want, r.ConsumeResetToken(ctx, "passes", testcase.hash, now); want != have {
+			t.Errorf("ConsumeResetToken(%s): want %v, have %v", testcase.hash, want, have)
+		}
+	}
+	if err := r.CreateResetToken(ctx, "passes", "expired", now.Add(-time.Second)); err != nil {
+		t.Fatalf("CreateResetToken: %v", err)
+	}
+	if want, have := auth.ErrBadAuth, r.ConsumeResetToken(ctx, "passes", "expired", now); want != have {
+		t.Errorf("ConsumeResetToken expired: want %v, have %v", want, have)
+	}
+}
+
+func testUsers(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if want, have := auth.ErrUnknownUser, r.SetDisabled(ctx, "users-a", true); want != have {
+		t.Errorf("SetDisabled missing user: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrUnknownUser, r.DeauthAll(ctx, "users-a"); want != have {
+		t.Errorf("DeauthAll missing user: want %v, have %v", want, have)
+	}
+	for _, user := range []string{"users-c", "users-a", "users-b"} {
+		if err := r.Create(ctx, user, "pass"); err != nil {
+			t.Fatalf("Create: %v", err)
+		}
+	}
+
+	// Users are listed in pages, sorted by name.
+	users, err := r.Users(ctx, "users-", 2)
+	if err != nil {
+		t.Fatalf("Users: %v", err)
+	}
+	if want, have := []auth.UserSummary{{User: "users-a", Role: rbac.User}, {User: "users-b", Role: rbac.User}}, users; !reflect.DeepEqual(want, have) {
+		t.Errorf("Users: want %+v, have %+v", want, have)
+	}
+	if users, err := r.Users(ctx, "users-b", 2); err != nil || len(users) == 0 || users[0].User != "users-c" {
+		t.Errorf("Users after users-b: want users-c first, have %+v (%v)", users, err)
+	}
+
+	// Disabled users are logged out, and can't log in or use API keys.
+	token, err := r.Auth(ctx, "users-b", "pass")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	key := auth.APIKey{ID: "users-b-1", User: "users-b", Name: "pipeline", Created: time.Unix(1500000000, 0).UTC()}
+	if err := r.CreateKey(ctx, key, "hash"); err != nil {
+		t.Fatalf("CreateKey: %v", err)
+	}
+	if want, have := error(nil), r.SetDisabled(ctx, "users-b", true); want != have {
+		t.Fatalf("SetDisabled: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "users-b", token); want != have {
+		t.Errorf("Validate disabled: want %v, have %v", want, have)
+	}
+	if _, err := r.Auth(ctx, "users-b", "pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth disabled: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if want, have := auth.ErrBadAuth, r.CheckPass(ctx, "users-b", "pass"); want != have {
+		t.Errorf("CheckPass disabled: want %v, have %v", want, have)
+	}
+	if _, err := r.IssueToken(ctx, "users-b"); err != auth.ErrUnknownUser {
+		t.Errorf("IssueToken disabled: want %v, have %v", auth.ErrUnknownUser, err)
+	}
+	if _, err := r.AuthKey(ctx, "users-b-1", "hash", time.Now()); err != auth.ErrBadAuth {
+		t.Errorf("AuthKey disabled: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if users, err := r.Users(ctx, "users-a", 1); err != nil || len(users) != 1 || !users[0].Disabled {
+		t.Errorf("Users: want users-b disabled, have %+v (%v)", users, err)
+	}
+	if data, err := r.Export(ctx, "users-b"); err != nil || data == nil || !data.Disabled {
+		t.Errorf("Export: want disabled, have %+v (%v)", data, err)
+	}
+
+	// Enabled users can log in again.
+	if want, have := error(nil), r.SetDisabled(ctx, "users-b", false); want != have {
+		t.Fatalf("SetDisabled false: want %v, have %v", want, have)
+	}
+	if _, err := r.AuthKey(ctx, "users-b-1", "hash", time.Now()); err != nil {
+		t.Errorf("AuthKey enabled: %v", err)
+	}
+	if token, err = r.Auth(ctx, "users-b", "pass"); err != nil {
+		t.Fatalf("Auth enabled: %v", err)
+	}
+	other, err := r.IssueToken(ctx, "users-b")
+	if err != nil {
+		t.Fatalf("IssueToken enabled: %v", err)
+	}
+	if users, err := r.Users(ctx, "users-a", 1); err != nil || len(users) != 1 || users[0].Sessions != 2 {
+		t.Errorf("Users: want users-b with 2 sessions, have %+v (%v)", users, err)
+	}
+
+	// DeauthAll ends every session, but leaves their API keys.
+	if want, have := error(nil), r.DeauthAll(ctx, "users-b"); want != have {
+		t.Fatalf("DeauthAll: want %v, have %v", want, have)
+	}
+	for _, token := range []string{token, other} {
+		if want, have := auth.ErrBadAuth, r.Validate(ctx, "users-b", token); want != have {
+			t.Errorf("Validate after DeauthAll: want %v, have %v", want, have)
+		}
+	}
+	if _, err := r.AuthKey(ctx, "users-b-1", "hash", time.Now()); err != nil {
+		t.Errorf("AuthKey after DeauthAll: %v", err)
+	}
+}
+
+func testExportAndErase(t *testing.T, r auth.Repository) {
+	ctx := context.Background()
+
+	if data, err := r.Export(ctx, "erase"); err != nil || data != nil {
+		t.Errorf("Export missing user: want nil, have %+v (%v)", data, err)
+	}
+
+	if err := r.Create(ctx, "erase", "pass"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	token, err := r.Auth(ctx, "erase", "pass")
+	if err != nil {
+		t.Fatalf("Auth: %v", err)
+	}
+	data, err := r.Export(ctx, "erase")
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if want, have := (auth.UserData{User: "erase", Role: rbac.User, Sessions: 1}), *data; !reflect.DeepEqual(want, have) {
+		t.Errorf("Export: want %+v, have %+v", want, have)
+	}
+
+	if want, have := error(nil), r.Erase(ctx, "erase"); want != have {
+		t.Fatalf("Erase: want %v, have %v", want, have)
+	}
+	if want, have := auth.ErrBadAuth, r.Validate(ctx, "erase", token); want != have {
+		t.Errorf("Validate after Erase: want %v, have %v", want, have)
+	}
+	if _, err := r.Auth(ctx, "erase", "pass"); err != auth.ErrBadAuth {
+		t.Errorf("Auth after Erase: want %v, have %v", auth.ErrBadAuth, err)
+	}
+	if data, err := r.Export(ctx, "erase"); err != nil || data != nil {
+		t.Errorf("Export after Erase: want nil, have %+v (%v)", data, err)
+	}
+	if want, have := error(nil), r.Erase(ctx, "erase"); want != have {
+		t.Errorf("Erase again: want %v, have %v", want, have)
+	}
+
+	// The user can sign up again.
+	if want, have := error(nil), r.Create(ctx, "erase", "new pass"); want != have {
+		t.Errorf("Create after Erase: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,106 @@
+package authtest
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/auth"
+	"github.com/peterbourgon/gattaca/pkg/internal/pgtest"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	r, err := auth.NewRepository("memory:", auth.PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*auth.MemoryRepository); !ok {
+		t.Fatalf("NewRepository(memory:): want %T, have %T", &auth.MemoryRepository{}, r)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	// A single connection, as concurrent writers to an in-memory DB with a
+	// shared cache fail with SQLITE_LOCKED rather than waiting. The DB is
+	// named uniquely, as it outlives the test when run with -count.
+	urn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", t.Name(), time.Now().UnixNano())
+	r, err := auth.NewRepository(urn, auth.PoolConfig{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteRepositoryWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "authtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := auth.NewSQLiteRepository("file:"+filepath.Join(dir, "auth.db"),
+		auth.WithJournalMode("WAL"),
+		auth.WithBusyTimeout(5*time.Second),
+		auth.WithReadPool(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteIntegration(t *testing.T) {
+	var (
+		filevar  = "AUTH_INTEGRATION_TEST_FILE"
+		filename = os.Getenv(filevar)
+	)
+	if filename == "" {
+		// If a test will write to disk, make it opt-in.
+		t.Skipf("skipping; set %s to run this test", filevar)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("%s: %v", filename, err)
+	}
+
+	defer func() {
+		if err := os.Remove(filename); err != nil {
+			t.Errorf("rm %s: %v", filename, err)
+		}
+	}()
+
+	r, err := auth.NewRepository("file:"+filename, auth.PoolConfig{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestPostgresRepository(t *testing.T) {
+	urn, stop := pgtest.Start(t)
+	defer stop()
+
+	r, err := auth.NewPostgresRepository(urn, auth.PoolConfig{MaxOpenConns: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db, err := sql.Open("postgres", urn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Exec(`DROP TABLE credentials, sessions`)
+	}()
+
+	TestRepository(t, r)
+}
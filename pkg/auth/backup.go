@@ -0,0 +1,389 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
+	"github.com/peterbourgon/gattaca/pkg/internal/sqlitebackup"
+	"github.com/pkg/errors"
+)
+
+// Backup writes a consistent snapshot of the repository to a new backup
+// file, with the SQLite online backup API. The repository remains usable
+// throughout.
+func (r *SQLiteRepository) Backup(ctx context.Context, filename string) error {
+	return sqlitebackup.ToFile(ctx, r.rdb, filename)
+}
+
+// Backup writes a snapshot of the repository to a new backup file.
+func (r *MemoryRepository) Backup(ctx context.Context, filename string) error {
+	r.mtx.Lock()
+	var (
+		creds    = make(map[string]string, len(r.creds))
+		sessions = make([]memorySession, 0, len(r.sessions))
+		roles    = make(map[string]string, len(r.roles))
+	)
+	for user, pass := range r.creds {
+		creds[user] = pass
+	}
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	for user, role := range r.roles {
+		roles[user] = string(role)
+	}
+	keys := make([]memoryKey, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key)
+	}
+	identities := make(map[Identity]string, len(r.identities))
+	for id, user := range r.identities {
+		identities[id] = user
+	}
+	totps := make(map[string]TOTP, len(r.totp))
+	for user, t := range r.totp {
+		totps[user] = t
+	}
+	recovery := make(map[string][]string, len(r.recovery))
+	for user, codes := range r.recovery {
+		for hash := range codes {
+			recovery[user] = append(recovery[user], hash)
+		}
+	}
+	disabled := make([]string, 0, len(r.disabled))
+	for user := range r.disabled {
+		disabled = append(disabled, user)
+	}
+	r.mtx.Unlock()
+
+	return writeBackup(ctx, filename, creds, sessions, roles, keys, identities, totps, recovery, disabled)
+}
+
+// Backup writes a consistent snapshot of the repository to a new backup
+// file, reading from a single read-only transaction.
+func (r *PostgresRepository) Backup(ctx context.Context, filename string) error {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "error starting backup transaction")
+	}
+	defer tx.Rollback() // read-only
+
+	creds, err := selectPairs(ctx, tx, `SELECT "user", pass FROM credentials`)
+	if err != nil {
+		return errors.Wrap(err, "error reading credentials")
+	}
+	sessions, err := selectSessions(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "error reading sessions")
+	}
+	roles, err := selectPairs(ctx, tx, `SELECT "user", role FROM roles`)
+	if err != nil {
+		return errors.Wrap(err, "error reading roles")
+	}
+	keys, err := selectKeys(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "error reading API keys")
+	}
+	identities, err := selectIdentities(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "error reading identities")
+	}
+	totps, err := selectTOTPs(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "error reading TOTP")
+	}
+	recovery, err := selectRecoveryCodes(ctx, tx)
+	if err != nil {
+		return errors.Wrap(err, "error reading recovery codes")
+	}
+	disabled, err := selectUsers(ctx, tx, `SELECT "user" FROM disabled_users`)
+	if err != nil {
+		return errors.Wrap(err, "error reading disabled users")
+	}
+
+	return writeBackup(ctx, filename, creds, sessions, roles, keys, identities, totps, recovery, disabled)
+}
+
+// VerifyBackup checks that the file is an intact backup, which can be
+// restored by this version of the package. Backups are SQLite DB files with
+// the schema of SQLiteRepository, whichever repository they were taken from.
+func VerifyBackup(ctx context.Context, filename string) error {
+	db, err := sqlitebackup.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := sqlitebackup.Check(ctx, db); err != nil {
+		return err
+	}
+	version, err := migrate.Current(ctx, db, sqliteMigrations)
+	if err != nil {
+		return errors.Wrap(err, "error reading schema version")
+	}
+	if version == 0 {
+		return errors.Errorf("%s isn't an auth backup", filename)
+	}
+	return nil
+}
+
+// RestoreBackup verifies the backup file, and restores it into the SQLite
+// DB represented by URN, which must be fresh, i.e. have no tables. The DB
+// is then migrated to the latest schema version.
+func RestoreBackup(ctx context.Context, filename, urn string) error {
+	if urn == "memory:" || strings.HasPrefix(urn, "postgres://") || strings.HasPrefix(urn, "postgresql://") {
+		return errors.New("backups can only be restored into SQLite")
+	}
+	if err := VerifyBackup(ctx, filename); err != nil {
+		return errors.Wrap(err, "error verifying backup")
+	}
+
+	src, err := sqlitebackup.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return errors.Wrap(err, "error opening DB")
+	}
+	defer dst.Close()
+
+	if empty, err := sqlitebackup.Empty(ctx, dst); err != nil {
+		return err
+	} else if !empty {
+		return errors.New("refusing to restore into a DB which already has tables")
+	}
+	if err := sqlitebackup.Copy(ctx, dst, src); err != nil {
+		return errors.Wrap(err, "error restoring backup")
+	}
+	if _, _, err := migrate.Migrate(ctx, dst, sqliteMigrations, -1); err != nil {
+		return errors.Wrap(err, "error migrating restored DB")
+	}
+	return nil
+}
+
+// writeBackup writes the credentials, sessions, roles, API keys, identities,
+// TOTP enrollments, recovery code hashes, and disabled users to a new backup
+// file. Login challenges and pass reset tokens are short-lived, and aren't
+// backed up.
+func writeBackup(ctx context.Context, filename string, creds map[string]string, sessions []memorySession, roles map[string]string, keys []memoryKey, identities map[Identity]string, totps map[string]TOTP, recovery map[string][]string, disabled []string) (err error) {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return errors.Errorf("%s already exists", filename)
+	}
+
+	r, err := NewSQLiteRepository("file:" + filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.db.Close()
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting backup transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	for user, pass := range creds {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO credentials (user, pass) VALUES (?, ?)`, user, pass); err != nil {
+			return errors.Wrap(err, "error writing credentials")
+		}
+	}
+	for _, s := range sessions {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO sessions (hash, user, created) VALUES (?, ?, ?)`, s.hash, s.user, s.created.Unix()); err != nil {
+			return errors.Wrap(err, "error writing sessions")
+		}
+	}
+	for user, role := range roles {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO roles (user, role) VALUES (?, ?)`, user, role); err != nil {
+			return errors.Wrap(err, "error writing roles")
+		}
+	}
+	for _, key := range keys {
+		var lastUsed sql.NullInt64
+		if !key.LastUsed.IsZero() {
+			lastUsed = sql.NullInt64{Int64: key.LastUsed.Unix(), Valid: true}
+		}
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO api_keys (id, user, name, scope, created, last_used, hash) VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, key.ID, key.User, key.Name, joinScope(key.Scope), key.Created.Unix(), lastUsed, key.hash); err != nil {
+			return errors.Wrap(err, "error writing API keys")
+		}
+	}
+	for id, user := range identities {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO identities (issuer, subject, user) VALUES (?, ?, ?)`, id.Issuer, id.Subject, user); err != nil {
+			return errors.Wrap(err, "error writing identities")
+		}
+	}
+	for user, t := range totps {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO totp (user, secret, enabled, last_step) VALUES (?, ?, ?, ?)`, user, t.Secret, t.Enabled, t.LastStep); err != nil {
+			return errors.Wrap(err, "error writing TOTP")
+		}
+	}
+	for user, hashes := range recovery {
+		for _, hash := range hashes {
+			if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes (user, hash) VALUES (?, ?)`, user, hash); err != nil {
+				return errors.Wrap(err, "error writing recovery codes")
+			}
+		}
+	}
+	for _, user := range disabled {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO disabled_users (user) VALUES (?)`, user); err != nil {
+			return errors.Wrap(err, "error writing disabled users")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing backup")
+}
+
+// selectKeys reads every API key, with the hash of its secret.
+func selectKeys(ctx context.Context, tx *sql.Tx) ([]memoryKey, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, "user", name, scope, created, last_used, hash FROM api_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []memoryKey
+	for rows.Next() {
+		key, hash, err := scanKey(rows.Scan, true)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, memoryKey{APIKey: key, hash: hash})
+	}
+	return keys, rows.Err()
+}
+
+// selectSessions reads every session.
+func selectSessions(ctx context.Context, tx *sql.Tx) ([]memorySession, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT hash, "user", created FROM sessions`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []memorySession
+	for rows.Next() {
+		var (
+			s       memorySession
+			created int64
+		)
+		if err := rows.Scan(&s.hash, &s.user, &created); err != nil {
+			return nil, err
+		}
+		s.created = time.Unix(created, 0).UTC()
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// selectPairs reads a query with two string columns into a map.
+func selectPairs(ctx context.Context, tx *sql.Tx, query string) (map[string]string, error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	m := map[string]string{}
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		m[k] = v
+	}
+	return m, rows.Err()
+}
+
+// selectUsers reads a query with one string column into a slice.
+func selectUsers(ctx context.Context, tx *sql.Tx, query string) ([]string, error) {
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []string
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+// selectIdentities reads every identity, and the user it's linked to.
+func selectIdentities(ctx context.Context, tx *sql.Tx) (map[Identity]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT issuer, subject, "user" FROM identities`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := map[Identity]string{}
+	for rows.Next() {
+		var (
+			id   Identity
+			user string
+		)
+		if err := rows.Scan(&id.Issuer, &id.Subject, &user); err != nil {
+			return nil, err
+		}
+		identities[id] = user
+	}
+	return identities, rows.Err()
+}
+
+// selectTOTPs reads every TOTP enrollment, by user.
+func selectTOTPs(ctx context.Context, tx *sql.Tx) (map[string]TOTP, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT "user", secret, enabled, last_step FROM totp`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totps := map[string]TOTP{}
+	for rows.Next() {
+		var (
+			user string
+			t    TOTP
+		)
+		if err := rows.Scan(&user, &t.Secret, &t.Enabled, &t.LastStep); err != nil {
+			return nil, err
+		}
+		totps[user] = t
+	}
+	return totps, rows.Err()
+}
+
+// selectRecoveryCodes reads every recovery code hash, by user.
+func selectRecoveryCodes(ctx context.Context, tx *sql.Tx) (map[string][]string, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT "user", hash FROM recovery_codes`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	recovery := map[string][]string{}
+	for rows.Next() {
+		var user, hash string
+		if err := rows.Scan(&user, &hash); err != nil {
+			return nil, err
+		}
+		recovery[user] = append(recovery[user], hash)
+	}
+	return recovery, rows.Err()
+}
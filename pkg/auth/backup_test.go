@@ -0,0 +1,226 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestBackupSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewSQLiteRepository("file:"+filepath.Join(dir, "auth.db"),
+		WithJournalMode("WAL"),
+		WithBusyTimeout(5*time.Second),
+		WithReadPool(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := r.Create(ctx, "alpha", "beta"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep writing throughout the backup.
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := r.Create(ctx, fmt.Sprintf("user-%d", i), "pass"); err != nil {
+				t.Errorf("Create during backup: %v", err)
+				return
+			}
+		}
+	}()
+
+	filename := filepath.Join(dir, "backup.db")
+	err = r.Backup(ctx, filename)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	if want, have := error(nil), VerifyBackup(ctx, filename); want != have {
+		t.Fatalf("VerifyBackup: want %v, have %v", want, have)
+	}
+	if err := r.Backup(ctx, filename); err == nil {
+		t.Errorf("Backup to existing file: want error, have none")
+	}
+
+	restored := "file:" + filepath.Join(dir, "restored.db")
+	if want, have := error(nil), RestoreBackup(ctx, filename, restored); want != have {
+		t.Fatalf("RestoreBackup: want %v, have %v", want, have)
+	}
+	rr, err := NewSQLiteRepository(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rr.Auth(ctx, "alpha", "beta"); err != nil {
+		t.Errorf("Auth after restore: %v", err)
+	}
+}
+
+func TestBackupMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx = context.Background()
+		r   = NewMemoryRepository()
+	)
+	if err := r.Create(ctx, "alpha", "beta"); err != nil {
+		t.Fatal(err)
+	}
+	token, err := r.Auth(ctx, "alpha", "beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, secret, hash, err := newKey("alpha", "pipeline", []rbac.Permission{rbac.SearchAll}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.CreateKey(ctx, key, hash); err != nil {
+		t.Fatal(err)
+	}
+	id := Identity{Issuer: "https://idp", Subject: "s-alpha"}
+	if err := r.Link(ctx, id, "alpha"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetTOTP(ctx, "alpha", TOTP{Secret: "S", Enabled: true, LastStep: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetRecoveryCodes(ctx, "alpha", []string{hashRecoveryCode("12345-67890")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, "gamma", "delta"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetDisabled(ctx, "gamma", true); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "backup.db")
+	if want, have := error(nil), r.Backup(ctx, filename); want != have {
+		t.Fatalf("Backup: want %v, have %v", want, have)
+	}
+
+	restored := "file:" + filepath.Join(dir, "restored.db")
+	if want, have := error(nil), RestoreBackup(ctx, filename, restored); want != have {
+		t.Fatalf("RestoreBackup: want %v, have %v", want, have)
+	}
+	rr, err := NewSQLiteRepository(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := error(nil), rr.Validate(ctx, "alpha", token); want != have {
+		t.Errorf("Validate after restore: want %v, have %v", want, have)
+	}
+	if _, err := NewDefaultService(rr).Validate(ctx, "alpha", secret); err != nil {
+		t.Errorf("Validate with API key after restore: %v", err)
+	}
+	if user, err := rr.Identity(ctx, id); err != nil || user != "alpha" {
+		t.Errorf("Identity after restore: want %q, have %q (%v)", "alpha", user, err)
+	}
+	if tp, err := rr.TOTP(ctx, "alpha"); err != nil || tp == nil || *tp != (TOTP{Secret: "S", Enabled: true, LastStep: 7}) {
+		t.Errorf("TOTP after restore: have %+v (%v)", tp, err)
+	}
+	if want, have := error(nil), rr.UseRecoveryCode(ctx, "alpha", hashRecoveryCode("12345-67890")); want != have {
+		t.Errorf("UseRecoveryCode after restore: want %v, have %v", want, have)
+	}
+	if _, err := rr.Auth(ctx, "gamma", "delta"); err != ErrBadAuth {
+		t.Errorf("Auth disabled user after restore: want %v, have %v", ErrBadAuth, err)
+	}
+}
+
+func TestRestoreBackupNotEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	filename := filepath.Join(dir, "backup.db")
+	if err := NewMemoryRepository().Backup(ctx, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := "file:" + filepath.Join(dir, "existing.db")
+	r, err := NewSQLiteRepository(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Create(ctx, "alpha", "beta"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestoreBackup(ctx, filename, existing); err == nil {
+		t.Fatalf("RestoreBackup into existing DB: want error, have none")
+	}
+	if _, err := r.Auth(ctx, "alpha", "beta"); err != nil {
+		t.Errorf("Auth after refused restore: %v", err)
+	}
+	if err := RestoreBackup(ctx, filename, "memory:"); err == nil {
+		t.Errorf("RestoreBackup into memory: want error, have none")
+	}
+}
+
+func TestVerifyBackupInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := ioutil.WriteFile(garbage, []byte("this is not a SQLite DB"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	other := filepath.Join(dir, "other.db")
+	db, err := sql.Open("sqlite3", "file:"+other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE t (a INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for name, filename := range map[string]string{
+		"missing":    filepath.Join(dir, "missing.db"),
+		"garbage":    garbage,
+		"not backup": other,
+	} {
+		if err := VerifyBackup(context.Background(), filename); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
@@ -1,29 +1,79 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
 )
 
 // HTTPServer wraps a Service and implements http.Handler.
 type HTTPServer struct {
 	router  *mux.Router
 	service Service
+	oidc    *OIDC
+	audit   *audit.Log
+}
+
+// HTTPServerOption configures an HTTPServer.
+type HTTPServerOption func(*HTTPServer)
+
+// WithOIDC serves logins with the external provider, at /oidc/login and
+// /oidc/callback, which should be the provider's redirect URL.
+func WithOIDC(o *OIDC) HTTPServerOption {
+	return func(s *HTTPServer) { s.oidc = o }
+}
+
+// WithAuditLog records logins with the external provider to the audit log.
+// Other logins are recorded by the service; see NewAuditedService.
+func WithAuditLog(l *audit.Log) HTTPServerOption {
+	return func(s *HTTPServer) { s.audit = l }
 }
 
 // NewHTTPServer returns an HTTPServer wrapping the Service.
-func NewHTTPServer(service Service) *HTTPServer {
+func NewHTTPServer(service Service, options ...HTTPServerOption) *HTTPServer {
 	s := &HTTPServer{
 		service: service,
 	}
+	for _, option := range options {
+		option(s)
+	}
 	r := mux.NewRouter()
 	{
 		r.Methods("POST").Path("/signup").HandlerFunc(s.handleSignup)
 		r.Methods("POST").Path("/login").HandlerFunc(s.handleLogin)
+		r.Methods("POST").Path("/login/totp").HandlerFunc(s.handleCompleteLogin)
 		r.Methods("GET").Path("/validate").HandlerFunc(s.handleValidate)
 		r.Methods("POST").Path("/logout").HandlerFunc(s.handleLogout)
+		r.Methods("POST").Path("/password").HandlerFunc(s.handleChangePassword)
+		r.Methods("POST").Path("/reset").HandlerFunc(s.handleRequestReset)
+		r.Methods("POST").Path("/reset/confirm").HandlerFunc(s.handleResetPassword)
+		r.Methods("POST").Path("/role").HandlerFunc(s.handleSetRole)
+		r.Methods("POST").Path("/keys").HandlerFunc(s.handleCreateKey)
+		r.Methods("GET").Path("/keys").HandlerFunc(s.handleKeys)
+		r.Methods("DELETE").Path("/keys/{id}").HandlerFunc(s.handleRevokeKey)
+		r.Methods("POST").Path("/totp").HandlerFunc(s.handleEnrollTOTP)
+		r.Methods("POST").Path("/totp/confirm").HandlerFunc(s.handleConfirmTOTP)
+		r.Methods("DELETE").Path("/totp").HandlerFunc(s.handleResetTwoFactor)
+		r.Methods("GET").Path("/lockouts").HandlerFunc(s.handleLockouts)
+		r.Methods("DELETE").Path("/lockouts/{user}").HandlerFunc(s.handleUnlock)
+		r.Methods("GET").Path("/users").HandlerFunc(s.handleUsers)
+		r.Methods("GET").Path("/users/{user}").HandlerFunc(s.handleUser)
+		r.Methods("POST").Path("/users/{user}/disable").HandlerFunc(s.handleSetDisabled(true))
+		r.Methods("POST").Path("/users/{user}/enable").HandlerFunc(s.handleSetDisabled(false))
+		r.Methods("DELETE").Path("/users/{user}/sessions").HandlerFunc(s.handleForceLogout)
+		r.Methods("DELETE").Path("/users/{user}").HandlerFunc(s.handleDeleteUser)
+	}
+	if s.oidc != nil {
+		r.Methods("GET").Path("/oidc/login").HandlerFunc(s.handleOIDCLogin)
+		r.Methods("GET").Path("/oidc/callback").HandlerFunc(s.handleOIDCCallback)
 	}
 	s.router = r
 	return s
@@ -40,7 +90,7 @@ func (s *HTTPServer) handleSignup(w http.ResponseWriter, r *http.Request) {
 		pass = r.URL.Query().Get("pass")
 	)
 	if err := s.service.Signup(r.Context(), user, pass); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	fmt.Fprintln(w, "signup successful")
@@ -51,7 +101,7 @@ func (s *HTTPServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		user = r.URL.Query().Get("user")
 		pass = r.URL.Query().Get("pass")
 	)
-	token, err := s.service.Login(r.Context(), user, pass)
+	token, challenge, err := s.service.Login(withClientIP(r), user, pass)
 	if err == ErrBadAuth {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
@@ -60,26 +110,47 @@ func (s *HTTPServer) handleLogin(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if challenge != "" {
+		// The challenge, rather than a token, is passed to /login/totp.
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintln(w, challenge)
+		return
+	}
+	fmt.Fprintln(w, token)
+}
+
+func (s *HTTPServer) handleCompleteLogin(w http.ResponseWriter, r *http.Request) {
+	var (
+		user      = r.URL.Query().Get("user")
+		challenge = r.URL.Query().Get("challenge")
+		code      = r.URL.Query().Get("code")
+	)
+	token, err := s.service.CompleteLogin(withClientIP(r), user, challenge, code)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 	fmt.Fprintln(w, token)
 }
 
 func (s *HTTPServer) handleValidate(w http.ResponseWriter, r *http.Request) {
 	var (
 		user  = r.URL.Query().Get("user")
-		token = r.URL.Query().Get("token")
+		token = extractToken(r)
 	)
-	err := s.service.Validate(r.Context(), user, token)
+	p, err := s.service.Validate(r.Context(), user, token)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-	fmt.Fprintln(w, "validate successful")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
 }
 
 func (s *HTTPServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 	var (
 		user  = r.URL.Query().Get("user")
-		token = r.URL.Query().Get("token")
+		token = extractToken(r)
 	)
 	err := s.service.Logout(r.Context(), user, token)
 	if err == ErrBadAuth {
@@ -92,3 +163,359 @@ func (s *HTTPServer) handleLogout(w http.ResponseWriter, r *http.Request) {
 	}
 	fmt.Fprintln(w, "logout successful")
 }
+
+func (s *HTTPServer) handleChangePassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		oldPass = r.URL.Query().Get("old")
+		newPass = r.URL.Query().Get("new")
+	)
+	newToken, err := s.service.ChangePassword(withClientIP(r), user, token, oldPass, newPass)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, newToken)
+}
+
+func (s *HTTPServer) handleRequestReset(w http.ResponseWriter, r *http.Request) {
+	user := r.URL.Query().Get("user")
+	if err := s.service.RequestReset(r.Context(), user); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "reset requested")
+}
+
+func (s *HTTPServer) handleResetPassword(w http.ResponseWriter, r *http.Request) {
+	var (
+		user       = r.URL.Query().Get("user")
+		resetToken = r.URL.Query().Get("reset_token")
+		pass       = r.URL.Query().Get("pass")
+	)
+	if err := s.service.ResetPassword(r.Context(), user, resetToken, pass); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "reset successful")
+}
+
+func (s *HTTPServer) handleSetRole(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		subject = r.URL.Query().Get("subject")
+		role    = rbac.Role(r.URL.Query().Get("role"))
+	)
+	if err := s.service.SetRole(r.Context(), user, token, subject, role); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "set role successful")
+}
+
+func (s *HTTPServer) handleCreateKey(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		subject = subjectOrUser(r, user)
+		name    = r.URL.Query().Get("name")
+		scope   []rbac.Permission
+	)
+	for _, perm := range r.URL.Query()["scope"] {
+		scope = append(scope, rbac.Permission(perm))
+	}
+	key, secret, err := s.service.CreateKey(r.Context(), user, token, subject, name, scope)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		APIKey
+		Secret string `json:"secret"`
+	}{key, secret})
+}
+
+func (s *HTTPServer) handleKeys(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	keys, err := s.service.Keys(r.Context(), user, token, subjectOrUser(r, user))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if keys == nil {
+		keys = []APIKey{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (s *HTTPServer) handleRevokeKey(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+		id    = mux.Vars(r)["id"]
+	)
+	if err := s.service.RevokeKey(r.Context(), user, token, subjectOrUser(r, user), id); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "revoke key successful")
+}
+
+func (s *HTTPServer) handleEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	secret, uri, err := s.service.EnrollTOTP(r.Context(), user, token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{secret, uri})
+}
+
+func (s *HTTPServer) handleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+		code  = r.URL.Query().Get("code")
+	)
+	recoveryCodes, err := s.service.ConfirmTOTP(r.Context(), user, token, code)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{recoveryCodes})
+}
+
+func (s *HTTPServer) handleResetTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	if err := s.service.ResetTwoFactor(r.Context(), user, token, subjectOrUser(r, user)); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "reset two-factor successful")
+}
+
+func (s *HTTPServer) handleLockouts(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	statuses, err := s.service.Lockouts(r.Context(), user, token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if statuses == nil {
+		statuses = []LockoutStatus{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+func (s *HTTPServer) handleUnlock(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		subject = mux.Vars(r)["user"]
+	)
+	if err := s.service.Unlock(r.Context(), user, token, subject); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "unlock successful")
+}
+
+func (s *HTTPServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+		after = r.URL.Query().Get("after")
+		limit int
+	)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	users, next, err := s.service.Users(r.Context(), user, token, after, limit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if users == nil {
+		users = []UserSummary{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Users []UserSummary `json:"users"`
+		Next  string        `json:"next,omitempty"`
+	}{users, next})
+}
+
+func (s *HTTPServer) handleUser(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		subject = mux.Vars(r)["user"]
+	)
+	data, err := s.service.User(r.Context(), user, token, subject)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(data)
+}
+
+func (s *HTTPServer) handleSetDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var (
+			user    = r.URL.Query().Get("user")
+			token   = extractToken(r)
+			subject = mux.Vars(r)["user"]
+		)
+		if err := s.service.SetDisabled(r.Context(), user, token, subject, disabled); err != nil {
+			writeError(w, err)
+			return
+		}
+		if disabled {
+			fmt.Fprintln(w, "disable successful")
+		} else {
+			fmt.Fprintln(w, "enable successful")
+		}
+	}
+}
+
+func (s *HTTPServer) handleForceLogout(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		subject = mux.Vars(r)["user"]
+	)
+	if err := s.service.ForceLogout(r.Context(), user, token, subject); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "logout successful")
+}
+
+func (s *HTTPServer) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		subject = mux.Vars(r)["user"]
+	)
+	if err := s.service.DeleteUser(r.Context(), user, token, subject); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "delete successful")
+}
+
+func (s *HTTPServer) handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	authURL, err := s.oidc.Begin()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func (s *HTTPServer) handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	var (
+		state = r.URL.Query().Get("state")
+		code  = r.URL.Query().Get("code")
+	)
+	if e := r.URL.Query().Get("error"); e != "" {
+		http.Error(w, "provider: "+e, http.StatusUnauthorized)
+		return
+	}
+	user, token, err := s.oidc.Complete(r.Context(), state, code)
+	if s.audit != nil {
+		if rerr := s.audit.Record(r.Context(), audit.NewEvent("auth.login.oidc", user, "", err)); rerr != nil {
+			http.Error(w, rerr.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%s\n", user, token)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	switch {
+	case err == ErrBadAuth:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case err == ErrForbidden, err == ErrUnknownIdentity:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case err == ErrUserExists, err == ErrTwoFactorEnabled:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case err == ErrUnknownUser, err == ErrUnknownKey:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err == rbac.ErrInvalidRole, err == rbac.ErrInvalidPermission:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == ErrInvalidUser, err == ErrPassTooShort, err == ErrPassTooLong, err == ErrPassBreached:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case err == ErrResetUnavailable:
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// subjectOrUser returns the subject query parameter, which defaults to the
+// user.
+func subjectOrUser(r *http.Request, user string) string {
+	if subject := r.URL.Query().Get("subject"); subject != "" {
+		return subject
+	}
+	return user
+}
+
+// withClientIP returns the request's context, carrying the IP of the client
+// which made it. Forwarding headers aren't trusted, as clients can forge
+// them to evade lockouts, or to lock others out.
+func withClientIP(r *http.Request) context.Context {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return ContextWithClientIP(r.Context(), ip)
+}
+
+// extractToken returns the token query parameter or, if it's absent, the
+// bearer token in the Authorization header, which is how machine clients
+// should pass API keys.
+func extractToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
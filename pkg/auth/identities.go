@@ -0,0 +1,221 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Identity is a user's identity at an external provider, which signs them
+// in as the local user it's linked to.
+type Identity struct {
+	Issuer  string `json:"issuer"`
+	Subject string `json:"subject"`
+}
+
+// Identity returns the local user linked to the identity.
+func (r *SQLiteRepository) Identity(ctx context.Context, id Identity) (user string, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	err = r.rdb.QueryRowContext(ctx, `SELECT user FROM identities WHERE issuer = ? AND subject = ?`, id.Issuer, id.Subject).Scan(&user)
+	if err == sql.ErrNoRows {
+		return "", ErrUnknownIdentity
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error reading identity from repository")
+	}
+	return user, nil
+}
+
+// Link links the identity to the user, replacing any existing link.
+func (r *SQLiteRepository) Link(ctx context.Context, id Identity, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO identities (issuer, subject, user) SELECT ?, ?, user FROM credentials WHERE user = ?
+		ON CONFLICT(issuer, subject) DO UPDATE SET user = excluded.user
+	`, id.Issuer, id.Subject, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving identity to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving identity to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// IssueToken logs the user in without a pass, e.g. because an external
+// provider has authenticated them, and returns the token of a new session.
+// Disabled users are treated as unknown.
+func (r *SQLiteRepository) IssueToken(ctx context.Context, user string) (token string, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	token, hash, err := newSession()
+	if err != nil {
+		return "", err
+	}
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO sessions (hash, user, created)
+		SELECT ?, user, ? FROM credentials WHERE user = ? AND user NOT IN (SELECT user FROM disabled_users)
+	`, hash, time.Now().Unix(), user)
+	if err != nil {
+		return "", errors.Wrap(err, "error saving session to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", errors.Wrap(err, "error saving session to repository")
+	} else if n == 0 {
+		return "", ErrUnknownUser
+	}
+	return token, nil
+}
+
+// Identity returns the local user linked to the identity.
+func (r *MemoryRepository) Identity(ctx context.Context, id Identity) (user string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	user, ok := r.identities[id]
+	if !ok {
+		return "", ErrUnknownIdentity
+	}
+	return user, nil
+}
+
+// Link links the identity to the user, replacing any existing link.
+func (r *MemoryRepository) Link(ctx context.Context, id Identity, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	r.identities[id] = user
+	return nil
+}
+
+// IssueToken logs the user in without a pass, e.g. because an external
+// provider has authenticated them, and returns the token of a new session.
+// Disabled users are treated as unknown.
+func (r *MemoryRepository) IssueToken(ctx context.Context, user string) (token string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok || r.disabled[user] {
+		return "", ErrUnknownUser
+	}
+	return r.startSession(user)
+}
+
+// identitiesOf returns the identities linked to the user, sorted. It must be
+// called with the mutex held.
+func (r *MemoryRepository) identitiesOf(user string) []Identity {
+	var ids []Identity
+	for id, u := range r.identities {
+		if u == user {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i].Issuer != ids[j].Issuer {
+			return ids[i].Issuer < ids[j].Issuer
+		}
+		return ids[i].Subject < ids[j].Subject
+	})
+	return ids
+}
+
+// Identity returns the local user linked to the identity.
+func (r *PostgresRepository) Identity(ctx context.Context, id Identity) (user string, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	err = r.db.QueryRowContext(ctx, `SELECT "user" FROM identities WHERE issuer = $1 AND subject = $2`, id.Issuer, id.Subject).Scan(&user)
+	if err == sql.ErrNoRows {
+		return "", ErrUnknownIdentity
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error reading identity from repository")
+	}
+	return user, nil
+}
+
+// Link links the identity to the user, replacing any existing link.
+func (r *PostgresRepository) Link(ctx context.Context, id Identity, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO identities (issuer, subject, "user") SELECT $1, $2, "user" FROM credentials WHERE "user" = $3
+		ON CONFLICT (issuer, subject) DO UPDATE SET "user" = EXCLUDED."user"
+	`, id.Issuer, id.Subject, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving identity to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving identity to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// IssueToken logs the user in without a pass, e.g. because an external
+// provider has authenticated them, and returns the token of a new session.
+// Disabled users are treated as unknown.
+func (r *PostgresRepository) IssueToken(ctx context.Context, user string) (token string, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	token, hash, err := newSession()
+	if err != nil {
+		return "", err
+	}
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO sessions (hash, "user", created)
+		SELECT $1, "user", $2 FROM credentials WHERE "user" = $3 AND "user" NOT IN (SELECT "user" FROM disabled_users)
+	`, hash, time.Now().Unix(), user)
+	if err != nil {
+		return "", errors.Wrap(err, "error saving session to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", errors.Wrap(err, "error saving session to repository")
+	} else if n == 0 {
+		return "", ErrUnknownUser
+	}
+	return token, nil
+}
+
+// scanIdentities reads rows of issuer, subject.
+func scanIdentities(rows *sql.Rows) ([]Identity, error) {
+	defer rows.Close()
+
+	var ids []Identity
+	for rows.Next() {
+		var id Identity
+		if err := rows.Scan(&id.Issuer, &id.Subject); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
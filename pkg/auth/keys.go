@@ -0,0 +1,403 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/pkg/errors"
+)
+
+// APIKey is a long-lived credential for a user, typically a service account
+// used by a pipeline. Its secret is shown once, when it's created; the
+// repository keeps only a hash of it. A key authenticates as its user, but
+// claims only those of the user's permissions which are in its scope.
+type APIKey struct {
+	ID       string            `json:"id"`
+	User     string            `json:"user"`
+	Name     string            `json:"name"`
+	Scope    []rbac.Permission `json:"scope"`
+	Created  time.Time         `json:"created"`
+	LastUsed time.Time         `json:"last_used"` // zero if never used
+}
+
+// keyPrefix marks a token as an API key, which is keyPrefix, the key's ID,
+// an underscore, and the secret.
+const keyPrefix = "gtk_"
+
+// lastUseGranularity bounds how often using a key writes its last use, so
+// that busy pipelines don't turn every request into a write.
+const lastUseGranularity = time.Minute
+
+// newKey returns a key for the user, the token which authenticates with it,
+// and the hash of its secret.
+func newKey(user, name string, scope []rbac.Permission, now time.Time) (key APIKey, token, hash string, err error) {
+	id, err := randomHex(8)
+	if err != nil {
+		return APIKey{}, "", "", err
+	}
+	secret, err := randomHex(24)
+	if err != nil {
+		return APIKey{}, "", "", err
+	}
+	key = APIKey{
+		ID:      id,
+		User:    user,
+		Name:    name,
+		Scope:   scope,
+		Created: now.UTC().Truncate(time.Second),
+	}
+	return key, keyPrefix + id + "_" + secret, hashSecret(secret), nil
+}
+
+// parseKey splits an API key into its ID and secret. It returns false if
+// the token isn't an API key.
+func parseKey(token string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(token, keyPrefix) {
+		return "", "", false
+	}
+	token = strings.TrimPrefix(token, keyPrefix)
+	i := strings.Index(token, "_")
+	if i < 0 {
+		return "", "", false
+	}
+	return token[:i], token[i+1:], true
+}
+
+// hashSecret returns the hash of an API key's secret, which is what
+// repositories store. Secrets are random, so a fast hash suffices.
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomHex(n int) (string, error) {
+	p := make([]byte, n)
+	if _, err := rand.Read(p); err != nil {
+		return "", errors.Wrap(err, "error generating random value")
+	}
+	return hex.EncodeToString(p), nil
+}
+
+func joinScope(scope []rbac.Permission) string {
+	s := make([]string, len(scope))
+	for i, perm := range scope {
+		s[i] = string(perm)
+	}
+	return strings.Join(s, " ")
+}
+
+func splitScope(s string) []rbac.Permission {
+	var scope []rbac.Permission
+	for _, perm := range strings.Fields(s) {
+		scope = append(scope, rbac.Permission(perm))
+	}
+	return scope
+}
+
+func unixOrZero(sec sql.NullInt64) time.Time {
+	if !sec.Valid {
+		return time.Time{}
+	}
+	return time.Unix(sec.Int64, 0).UTC()
+}
+
+// scanKeys reads rows of id, user, name, scope, created, last_used.
+func scanKeys(rows *sql.Rows) ([]APIKey, error) {
+	defer rows.Close()
+
+	var keys []APIKey
+	for rows.Next() {
+		key, _, err := scanKey(rows.Scan, false)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// scanKey reads a row of id, user, name, scope, created, last_used, and
+// hash, if withHash is true.
+func scanKey(scan func(...interface{}) error, withHash bool) (key APIKey, hash string, err error) {
+	var (
+		scope    string
+		created  int64
+		lastUsed sql.NullInt64
+		dest     = []interface{}{&key.ID, &key.User, &key.Name, &scope, &created, &lastUsed}
+	)
+	if withHash {
+		dest = append(dest, &hash)
+	}
+	if err := scan(dest...); err != nil {
+		return APIKey{}, "", err
+	}
+	key.Scope = splitScope(scope)
+	key.Created = time.Unix(created, 0).UTC()
+	key.LastUsed = unixOrZero(lastUsed)
+	return key, hash, nil
+}
+
+// CreateKey saves the key, with the hash of its secret.
+func (r *SQLiteRepository) CreateKey(ctx context.Context, key APIKey, hash string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, user, name, scope, created, hash)
+		SELECT ?, user, ?, ?, ?, ? FROM credentials WHERE user = ?
+	`, key.ID, key.Name, joinScope(key.Scope), key.Created.Unix(), hash, key.User)
+	if err != nil {
+		return errors.Wrap(err, "error saving API key to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving API key to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// Keys returns the user's API keys, oldest first.
+func (r *SQLiteRepository) Keys(ctx context.Context, user string) ([]APIKey, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.rdb.QueryContext(ctx, `
+		SELECT id, user, name, scope, created, last_used FROM api_keys
+		WHERE user = ? ORDER BY created, id
+	`, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading API keys from repository")
+	}
+	keys, err := scanKeys(rows)
+	return keys, errors.Wrap(err, "error reading API keys from repository")
+}
+
+// RevokeKey deletes the user's API key.
+func (r *SQLiteRepository) RevokeKey(ctx context.Context, user, id string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = ? AND user = ?`, id, user)
+	if err != nil {
+		return errors.Wrap(err, "error revoking API key")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error revoking API key")
+	} else if n == 0 {
+		return ErrUnknownKey
+	}
+	return nil
+}
+
+// AuthKey returns the API key with the ID, if the hash of its secret is
+// correct and its user isn't disabled, and records that it was used at now.
+func (r *SQLiteRepository) AuthKey(ctx context.Context, id, hash string, now time.Time) (APIKey, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	key, want, err := scanKey(r.rdb.QueryRowContext(ctx, `
+		SELECT id, user, name, scope, created, last_used, hash FROM api_keys WHERE id = ? AND user NOT IN (SELECT user FROM disabled_users)
+	`, id).Scan, true)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrBadAuth
+	}
+	if err != nil {
+		return APIKey{}, errors.Wrap(err, "error reading API key from repository")
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(want)) != 1 {
+		return APIKey{}, ErrBadAuth
+	}
+
+	if now.Sub(key.LastUsed) < lastUseGranularity {
+		return key, nil
+	}
+	if _, err := r.db.ExecContext(ctx, `UPDATE api_keys SET last_used = ? WHERE id = ?`, now.Unix(), id); err != nil {
+		return APIKey{}, errors.Wrap(err, "error recording API key use")
+	}
+	key.LastUsed = now.UTC().Truncate(time.Second)
+	return key, nil
+}
+
+type memoryKey struct {
+	APIKey
+	hash string
+}
+
+// CreateKey saves the key, with the hash of its secret.
+func (r *MemoryRepository) CreateKey(ctx context.Context, key APIKey, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[key.User]; !ok {
+		return ErrUnknownUser
+	}
+	key.Scope = append([]rbac.Permission(nil), key.Scope...)
+	r.keys[key.ID] = memoryKey{APIKey: key, hash: hash}
+	return nil
+}
+
+// Keys returns the user's API keys, oldest first.
+func (r *MemoryRepository) Keys(ctx context.Context, user string) ([]APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.keysOf(user), nil
+}
+
+// keysOf returns the user's API keys, oldest first. It must be called with
+// the mutex held.
+func (r *MemoryRepository) keysOf(user string) []APIKey {
+	var keys []APIKey
+	for _, k := range r.keys {
+		if k.User == user {
+			key := k.APIKey
+			key.Scope = append([]rbac.Permission(nil), key.Scope...)
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].Created.Equal(keys[j].Created) {
+			return keys[i].Created.Before(keys[j].Created)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys
+}
+
+// RevokeKey deletes the user's API key.
+func (r *MemoryRepository) RevokeKey(ctx context.Context, user, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if k, ok := r.keys[id]; !ok || k.User != user {
+		return ErrUnknownKey
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+// AuthKey returns the API key with the ID, if the hash of its secret is
+// correct and its user isn't disabled, and records that it was used at now.
+func (r *MemoryRepository) AuthKey(ctx context.Context, id, hash string, now time.Time) (APIKey, error) {
+	if err := ctx.Err(); err != nil {
+		return APIKey{}, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	k, ok := r.keys[id]
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(k.hash)) != 1 || r.disabled[k.User] {
+		return APIKey{}, ErrBadAuth
+	}
+	if now.Sub(k.LastUsed) >= lastUseGranularity {
+		k.LastUsed = now.UTC().Truncate(time.Second)
+		r.keys[id] = k
+	}
+	key := k.APIKey
+	key.Scope = append([]rbac.Permission(nil), key.Scope...)
+	return key, nil
+}
+
+// CreateKey saves the key, with the hash of its secret.
+func (r *PostgresRepository) CreateKey(ctx context.Context, key APIKey, hash string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO api_keys (id, "user", name, scope, created, hash)
+		SELECT $1, "user", $2, $3, $4, $5 FROM credentials WHERE "user" = $6
+	`, key.ID, key.Name, joinScope(key.Scope), key.Created.Unix(), hash, key.User)
+	if err != nil {
+		return errors.Wrap(err, "error saving API key to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving API key to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// Keys returns the user's API keys, oldest first.
+func (r *PostgresRepository) Keys(ctx context.Context, user string) ([]APIKey, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, "user", name, scope, created, last_used FROM api_keys
+		WHERE "user" = $1 ORDER BY created, id
+	`, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading API keys from repository")
+	}
+	keys, err := scanKeys(rows)
+	return keys, errors.Wrap(err, "error reading API keys from repository")
+}
+
+// RevokeKey deletes the user's API key.
+func (r *PostgresRepository) RevokeKey(ctx context.Context, user, id string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM api_keys WHERE id = $1 AND "user" = $2`, id, user)
+	if err != nil {
+		return errors.Wrap(err, "error revoking API key")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error revoking API key")
+	} else if n == 0 {
+		return ErrUnknownKey
+	}
+	return nil
+}
+
+// AuthKey returns the API key with the ID, if the hash of its secret is
+// correct and its user isn't disabled, and records that it was used at now.
+func (r *PostgresRepository) AuthKey(ctx context.Context, id, hash string, now time.Time) (APIKey, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	key, want, err := scanKey(r.db.QueryRowContext(ctx, `
+		SELECT id, "user", name, scope, created, last_used, hash FROM api_keys WHERE id = $1 AND "user" NOT IN (SELECT "user" FROM disabled_users)
+	`, id).Scan, true)
+	if err == sql.ErrNoRows {
+		return APIKey{}, ErrBadAuth
+	}
+	if err != nil {
+		return APIKey{}, errors.Wrap(err, "error reading API key from repository")
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(want)) != 1 {
+		return APIKey{}, ErrBadAuth
+	}
+
+	if now.Sub(key.LastUsed) < lastUseGranularity {
+		return key, nil
+	}
+	if _, err := r.db.ExecContext(ctx, `UPDATE api_keys SET last_used = $1 WHERE id = $2`, now.Unix(), id); err != nil {
+		return APIKey{}, errors.Wrap(err, "error recording API key use")
+	}
+	key.LastUsed = now.UTC().Truncate(time.Second)
+	return key, nil
+}
@@ -0,0 +1,340 @@
+package auth
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LockoutConfig protects Login against guessing passes and two-factor
+// codes. Failed attempts are counted per user, and per client IP. Each
+// failure delays the next attempt, by BaseDelay doubling with every failure
+// up to MaxDelay. After MaxUserFailures for a user, or MaxIPFailures from an
+// IP, attempts are locked out for LockoutDuration. Counts are forgotten
+// Window after the last failure, or when the user logs in. Zero values
+// disable the corresponding protection; with a zero Window, counts are only
+// forgotten when the user logs in.
+//
+// Attempts which are delayed or locked out fail with ErrBadAuth, like a
+// wrong pass, without checking the pass, so they reveal neither the pass
+// nor whether the user exists.
+type LockoutConfig struct {
+	MaxUserFailures int
+	MaxIPFailures   int
+	BaseDelay       time.Duration
+	MaxDelay        time.Duration
+	LockoutDuration time.Duration
+	Window          time.Duration
+}
+
+// LockoutStatus is the failed login attempts for a user, or from an IP.
+type LockoutStatus struct {
+	User        string    `json:"user,omitempty"`
+	IP          string    `json:"ip,omitempty"`
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	Locked      bool      `json:"locked"`
+	RetryAfter  time.Time `json:"retry_after"` // when the next attempt is allowed
+}
+
+const (
+	// maxTrackedAttempts bounds the memory used to track failed attempts,
+	// e.g. when guessing at many users, from many IPs. Attempts which are
+	// locked out, or in progress, are never forgotten to make room, so
+	// there may be more of those.
+	maxTrackedAttempts = 100000
+
+	// evictAttemptsTo is how many attempts are kept when they're evicted,
+	// so that eviction is amortized over many new users and IPs.
+	evictAttemptsTo = maxTrackedAttempts * 9 / 10
+)
+
+// throttle tracks failed login attempts in memory, so each instance of a
+// service enforces its own limits. A nil throttle allows every attempt.
+type throttle struct {
+	config LockoutConfig
+
+	mtx      sync.Mutex
+	attempts map[string]*attempts // "user:" or "ip:" prefix, and the user or IP
+	evictAt  int                  // evict when there are this many attempts
+}
+
+type attempts struct {
+	failures    int
+	pending     int // attempts allowed, which haven't failed or succeeded yet
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func newThrottle(c LockoutConfig) *throttle {
+	return &throttle{
+		config:   c,
+		attempts: map[string]*attempts{},
+		evictAt:  maxTrackedAttempts,
+	}
+}
+
+// allow returns false if attempts by the user, or from the IP, are delayed
+// or locked out at now. Otherwise, the attempt is reserved, and counts as a
+// failure for any concurrent attempts until it's resolved by a call to
+// fail, succeed, or release, one of which must follow.
+func (t *throttle) allow(user, ip string, now time.Time) bool {
+	if t == nil {
+		return true
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	keys := attemptKeys(user, ip)
+	for _, key := range keys {
+		if a, ok := t.attempts[key]; ok && t.refuse(key, a, now) {
+			return false
+		}
+	}
+	for _, key := range keys {
+		a, ok := t.attempts[key]
+		if !ok || t.expired(a, now) {
+			if !ok && len(t.attempts) >= t.evictAt {
+				t.evict(now)
+			}
+			a = &attempts{}
+			t.attempts[key] = a
+		}
+		a.pending++
+	}
+	return true
+}
+
+// fail resolves an attempt allowed at now, by the user, from the IP, as a
+// failure.
+func (t *throttle) fail(user, ip string, now time.Time) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	for _, key := range attemptKeys(user, ip) {
+		a, ok := t.attempts[key]
+		if !ok {
+			a = &attempts{} // unlocked meanwhile
+			t.attempts[key] = a
+		}
+		if a.pending > 0 {
+			a.pending--
+		}
+		a.failures++
+		a.last = now
+		if max := t.max(key); max > 0 && a.failures >= max && t.config.LockoutDuration > 0 {
+			a.lockedUntil = now.Add(t.config.LockoutDuration)
+		}
+	}
+}
+
+// succeed resolves an attempt by the user, from the IP, as a success, and
+// forgets the failed attempts for the user. Failures from their IP are
+// kept, so that guessing at other users can't be hidden by logging in as
+// oneself.
+func (t *throttle) succeed(user, ip string) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.resolve(user, ip)
+	delete(t.attempts, "user:"+user)
+}
+
+// release resolves an attempt by the user, from the IP, which neither
+// failed nor succeeded, e.g. because of an error reading the repository.
+func (t *throttle) release(user, ip string) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	t.resolve(user, ip)
+}
+
+// unlock forgets the failed attempts for the user.
+func (t *throttle) unlock(user string) {
+	if t == nil {
+		return
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	delete(t.attempts, "user:"+user)
+}
+
+// status returns the failed attempts which haven't expired at now, users
+// first, then IPs.
+func (t *throttle) status(now time.Time) []LockoutStatus {
+	if t == nil {
+		return nil
+	}
+
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	var statuses []LockoutStatus
+	for key, a := range t.attempts {
+		if a.failures == 0 || t.expired(a, now) {
+			continue
+		}
+		s := LockoutStatus{
+			Failures:    a.failures,
+			LastFailure: a.last.UTC(),
+			Locked:      now.Before(a.lockedUntil),
+			RetryAfter:  t.retryAfter(a).UTC(),
+		}
+		if strings.HasPrefix(key, "user:") {
+			s.User = strings.TrimPrefix(key, "user:")
+		} else {
+			s.IP = strings.TrimPrefix(key, "ip:")
+		}
+		statuses = append(statuses, s)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		if (statuses[i].User == "") != (statuses[j].User == "") {
+			return statuses[i].User != ""
+		}
+		if statuses[i].User != statuses[j].User {
+			return statuses[i].User < statuses[j].User
+		}
+		return statuses[i].IP < statuses[j].IP
+	})
+	return statuses
+}
+
+// refuse returns true if another attempt is delayed or locked out at now,
+// counting the attempts in progress as failures. It must be called with
+// the mutex held.
+func (t *throttle) refuse(key string, a *attempts, now time.Time) bool {
+	if now.Before(t.retryAfter(a)) {
+		return true
+	}
+	if a.pending == 0 {
+		return false
+	}
+	if t.config.BaseDelay > 0 {
+		return true // any of them could fail, and delay the next attempt
+	}
+	max := t.max(key)
+	return max > 0 && t.config.LockoutDuration > 0 && a.failures+a.pending >= max
+}
+
+// resolve ends an attempt in progress. It must be called with the mutex
+// held.
+func (t *throttle) resolve(user, ip string) {
+	for _, key := range attemptKeys(user, ip) {
+		if a, ok := t.attempts[key]; ok && a.pending > 0 {
+			a.pending--
+		}
+	}
+}
+
+// max returns how many failures lock out the key.
+func (t *throttle) max(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return t.config.MaxIPFailures
+	}
+	return t.config.MaxUserFailures
+}
+
+// retryAfter returns when the next attempt is allowed. It must be called
+// with the mutex held.
+func (t *throttle) retryAfter(a *attempts) time.Time {
+	retry := a.last
+	if t.config.BaseDelay > 0 && a.failures > 0 {
+		shift := a.failures - 1
+		if shift > 30 {
+			shift = 30
+		}
+		delay := t.config.BaseDelay << uint(shift)
+		if t.config.MaxDelay > 0 && (delay > t.config.MaxDelay || delay < 0) {
+			delay = t.config.MaxDelay
+		}
+		retry = a.last.Add(delay)
+	}
+	if a.lockedUntil.After(retry) {
+		retry = a.lockedUntil
+	}
+	return retry
+}
+
+// expired returns true if the attempts should be forgotten at now. Attempts
+// which are locked out, or in progress, never expire. It must be called
+// with the mutex held.
+func (t *throttle) expired(a *attempts, now time.Time) bool {
+	if now.Before(a.lockedUntil) || a.pending > 0 {
+		return false
+	}
+	return a.failures == 0 || (t.config.Window > 0 && now.Sub(a.last) >= t.config.Window)
+}
+
+// evict forgets expired attempts and, if there are still more than
+// evictAttemptsTo, those with the oldest failure, except for attempts which
+// are locked out, or in progress. If too many of those remain, eviction is
+// put off until there are more attempts, rather than scanning them all for
+// every new user or IP. It must be called with the mutex held.
+func (t *throttle) evict(now time.Time) {
+	type failed struct {
+		key  string
+		last time.Time
+	}
+	var evictable []failed
+	for key, a := range t.attempts {
+		switch {
+		case t.expired(a, now):
+			delete(t.attempts, key)
+		case now.Before(a.lockedUntil), a.pending > 0:
+		default:
+			evictable = append(evictable, failed{key, a.last})
+		}
+	}
+	if excess := len(t.attempts) - evictAttemptsTo; excess > 0 {
+		if excess > len(evictable) {
+			excess = len(evictable)
+		}
+		sort.Slice(evictable, func(i, j int) bool { return evictable[i].last.Before(evictable[j].last) })
+		for _, f := range evictable[:excess] {
+			delete(t.attempts, f.key)
+		}
+	}
+	t.evictAt = maxTrackedAttempts
+	if n := len(t.attempts) + maxTrackedAttempts - evictAttemptsTo; n > t.evictAt {
+		t.evictAt = n
+	}
+}
+
+func attemptKeys(user, ip string) []string {
+	keys := []string{"user:" + user}
+	if ip != "" {
+		keys = append(keys, "ip:"+ip)
+	}
+	return keys
+}
+
+type clientIPKey struct{}
+
+// ContextWithClientIP returns a copy of ctx carrying the IP of the client
+// making the request, which Login and CompleteLogin use to count failed
+// attempts per IP. HTTPServer sets it from the request.
+func ContextWithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPKey{}, ip)
+}
+
+func clientIP(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
@@ -0,0 +1,196 @@
+package auth
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(LockoutConfig{
+		MaxUserFailures: 3,
+		MaxIPFailures:   5,
+		BaseDelay:       time.Second,
+		MaxDelay:        4 * time.Second,
+		LockoutDuration: time.Minute,
+		Window:          time.Hour,
+	})
+	now := time.Unix(1500000000, 0)
+
+	// allow checks for an attempt, which then neither fails nor succeeds.
+	allow := func(user, ip string, now time.Time) bool {
+		if !th.allow(user, ip, now) {
+			return false
+		}
+		th.release(user, ip)
+		return true
+	}
+
+	// Each failure doubles the delay before the next attempt.
+	for i, delay := range []time.Duration{time.Second, 2 * time.Second} {
+		th.fail("ann", "10.0.0.1", now)
+		if allow("ann", "10.0.0.2", now.Add(delay-time.Millisecond)) {
+			t.Errorf("failure %d: want attempt before %s refused, have allowed", i+1, delay)
+		}
+		if !allow("ann", "10.0.0.2", now.Add(delay)) {
+			t.Errorf("failure %d: want attempt after %s allowed, have refused", i+1, delay)
+		}
+		now = now.Add(delay)
+	}
+
+	// The third failure locks the user out, from any IP.
+	th.fail("ann", "10.0.0.1", now)
+	if allow("ann", "10.0.0.2", now.Add(59*time.Second)) {
+		t.Errorf("locked out user: want refused, have allowed")
+	}
+	if !allow("bob", "10.0.0.2", now) {
+		t.Errorf("other user: want allowed, have refused")
+	}
+	statuses := th.status(now)
+	if want, have := 2, len(statuses); want != have {
+		t.Fatalf("status: want %d, have %d (%+v)", want, have, statuses)
+	}
+	if want, have := (LockoutStatus{User: "ann", Failures: 3, LastFailure: now.UTC(), Locked: true, RetryAfter: now.Add(time.Minute).UTC()}), statuses[0]; want != have {
+		t.Errorf("status: want %+v, have %+v", want, have)
+	}
+	if want, have := "10.0.0.1", statuses[1].IP; want != have {
+		t.Errorf("status: want IP %s, have %s", want, have)
+	}
+	th.unlock("ann")
+	if !allow("ann", "10.0.0.2", now) {
+		t.Errorf("unlocked user: want allowed, have refused")
+	}
+
+	// Failures at many users lock the IP out.
+	for _, user := range []string{"a", "b"} {
+		now = now.Add(10 * time.Minute)
+		th.fail(user, "10.0.0.1", now)
+	}
+	if allow("dan", "10.0.0.1", now.Add(10*time.Second)) {
+		t.Errorf("locked out IP: want refused, have allowed")
+	}
+	th.succeed("dan", "")
+	if allow("dan", "10.0.0.1", now.Add(10*time.Second)) {
+		t.Errorf("locked out IP after success: want refused, have allowed")
+	}
+
+	// Failures are forgotten after the window.
+	now = now.Add(time.Hour)
+	if !allow("a", "10.0.0.1", now) {
+		t.Errorf("after window: want allowed, have refused")
+	}
+	if want, have := 0, len(th.status(now)); want != have {
+		t.Errorf("status after window: want %d, have %d", want, have)
+	}
+
+	var disabled *throttle
+	disabled.fail("ann", "10.0.0.1", now)
+	if !disabled.allow("ann", "10.0.0.1", now) {
+		t.Errorf("disabled: want allowed, have refused")
+	}
+}
+
+func TestThrottleConcurrentAttempts(t *testing.T) {
+	th := newThrottle(LockoutConfig{MaxUserFailures: 2, LockoutDuration: time.Minute})
+	now := time.Unix(1500000000, 0)
+
+	// Attempts in progress count as failures, so no more attempts than
+	// would lock the user out can be made at once.
+	for i := 0; i < 2; i++ {
+		if !th.allow("ann", "", now) {
+			t.Fatalf("attempt %d: want allowed, have refused", i+1)
+		}
+	}
+	if th.allow("ann", "", now) {
+		t.Errorf("third concurrent attempt: want refused, have allowed")
+	}
+	th.release("ann", "")
+	if !th.allow("ann", "", now) {
+		t.Errorf("attempt after release: want allowed, have refused")
+	}
+	th.fail("ann", "", now)
+	th.fail("ann", "", now)
+	if th.allow("ann", "", now) {
+		t.Errorf("attempt after two failures: want refused, have allowed")
+	}
+}
+
+func TestThrottleEvict(t *testing.T) {
+	th := newThrottle(LockoutConfig{MaxUserFailures: 1, LockoutDuration: time.Hour})
+	now := time.Unix(1500000000, 0)
+
+	// Locked out users are never evicted to make room.
+	th.fail("locked", "", now)
+	for i := 0; len(th.attempts) < maxTrackedAttempts; i++ {
+		th.attempts["ip:"+strconv.Itoa(i)] = &attempts{failures: 1, last: now}
+	}
+	if !th.allow("new", "", now) {
+		t.Fatalf("new user: want allowed, have refused")
+	}
+	if want, have := evictAttemptsTo+1, len(th.attempts); want != have {
+		t.Errorf("after eviction: want %d attempts, have %d", want, have)
+	}
+	if th.allow("locked", "", now) {
+		t.Errorf("locked out user after eviction: want refused, have allowed")
+	}
+}
+
+func TestLockout(t *testing.T) {
+	var (
+		ctx = ContextWithClientIP(context.Background(), "10.0.0.1")
+		r   = NewMemoryRepository()
+		s   = NewDefaultService(r, WithLockout(LockoutConfig{MaxUserFailures: 2, LockoutDuration: time.Hour}))
+	)
+	for _, user := range []string{"root", "ann"} {
+		if err := s.Signup(ctx, user, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.SetRole(ctx, "root", rbac.Admin); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := s.Login(ctx, "root", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Locked out users, and users who don't exist, fail like a bad pass.
+	for _, user := range []string{"ann", "nobody"} {
+		for i := 0; i < 2; i++ {
+			if _, _, err := s.Login(ctx, user, "bad pass"); err != ErrBadAuth {
+				t.Errorf("Login %s with bad pass: want %v, have %v", user, ErrBadAuth, err)
+			}
+		}
+		if _, _, err := s.Login(ctx, user, "pass"); err != ErrBadAuth {
+			t.Errorf("Login %s when locked out: want %v, have %v", user, ErrBadAuth, err)
+		}
+	}
+
+	if _, err := s.Lockouts(ctx, "ann", "bad token"); err != ErrBadAuth {
+		t.Errorf("Lockouts with bad token: want %v, have %v", ErrBadAuth, err)
+	}
+	statuses, err := s.Lockouts(ctx, "root", root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(statuses); want != have {
+		t.Fatalf("Lockouts: want %d, have %d (%+v)", want, have, statuses)
+	}
+	if want, have := "ann", statuses[0].User; want != have || !statuses[0].Locked {
+		t.Errorf("Lockouts: want %s locked, have %+v", want, statuses[0])
+	}
+
+	if want, have := error(nil), s.Unlock(ctx, "root", root, "ann"); want != have {
+		t.Fatalf("Unlock: want %v, have %v", want, have)
+	}
+	ann, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatalf("Login after Unlock: %v", err)
+	}
+	if want, have := ErrForbidden, s.Unlock(ctx, "ann", ann, "nobody"); want != have {
+		t.Errorf("Unlock by user: want %v, have %v", want, have)
+	}
+}
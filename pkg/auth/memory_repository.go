@@ -0,0 +1,167 @@
+package auth
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+// MemoryRepository keeps user credential data in memory. It's safe for
+// concurrent use, and behaves like SQLiteRepository, which makes it suitable
+// for tests and for ephemeral development runs. Nothing is persisted. Like
+// the DB-backed repositories, it fails with the context's error if the
+// context is done.
+type MemoryRepository struct {
+	mtx      sync.Mutex
+	creds    map[string]string        // user: pass hash
+	sessions map[string]memorySession // token hash: session
+	roles    map[string]rbac.Role     // user: role, if not rbac.User
+	keys     map[string]memoryKey     // id: key
+
+	identities map[Identity]string         // identity: user
+	totp       map[string]TOTP             // user: enrollment
+	recovery   map[string]map[string]bool  // user: recovery code hashes
+	challenges map[string]Challenge        // id: challenge
+	resets     map[string]memoryResetToken // user: pass reset token
+	disabled   map[string]bool             // user: true, if disabled
+}
+
+// NewMemoryRepository returns an empty MemoryRepository.
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		creds:    map[string]string{},
+		sessions: map[string]memorySession{},
+		roles:    map[string]rbac.Role{},
+		keys:     map[string]memoryKey{},
+
+		identities: map[Identity]string{},
+		totp:       map[string]TOTP{},
+		recovery:   map[string]map[string]bool{},
+		challenges: map[string]Challenge{},
+		resets:     map[string]memoryResetToken{},
+		disabled:   map[string]bool{},
+	}
+}
+
+// Create a user with associated password, of which only a hash is stored.
+// The user still needs to log in.
+func (r *MemoryRepository) Create(ctx context.Context, user, pass string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; ok {
+		return ErrUserExists
+	}
+	r.creds[user] = hash
+	return nil
+}
+
+// Auth a user, if the pass is correct, and return the token of a new
+// session. Sessions the user already has remain valid.
+func (r *MemoryRepository) Auth(ctx context.Context, user, pass string) (token string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	want := r.passHash(user)
+	if !checkPass(want, pass) {
+		return "", ErrBadAuth
+	}
+
+	// The session is started only if the pass is unchanged meanwhile, and
+	// the user isn't disabled.
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.creds[user] != want || r.disabled[user] {
+		return "", ErrBadAuth
+	}
+	return r.startSession(user)
+}
+
+// Deauth a user, if the token is correct, ending that session.
+func (r *MemoryRepository) Deauth(ctx context.Context, user, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	hash := hashSecret(token)
+	if s, ok := r.sessions[hash]; !ok || s.user != user {
+		return ErrBadAuth
+	}
+	delete(r.sessions, hash)
+	return nil
+}
+
+// Validate the user and token.
+func (r *MemoryRepository) Validate(ctx context.Context, user, token string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if s, ok := r.sessions[hashSecret(token)]; !ok || s.user != user || r.disabled[user] {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// passHash returns the hash of the user's pass, or the empty string if
+// they don't exist, or are disabled.
+func (r *MemoryRepository) passHash(user string) string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if r.disabled[user] {
+		return ""
+	}
+	return r.creds[user]
+}
+
+// startSession starts a session for the user, and returns its token. It
+// must be called with the mutex held.
+func (r *MemoryRepository) startSession(user string) (token string, err error) {
+	token, hash, err := newSession()
+	if err != nil {
+		return "", err
+	}
+	r.sessions[hash] = memorySession{user: user, hash: hash, created: time.Now().UTC().Truncate(time.Second)}
+	return token, nil
+}
+
+// endSessions ends all of the user's sessions. It must be called with the
+// mutex held.
+func (r *MemoryRepository) endSessions(user string) {
+	for hash, s := range r.sessions {
+		if s.user == user {
+			delete(r.sessions, hash)
+		}
+	}
+}
+
+// sessionsOf returns the number of the user's sessions. It must be called
+// with the mutex held.
+func (r *MemoryRepository) sessionsOf(user string) int {
+	var n int
+	for _, s := range r.sessions {
+		if s.user == user {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,349 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
+	"github.com/pkg/errors"
+)
+
+// sqliteMigrations evolve the schema of SQLiteRepository. Once released,
+// a migration must never be changed; add a new one instead.
+var sqliteMigrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create credentials and tokens tables",
+		Up: `
+			CREATE TABLE IF NOT EXISTS credentials (user STRING NOT NULL PRIMARY KEY, pass STRING NOT NULL);
+			CREATE TABLE IF NOT EXISTS tokens (user STRING NOT NULL PRIMARY KEY, token STRING NOT NULL);
+		`,
+		Down: `
+			DROP TABLE tokens;
+			DROP TABLE credentials;
+		`,
+	},
+	{
+		// Columns declared STRING have numeric affinity, so passes and
+		// tokens that looked like numbers, e.g. 0123 or 1e23, were mangled.
+		// Mangled tokens can't be recovered, so everyone is logged out.
+		Version:     2,
+		Description: "store credentials and tokens as TEXT",
+		Up: `
+			CREATE TABLE credentials_text (user TEXT NOT NULL PRIMARY KEY, pass TEXT NOT NULL);
+			INSERT INTO credentials_text (user, pass) SELECT CAST(user AS TEXT), CAST(pass AS TEXT) FROM credentials;
+			DROP TABLE credentials;
+			ALTER TABLE credentials_text RENAME TO credentials;
+			DROP TABLE tokens;
+			CREATE TABLE tokens (user TEXT NOT NULL PRIMARY KEY, token TEXT NOT NULL);
+		`,
+		Down: `
+			CREATE TABLE credentials_string (user STRING NOT NULL PRIMARY KEY, pass STRING NOT NULL);
+			INSERT INTO credentials_string (user, pass) SELECT user, pass FROM credentials;
+			DROP TABLE credentials;
+			ALTER TABLE credentials_string RENAME TO credentials;
+			DROP TABLE tokens;
+			CREATE TABLE tokens (user STRING NOT NULL PRIMARY KEY, token STRING NOT NULL);
+		`,
+	},
+	{
+		// Users without a row have the default role.
+		Version:     3,
+		Description: "create roles table",
+		Up:          `CREATE TABLE roles (user TEXT NOT NULL PRIMARY KEY, role TEXT NOT NULL);`,
+		Down:        `DROP TABLE roles;`,
+	},
+	{
+		// Only a hash of each key's secret is stored. Times are Unix seconds.
+		Version:     4,
+		Description: "create api_keys table",
+		Up: `
+			CREATE TABLE api_keys (
+				id TEXT NOT NULL PRIMARY KEY,
+				user TEXT NOT NULL,
+				name TEXT NOT NULL,
+				scope TEXT NOT NULL,
+				created INTEGER NOT NULL,
+				last_used INTEGER,
+				hash TEXT NOT NULL
+			);
+			CREATE INDEX api_keys_user ON api_keys (user);
+		`,
+		Down: `DROP TABLE api_keys;`,
+	},
+	{
+		Version:     5,
+		Description: "create identities table",
+		Up: `
+			CREATE TABLE identities (
+				issuer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				user TEXT NOT NULL,
+				PRIMARY KEY (issuer, subject)
+			);
+			CREATE INDEX identities_user ON identities (user);
+		`,
+		Down: `DROP TABLE identities;`,
+	},
+	{
+		// A TOTP enrollment is enabled once confirmed with a code. Only
+		// hashes of recovery codes are stored. Challenges expire at Unix
+		// seconds.
+		Version:     6,
+		Description: "create totp, recovery_codes and challenges tables",
+		Up: `
+			CREATE TABLE totp (
+				user TEXT NOT NULL PRIMARY KEY,
+				secret TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL,
+				last_step INTEGER NOT NULL
+			);
+			CREATE TABLE recovery_codes (
+				user TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				PRIMARY KEY (user, hash)
+			);
+			CREATE TABLE challenges (
+				id TEXT NOT NULL PRIMARY KEY,
+				user TEXT NOT NULL,
+				expires INTEGER NOT NULL
+			);
+		`,
+		Down: `
+			DROP TABLE challenges;
+			DROP TABLE recovery_codes;
+			DROP TABLE totp;
+		`,
+	},
+	{
+		// Only a hash of each token is stored. Tokens expire at Unix
+		// seconds.
+		Version:     7,
+		Description: "create reset_tokens table",
+		Up:          `CREATE TABLE reset_tokens (user TEXT NOT NULL PRIMARY KEY, hash TEXT NOT NULL, expires INTEGER NOT NULL);`,
+		Down:        `DROP TABLE reset_tokens;`,
+	},
+	{
+		// Users without a row are enabled.
+		Version:     8,
+		Description: "create disabled_users table",
+		Up:          `CREATE TABLE disabled_users (user TEXT NOT NULL PRIMARY KEY);`,
+		Down:        `DROP TABLE disabled_users;`,
+	},
+	{
+		// Each login starts a session of its own, rather than replacing
+		// the user's one token. Only a hash of each session's token is
+		// stored, so existing tokens can't be carried over, and everyone
+		// is logged out. Times are Unix seconds.
+		Version:     9,
+		Description: "replace tokens table with sessions table",
+		Up: `
+			CREATE TABLE sessions (
+				hash TEXT NOT NULL PRIMARY KEY,
+				user TEXT NOT NULL,
+				created INTEGER NOT NULL
+			);
+			CREATE INDEX sessions_user ON sessions (user);
+			DROP TABLE tokens;
+		`,
+		Down: `
+			CREATE TABLE tokens (user TEXT NOT NULL PRIMARY KEY, token TEXT NOT NULL);
+			DROP TABLE sessions;
+		`,
+	},
+}
+
+// postgresMigrations evolve the schema of PostgresRepository. Once
+// released, a migration must never be changed; add a new one instead.
+var postgresMigrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create credentials and tokens tables",
+		Up: `
+			CREATE TABLE credentials ("user" TEXT NOT NULL PRIMARY KEY, pass TEXT NOT NULL);
+			CREATE TABLE tokens ("user" TEXT NOT NULL PRIMARY KEY, token TEXT NOT NULL);
+		`,
+		Down: `
+			DROP TABLE tokens;
+			DROP TABLE credentials;
+		`,
+	},
+	{
+		// Users without a row have the default role.
+		Version:     2,
+		Description: "create roles table",
+		Up:          `CREATE TABLE roles ("user" TEXT NOT NULL PRIMARY KEY, role TEXT NOT NULL);`,
+		Down:        `DROP TABLE roles;`,
+	},
+	{
+		Version:     3,
+		Description: "create api_keys table",
+		Up: `
+			CREATE TABLE api_keys (
+				id TEXT NOT NULL PRIMARY KEY,
+				"user" TEXT NOT NULL,
+				name TEXT NOT NULL,
+				scope TEXT NOT NULL,
+				created BIGINT NOT NULL,
+				last_used BIGINT,
+				hash TEXT NOT NULL
+			);
+			CREATE INDEX api_keys_user ON api_keys ("user");
+		`,
+		Down: `DROP TABLE api_keys;`,
+	},
+	{
+		Version:     4,
+		Description: "create identities table",
+		Up: `
+			CREATE TABLE identities (
+				issuer TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				"user" TEXT NOT NULL,
+				PRIMARY KEY (issuer, subject)
+			);
+			CREATE INDEX identities_user ON identities ("user");
+		`,
+		Down: `DROP TABLE identities;`,
+	},
+	{
+		Version:     5,
+		Description: "create totp, recovery_codes and challenges tables",
+		Up: `
+			CREATE TABLE totp (
+				"user" TEXT NOT NULL PRIMARY KEY,
+				secret TEXT NOT NULL,
+				enabled BOOLEAN NOT NULL,
+				last_step BIGINT NOT NULL
+			);
+			CREATE TABLE recovery_codes (
+				"user" TEXT NOT NULL,
+				hash TEXT NOT NULL,
+				PRIMARY KEY ("user", hash)
+			);
+			CREATE TABLE challenges (
+				id TEXT NOT NULL PRIMARY KEY,
+				"user" TEXT NOT NULL,
+				expires BIGINT NOT NULL
+			);
+		`,
+		Down: `
+			DROP TABLE challenges;
+			DROP TABLE recovery_codes;
+			DROP TABLE totp;
+		`,
+	},
+	{
+		Version:     6,
+		Description: "create reset_tokens table",
+		Up:          `CREATE TABLE reset_tokens ("user" TEXT NOT NULL PRIMARY KEY, hash TEXT NOT NULL, expires BIGINT NOT NULL);`,
+		Down:        `DROP TABLE reset_tokens;`,
+	},
+	{
+		Version:     7,
+		Description: "create disabled_users table",
+		Up:          `CREATE TABLE disabled_users ("user" TEXT NOT NULL PRIMARY KEY);`,
+		Down:        `DROP TABLE disabled_users;`,
+	},
+	{
+		Version:     8,
+		Description: "replace tokens table with sessions table",
+		Up: `
+			CREATE TABLE sessions (
+				hash TEXT NOT NULL PRIMARY KEY,
+				"user" TEXT NOT NULL,
+				created BIGINT NOT NULL
+			);
+			CREATE INDEX sessions_user ON sessions ("user");
+			DROP TABLE tokens;
+		`,
+		Down: `
+			CREATE TABLE tokens ("user" TEXT NOT NULL PRIMARY KEY, token TEXT NOT NULL);
+			DROP TABLE sessions;
+		`,
+	},
+}
+
+// MigrateSQLite migrates the SQLite DB represented by URN to the target
+// schema version, and returns the version it was migrated from and to.
+// A target of -1 means the latest version. NewSQLiteRepository always
+// migrates to the latest version; this is useful to revert migrations,
+// or to migrate ahead of a deploy.
+func MigrateSQLite(ctx context.Context, urn string, target int) (from, to int, err error) {
+	db, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	return migrate.Migrate(ctx, db, sqliteMigrations, target)
+}
+
+// SQLiteSchemaVersion returns the current schema version of the SQLite DB
+// represented by URN, and the latest version known to this package.
+func SQLiteSchemaVersion(ctx context.Context, urn string) (current, latest int, err error) {
+	db, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	current, err = migrate.Current(ctx, db, sqliteMigrations)
+	return current, migrate.Latest(sqliteMigrations), err
+}
+
+// MigratePostgres migrates the PostgreSQL DB represented by URN to the
+// target schema version, and returns the version it was migrated from and
+// to. A target of -1 means the latest version. NewPostgresRepository always
+// migrates to the latest version.
+func MigratePostgres(ctx context.Context, urn string, target int) (from, to int, err error) {
+	db, err := sql.Open("postgres", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	return migrate.Migrate(ctx, db, postgresMigrations, target)
+}
+
+// PostgresSchemaVersion returns the current schema version of the
+// PostgreSQL DB represented by URN, and the latest version known to this
+// package.
+func PostgresSchemaVersion(ctx context.Context, urn string) (current, latest int, err error) {
+	db, err := sql.Open("postgres", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	current, err = migrate.Current(ctx, db, postgresMigrations)
+	return current, migrate.Latest(postgresMigrations), err
+}
+
+// Migrate migrates the SQLite or PostgreSQL DB represented by URN, as
+// NewRepository would interpret it, to the target schema version. See
+// MigrateSQLite and MigratePostgres.
+func Migrate(ctx context.Context, urn string, target int) (from, to int, err error) {
+	switch {
+	case urn == "memory:":
+		return 0, 0, errors.New("in-memory DBs have no schema to migrate")
+	case isPostgres(urn):
+		return MigratePostgres(ctx, urn, target)
+	default:
+		return MigrateSQLite(ctx, urn, target)
+	}
+}
+
+// SchemaVersion returns the current schema version of the SQLite or
+// PostgreSQL DB represented by URN, and the latest version known to this
+// package.
+func SchemaVersion(ctx context.Context, urn string) (current, latest int, err error) {
+	switch {
+	case urn == "memory:":
+		return 0, 0, errors.New("in-memory DBs have no schema version")
+	case isPostgres(urn):
+		return PostgresSchemaVersion(ctx, urn)
+	default:
+		return SQLiteSchemaVersion(ctx, urn)
+	}
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/oidc"
+	"github.com/pkg/errors"
+)
+
+// OIDCConfig configures signing in with an external OpenID Connect
+// provider, e.g. a company identity provider.
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string // empty for public clients
+	RedirectURL  string // the callback, e.g. https://auth.example.com/oidc/callback
+
+	// UserClaim names the ID token claim used as the name of provisioned
+	// users. If empty, it's preferred_username.
+	UserClaim string
+
+	// AutoProvision creates a local user for an identity which isn't linked
+	// to one. Otherwise, identities must be linked by an operator.
+	AutoProvision bool
+}
+
+// OIDC signs users in with an external OpenID Connect provider, by the
+// authorization code flow with PKCE, and issues regular tokens for the
+// local users their identities are linked to.
+//
+// Logins in progress are kept in memory, so a login must complete on the
+// instance which began it.
+type OIDC struct {
+	repo          Repository
+	provider      *oidc.Provider
+	config        oidc.Config
+	userClaim     string
+	autoProvision bool
+
+	mtx     sync.Mutex
+	pending map[string]pendingLogin // state: login
+}
+
+type pendingLogin struct {
+	verifier string
+	nonce    string
+	expires  time.Time
+}
+
+const (
+	// loginTTL is how long users have to sign in with the provider.
+	loginTTL = 10 * time.Minute
+
+	// maxPendingLogins bounds the memory used by logins which are begun but
+	// never completed.
+	maxPendingLogins = 10000
+)
+
+// NewOIDC returns an OIDC for the repository, after discovering the
+// provider's endpoints.
+func NewOIDC(ctx context.Context, repo Repository, c OIDCConfig) (*OIDC, error) {
+	if c.Issuer == "" || c.ClientID == "" || c.RedirectURL == "" {
+		return nil, errors.New("OIDC requires an issuer, client ID, and redirect URL")
+	}
+	if c.UserClaim == "" {
+		c.UserClaim = "preferred_username"
+	}
+
+	provider, err := oidc.Discover(ctx, http.DefaultClient, c.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	return &OIDC{
+		repo:     repo,
+		provider: provider,
+		config: oidc.Config{
+			ClientID:     c.ClientID,
+			ClientSecret: c.ClientSecret,
+			RedirectURL:  c.RedirectURL,
+			Scopes:       []string{"profile", "email"},
+		},
+		userClaim:     c.UserClaim,
+		autoProvision: c.AutoProvision,
+		pending:       map[string]pendingLogin{},
+	}, nil
+}
+
+// Begin starts a login, and returns the provider URL to send the user to.
+// The provider redirects them back to the configured redirect URL, with
+// the state and code to pass to Complete.
+func (o *OIDC) Begin() (authURL string, err error) {
+	state, err := oidc.Random()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := oidc.Random()
+	if err != nil {
+		return "", err
+	}
+	verifier, challenge, err := oidc.NewVerifier()
+	if err != nil {
+		return "", err
+	}
+
+	o.mtx.Lock()
+	defer o.mtx.Unlock()
+
+	now := time.Now()
+	for s, login := range o.pending {
+		if now.After(login.expires) {
+			delete(o.pending, s)
+		}
+	}
+	if len(o.pending) >= maxPendingLogins {
+		return "", errors.New("too many logins in progress")
+	}
+	o.pending[state] = pendingLogin{verifier: verifier, nonce: nonce, expires: now.Add(loginTTL)}
+	return o.provider.AuthCodeURL(o.config, state, nonce, challenge), nil
+}
+
+// Complete finishes the login with the state, and the code from the
+// provider, and logs in the local user linked to the identity. If there's
+// none, and auto-provisioning is enabled, a user named by the configured
+// claim is created first. An existing user isn't linked automatically, as
+// that would let the provider take over local accounts.
+func (o *OIDC) Complete(ctx context.Context, state, code string) (user, token string, err error) {
+	o.mtx.Lock()
+	login, ok := o.pending[state]
+	delete(o.pending, state)
+	o.mtx.Unlock()
+	if !ok || time.Now().After(login.expires) {
+		return "", "", ErrBadAuth
+	}
+
+	idToken, err := o.provider.Exchange(ctx, o.config, code, login.verifier)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error redeeming code")
+	}
+	claims, err := o.provider.Verify(ctx, o.config, idToken, login.nonce, time.Now())
+	if err == oidc.ErrInvalidToken {
+		return "", "", ErrBadAuth
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	id := Identity{Issuer: o.provider.Issuer, Subject: claims.Subject}
+	user, err = o.repo.Identity(ctx, id)
+	if err == ErrUnknownIdentity && o.autoProvision {
+		user, err = o.provision(ctx, id, claims.String(o.userClaim))
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	token, err = o.repo.IssueToken(ctx, user)
+	if err == ErrUnknownUser {
+		return "", "", ErrUnknownIdentity // erased since linking
+	}
+	if err != nil {
+		return "", "", err
+	}
+	return user, token, nil
+}
+
+// provision creates the user, and links the identity to them. The user gets
+// a random pass, which nobody knows, so they can only sign in with the
+// identity, or an API key.
+func (o *OIDC) provision(ctx context.Context, id Identity, user string) (string, error) {
+	if user == "" {
+		return "", errors.Errorf("ID token has no %s claim", o.userClaim)
+	}
+	pass, err := randomHex(32)
+	if err != nil {
+		return "", err
+	}
+	if err := o.repo.Create(ctx, user, pass); err != nil {
+		return "", err
+	}
+	if err := o.repo.Link(ctx, id, user); err != nil {
+		return "", err
+	}
+	return user, nil
+}
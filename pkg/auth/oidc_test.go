@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/peterbourgon/gattaca/pkg/oidc/oidctest"
+)
+
+func TestOIDC(t *testing.T) {
+	idp, err := oidctest.NewProvider("gattaca", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	idp.AddUser("s-ann", map[string]interface{}{"preferred_username": "ann"})
+	idp.AddUser("s-bob", map[string]interface{}{"preferred_username": "bob"})
+	idp.AddUser("s-eve", map[string]interface{}{"preferred_username": "local"})
+
+	var (
+		ctx  = context.Background()
+		repo = NewMemoryRepository()
+		s    = NewDefaultService(repo)
+	)
+	if err := s.Signup(ctx, "local", "pass"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, autoProvision := range []bool{false, true} {
+		var handler http.Handler
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { handler.ServeHTTP(w, r) }))
+		defer server.Close()
+
+		o, err := NewOIDC(ctx, repo, OIDCConfig{
+			Issuer:        idp.URL,
+			ClientID:      "gattaca",
+			ClientSecret:  "secret",
+			RedirectURL:   server.URL + "/oidc/callback",
+			AutoProvision: autoProvision,
+		})
+		if err != nil {
+			t.Fatalf("NewOIDC: %v", err)
+		}
+		handler = NewHTTPServer(s, WithOIDC(o))
+
+		// login signs in at the provider as the subject, and returns the
+		// response from the callback.
+		login := func(subject string) (code int, body string) {
+			t.Helper()
+			client := &http.Client{
+				CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+			}
+			resp, err := client.Get(server.URL + "/oidc/login")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			callback, err := idp.Login(resp.Header.Get("Location"), subject)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err = http.Get(callback.String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			buf, _ := ioutil.ReadAll(resp.Body)
+			return resp.StatusCode, strings.TrimSpace(string(buf))
+		}
+
+		// Linked identities sign in as their local user.
+		if err := repo.Link(ctx, Identity{Issuer: idp.URL, Subject: "s-bob"}, "local"); err != nil {
+			t.Fatal(err)
+		}
+		code, body := login("s-bob")
+		if want, have := http.StatusOK, code; want != have {
+			t.Fatalf("auto-provision %v: login linked: want %d, have %d (%s)", autoProvision, want, have, body)
+		}
+		fields := strings.Split(body, "\t")
+		if want, have := "local", fields[0]; want != have {
+			t.Errorf("auto-provision %v: login linked: want user %q, have %q", autoProvision, want, have)
+		}
+		if _, err := s.Validate(ctx, "local", fields[len(fields)-1]); err != nil {
+			t.Errorf("auto-provision %v: Validate issued token: %v", autoProvision, err)
+		}
+
+		// An existing local user isn't taken over by provisioning.
+		want := http.StatusForbidden
+		if autoProvision {
+			want = http.StatusConflict
+		}
+		if code, body := login("s-eve"); want != code {
+			t.Errorf("auto-provision %v: login as existing user: want %d, have %d (%s)", autoProvision, want, code, body)
+		}
+
+		want = http.StatusForbidden
+		if autoProvision {
+			want = http.StatusOK
+		}
+		if code, body := login("s-ann"); want != code {
+			t.Errorf("auto-provision %v: login unknown: want %d, have %d (%s)", autoProvision, want, code, body)
+		}
+	}
+
+	// The provisioned user can't log in with a pass.
+	if _, _, err := s.Login(ctx, "ann", ""); err != ErrBadAuth {
+		t.Errorf("Login provisioned user: want %v, have %v", ErrBadAuth, err)
+	}
+	if user, err := repo.Identity(ctx, Identity{Issuer: idp.URL, Subject: "s-ann"}); err != nil || user != "ann" {
+		t.Errorf("Identity of provisioned user: want %q, have %q (%v)", "ann", user, err)
+	}
+}
+
+func TestOIDCState(t *testing.T) {
+	idp, err := oidctest.NewProvider("gattaca", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	idp.AddUser("s-ann", map[string]interface{}{"preferred_username": "ann"})
+
+	ctx := context.Background()
+	o, err := NewOIDC(ctx, NewMemoryRepository(), OIDCConfig{
+		Issuer:        idp.URL,
+		ClientID:      "gattaca",
+		RedirectURL:   "http://localhost/oidc/callback",
+		AutoProvision: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, err := o.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	callback, err := idp.Login(authURL, "s-ann")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		state = callback.Query().Get("state")
+		code  = callback.Query().Get("code")
+	)
+
+	if _, _, err := o.Complete(ctx, "forged", code); err != ErrBadAuth {
+		t.Errorf("Complete with forged state: want %v, have %v", ErrBadAuth, err)
+	}
+	if user, _, err := o.Complete(ctx, state, code); err != nil || user != "ann" {
+		t.Errorf("Complete: want %q, have %q (%v)", "ann", user, err)
+	}
+	if _, _, err := o.Complete(ctx, state, code); err != ErrBadAuth {
+		t.Errorf("Complete replayed: want %v, have %v", ErrBadAuth, err)
+	}
+}
@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// passCost is the bcrypt cost of hashing passes.
+var passCost = bcrypt.DefaultCost
+
+// hashPass returns the hash of the pass, which is what repositories store.
+// Passes are hashed with bcrypt, which is slow by design, so that stolen
+// hashes are slow to crack. bcrypt reads at most 72 bytes, so it's given
+// the SHA-256 of the pass, which any length of pass changes.
+func hashPass(pass string) (string, error) {
+	p, err := bcrypt.GenerateFromPassword(prehashPass(pass), passCost)
+	if err != nil {
+		return "", errors.Wrap(err, "error hashing pass")
+	}
+	return string(p), nil
+}
+
+// checkPass returns true if the pass matches the hash. The empty hash, of a
+// user who doesn't exist, matches no pass, but takes as long to check, so
+// that response times don't reveal which users exist.
+func checkPass(hash, pass string) bool {
+	if hash == "" {
+		bcrypt.CompareHashAndPassword(missingUserHash(), prehashPass(pass))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), prehashPass(pass)) == nil
+}
+
+func prehashPass(pass string) []byte {
+	sum := sha256.Sum256([]byte(pass))
+	return []byte(base64.StdEncoding.EncodeToString(sum[:]))
+}
+
+var (
+	missingUserOnce sync.Once
+	missingUser     []byte
+)
+
+// missingUserHash returns a hash checked in place of those of users who
+// don't exist.
+func missingUserHash() []byte {
+	missingUserOnce.Do(func() {
+		missingUser, _ = bcrypt.GenerateFromPassword([]byte("missing user"), passCost)
+	})
+	return missingUser
+}
+
+// isPassHash returns true if the stored pass is a hash, rather than a pass
+// stored in plaintext, as they were before they were hashed.
+func isPassHash(stored string) bool {
+	_, err := bcrypt.Cost([]byte(stored))
+	return err == nil
+}
+
+// hashPlaintextPasses hashes any passes stored in plaintext, e.g. in DBs
+// created, or backups taken, before passes were hashed. selectQuery reads
+// the user and pass of candidates; updateQuery is given a hash, a user, and
+// their plaintext pass, and replaces the pass only if it's unchanged. Several
+// processes may run it at once, e.g. replicas starting up.
+func hashPlaintextPasses(ctx context.Context, db *sql.DB, selectQuery, updateQuery string) error {
+	rows, err := db.QueryContext(ctx, selectQuery)
+	if err != nil {
+		return errors.Wrap(err, "error reading credentials")
+	}
+	plaintext := map[string]string{}
+	for rows.Next() {
+		var user, pass string
+		if err := rows.Scan(&user, &pass); err != nil {
+			rows.Close()
+			return errors.Wrap(err, "error reading credentials")
+		}
+		if !isPassHash(pass) {
+			plaintext[user] = pass
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error reading credentials")
+	}
+
+	for user, pass := range plaintext {
+		hash, err := hashPass(pass)
+		if err != nil {
+			return err
+		}
+		if _, err := db.ExecContext(ctx, updateQuery, hash, user, pass); err != nil {
+			return errors.Wrap(err, "error saving pass hash")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestMain(m *testing.M) {
+	passCost = bcrypt.MinCost // hashing at the default cost makes tests slow
+	os.Exit(m.Run())
+}
+
+func TestHashPass(t *testing.T) {
+	long := strings.Repeat("a", 100)
+	hash, err := hashPass(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, testcase := range []struct {
+		pass string
+		want bool
+	}{
+		{long, true},
+		{long + "b", false}, // bcrypt alone would ignore bytes past 72
+		{long[:72], false},
+		{"", false},
+	} {
+		if want, have := testcase.want, checkPass(hash, testcase.pass); want != have {
+			t.Errorf("checkPass(%d bytes): want %v, have %v", len(testcase.pass), want, have)
+		}
+	}
+	if checkPass("", "") {
+		t.Errorf("checkPass with empty hash: want false, have true")
+	}
+}
+
+func TestSQLiteHashesPlaintextPasses(t *testing.T) {
+	var (
+		ctx = context.Background()
+		urn = memoryURN(t)
+	)
+	r, err := NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.db.Close()
+
+	// Passes were once stored in plaintext.
+	if _, err := r.db.Exec(`INSERT INTO credentials (user, pass) VALUES ('old', 'plain pass')`); err != nil {
+		t.Fatal(err)
+	}
+
+	rr, err := NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored string
+	if err := rr.db.QueryRow(`SELECT pass FROM credentials WHERE user = 'old'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if !isPassHash(stored) {
+		t.Errorf("pass after reopening: want a hash, have %q", stored)
+	}
+	if _, err := rr.Auth(ctx, "old", "plain pass"); err != nil {
+		t.Errorf("Auth after reopening: %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Policy constrains the user names and passes accepted by Signup, and the
+// passes accepted by ChangePassword and ResetPassword. Lengths are in
+// characters; zero values don't constrain.
+type Policy struct {
+	MinUserLength int
+	MaxUserLength int
+	UserPattern   *regexp.Regexp // nil to allow any characters
+	MinPassLength int
+	MaxPassLength int
+	Breached      *BreachedList // nil to skip the check
+}
+
+// DefaultPolicy is the policy of services which aren't configured with one.
+// It requires a user name of plain characters, and a non-empty pass.
+var DefaultPolicy = Policy{
+	MinUserLength: 1,
+	MaxUserLength: 64,
+	UserPattern:   regexp.MustCompile(`^[A-Za-z0-9._@-]*$`),
+	MinPassLength: 1,
+	MaxPassLength: 1024,
+}
+
+// CheckUser returns ErrInvalidUser if the user name doesn't meet the
+// policy.
+func (p Policy) CheckUser(user string) error {
+	n := utf8.RuneCountInString(user)
+	if n < p.MinUserLength || (p.MaxUserLength > 0 && n > p.MaxUserLength) {
+		return ErrInvalidUser
+	}
+	if p.UserPattern != nil && !p.UserPattern.MatchString(user) {
+		return ErrInvalidUser
+	}
+	return nil
+}
+
+// CheckPass returns an error if the user's pass doesn't meet the policy.
+func (p Policy) CheckPass(user, pass string) error {
+	n := utf8.RuneCountInString(pass)
+	if n < p.MinPassLength {
+		return ErrPassTooShort
+	}
+	if p.MaxPassLength > 0 && n > p.MaxPassLength {
+		return ErrPassTooLong
+	}
+	if strings.EqualFold(pass, user) || p.Breached.Contains(pass) {
+		return ErrPassBreached
+	}
+	return nil
+}
+
+// BreachedList is a set of passes known to attackers, e.g. from published
+// breaches, which users may not choose.
+type BreachedList struct {
+	hashes map[[sha1.Size]byte]struct{}
+}
+
+// LoadBreachedList reads a list of passes from a local file, one per line.
+// Lines may be passes, or their SHA-1 hashes in hex, optionally followed by
+// a colon and a count, as in the Pwned Passwords downloads. Blank lines are
+// ignored.
+func LoadBreachedList(filename string) (*BreachedList, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening breached pass list")
+	}
+	defer f.Close()
+
+	l := &BreachedList{hashes: map[[sha1.Size]byte]struct{}{}}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimRight(s.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if hash, ok := parseSHA1(line); ok {
+			l.hashes[hash] = struct{}{}
+			continue
+		}
+		l.hashes[sha1.Sum([]byte(line))] = struct{}{}
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading breached pass list")
+	}
+	return l, nil
+}
+
+// Len returns the number of passes in the list.
+func (l *BreachedList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.hashes)
+}
+
+// Contains returns true if the pass is in the list.
+func (l *BreachedList) Contains(pass string) bool {
+	if l == nil {
+		return false
+	}
+	_, ok := l.hashes[sha1.Sum([]byte(pass))]
+	return ok
+}
+
+// parseSHA1 parses a hex SHA-1 hash, optionally followed by :count.
+func parseSHA1(line string) (hash [sha1.Size]byte, ok bool) {
+	if i := strings.IndexByte(line, ':'); i >= 0 {
+		line = line[:i]
+	}
+	if len(line) != hex.EncodedLen(sha1.Size) {
+		return hash, false
+	}
+	if _, err := hex.Decode(hash[:], []byte(line)); err != nil {
+		return hash, false
+	}
+	return hash, true
+}
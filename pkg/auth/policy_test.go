@@ -0,0 +1,66 @@
+package auth
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	breached, err := LoadBreachedList("testdata/breached.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, breached.Len(); want != have {
+		t.Errorf("LoadBreachedList: want %d passes, have %d", want, have)
+	}
+
+	p := Policy{
+		MinUserLength: 2,
+		MaxUserLength: 8,
+		UserPattern:   regexp.MustCompile(`^[a-z]*$`),
+		MinPassLength: 6,
+		MaxPassLength: 12,
+		Breached:      breached,
+	}
+	for _, testcase := range []struct {
+		user string
+		want error
+	}{
+		{"ann", nil},
+		{"a", ErrInvalidUser},
+		{"annabella", ErrInvalidUser},
+		{"ann b", ErrInvalidUser},
+		{"", ErrInvalidUser},
+	} {
+		if want, have := testcase.want, p.CheckUser(testcase.user); want != have {
+			t.Errorf("CheckUser(%q): want %v, have %v", testcase.user, want, have)
+		}
+	}
+	for _, testcase := range []struct {
+		pass string
+		want error
+	}{
+		{"correct horse", ErrPassTooLong},
+		{"horse", ErrPassTooShort},
+		{"çorrect", nil},
+		{"password", ErrPassBreached}, // as a hash, with a count
+		{"123456", ErrPassBreached},   // in the clear
+		{"qwerty", ErrPassBreached},   // as a lowercase hash
+		{"annann", nil},
+		{"ANNANN", nil},
+	} {
+		if want, have := testcase.want, p.CheckPass("ann", testcase.pass); want != have {
+			t.Errorf("CheckPass(%q): want %v, have %v", testcase.pass, want, have)
+		}
+	}
+	if want, have := ErrPassBreached, p.CheckPass("annann", "AnnAnn"); want != have {
+		t.Errorf("CheckPass of user name: want %v, have %v", want, have)
+	}
+
+	if want, have := ErrInvalidUser, DefaultPolicy.CheckUser(""); want != have {
+		t.Errorf("DefaultPolicy.CheckUser empty: want %v, have %v", want, have)
+	}
+	if want, have := ErrPassTooShort, DefaultPolicy.CheckPass("ann", ""); want != have {
+		t.Errorf("DefaultPolicy.CheckPass empty: want %v, have %v", want, have)
+	}
+}
@@ -0,0 +1,230 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/pkg/errors"
+)
+
+// UserData is what a repository holds about a user. Passwords, tokens, API
+// key hashes, and two-factor secrets are secrets, so only the number of
+// active sessions, the API keys without their hashes, and whether the user
+// is disabled, and has two-factor authentication enabled, are exported.
+type UserData struct {
+	User       string     `json:"user"`
+	Role       rbac.Role  `json:"role"`
+	Disabled   bool       `json:"disabled"`
+	Sessions   int        `json:"sessions"`
+	TwoFactor  bool       `json:"two_factor"`
+	Keys       []APIKey   `json:"keys,omitempty"`
+	Identities []Identity `json:"identities,omitempty"`
+}
+
+// Export returns what the repository holds about the user, or nil if the
+// user doesn't exist.
+func (r *SQLiteRepository) Export(ctx context.Context, user string) (*UserData, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var (
+		data = UserData{User: user}
+		role sql.NullString
+	)
+	if err := r.rdb.QueryRowContext(ctx, `
+		SELECT r.role, EXISTS (SELECT 1 FROM disabled_users WHERE user = c.user),
+			(SELECT count(*) FROM sessions WHERE user = c.user),
+			EXISTS (SELECT 1 FROM totp WHERE user = c.user AND enabled)
+		FROM credentials c LEFT JOIN roles r ON r.user = c.user
+		WHERE c.user = ?
+	`, user).Scan(&role, &data.Disabled, &data.Sessions, &data.TwoFactor); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error reading from repository")
+	}
+	data.Role = roleOrDefault(role)
+	keys, err := r.Keys(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	data.Keys = keys
+	rows, err := r.rdb.QueryContext(ctx, `SELECT issuer, subject FROM identities WHERE user = ? ORDER BY issuer, subject`, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading identities from repository")
+	}
+	if data.Identities, err = scanIdentities(rows); err != nil {
+		return nil, errors.Wrap(err, "error reading identities from repository")
+	}
+	return &data, nil
+}
+
+// Erase the user's credentials, sessions, role, API keys, identities,
+// two-factor authentication, pass reset token, and disabled status. It
+// succeeds if the user doesn't exist.
+func (r *SQLiteRepository) Erase(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting erase transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error erasing sessions")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM roles WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error erasing role")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM api_keys WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error erasing API keys")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM identities WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error erasing identities")
+	}
+	for _, table := range []string{"totp", "recovery_codes", "challenges", "reset_tokens", "disabled_users"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE user = ?`, user); err != nil {
+			return errors.Wrap(err, "error erasing "+table)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM credentials WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error erasing credentials")
+	}
+	return errors.Wrap(tx.Commit(), "error committing erase transaction")
+}
+
+// Export returns what the repository holds about the user, or nil if the
+// user doesn't exist.
+func (r *MemoryRepository) Export(ctx context.Context, user string) (*UserData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return nil, nil
+	}
+	data := UserData{User: user, Role: rbac.User}
+	if role, ok := r.roles[user]; ok {
+		data.Role = role
+	}
+	data.Disabled = r.disabled[user]
+	data.Sessions = r.sessionsOf(user)
+	data.TwoFactor = r.totp[user].Enabled
+	data.Keys = r.keysOf(user)
+	data.Identities = r.identitiesOf(user)
+	return &data, nil
+}
+
+// Erase the user's credentials, sessions, role, API keys, identities,
+// two-factor authentication, pass reset token, and disabled status. It
+// succeeds if the user doesn't exist.
+func (r *MemoryRepository) Erase(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.endSessions(user)
+	delete(r.roles, user)
+	delete(r.creds, user)
+	for id, key := range r.keys {
+		if key.User == user {
+			delete(r.keys, id)
+		}
+	}
+	for id, u := range r.identities {
+		if u == user {
+			delete(r.identities, id)
+		}
+	}
+	delete(r.totp, user)
+	delete(r.recovery, user)
+	delete(r.resets, user)
+	delete(r.disabled, user)
+	for id, c := range r.challenges {
+		if c.User == user {
+			delete(r.challenges, id)
+		}
+	}
+	return nil
+}
+
+// Export returns what the repository holds about the user, or nil if the
+// user doesn't exist.
+func (r *PostgresRepository) Export(ctx context.Context, user string) (*UserData, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var (
+		data = UserData{User: user}
+		role sql.NullString
+	)
+	if err := r.db.QueryRowContext(ctx, `
+		SELECT r.role, EXISTS (SELECT 1 FROM disabled_users WHERE "user" = c."user"),
+			(SELECT count(*) FROM sessions WHERE "user" = c."user"),
+			EXISTS (SELECT 1 FROM totp WHERE "user" = c."user" AND enabled)
+		FROM credentials c LEFT JOIN roles r ON r."user" = c."user"
+		WHERE c."user" = $1
+	`, user).Scan(&role, &data.Disabled, &data.Sessions, &data.TwoFactor); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error reading from repository")
+	}
+	data.Role = roleOrDefault(role)
+	keys, err := r.Keys(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	data.Keys = keys
+	rows, err := r.db.QueryContext(ctx, `SELECT issuer, subject FROM identities WHERE "user" = $1 ORDER BY issuer, subject`, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading identities from repository")
+	}
+	if data.Identities, err = scanIdentities(rows); err != nil {
+		return nil, errors.Wrap(err, "error reading identities from repository")
+	}
+	return &data, nil
+}
+
+// Erase the user's credentials, sessions, role, API keys, identities,
+// two-factor authentication, pass reset token, and disabled status. It
+// succeeds if the user doesn't exist.
+func (r *PostgresRepository) Erase(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting erase transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error erasing sessions")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM roles WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error erasing role")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM api_keys WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error erasing API keys")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM identities WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error erasing identities")
+	}
+	for _, table := range []string{"totp", "recovery_codes", "challenges", "reset_tokens", "disabled_users"} {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM `+table+` WHERE "user" = $1`, user); err != nil {
+			return errors.Wrap(err, "error erasing "+table)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM credentials WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error erasing credentials")
+	}
+	return errors.Wrap(tx.Commit(), "error committing erase transaction")
+}
@@ -3,149 +3,209 @@ package auth
 import (
 	"context"
 	"database/sql"
-	"fmt"
-	"math/rand"
+	"strings"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3" // driver
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
 	"github.com/pkg/errors"
 )
 
+// NewRepository connects to the DB represented by URN. URNs with a
+// postgres:// or postgresql:// scheme yield a PostgresRepository, and the
+// URN memory: yields an empty MemoryRepository; anything else is taken to be
+// a SQLite DB, tuned by the options.
+func NewRepository(urn string, pool PoolConfig, options ...SQLiteOption) (Repository, error) {
+	if urn == "memory:" {
+		return NewMemoryRepository(), nil
+	}
+	if isPostgres(urn) {
+		return NewPostgresRepository(urn, pool)
+	}
+	return NewSQLiteRepository(urn, append([]SQLiteOption{withPoolConfig(pool)}, options...)...)
+}
+
+// isPostgres returns true if URN represents a PostgreSQL DB.
+func isPostgres(urn string) bool {
+	return strings.HasPrefix(urn, "postgres://") || strings.HasPrefix(urn, "postgresql://")
+}
+
+// PoolConfig configures the pool of connections to the DB, and how long
+// each repository operation may use a connection for. Zero values leave
+// the database/sql defaults in place, and operations bounded only by the
+// context passed to them.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	QueryTimeout    time.Duration
+}
+
+func (c PoolConfig) apply(db *sql.DB) {
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+}
+
+// withTimeout bounds ctx by timeout, unless it's zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
 // SQLiteRepository for persistence of user credential data.
 type SQLiteRepository struct {
-	db *sql.DB
+	db      *sql.DB // for writes, and reads without a separate read pool
+	rdb     *sql.DB // for reads
+	timeout time.Duration
 }
 
-// NewSQLiteRepository connects to the DB represented by URN.
-func NewSQLiteRepository(urn string) (*SQLiteRepository, error) {
-	db, err := sql.Open("sqlite3", urn)
+// NewSQLiteRepository connects to the DB represented by URN, and migrates
+// it to the latest schema version.
+func NewSQLiteRepository(urn string, options ...SQLiteOption) (*SQLiteRepository, error) {
+	var c sqliteConfig
+	for _, option := range options {
+		option(&c)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", c.writeDSN(urn))
 	if err != nil {
 		return nil, errors.Wrap(err, "error opening DB")
 	}
+	c.pool.apply(db)
 
-	if _, err := db.Query(`SELECT 1 FROM credentials`); err != nil {
-		if _, err := db.Exec(`CREATE TABLE credentials (user STRING NOT NULL PRIMARY KEY, pass STRING NOT NULL)`); err != nil {
-			return nil, errors.Wrap(err, "error creating credentials table")
-		}
-		for user, pass := range map[string]string{
-			"alice": "hunter2",
-			"bob":   "qwerty",
-		} {
-			if _, err := db.Exec(`INSERT INTO credentials (user, pass) VALUES (?, ?)`, user, pass); err != nil {
-				return nil, errors.Wrap(err, "error populating initial credentials")
-			}
-		}
+	if _, _, err := migrate.Migrate(context.Background(), db, sqliteMigrations, -1); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error migrating DB")
+	}
+	if err := hashPlaintextPasses(context.Background(), db,
+		`SELECT user, pass FROM credentials WHERE pass NOT LIKE '$2%'`,
+		`UPDATE credentials SET pass = ? WHERE user = ? AND pass = ?`,
+	); err != nil {
+		db.Close()
+		return nil, err
 	}
 
-	if _, err := db.Query(`SELECT 1 FROM tokens`); err != nil {
-		if _, err := db.Exec(`CREATE TABLE tokens (user STRING NOT NULL PRIMARY KEY, token STRING NOT NULL)`); err != nil {
-			return nil, errors.Wrap(err, "error creating tokens table")
-		}
+	r := &SQLiteRepository{
+		db:      db,
+		rdb:     db,
+		timeout: c.pool.QueryTimeout,
+	}
+	if !c.readPool {
+		return r, nil
 	}
 
-	return &SQLiteRepository{
-		db: db,
-	}, nil
+	db.SetMaxOpenConns(1)
+	r.rdb, err = sql.Open("sqlite3", c.readDSN(urn))
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error opening DB for reads")
+	}
+	c.pool.apply(r.rdb)
+	return r, nil
 }
 
-// Create a user with associated password.
+// Create a user with associated password, of which only a hash is stored.
 // The user still needs to log in.
 func (r *SQLiteRepository) Create(ctx context.Context, user, pass string) error {
-	if _, err := r.db.Exec(`INSERT INTO credentials (user, pass) VALUES (?, ?)`, user, pass); err != nil {
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `INSERT INTO credentials (user, pass) VALUES (?, ?) ON CONFLICT(user) DO NOTHING`, user, hash)
+	if err != nil {
 		return errors.Wrap(err, "error creating user")
 	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error creating user")
+	} else if n == 0 {
+		return ErrUserExists
+	}
 	return nil
 }
 
-// Auth a user, if the pass is correct, and return a token.
-// If the user is already authed, overwrites the token.
+// Auth a user, if the pass is correct, and return the token of a new
+// session. Sessions the user already has remain valid.
 func (r *SQLiteRepository) Auth(ctx context.Context, user, pass string) (token string, err error) {
-	tx, err := r.db.BeginTx(ctx, nil)
-	if err != nil {
-		return "", errors.Wrap(err, "error starting auth transaction")
-	}
-
-	defer func() {
-		if err == nil {
-			if commitErr := tx.Commit(); commitErr != nil {
-				err = errors.Wrap(commitErr, "error committing auth transaction")
-			}
-		} else {
-			tx.Rollback() // ignore error
-		}
-	}()
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
 
 	var want string
-	err = tx.QueryRowContext(ctx, `SELECT pass FROM credentials WHERE user = ?`, user).Scan(&want)
-	if err == sql.ErrNoRows {
-		return "", ErrBadAuth
-	}
-	if err != nil {
+	err = r.rdb.QueryRowContext(ctx, `SELECT pass FROM credentials WHERE user = ? AND user NOT IN (SELECT user FROM disabled_users)`, user).Scan(&want)
+	if err != nil && err != sql.ErrNoRows {
 		return "", errors.Wrap(err, "error reading credentials from repository")
 	}
-	if pass != want {
+	if !checkPass(want, pass) {
 		return "", ErrBadAuth
 	}
 
-	p := make([]byte, 8)
-	rand.New(rand.NewSource(time.Now().UnixNano())).Read(p)
-	token = fmt.Sprintf("%x", p)
-	if _, err = tx.ExecContext(ctx, `INSERT INTO tokens(user, token) VALUES(?, ?)`, user, token); err != nil {
-		return "", errors.Wrap(err, "error saving token to repository")
+	// Checking the pass is slow, so it's done outside of a transaction, and
+	// the session is started only if the pass is unchanged meanwhile, and
+	// the user isn't disabled.
+	token, hash, err := newSession()
+	if err != nil {
+		return "", err
+	}
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO sessions (hash, user, created)
+		SELECT ?, user, ? FROM credentials WHERE user = ? AND pass = ? AND user NOT IN (SELECT user FROM disabled_users)
+	`, hash, time.Now().Unix(), user, want)
+	if err != nil {
+		return "", errors.Wrap(err, "error saving session to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return "", errors.Wrap(err, "error saving session to repository")
+	} else if n == 0 {
+		return "", ErrBadAuth
 	}
-
 	return token, nil
 }
 
-// Deauth a user, if the token is correct.
+// Deauth a user, if the token is correct, ending that session.
 func (r *SQLiteRepository) Deauth(ctx context.Context, user, token string) error {
-	tx, err := r.db.BeginTx(ctx, nil)
-	if err != nil {
-		return errors.Wrap(err, "error starting deauth transaction")
-	}
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
 
-	defer func() {
-		if err == nil {
-			if commitErr := tx.Commit(); commitErr != nil {
-				err = errors.Wrap(commitErr, "error committing deauth transaction")
-			}
-		} else {
-			tx.Rollback() // ignore error
-		}
-	}()
-
-	var want string
-	err = tx.QueryRowContext(ctx, `SELECT token FROM tokens WHERE user = ?`, user).Scan(&want)
-	if err == sql.ErrNoRows {
-		return ErrBadAuth // not logged in
-	}
+	result, err := r.db.ExecContext(ctx, `DELETE FROM sessions WHERE hash = ? AND user = ?`, hashSecret(token), user)
 	if err != nil {
-		return errors.Wrap(err, "error reading token from repository")
-	}
-	if token != want {
-		return ErrBadAuth
+		return errors.Wrap(err, "error removing session from repository")
 	}
-
-	if _, err := tx.ExecContext(ctx, `DELETE FROM tokens WHERE user = ?`, user); err != nil {
-		return errors.Wrap(err, "error removing token from repository")
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error removing session from repository")
+	} else if n == 0 {
+		return ErrBadAuth // not logged in, or wrong token
 	}
-
 	return nil
 }
 
 // Validate the user and token.
 func (r *SQLiteRepository) Validate(ctx context.Context, user, token string) error {
-	var want string
-	err := r.db.QueryRowContext(ctx, `SELECT token FROM tokens WHERE user = ?`, user).Scan(&want)
-	if err == sql.ErrNoRows {
-		return ErrBadAuth // not logged in
-	}
-	if err != nil {
-		return errors.Wrap(err, "error reading token from repository")
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var ok bool
+	if err := r.rdb.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM sessions WHERE hash = ? AND user = ? AND user NOT IN (SELECT user FROM disabled_users))
+	`, hashSecret(token), user).Scan(&ok); err != nil {
+		return errors.Wrap(err, "error reading session from repository")
 	}
-	if token != want {
-		return ErrBadAuth
+	if !ok {
+		return ErrBadAuth // not logged in, or wrong token
 	}
-
 	return nil
 }
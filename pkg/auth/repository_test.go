@@ -2,12 +2,25 @@ package auth
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestSQLiteFixture(t *testing.T) {
-	r, err := NewSQLiteRepository("file:testdata/fixture.db")
+	filename, cleanup := copyFixture(t)
+	defer cleanup()
+
+	r, err := NewSQLiteRepository("file:" + filename)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -36,49 +49,238 @@ func TestSQLiteFixture(t *testing.T) {
 	}
 }
 
-func TestSQLiteIntegration(t *testing.T) {
+func TestSQLiteMigrations(t *testing.T) {
+	filename, cleanup := copyFixture(t)
+	defer cleanup()
+
 	var (
-		filevar  = "AUTH_INTEGRATION_TEST_FILE"
-		filename = os.Getenv(filevar)
+		ctx = context.Background()
+		urn = "file:" + filename
 	)
-	if filename == "" {
-		// If a test will write to disk, make it opt-in.
-		t.Skipf("skipping; set %s to run this test", filevar)
+
+	// The fixture predates migrations.
+	current, latest, err := SQLiteSchemaVersion(ctx, urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, current; want != have {
+		t.Errorf("SQLiteSchemaVersion: want %d, have %d", want, have)
 	}
 
-	if _, err := os.Stat(filename); !os.IsNotExist(err) {
-		t.Fatalf("%s: %v", filename, err)
+	if from, to, err := MigrateSQLite(ctx, urn, -1); err != nil || from != 0 || to != latest {
+		t.Fatalf("MigrateSQLite: want 0 → %d, have %d → %d (%v)", latest, from, to, err)
 	}
 
-	defer func() {
-		if err := os.Remove(filename); err != nil {
-			t.Errorf("rm %s: %v", filename, err)
-		}
-	}()
+	r, err := NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Auth(ctx, "charlie", "abc123"); err != nil {
+		t.Errorf("Auth after migration: %v", err)
+	}
+	r.db.Close()
 
-	r, err := NewSQLiteRepository("file:" + filename)
+	if from, to, err := MigrateSQLite(ctx, urn, 0); err != nil || from != latest || to != 0 {
+		t.Fatalf("MigrateSQLite down: want %d → 0, have %d → %d (%v)", latest, from, to, err)
+	}
+	if from, to, err := MigrateSQLite(ctx, urn, -1); err != nil || from != 0 || to != latest {
+		t.Fatalf("MigrateSQLite up again: want 0 → %d, have %d → %d (%v)", latest, from, to, err)
+	}
+}
+
+func TestSQLiteNumericStrings(t *testing.T) {
+	r, err := NewSQLiteRepository(memoryURN(t))
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	const (
-		user = "alpha"
-		pass = "beta"
+	ctx := context.Background()
+	if err := r.Create(ctx, "007", "0123"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := r.Auth(ctx, "007", "0123"); err != nil {
+		t.Errorf("Auth with numeric pass: %v", err)
+	}
+
+	// Token hashes are hex, so they can look like numbers in scientific
+	// notation, which mustn't be mangled.
+	if _, err := r.db.Exec(`UPDATE sessions SET hash = '1e92376928284773' WHERE user = '007'`); err != nil {
+		t.Fatal(err)
+	}
+	var hash string
+	if err := r.db.QueryRow(`SELECT hash FROM sessions WHERE user = '007'`).Scan(&hash); err != nil || hash != "1e92376928284773" {
+		t.Errorf("numeric token hash: want %q, have %q (%v)", "1e92376928284773", hash, err)
+	}
+}
+
+func TestSQLiteQueryTimeout(t *testing.T) {
+	var (
+		ctx = context.Background()
+		urn = memoryURN(t)
 	)
-	if want, have := error(nil), r.Create(context.Background(), user, pass); want != have {
-		t.Fatalf("Create: want %v, have %v", want, have)
+
+	// Both repositories share the same in-memory DB.
+	unbounded, err := NewRepository(urn, PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounded, err := NewRepository(urn, PoolConfig{QueryTimeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	token, err := r.Auth(context.Background(), user, pass)
-	if want, have := error(nil), err; want != have {
-		t.Fatalf("Auth: want %v, have %v", want, have)
+	if err := bounded.Create(ctx, "alpha", "beta"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Create with timeout: want %v, have %v", context.DeadlineExceeded, err)
+	}
+	if _, err := unbounded.Auth(ctx, "alpha", "beta"); err != ErrBadAuth {
+		t.Errorf("Auth after timed out Create: want %v, have %v", ErrBadAuth, err)
 	}
 
-	if want, have := error(nil), r.Validate(context.Background(), user, token); want != have {
-		t.Errorf("Validate: want %v, have %v", want, have)
+	if err := unbounded.Create(ctx, "alpha", "beta"); err != nil {
+		t.Fatalf("Create: %v", err)
+	}
+	if _, err := bounded.Auth(ctx, "alpha", "beta"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Auth with timeout: want %v, have %v", context.DeadlineExceeded, err)
 	}
+	if err := bounded.Validate(ctx, "alpha", "any"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Validate with timeout: want %v, have %v", context.DeadlineExceeded, err)
+	}
+}
 
-	if want, have := error(nil), r.Deauth(context.Background(), user, token); want != have {
-		t.Errorf("Deauth: want %v, have %v", want, have)
+func TestSQLiteRequestCanceled(t *testing.T) {
+	r, err := NewSQLiteRepository(memoryURN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client goes away before the request is served.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var (
+		server = NewHTTPServer(NewDefaultService(r))
+		req    = httptest.NewRequest("POST", "/signup?user=alpha&pass=beta", nil).WithContext(ctx)
+		rec    = httptest.NewRecorder()
+	)
+	server.ServeHTTP(rec, req)
+	if want, have := http.StatusInternalServerError, rec.Code; want != have {
+		t.Errorf("signup: want %d, have %d", want, have)
+	}
+	if _, err := r.Auth(context.Background(), "alpha", "beta"); err != ErrBadAuth {
+		t.Errorf("Auth after canceled signup: want %v, have %v", ErrBadAuth, err)
+	}
+}
+
+func TestSQLiteStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
 	}
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewSQLiteRepository("file:"+filepath.Join(dir, "stress.db"),
+		WithJournalMode("WAL"),
+		WithSynchronous("NORMAL"),
+		WithBusyTimeout(5*time.Second),
+		WithReadPool(true),
+		WithMaxOpenConns(8),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx        = context.Background()
+		goroutines = 16
+		iterations = 25
+		wg         sync.WaitGroup
+	)
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if err := r.Create(ctx, user, "pass"); err != nil {
+				t.Errorf("Create(%s): %v", user, err)
+				return
+			}
+			for j := 0; j < iterations; j++ {
+				token, err := r.Auth(ctx, user, "pass")
+				if err != nil {
+					t.Errorf("Auth(%s): %v", user, err)
+					return
+				}
+				if err := r.Validate(ctx, user, token); err != nil {
+					t.Errorf("Validate(%s): %v", user, err)
+					return
+				}
+				if err := r.Create(ctx, "shared", "pass"); err != nil && err != ErrUserExists {
+					t.Errorf("Create(shared): %v", err)
+					return
+				}
+			}
+		}(fmt.Sprintf("user-%d", i))
+	}
+	wg.Wait()
+
+	var mode string
+	if err := r.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode: want %q, have %q (%v)", "wal", mode, err)
+	}
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	for _, option := range []SQLiteOption{
+		WithJournalMode("bogus"),
+		WithSynchronous("sometimes"),
+		WithBusyTimeout(-time.Second),
+	} {
+		if _, err := NewSQLiteRepository(memoryURN(t), option); err == nil {
+			t.Errorf("NewSQLiteRepository with invalid option: want error, have none")
+		}
+	}
+}
+
+// memoryURN returns the URN of a new, empty, in-memory DB, which is shared
+// by every connection to it. The DB is named uniquely, as it outlives the
+// test when run with -count.
+func memoryURN(t *testing.T) string {
+	return fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", t.Name(), time.Now().UnixNano())
+}
+
+// copyFixture copies testdata/fixture.db to a temporary file, so that tests
+// which modify the DB (including its schema) leave the fixture intact.
+func copyFixture(t *testing.T) (filename string, cleanup func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	src, err := os.Open("testdata/fixture.db")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	filename = filepath.Join(dir, "fixture.db")
+	dst, err := os.Create(filename)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return filename, cleanup
 }
@@ -0,0 +1,304 @@
+package auth
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Notifier delivers pass reset tokens to users, e.g. by email. The service
+// has no way to contact users itself, so the notifier is responsible for
+// knowing how to reach them.
+type Notifier interface {
+	NotifyReset(ctx context.Context, user, token string, expires time.Time) error
+}
+
+// FileNotifier appends reset tokens to a file, as JSON lines, rather than
+// delivering them. It's meant for local development and testing.
+type FileNotifier struct {
+	mtx      sync.Mutex
+	filename string
+}
+
+// NewFileNotifier returns a notifier appending to the file, which is
+// created if it doesn't exist.
+func NewFileNotifier(filename string) *FileNotifier {
+	return &FileNotifier{filename: filename}
+}
+
+// NotifyReset appends the reset token to the file.
+func (n *FileNotifier) NotifyReset(ctx context.Context, user, token string, expires time.Time) error {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+
+	f, err := os.OpenFile(n.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return errors.Wrap(err, "error opening reset notification file")
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(struct {
+		User    string    `json:"user"`
+		Token   string    `json:"token"`
+		Expires time.Time `json:"expires"`
+	}{user, token, expires.UTC()}); err != nil {
+		return errors.Wrap(err, "error writing reset notification")
+	}
+	return nil
+}
+
+// LogNotifier logs reset tokens, rather than delivering them. It's meant
+// for local development and testing.
+type LogNotifier struct {
+	Logger log.Logger
+}
+
+// NotifyReset logs the reset token.
+func (n LogNotifier) NotifyReset(ctx context.Context, user, token string, expires time.Time) error {
+	return n.Logger.Log("reset_user", user, "reset_token", token, "expires", expires.UTC())
+}
+
+// resetTTL is how long users have to use a pass reset token.
+const resetTTL = time.Hour
+
+// SetPass replaces the user's pass, and logs them out, which also abandons
+// logins awaiting a two-factor code.
+func (r *SQLiteRepository) SetPass(ctx context.Context, user, pass string) error {
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting pass transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	result, err := tx.ExecContext(ctx, `UPDATE credentials SET pass = ? WHERE user = ?`, hash, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving pass to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving pass to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing sessions from repository")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM challenges WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing challenges from repository")
+	}
+	return errors.Wrap(tx.Commit(), "error committing pass transaction")
+}
+
+// CreateResetToken saves the hash of a pass reset token for the user,
+// replacing any existing one.
+func (r *SQLiteRepository) CreateResetToken(ctx context.Context, user, hash string, expires time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO reset_tokens (user, hash, expires) SELECT user, ?, ? FROM credentials WHERE user = ?
+		ON CONFLICT(user) DO UPDATE SET hash = excluded.hash, expires = excluded.expires
+	`, hash, expires.Unix(), user)
+	if err != nil {
+		return errors.Wrap(err, "error saving reset token to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving reset token to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// ConsumeResetToken deletes the user's pass reset token, if the hash is
+// correct, and it hasn't expired at now. Otherwise, it returns ErrBadAuth.
+func (r *SQLiteRepository) ConsumeResetToken(ctx context.Context, user, hash string, now time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting reset transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var (
+		want    string
+		expires int64
+	)
+	err = tx.QueryRowContext(ctx, `SELECT hash, expires FROM reset_tokens WHERE user = ?`, user).Scan(&want, &expires)
+	if err == sql.ErrNoRows {
+		return ErrBadAuth
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reading reset token from repository")
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(want)) != 1 {
+		return ErrBadAuth
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM reset_tokens WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing reset token from repository")
+	}
+	if err := tx.Commit(); err != nil {
+		return errors.Wrap(err, "error committing reset transaction")
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+type memoryResetToken struct {
+	hash    string
+	expires time.Time
+}
+
+// SetPass replaces the user's pass, and logs them out, which also abandons
+// logins awaiting a two-factor code.
+func (r *MemoryRepository) SetPass(ctx context.Context, user, pass string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	r.creds[user] = hash
+	r.deauthAll(user)
+	return nil
+}
+
+// CreateResetToken saves the hash of a pass reset token for the user,
+// replacing any existing one.
+func (r *MemoryRepository) CreateResetToken(ctx context.Context, user, hash string, expires time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	r.resets[user] = memoryResetToken{hash: hash, expires: expires}
+	return nil
+}
+
+// ConsumeResetToken deletes the user's pass reset token, if the hash is
+// correct, and it hasn't expired at now. Otherwise, it returns ErrBadAuth.
+func (r *MemoryRepository) ConsumeResetToken(ctx context.Context, user, hash string, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	t, ok := r.resets[user]
+	if !ok || subtle.ConstantTimeCompare([]byte(hash), []byte(t.hash)) != 1 {
+		return ErrBadAuth
+	}
+	delete(r.resets, user)
+	if !now.Before(t.expires) {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// SetPass replaces the user's pass, and logs them out, which also abandons
+// logins awaiting a two-factor code.
+func (r *PostgresRepository) SetPass(ctx context.Context, user, pass string) error {
+	hash, err := hashPass(pass)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting pass transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	result, err := tx.ExecContext(ctx, `UPDATE credentials SET pass = $1 WHERE "user" = $2`, hash, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving pass to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving pass to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error removing sessions from repository")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM challenges WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error removing challenges from repository")
+	}
+	return errors.Wrap(tx.Commit(), "error committing pass transaction")
+}
+
+// CreateResetToken saves the hash of a pass reset token for the user,
+// replacing any existing one.
+func (r *PostgresRepository) CreateResetToken(ctx context.Context, user, hash string, expires time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO reset_tokens ("user", hash, expires) SELECT "user", $1, $2 FROM credentials WHERE "user" = $3
+		ON CONFLICT ("user") DO UPDATE SET hash = EXCLUDED.hash, expires = EXCLUDED.expires
+	`, hash, expires.Unix(), user)
+	if err != nil {
+		return errors.Wrap(err, "error saving reset token to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving reset token to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// ConsumeResetToken deletes the user's pass reset token, if the hash is
+// correct, and it hasn't expired at now. Otherwise, it returns ErrBadAuth.
+func (r *PostgresRepository) ConsumeResetToken(ctx context.Context, user, hash string, now time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var expires int64
+	err := r.db.QueryRowContext(ctx, `DELETE FROM reset_tokens WHERE "user" = $1 AND hash = $2 RETURNING expires`, user, hash).Scan(&expires)
+	if err == sql.ErrNoRows {
+		return ErrBadAuth
+	}
+	if err != nil {
+		return errors.Wrap(err, "error consuming reset token")
+	}
+	if !now.Before(time.Unix(expires, 0)) {
+		return ErrBadAuth
+	}
+	return nil
+}
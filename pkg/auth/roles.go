@@ -0,0 +1,140 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/pkg/errors"
+)
+
+// Role returns the user's role. Users who haven't been assigned one are
+// rbac.User.
+func (r *SQLiteRepository) Role(ctx context.Context, user string) (rbac.Role, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var role sql.NullString
+	err := r.rdb.QueryRowContext(ctx,
+		`SELECT r.role FROM credentials c LEFT JOIN roles r ON r.user = c.user WHERE c.user = ?`, user,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrUnknownUser
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error reading role from repository")
+	}
+	return roleOrDefault(role), nil
+}
+
+// SetRole assigns the role to the user.
+func (r *SQLiteRepository) SetRole(ctx context.Context, user string, role rbac.Role) error {
+	if _, err := rbac.ParseRole(string(role)); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO roles (user, role) SELECT user, ? FROM credentials WHERE user = ?
+		ON CONFLICT(user) DO UPDATE SET role = excluded.role
+	`, role, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving role to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving role to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// Role returns the user's role. Users who haven't been assigned one are
+// rbac.User.
+func (r *MemoryRepository) Role(ctx context.Context, user string) (rbac.Role, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return "", ErrUnknownUser
+	}
+	if role, ok := r.roles[user]; ok {
+		return role, nil
+	}
+	return rbac.User, nil
+}
+
+// SetRole assigns the role to the user.
+func (r *MemoryRepository) SetRole(ctx context.Context, user string, role rbac.Role) error {
+	if _, err := rbac.ParseRole(string(role)); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	r.roles[user] = role
+	return nil
+}
+
+// Role returns the user's role. Users who haven't been assigned one are
+// rbac.User.
+func (r *PostgresRepository) Role(ctx context.Context, user string) (rbac.Role, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var role sql.NullString
+	err := r.db.QueryRowContext(ctx,
+		`SELECT r.role FROM credentials c LEFT JOIN roles r ON r."user" = c."user" WHERE c."user" = $1`, user,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrUnknownUser
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "error reading role from repository")
+	}
+	return roleOrDefault(role), nil
+}
+
+// SetRole assigns the role to the user.
+func (r *PostgresRepository) SetRole(ctx context.Context, user string, role rbac.Role) error {
+	if _, err := rbac.ParseRole(string(role)); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO roles ("user", role) SELECT "user", $1 FROM credentials WHERE "user" = $2
+		ON CONFLICT ("user") DO UPDATE SET role = EXCLUDED.role
+	`, role, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving role to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving role to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+func roleOrDefault(role sql.NullString) rbac.Role {
+	if !role.Valid {
+		return rbac.User
+	}
+	return rbac.Role(role.String)
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/pkg/errors"
+)
+
+// Seed is a set of users to load into a repository, e.g. for development
+// or tests. Repositories start out empty; production DBs shouldn't be
+// seeded. It's the JSON structure of a seed file, which may contain other
+// sections for other services.
+//
+//	{"users": [{"user": "alice", "pass": "hunter2", "role": "admin"}]}
+type Seed struct {
+	Users []SeedUser `json:"users"`
+}
+
+// SeedUser is a user, their password, and optionally their role.
+type SeedUser struct {
+	User string    `json:"user"`
+	Pass string    `json:"pass"`
+	Role rbac.Role `json:"role,omitempty"`
+}
+
+// LoadSeed reads a seed file from r, and creates its users in the repo.
+// Users that already exist are skipped, so a seed file can be loaded more
+// than once.
+func LoadSeed(ctx context.Context, repo Repository, r io.Reader) (created, skipped int, err error) {
+	var seed Seed
+	if err := json.NewDecoder(r).Decode(&seed); err != nil {
+		return 0, 0, errors.Wrap(err, "error decoding seed file")
+	}
+
+	for _, u := range seed.Users {
+		switch err := repo.Create(ctx, u.User, u.Pass); err {
+		case nil:
+			if u.Role != "" {
+				if err := repo.SetRole(ctx, u.User, u.Role); err != nil {
+					return created, skipped, errors.Wrapf(err, "error assigning role to user %s", u.User)
+				}
+			}
+			created++
+		case ErrUserExists:
+			skipped++
+		default:
+			return created, skipped, errors.Wrapf(err, "error creating user %s", u.User)
+		}
+	}
+
+	return created, skipped, nil
+}
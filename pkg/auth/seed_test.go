@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"testing"
+)
+
+func TestLoadSeed(t *testing.T) {
+	r := NewMemoryRepository()
+
+	// A new repository starts out empty.
+	if _, err := r.Auth(context.Background(), "alice", "hunter2"); err != ErrBadAuth {
+		t.Errorf("Auth before LoadSeed: want %v, have %v", ErrBadAuth, err)
+	}
+
+	for _, want := range []struct{ created, skipped int }{
+		{2, 0},
+		{0, 2}, // loading again is a no-op
+	} {
+		f, err := os.Open("testdata/seed.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		created, skipped, err := LoadSeed(context.Background(), r, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("LoadSeed: %v", err)
+		}
+		if created != want.created || skipped != want.skipped {
+			t.Errorf("LoadSeed: want %d created %d skipped, have %d created %d skipped", want.created, want.skipped, created, skipped)
+		}
+	}
+
+	if _, err := r.Auth(context.Background(), "alice", "hunter2"); err != nil {
+		t.Errorf("Auth after LoadSeed: %v", err)
+	}
+}
@@ -3,44 +3,321 @@ package auth
 import (
 	"context"
 	"errors"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/peterbourgon/gattaca/pkg/totp"
 )
 
 // Service describes the expected behavior of the authentication service.
-// Users can create accounts, log in, and log out; other services can
-// validate user tokens (sessions) that they've received.
+// Users can create accounts, log in, log out, and change or reset their
+// passes; other services can validate user tokens (sessions) that they've
+// received, and learn what the user is allowed to do. Admins can assign
+// roles. Machine clients authenticate with API keys, which validate like
+// tokens. Users may enable two-factor authentication, after which logging
+// in takes a second step. Repeated failures to log in lock the user, or the
+// client, out for a time. Admins can list, disable, log out, and delete
+// users.
 type Service interface {
 	Signup(ctx context.Context, user, pass string) error
-	Login(ctx context.Context, user, pass string) (token string, err error)
+	Login(ctx context.Context, user, pass string) (token, challenge string, err error)
+	CompleteLogin(ctx context.Context, user, challenge, code string) (token string, err error)
 	Logout(ctx context.Context, user, token string) error
-	Validate(ctx context.Context, user, token string) error
+	ChangePassword(ctx context.Context, user, token, oldPass, newPass string) (newToken string, err error)
+	RequestReset(ctx context.Context, user string) error
+	ResetPassword(ctx context.Context, user, resetToken, newPass string) error
+	Validate(ctx context.Context, user, token string) (rbac.Principal, error)
+	SetRole(ctx context.Context, user, token, subject string, role rbac.Role) error
+	CreateKey(ctx context.Context, user, token, subject, name string, scope []rbac.Permission) (key APIKey, secret string, err error)
+	Keys(ctx context.Context, user, token, subject string) ([]APIKey, error)
+	RevokeKey(ctx context.Context, user, token, subject, id string) error
+	EnrollTOTP(ctx context.Context, user, token string) (secret, uri string, err error)
+	ConfirmTOTP(ctx context.Context, user, token, code string) (recoveryCodes []string, err error)
+	ResetTwoFactor(ctx context.Context, user, token, subject string) error
+	Lockouts(ctx context.Context, user, token string) ([]LockoutStatus, error)
+	Unlock(ctx context.Context, user, token, subject string) error
+	Users(ctx context.Context, user, token, after string, limit int) (users []UserSummary, next string, err error)
+	User(ctx context.Context, user, token, subject string) (*UserData, error)
+	SetDisabled(ctx context.Context, user, token, subject string, disabled bool) error
+	ForceLogout(ctx context.Context, user, token, subject string) error
+	DeleteUser(ctx context.Context, user, token, subject string) error
 }
 
-// ErrBadAuth is returned when authentication fails for any reason.
-var ErrBadAuth = errors.New("bad auth")
+var (
+	// ErrBadAuth is returned when authentication fails for any reason.
+	ErrBadAuth = errors.New("bad auth")
+
+	// ErrUserExists is returned by Signup when the user already exists.
+	ErrUserExists = errors.New("user already exists")
+
+	// ErrUnknownUser is returned when assigning a role, or creating an API
+	// key, for a user who doesn't exist.
+	ErrUnknownUser = errors.New("unknown user")
+
+	// ErrUnknownKey is returned when revoking an API key that doesn't exist.
+	ErrUnknownKey = errors.New("unknown API key")
+
+	// ErrUnknownIdentity is returned when signing in with an external
+	// identity which isn't linked to a local user.
+	ErrUnknownIdentity = errors.New("unknown identity")
+
+	// ErrForbidden is returned when an authenticated user lacks the
+	// permission to do something.
+	ErrForbidden = errors.New("forbidden")
+
+	// ErrTwoFactorEnabled is returned when enrolling in two-factor
+	// authentication, if the user already has it enabled.
+	ErrTwoFactorEnabled = errors.New("two-factor authentication already enabled")
+
+	// ErrInvalidUser is returned by Signup when the user name doesn't meet
+	// the policy.
+	ErrInvalidUser = errors.New("invalid user name")
+
+	// ErrPassTooShort is returned when a new pass is shorter than the
+	// policy allows.
+	ErrPassTooShort = errors.New("pass too short")
+
+	// ErrPassTooLong is returned when a new pass is longer than the policy
+	// allows.
+	ErrPassTooLong = errors.New("pass too long")
 
-// DefaultService provides authentication via a repository (DB).
-// It's a very thin layer around the repository.
+	// ErrPassBreached is returned when a new pass is the user name, or
+	// appears in the policy's list of breached passes.
+	ErrPassBreached = errors.New("pass is too easily guessed")
+
+	// ErrResetUnavailable is returned when requesting a pass reset from a
+	// service without a notifier to deliver reset tokens.
+	ErrResetUnavailable = errors.New("pass reset unavailable")
+)
+
+// DefaultService provides authentication via a repository (DB). On top of
+// the repository, it checks roles and the pass policy, verifies two-factor
+// codes, throttles failed logins, and sends pass resets via the notifier.
 type DefaultService struct {
-	repo Repository
+	repo     Repository
+	throttle *throttle
+	policy   Policy
+	notifier Notifier
 }
 
 // NewDefaultService returns a usable service, wrapping a repository.
-func NewDefaultService(repo Repository) *DefaultService {
-	return &DefaultService{
-		repo: repo,
+func NewDefaultService(repo Repository, options ...Option) *DefaultService {
+	s := &DefaultService{
+		repo:   repo,
+		policy: DefaultPolicy,
 	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Option configures a DefaultService.
+type Option func(*DefaultService)
+
+// WithLockout protects Login and CompleteLogin against guessing, as
+// configured. Failed attempts are tracked in memory, so each instance of the
+// service enforces its own limits.
+func WithLockout(c LockoutConfig) Option {
+	return func(s *DefaultService) { s.throttle = newThrottle(c) }
+}
+
+// WithPolicy constrains user names and passes by the policy, rather than
+// DefaultPolicy.
+func WithPolicy(p Policy) Option {
+	return func(s *DefaultService) { s.policy = p }
+}
+
+// WithNotifier enables pass resets, with reset tokens delivered by the
+// notifier.
+func WithNotifier(n Notifier) Option {
+	return func(s *DefaultService) { s.notifier = n }
 }
 
-// Signup creates a user with the given pass.
+// Signup creates a user with the given pass, if they meet the policy.
 // The user still needs to login.
 func (s *DefaultService) Signup(ctx context.Context, user, pass string) (err error) {
+	if err := s.policy.CheckUser(user); err != nil {
+		return err
+	}
+	if err := s.policy.CheckPass(user, pass); err != nil {
+		return err
+	}
 	return s.repo.Create(ctx, user, pass)
 }
 
+// ChangePassword replaces the user's pass, if the old pass is correct, and
+// the new one meets the policy. Every session of the user is logged out,
+// including the token's; the returned token replaces it. API keys can't
+// change passes.
+func (s *DefaultService) ChangePassword(ctx context.Context, user, token, oldPass, newPass string) (newToken string, err error) {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return "", err
+	}
+	if p.Key != "" {
+		return "", ErrForbidden
+	}
+
+	ip, now := clientIP(ctx), time.Now()
+	if !s.throttle.allow(user, ip, now) {
+		return "", ErrBadAuth
+	}
+	err = s.repo.CheckPass(ctx, user, oldPass)
+	if err == ErrBadAuth {
+		s.throttle.fail(user, ip, now)
+	} else {
+		s.throttle.release(user, ip)
+	}
+	if err != nil {
+		return "", err
+	}
+	if err := s.policy.CheckPass(user, newPass); err != nil {
+		return "", err
+	}
+
+	if err := s.repo.SetPass(ctx, user, newPass); err != nil {
+		return "", err
+	}
+	newToken, err = s.repo.IssueToken(ctx, user)
+	if err == ErrUnknownUser {
+		return "", ErrBadAuth // erased meanwhile
+	}
+	return newToken, err
+}
+
+// RequestReset sends the user a pass reset token, via the notifier, to pass
+// to ResetPassword. It succeeds whether or not the user exists, so that it
+// doesn't reveal which users do. A new request replaces an outstanding
+// token.
+func (s *DefaultService) RequestReset(ctx context.Context, user string) error {
+	if s.notifier == nil {
+		return ErrResetUnavailable
+	}
+	token, err := randomHex(24)
+	if err != nil {
+		return err
+	}
+	expires := time.Now().Add(resetTTL)
+	err = s.repo.CreateResetToken(ctx, user, hashSecret(token), expires)
+	if err == ErrUnknownUser {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.notifier.NotifyReset(ctx, user, token, expires)
+}
+
+// ResetPassword replaces the user's pass, if the reset token is valid, and
+// the new pass meets the policy. Every session of the user is logged out,
+// and any lockout is lifted. Two-factor authentication remains enabled.
+func (s *DefaultService) ResetPassword(ctx context.Context, user, resetToken, newPass string) error {
+	if err := s.policy.CheckPass(user, newPass); err != nil {
+		return err
+	}
+	if err := s.repo.ConsumeResetToken(ctx, user, hashSecret(resetToken), time.Now()); err != nil {
+		return err
+	}
+	if err := s.repo.SetPass(ctx, user, newPass); err == ErrUnknownUser {
+		return ErrBadAuth // erased since the request
+	} else if err != nil {
+		return err
+	}
+	s.throttle.unlock(user)
+	return nil
+}
+
 // Login logs the user in, if the pass is correct.
-// The returned token should be passed to Logout or Validate.
-func (s *DefaultService) Login(ctx context.Context, user, pass string) (token string, err error) {
-	return s.repo.Auth(ctx, user, pass)
+// The returned token should be passed to Logout or Validate. If the user has
+// two-factor authentication enabled, no token is returned; instead, the
+// returned challenge should be passed to CompleteLogin with a code.
+func (s *DefaultService) Login(ctx context.Context, user, pass string) (token, challenge string, err error) {
+	ip, now := clientIP(ctx), time.Now()
+	if !s.throttle.allow(user, ip, now) {
+		return "", "", ErrBadAuth
+	}
+	token, challenge, err = s.login(ctx, user, pass)
+	switch {
+	case err == ErrBadAuth:
+		s.throttle.fail(user, ip, now)
+	case token != "":
+		s.throttle.succeed(user, ip)
+	default:
+		s.throttle.release(user, ip) // an error, or a challenge
+	}
+	return token, challenge, err
+}
+
+func (s *DefaultService) login(ctx context.Context, user, pass string) (token, challenge string, err error) {
+	t, err := s.repo.TOTP(ctx, user)
+	if err != nil {
+		return "", "", err
+	}
+	if t == nil || !t.Enabled {
+		token, err := s.repo.Auth(ctx, user, pass)
+		return token, "", err
+	}
+
+	if err := s.repo.CheckPass(ctx, user, pass); err != nil {
+		return "", "", err
+	}
+	c, err := newChallenge(user, time.Now())
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.repo.CreateChallenge(ctx, c); err != nil {
+		return "", "", err
+	}
+	return "", c.ID, nil
+}
+
+// CompleteLogin logs the user in, if the challenge from Login is valid, and
+// the code is a current TOTP code, or one of their unused recovery codes.
+// Each challenge may be tried once, so a wrong code means logging in again.
+func (s *DefaultService) CompleteLogin(ctx context.Context, user, challenge, code string) (token string, err error) {
+	ip, now := clientIP(ctx), time.Now()
+	if !s.throttle.allow(user, ip, now) {
+		return "", ErrBadAuth
+	}
+	token, err = s.completeLogin(ctx, user, challenge, code, now)
+	switch {
+	case err == ErrBadAuth:
+		s.throttle.fail(user, ip, now)
+	case err == nil:
+		s.throttle.succeed(user, ip)
+	default:
+		s.throttle.release(user, ip)
+	}
+	return token, err
+}
+
+func (s *DefaultService) completeLogin(ctx context.Context, user, challenge, code string, now time.Time) (token string, err error) {
+	if err := s.repo.ConsumeChallenge(ctx, challenge, user, now); err != nil {
+		return "", err
+	}
+
+	t, err := s.repo.TOTP(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	if t == nil || !t.Enabled {
+		return "", ErrBadAuth // reset since the challenge
+	}
+	if step, ok := totp.Validate(t.Secret, code, now); ok {
+		err = s.repo.UseTOTPStep(ctx, user, step)
+	} else {
+		err = s.repo.UseRecoveryCode(ctx, user, hashRecoveryCode(code))
+	}
+	if err != nil {
+		return "", err
+	}
+
+	token, err = s.repo.IssueToken(ctx, user)
+	if err == ErrUnknownUser {
+		return "", ErrBadAuth // erased since the challenge
+	}
+	return token, err
 }
 
 // Logout logs the user out, if the token is valid.
@@ -48,10 +325,329 @@ func (s *DefaultService) Logout(ctx context.Context, user, token string) (err er
 	return s.repo.Deauth(ctx, user, token)
 }
 
-// Validate returns a nil error if the user is logged in and
-// provides the correct token.
-func (s *DefaultService) Validate(ctx context.Context, user, token string) (err error) {
-	return s.repo.Validate(ctx, user, token)
+// Validate returns the principal for the user if they're logged in and
+// provide the correct token, or provide one of their API keys as the token,
+// and they aren't disabled.
+func (s *DefaultService) Validate(ctx context.Context, user, token string) (p rbac.Principal, err error) {
+	var key *APIKey
+	if id, secret, ok := parseKey(token); ok {
+		k, err := s.repo.AuthKey(ctx, id, hashSecret(secret), time.Now())
+		if err != nil {
+			return rbac.Principal{}, err
+		}
+		if k.User != user {
+			return rbac.Principal{}, ErrBadAuth
+		}
+		key = &k
+	} else if err := s.repo.Validate(ctx, user, token); err != nil {
+		return rbac.Principal{}, err
+	}
+
+	role, err := s.repo.Role(ctx, user)
+	if err == ErrUnknownUser {
+		return rbac.Principal{}, ErrBadAuth // erased since validating
+	}
+	if err != nil {
+		return rbac.Principal{}, err
+	}
+
+	p = rbac.NewPrincipal(user, role)
+	if key != nil {
+		p = p.Restrict(key.Scope)
+		p.Key = key.ID
+	}
+	return p, nil
+}
+
+// SetRole assigns the role to the subject, if the user is permitted to
+// manage roles.
+func (s *DefaultService) SetRole(ctx context.Context, user, token, subject string, role rbac.Role) (err error) {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return err
+	}
+	if !p.Can(rbac.ManageRoles) {
+		return ErrForbidden
+	}
+	return s.repo.SetRole(ctx, subject, role)
+}
+
+// CreateKey creates an API key for the subject, who must be the user, unless
+// the user is permitted to manage keys. The key claims only those of the
+// subject's permissions which are in scope; an empty scope allows access to
+// the subject's own data only. The returned secret is the token to pass to
+// Validate, and can't be recovered later. API keys can't manage keys.
+func (s *DefaultService) CreateKey(ctx context.Context, user, token, subject, name string, scope []rbac.Permission) (key APIKey, secret string, err error) {
+	if err := s.authorizeKeys(ctx, user, token, subject); err != nil {
+		return APIKey{}, "", err
+	}
+	for _, perm := range scope {
+		if _, err := rbac.ParsePermission(string(perm)); err != nil {
+			return APIKey{}, "", err
+		}
+	}
+	if len(scope) == 0 {
+		scope = nil
+	}
+
+	key, secret, hash, err := newKey(subject, name, scope, time.Now())
+	if err != nil {
+		return APIKey{}, "", err
+	}
+	if err := s.repo.CreateKey(ctx, key, hash); err != nil {
+		return APIKey{}, "", err
+	}
+	return key, secret, nil
+}
+
+// Keys returns the subject's API keys, without their secrets.
+func (s *DefaultService) Keys(ctx context.Context, user, token, subject string) ([]APIKey, error) {
+	if err := s.authorizeKeys(ctx, user, token, subject); err != nil {
+		return nil, err
+	}
+	return s.repo.Keys(ctx, subject)
+}
+
+// RevokeKey revokes one of the subject's API keys, which immediately stops
+// validating.
+func (s *DefaultService) RevokeKey(ctx context.Context, user, token, subject, id string) error {
+	if err := s.authorizeKeys(ctx, user, token, subject); err != nil {
+		return err
+	}
+	return s.repo.RevokeKey(ctx, subject, id)
+}
+
+// EnrollTOTP begins enrolling the user in two-factor authentication, and
+// returns a new secret, and its provisioning URI for authenticator apps.
+// Enrollment takes effect once confirmed by ConfirmTOTP; until then, a new
+// enrollment replaces the pending one. API keys can't enroll.
+func (s *DefaultService) EnrollTOTP(ctx context.Context, user, token string) (secret, uri string, err error) {
+	if err := s.authorizeTwoFactor(ctx, user, token); err != nil {
+		return "", "", err
+	}
+	if t, err := s.repo.TOTP(ctx, user); err != nil {
+		return "", "", err
+	} else if t != nil && t.Enabled {
+		return "", "", ErrTwoFactorEnabled
+	}
+
+	secret, err = totp.NewSecret()
+	if err != nil {
+		return "", "", err
+	}
+	if err := s.repo.SetTOTP(ctx, user, TOTP{Secret: secret}); err != nil {
+		return "", "", err
+	}
+	return secret, totp.URI(totpIssuer, user, secret), nil
+}
+
+// ConfirmTOTP enables the user's pending enrollment, if the code is current,
+// and returns their recovery codes. Each recovery code may be used once in
+// place of a TOTP code, and can't be recovered later.
+func (s *DefaultService) ConfirmTOTP(ctx context.Context, user, token, code string) (recoveryCodes []string, err error) {
+	if err := s.authorizeTwoFactor(ctx, user, token); err != nil {
+		return nil, err
+	}
+	t, err := s.repo.TOTP(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, ErrBadAuth // not enrolled
+	}
+	if t.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	step, ok := totp.Validate(t.Secret, code, time.Now())
+	if !ok {
+		return nil, ErrBadAuth
+	}
+
+	recoveryCodes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetRecoveryCodes(ctx, user, hashes); err != nil {
+		return nil, err
+	}
+	if err := s.repo.SetTOTP(ctx, user, TOTP{Secret: t.Secret, Enabled: true, LastStep: step}); err != nil {
+		return nil, err
+	}
+	return recoveryCodes, nil
+}
+
+// ResetTwoFactor removes the subject's two-factor authentication and
+// recovery codes, if the user is permitted to reset it, e.g. because the
+// subject has lost their authenticator. The subject then logs in with their
+// pass alone.
+func (s *DefaultService) ResetTwoFactor(ctx context.Context, user, token, subject string) error {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return err
+	}
+	if !p.Can(rbac.ResetTwoFactor) {
+		return ErrForbidden
+	}
+	if _, err := s.repo.Role(ctx, subject); err != nil {
+		return err // ErrUnknownUser
+	}
+	return s.repo.DeleteTOTP(ctx, subject)
+}
+
+// Lockouts returns the users and IPs with recent failed login attempts, if
+// the user is permitted to manage lockouts.
+func (s *DefaultService) Lockouts(ctx context.Context, user, token string) ([]LockoutStatus, error) {
+	if err := s.authorizeLockouts(ctx, user, token); err != nil {
+		return nil, err
+	}
+	return s.throttle.status(time.Now()), nil
+}
+
+// Unlock forgets the subject's failed login attempts, which lifts any
+// lockout, if the user is permitted to manage lockouts. Lockouts of IPs
+// expire by themselves.
+func (s *DefaultService) Unlock(ctx context.Context, user, token, subject string) error {
+	if err := s.authorizeLockouts(ctx, user, token); err != nil {
+		return err
+	}
+	s.throttle.unlock(subject)
+	return nil
+}
+
+// Users returns a page of up to limit users, sorted by name, after the
+// given user, which may be empty to start from the beginning, if the user is
+// permitted to manage users. A limit of zero lists a default number of
+// users, and large limits are capped. If there are more users, next is the
+// after of the following page; otherwise, it's empty.
+func (s *DefaultService) Users(ctx context.Context, user, token, after string, limit int) (users []UserSummary, next string, err error) {
+	if err := s.authorizeUsers(ctx, user, token); err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	users, err = s.repo.Users(ctx, after, limit+1)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(users) > limit {
+		users = users[:limit]
+		next = users[limit-1].User
+	}
+	return users, next, nil
+}
+
+// User returns what the repository holds about the subject, including
+// whether they're disabled, and their sessions and API keys, if the user is
+// permitted to manage users.
+func (s *DefaultService) User(ctx context.Context, user, token, subject string) (*UserData, error) {
+	if err := s.authorizeUsers(ctx, user, token); err != nil {
+		return nil, err
+	}
+	data, err := s.repo.Export(ctx, subject)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, ErrUnknownUser
+	}
+	return data, nil
+}
+
+// SetDisabled disables or enables the subject, if the user is permitted to
+// manage users. Disabling logs the subject out, and their tokens and API
+// keys immediately stop validating. Users can't disable themselves, so that
+// admins can't lock everyone out by mistake.
+func (s *DefaultService) SetDisabled(ctx context.Context, user, token, subject string, disabled bool) error {
+	if err := s.authorizeUsers(ctx, user, token); err != nil {
+		return err
+	}
+	if disabled && subject == user {
+		return ErrForbidden
+	}
+	return s.repo.SetDisabled(ctx, subject, disabled)
+}
+
+// ForceLogout logs the subject out of every session, if the user is
+// permitted to manage users. The subject's API keys remain valid; revoke
+// them with RevokeKey.
+func (s *DefaultService) ForceLogout(ctx context.Context, user, token, subject string) error {
+	if err := s.authorizeUsers(ctx, user, token); err != nil {
+		return err
+	}
+	return s.repo.DeauthAll(ctx, subject)
+}
+
+// DeleteUser erases the subject from the repository, if the user is
+// permitted to manage users. Data held by other services, e.g. DNA samples,
+// is kept; users erase that themselves, via the privacy endpoints. Users
+// can't delete themselves here, for the same reason they can't disable
+// themselves.
+func (s *DefaultService) DeleteUser(ctx context.Context, user, token, subject string) error {
+	if err := s.authorizeUsers(ctx, user, token); err != nil {
+		return err
+	}
+	if subject == user {
+		return ErrForbidden
+	}
+	if _, err := s.repo.Role(ctx, subject); err != nil {
+		return err // ErrUnknownUser
+	}
+	if err := s.repo.Erase(ctx, subject); err != nil {
+		return err
+	}
+	s.throttle.unlock(subject)
+	return nil
+}
+
+func (s *DefaultService) authorizeUsers(ctx context.Context, user, token string) error {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return err
+	}
+	if !p.Can(rbac.ManageUsers) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (s *DefaultService) authorizeLockouts(ctx context.Context, user, token string) error {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return err
+	}
+	if !p.Can(rbac.ManageLockouts) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (s *DefaultService) authorizeTwoFactor(ctx context.Context, user, token string) error {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return err
+	}
+	if p.Key != "" {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (s *DefaultService) authorizeKeys(ctx context.Context, user, token, subject string) error {
+	p, err := s.Validate(ctx, user, token)
+	if err != nil {
+		return err
+	}
+	if p.Key != "" {
+		return ErrForbidden
+	}
+	if subject != user && !p.Can(rbac.ManageKeys) {
+		return ErrForbidden
+	}
+	return nil
 }
 
 // Repository models the data access layer required by the auth service.
@@ -62,4 +658,31 @@ type Repository interface {
 	Auth(ctx context.Context, user, pass string) (token string, err error)
 	Deauth(ctx context.Context, user, token string) error
 	Validate(ctx context.Context, user, token string) error
+	Role(ctx context.Context, user string) (rbac.Role, error)
+	SetRole(ctx context.Context, user string, role rbac.Role) error
+	CreateKey(ctx context.Context, key APIKey, hash string) error
+	Keys(ctx context.Context, user string) ([]APIKey, error)
+	RevokeKey(ctx context.Context, user, id string) error
+	AuthKey(ctx context.Context, id, hash string, now time.Time) (APIKey, error)
+	Identity(ctx context.Context, id Identity) (user string, err error)
+	Link(ctx context.Context, id Identity, user string) error
+	IssueToken(ctx context.Context, user string) (token string, err error)
+	CheckPass(ctx context.Context, user, pass string) error
+	TOTP(ctx context.Context, user string) (*TOTP, error)
+	SetTOTP(ctx context.Context, user string, t TOTP) error
+	UseTOTPStep(ctx context.Context, user string, step int64) error
+	DeleteTOTP(ctx context.Context, user string) error
+	SetRecoveryCodes(ctx context.Context, user string, hashes []string) error
+	UseRecoveryCode(ctx context.Context, user, hash string) error
+	CreateChallenge(ctx context.Context, c Challenge) error
+	ConsumeChallenge(ctx context.Context, id, user string, now time.Time) error
+	SetPass(ctx context.Context, user, pass string) error
+	CreateResetToken(ctx context.Context, user, hash string, expires time.Time) error
+	ConsumeResetToken(ctx context.Context, user, hash string, now time.Time) error
+	Users(ctx context.Context, after string, limit int) ([]UserSummary, error)
+	SetDisabled(ctx context.Context, user string, disabled bool) error
+	DeauthAll(ctx context.Context, user string) error
+	Backup(ctx context.Context, filename string) error
+	Export(ctx context.Context, user string) (*UserData, error)
+	Erase(ctx context.Context, user string) error
 }
@@ -2,84 +2,495 @@ package auth
 
 import (
 	"context"
-	"fmt"
-	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 
-	"github.com/pkg/errors"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/peterbourgon/gattaca/pkg/totp"
 )
 
 func TestFlow(t *testing.T) {
-	s := NewDefaultService(newMockRepo())
+	s := NewDefaultService(NewMemoryRepository())
 
 	if want, have := error(nil), s.Signup(context.Background(), "peter", "123456"); want != have {
 		t.Fatalf("Signup: want %v, have %v", want, have)
 	}
 
-	token, err := s.Login(context.Background(), "peter", "123456")
+	token, _, err := s.Login(context.Background(), "peter", "123456")
 	if want, have := error(nil), err; want != have {
 		t.Fatalf("Login: want %v, have %v", want, have)
 	}
 
-	if want, have := error(nil), s.Validate(context.Background(), "peter", token); want != have {
+	p, err := s.Validate(context.Background(), "peter", token)
+	if want, have := error(nil), err; want != have {
 		t.Errorf("Validate: want %v, have %v", want, have)
 	}
+	if want, have := rbac.User, p.Role; want != have {
+		t.Errorf("Validate: want role %q, have %q", want, have)
+	}
 
 	if want, have := error(nil), s.Logout(context.Background(), "peter", token); want != have {
 		t.Errorf("Logout: want %v, have %v", want, have)
 	}
 
-	if want, have := ErrBadAuth, s.Validate(context.Background(), "peter", token); want != have {
-		t.Errorf("Validate after Logout: want %v, have %v", want, have)
+	if _, err := s.Validate(context.Background(), "peter", token); err != ErrBadAuth {
+		t.Errorf("Validate after Logout: want %v, have %v", ErrBadAuth, err)
 	}
 }
 
-type mockRepo struct {
-	creds  map[string]string
-	tokens map[string]string
-}
+func TestSetRole(t *testing.T) {
+	var (
+		ctx = context.Background()
+		r   = NewMemoryRepository()
+		s   = NewDefaultService(r)
+	)
+	for _, user := range []string{"root", "ann", "bob"} {
+		if err := s.Signup(ctx, user, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.SetRole(ctx, "root", rbac.Admin); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := s.Login(ctx, "root", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want, have := ErrForbidden, s.SetRole(ctx, "ann", ann, "ann", rbac.Admin); want != have {
+		t.Errorf("SetRole by user: want %v, have %v", want, have)
+	}
+	if want, have := ErrBadAuth, s.SetRole(ctx, "root", "bad token", "ann", rbac.Analyst); want != have {
+		t.Errorf("SetRole with bad token: want %v, have %v", want, have)
+	}
+	if want, have := rbac.ErrInvalidRole, s.SetRole(ctx, "root", root, "ann", rbac.Role("root")); want != have {
+		t.Errorf("SetRole invalid role: want %v, have %v", want, have)
+	}
+	if want, have := ErrUnknownUser, s.SetRole(ctx, "root", root, "nobody", rbac.Analyst); want != have {
+		t.Errorf("SetRole unknown user: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), s.SetRole(ctx, "root", root, "ann", rbac.Analyst); want != have {
+		t.Fatalf("SetRole by admin: want %v, have %v", want, have)
+	}
 
-func newMockRepo() *mockRepo {
-	return &mockRepo{
-		creds:  map[string]string{},
-		tokens: map[string]string{},
+	// The new role takes effect without logging in again.
+	p, err := s.Validate(ctx, "ann", ann)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := true, p.Can(rbac.SearchAll); want != have {
+		t.Errorf("analyst Can(%s): want %v, have %v", rbac.SearchAll, want, have)
+	}
+	if want, have := false, p.Can(rbac.ReadAny); want != have {
+		t.Errorf("analyst Can(%s): want %v, have %v", rbac.ReadAny, want, have)
 	}
 }
 
-func (r *mockRepo) Create(ctx context.Context, user, pass string) error {
-	if _, ok := r.creds[user]; ok {
-		return errors.New("user already exists")
+func TestKeys(t *testing.T) {
+	var (
+		ctx = context.Background()
+		r   = NewMemoryRepository()
+		s   = NewDefaultService(r)
+	)
+	for _, user := range []string{"root", "ann", "svc"} {
+		if err := s.Signup(ctx, user, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for user, role := range map[string]rbac.Role{"root": rbac.Admin, "svc": rbac.Analyst} {
+		if err := r.SetRole(ctx, user, role); err != nil {
+			t.Fatal(err)
+		}
+	}
+	root, _, err := s.Login(ctx, "root", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	r.creds[user] = pass
-	return nil
+	if _, _, err := s.CreateKey(ctx, "ann", ann, "svc", "pipeline", nil); err != ErrForbidden {
+		t.Errorf("CreateKey for other user: want %v, have %v", ErrForbidden, err)
+	}
+	if _, _, err := s.CreateKey(ctx, "root", root, "svc", "pipeline", []rbac.Permission{"dna:write:any"}); err != rbac.ErrInvalidPermission {
+		t.Errorf("CreateKey with invalid scope: want %v, have %v", rbac.ErrInvalidPermission, err)
+	}
+	if _, _, err := s.CreateKey(ctx, "root", root, "nobody", "pipeline", nil); err != ErrUnknownUser {
+		t.Errorf("CreateKey for unknown user: want %v, have %v", ErrUnknownUser, err)
+	}
+
+	// The key authenticates as its user, with only the permissions in scope.
+	key, secret, err := s.CreateKey(ctx, "root", root, "svc", "pipeline", []rbac.Permission{rbac.SearchAll, rbac.ReadAny})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := s.Validate(ctx, "svc", secret)
+	if err != nil {
+		t.Fatalf("Validate with key: %v", err)
+	}
+	if want, have := (rbac.Principal{User: "svc", Role: rbac.Analyst, Claims: []rbac.Permission{rbac.SearchAll}, Key: key.ID}), p; !reflect.DeepEqual(want, have) {
+		t.Errorf("Validate with key: want %+v, have %+v", want, have)
+	}
+	if _, err := s.Validate(ctx, "ann", secret); err != ErrBadAuth {
+		t.Errorf("Validate with another user's key: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.Validate(ctx, "svc", secret+"0"); err != ErrBadAuth {
+		t.Errorf("Validate with bad secret: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, _, err := s.CreateKey(ctx, "svc", secret, "svc", "child", nil); err != ErrForbidden {
+		t.Errorf("CreateKey with key: want %v, have %v", ErrForbidden, err)
+	}
+
+	keys, err := s.Keys(ctx, "root", root, "svc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 1, len(keys); want != have {
+		t.Fatalf("Keys: want %d, have %d", want, have)
+	}
+	if keys[0].LastUsed.IsZero() {
+		t.Errorf("Keys: want last use recorded, have none")
+	}
+	if _, err := s.Keys(ctx, "ann", ann, "svc"); err != ErrForbidden {
+		t.Errorf("Keys for other user: want %v, have %v", ErrForbidden, err)
+	}
+
+	if want, have := error(nil), s.RevokeKey(ctx, "root", root, "svc", key.ID); want != have {
+		t.Fatalf("RevokeKey: want %v, have %v", want, have)
+	}
+	if _, err := s.Validate(ctx, "svc", secret); err != ErrBadAuth {
+		t.Errorf("Validate after RevokeKey: want %v, have %v", ErrBadAuth, err)
+	}
 }
 
-func (r *mockRepo) Auth(ctx context.Context, user, pass string) (token string, err error) {
-	if have, ok := r.creds[user]; !ok || pass != have {
-		return "", ErrBadAuth
+func TestTwoFactor(t *testing.T) {
+	var (
+		ctx = context.Background()
+		r   = NewMemoryRepository()
+		s   = NewDefaultService(r)
+	)
+	for _, user := range []string{"root", "ann"} {
+		if err := s.Signup(ctx, user, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.SetRole(ctx, "root", rbac.Admin); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := s.Login(ctx, "root", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Enrollment takes effect once confirmed.
+	secret, uri, err := s.EnrollTOTP(ctx, "ann", ann)
+	if err != nil {
+		t.Fatalf("EnrollTOTP: %v", err)
+	}
+	if want, have := totp.URI("gattaca", "ann", secret), uri; want != have {
+		t.Errorf("EnrollTOTP: want URI %s, have %s", want, have)
+	}
+	ann, challenge, err := s.Login(ctx, "ann", "pass")
+	if err != nil || ann == "" || challenge != "" {
+		t.Fatalf("Login before ConfirmTOTP: want token, have %q, challenge %q (%v)", ann, challenge, err)
+	}
+	if _, err := s.ConfirmTOTP(ctx, "ann", ann, "000000"); err != ErrBadAuth {
+		t.Errorf("ConfirmTOTP with bad code: want %v, have %v", ErrBadAuth, err)
+	}
+	code, err := totp.Code(secret, totp.Step(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recoveryCodes, err := s.ConfirmTOTP(ctx, "ann", ann, code)
+	if err != nil {
+		t.Fatalf("ConfirmTOTP: %v", err)
+	}
+	if want, have := recoveryCodeCount, len(recoveryCodes); want != have {
+		t.Errorf("ConfirmTOTP: want %d recovery codes, have %d", want, have)
+	}
+	if _, _, err := s.EnrollTOTP(ctx, "ann", ann); err != ErrTwoFactorEnabled {
+		t.Errorf("EnrollTOTP when enabled: want %v, have %v", ErrTwoFactorEnabled, err)
+	}
+
+	// Logging in now takes a code.
+	if _, _, err := s.Login(ctx, "ann", "bad pass"); err != ErrBadAuth {
+		t.Errorf("Login with bad pass: want %v, have %v", ErrBadAuth, err)
+	}
+	login := func() string {
+		t.Helper()
+		token, challenge, err := s.Login(ctx, "ann", "pass")
+		if err != nil || token != "" || challenge == "" {
+			t.Fatalf("Login: want challenge, have token %q, challenge %q (%v)", token, challenge, err)
+		}
+		return challenge
+	}
+	challenge = login()
+	if _, err := s.CompleteLogin(ctx, "ann", challenge, code); err != ErrBadAuth {
+		t.Errorf("CompleteLogin with code used to confirm: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.CompleteLogin(ctx, "ann", challenge, recoveryCodes[0]); err != ErrBadAuth {
+		t.Errorf("CompleteLogin with used challenge: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.CompleteLogin(ctx, "root", login(), recoveryCodes[0]); err != ErrBadAuth {
+		t.Errorf("CompleteLogin as other user: want %v, have %v", ErrBadAuth, err)
+	}
+	token, err := s.CompleteLogin(ctx, "ann", login(), " "+recoveryCodes[0]+" ")
+	if err != nil {
+		t.Fatalf("CompleteLogin with recovery code: %v", err)
+	}
+	if _, err := s.Validate(ctx, "ann", token); err != nil {
+		t.Errorf("Validate after CompleteLogin: %v", err)
+	}
+	if _, err := s.CompleteLogin(ctx, "ann", login(), recoveryCodes[0]); err != ErrBadAuth {
+		t.Errorf("CompleteLogin with used recovery code: want %v, have %v", ErrBadAuth, err)
+	}
+
+	// Only admins can reset it.
+	if want, have := ErrForbidden, s.ResetTwoFactor(ctx, "ann", token, "ann"); want != have {
+		t.Errorf("ResetTwoFactor by user: want %v, have %v", want, have)
+	}
+	if want, have := ErrUnknownUser, s.ResetTwoFactor(ctx, "root", root, "nobody"); want != have {
+		t.Errorf("ResetTwoFactor unknown user: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), s.ResetTwoFactor(ctx, "root", root, "ann"); want != have {
+		t.Fatalf("ResetTwoFactor by admin: want %v, have %v", want, have)
 	}
+	if token, challenge, err := s.Login(ctx, "ann", "pass"); err != nil || token == "" || challenge != "" {
+		t.Errorf("Login after ResetTwoFactor: want token, have %q, challenge %q (%v)", token, challenge, err)
+	}
+}
 
-	p := make([]byte, 8)
-	rand.New(rand.NewSource(time.Now().UnixNano())).Read(p)
-	token = fmt.Sprintf("%x", p)
-	r.tokens[user] = token
-	return token, nil
+func TestSignupPolicy(t *testing.T) {
+	s := NewDefaultService(NewMemoryRepository(), WithPolicy(Policy{MinUserLength: 1, MinPassLength: 8}))
+	for _, testcase := range []struct {
+		user, pass string
+		want       error
+	}{
+		{"", "long enough", ErrInvalidUser},
+		{"ann", "short", ErrPassTooShort},
+		{"ann", "long enough", nil},
+	} {
+		if want, have := testcase.want, s.Signup(context.Background(), testcase.user, testcase.pass); want != have {
+			t.Errorf("Signup(%q, %q): want %v, have %v", testcase.user, testcase.pass, want, have)
+		}
+	}
 }
 
-func (r *mockRepo) Deauth(ctx context.Context, user, token string) error {
-	if have, ok := r.tokens[user]; !ok || token != have {
-		return ErrBadAuth
+func TestChangePassword(t *testing.T) {
+	var (
+		ctx = context.Background()
+		s   = NewDefaultService(NewMemoryRepository())
+	)
+	if err := s.Signup(ctx, "ann", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.ChangePassword(ctx, "ann", token, "bad pass", "new pass"); err != ErrBadAuth {
+		t.Errorf("ChangePassword with bad pass: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.ChangePassword(ctx, "ann", token, "pass", ""); err != ErrPassTooShort {
+		t.Errorf("ChangePassword to empty pass: want %v, have %v", ErrPassTooShort, err)
+	}
+	newToken, err := s.ChangePassword(ctx, "ann", token, "pass", "new pass")
+	if err != nil {
+		t.Fatalf("ChangePassword: %v", err)
 	}
-	delete(r.tokens, user)
+	if _, err := s.Validate(ctx, "ann", token); err != ErrBadAuth {
+		t.Errorf("Validate old token: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.Validate(ctx, "ann", newToken); err != nil {
+		t.Errorf("Validate new token: %v", err)
+	}
+	if _, _, err := s.Login(ctx, "ann", "pass"); err != ErrBadAuth {
+		t.Errorf("Login with old pass: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, _, err := s.Login(ctx, "ann", "new pass"); err != nil {
+		t.Errorf("Login with new pass: %v", err)
+	}
+}
+
+type recordingNotifier map[string]string // user: token
+
+func (n recordingNotifier) NotifyReset(ctx context.Context, user, token string, expires time.Time) error {
+	n[user] = token
 	return nil
 }
 
-func (r *mockRepo) Validate(ctx context.Context, user, token string) error {
-	if have, ok := r.tokens[user]; !ok || token != have {
-		return ErrBadAuth
+func TestResetPassword(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		notifier = recordingNotifier{}
+	)
+	if want, have := ErrResetUnavailable, NewDefaultService(NewMemoryRepository()).RequestReset(ctx, "ann"); want != have {
+		t.Errorf("RequestReset without notifier: want %v, have %v", want, have)
 	}
 
-	return nil
+	s := NewDefaultService(NewMemoryRepository(), WithNotifier(notifier))
+	if err := s.Signup(ctx, "ann", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	token, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Unknown users look the same, but aren't notified.
+	for _, user := range []string{"ann", "nobody"} {
+		if want, have := error(nil), s.RequestReset(ctx, user); want != have {
+			t.Errorf("RequestReset(%s): want %v, have %v", user, want, have)
+		}
+	}
+	if want, have := 1, len(notifier); want != have {
+		t.Fatalf("RequestReset: want %d notification, have %d", want, have)
+	}
+
+	resetToken := notifier["ann"]
+	if want, have := ErrPassTooShort, s.ResetPassword(ctx, "ann", resetToken, ""); want != have {
+		t.Errorf("ResetPassword to empty pass: want %v, have %v", want, have)
+	}
+	if want, have := ErrBadAuth, s.ResetPassword(ctx, "ann", "bad token", "new pass"); want != have {
+		t.Errorf("ResetPassword with bad token: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), s.ResetPassword(ctx, "ann", resetToken, "new pass"); want != have {
+		t.Fatalf("ResetPassword: want %v, have %v", want, have)
+	}
+	if want, have := ErrBadAuth, s.ResetPassword(ctx, "ann", resetToken, "newer pass"); want != have {
+		t.Errorf("ResetPassword with used token: want %v, have %v", want, have)
+	}
+	if _, err := s.Validate(ctx, "ann", token); err != ErrBadAuth {
+		t.Errorf("Validate after ResetPassword: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, _, err := s.Login(ctx, "ann", "new pass"); err != nil {
+		t.Errorf("Login with new pass: %v", err)
+	}
+}
+
+func TestManageUsers(t *testing.T) {
+	var (
+		ctx = context.Background()
+		r   = NewMemoryRepository()
+		s   = NewDefaultService(r)
+	)
+	for _, user := range []string{"root", "ann", "bob", "cat"} {
+		if err := s.Signup(ctx, user, "pass"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.SetRole(ctx, "root", rbac.Admin); err != nil {
+		t.Fatal(err)
+	}
+	root, _, err := s.Login(ctx, "root", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ann, _, err := s.Login(ctx, "ann", "pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := s.CreateKey(ctx, "ann", ann, "ann", "pipeline", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := s.Users(ctx, "ann", ann, "", 0); err != ErrForbidden {
+		t.Errorf("Users by user: want %v, have %v", ErrForbidden, err)
+	}
+
+	// Pages end with the last user.
+	var pages [][]string
+	for after := ""; ; {
+		users, next, err := s.Users(ctx, "root", root, after, 3)
+		if err != nil {
+			t.Fatalf("Users: %v", err)
+		}
+		var page []string
+		for _, u := range users {
+			page = append(page, u.User)
+		}
+		pages = append(pages, page)
+		if next == "" {
+			break
+		}
+		after = next
+	}
+	if want, have := [][]string{{"ann", "bob", "cat"}, {"root"}}, pages; !reflect.DeepEqual(want, have) {
+		t.Errorf("Users: want %v, have %v", want, have)
+	}
+
+	// Disabling stops the user's token and API keys validating at once.
+	if want, have := error(nil), s.SetDisabled(ctx, "root", root, "ann", true); want != have {
+		t.Fatalf("SetDisabled: want %v, have %v", want, have)
+	}
+	if _, err := s.Validate(ctx, "ann", ann); err != ErrBadAuth {
+		t.Errorf("Validate disabled user: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.Validate(ctx, "ann", secret); err != ErrBadAuth {
+		t.Errorf("Validate disabled user's API key: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, _, err := s.Login(ctx, "ann", "pass"); err != ErrBadAuth {
+		t.Errorf("Login disabled user: want %v, have %v", ErrBadAuth, err)
+	}
+	data, err := s.User(ctx, "root", root, "ann")
+	if err != nil {
+		t.Fatalf("User: %v", err)
+	}
+	if !data.Disabled || data.Sessions != 0 || len(data.Keys) != 1 {
+		t.Errorf("User: want disabled, without sessions, with 1 key, have %+v", data)
+	}
+	if want, have := error(nil), s.SetDisabled(ctx, "root", root, "ann", false); want != have {
+		t.Fatalf("SetDisabled false: want %v, have %v", want, have)
+	}
+	if _, err := s.Validate(ctx, "ann", secret); err != nil {
+		t.Errorf("Validate enabled user's API key: %v", err)
+	}
+
+	// Forced logouts end sessions, but not API keys.
+	if ann, _, err = s.Login(ctx, "ann", "pass"); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := error(nil), s.ForceLogout(ctx, "root", root, "ann"); want != have {
+		t.Fatalf("ForceLogout: want %v, have %v", want, have)
+	}
+	if _, err := s.Validate(ctx, "ann", ann); err != ErrBadAuth {
+		t.Errorf("Validate after ForceLogout: want %v, have %v", ErrBadAuth, err)
+	}
+	if _, err := s.Validate(ctx, "ann", secret); err != nil {
+		t.Errorf("Validate API key after ForceLogout: %v", err)
+	}
+
+	// Admins can't disable or delete themselves.
+	if want, have := ErrForbidden, s.SetDisabled(ctx, "root", root, "root", true); want != have {
+		t.Errorf("SetDisabled self: want %v, have %v", want, have)
+	}
+	if want, have := ErrForbidden, s.DeleteUser(ctx, "root", root, "root"); want != have {
+		t.Errorf("DeleteUser self: want %v, have %v", want, have)
+	}
+
+	if want, have := error(nil), s.DeleteUser(ctx, "root", root, "ann"); want != have {
+		t.Fatalf("DeleteUser: want %v, have %v", want, have)
+	}
+	if _, err := s.Validate(ctx, "ann", secret); err != ErrBadAuth {
+		t.Errorf("Validate deleted user's API key: want %v, have %v", ErrBadAuth, err)
+	}
+	if want, have := ErrUnknownUser, s.DeleteUser(ctx, "root", root, "ann"); want != have {
+		t.Errorf("DeleteUser again: want %v, have %v", want, have)
+	}
+	if _, err := s.User(ctx, "root", root, "ann"); err != ErrUnknownUser {
+		t.Errorf("User deleted: want %v, have %v", ErrUnknownUser, err)
+	}
 }
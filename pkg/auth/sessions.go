@@ -0,0 +1,21 @@
+package auth
+
+import "time"
+
+// newSession returns the token of a new session, and the hash of it, which
+// is what repositories store. Each login starts a session of its own, which
+// lasts until it's logged out, or all of the user's sessions are ended, e.g.
+// by DeauthAll or SetPass.
+func newSession() (token, hash string, err error) {
+	token, err = randomHex(24)
+	if err != nil {
+		return "", "", err
+	}
+	return token, hashSecret(token), nil
+}
+
+type memorySession struct {
+	user    string
+	hash    string
+	created time.Time
+}
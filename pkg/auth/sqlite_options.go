@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SQLiteOption tunes a SQLiteRepository.
+type SQLiteOption func(*sqliteConfig)
+
+// WithJournalMode sets the journal mode of the DB: DELETE, TRUNCATE,
+// PERSIST, MEMORY, WAL, or OFF. WAL allows reads to proceed concurrently
+// with a write, and is recommended for services.
+func WithJournalMode(mode string) SQLiteOption {
+	return func(c *sqliteConfig) { c.journalMode = strings.ToUpper(mode) }
+}
+
+// WithSynchronous sets how carefully SQLite syncs writes to disk: OFF,
+// NORMAL, FULL, or EXTRA. NORMAL is safe, and faster, in WAL mode.
+func WithSynchronous(level string) SQLiteOption {
+	return func(c *sqliteConfig) { c.synchronous = strings.ToUpper(level) }
+}
+
+// WithBusyTimeout sets how long an operation waits for a lock held by
+// another connection before failing with "database is locked".
+func WithBusyTimeout(d time.Duration) SQLiteOption {
+	return func(c *sqliteConfig) { c.busyTimeout = d }
+}
+
+// WithMaxOpenConns limits the number of open connections. With a separate
+// read pool, it limits the number of open connections used for reads.
+func WithMaxOpenConns(n int) SQLiteOption {
+	return func(c *sqliteConfig) { c.pool.MaxOpenConns = n }
+}
+
+// WithReadPool, if enabled, makes the repository use separate pools of
+// connections for reads and writes. Writes go through a single connection,
+// so they never contend with one another; reads use up to the max open
+// conns, and don't block writes in WAL mode.
+func WithReadPool(enabled bool) SQLiteOption {
+	return func(c *sqliteConfig) { c.readPool = enabled }
+}
+
+// WithQueryTimeout bounds each repository operation.
+func WithQueryTimeout(d time.Duration) SQLiteOption {
+	return func(c *sqliteConfig) { c.pool.QueryTimeout = d }
+}
+
+// withPoolConfig sets every field of the PoolConfig at once.
+func withPoolConfig(pool PoolConfig) SQLiteOption {
+	return func(c *sqliteConfig) { c.pool = pool }
+}
+
+type sqliteConfig struct {
+	journalMode string
+	synchronous string
+	busyTimeout time.Duration
+	readPool    bool
+	pool        PoolConfig
+}
+
+func (c sqliteConfig) validate() error {
+	switch c.journalMode {
+	case "", "DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF":
+	default:
+		return errors.Errorf("invalid journal mode %q", c.journalMode)
+	}
+	switch c.synchronous {
+	case "", "OFF", "NORMAL", "FULL", "EXTRA":
+	default:
+		return errors.Errorf("invalid synchronous level %q", c.synchronous)
+	}
+	if c.busyTimeout < 0 {
+		return errors.Errorf("invalid busy timeout %s", c.busyTimeout)
+	}
+	return nil
+}
+
+// writeDSN returns the data source name for connections used for writes.
+// Write transactions take the write lock when they begin, rather than when
+// they first write, so that waiting for it is governed by the busy timeout.
+func (c sqliteConfig) writeDSN(urn string) string {
+	params := []string{"_txlock=immediate"}
+	if c.journalMode != "" {
+		params = append(params, "_journal_mode="+c.journalMode)
+	}
+	return c.dsn(urn, params)
+}
+
+// readDSN returns the data source name for connections used only for
+// reads, if there's a separate read pool.
+func (c sqliteConfig) readDSN(urn string) string {
+	return c.dsn(urn, []string{"_query_only=1"})
+}
+
+func (c sqliteConfig) dsn(urn string, params []string) string {
+	if c.synchronous != "" {
+		params = append(params, "_synchronous="+c.synchronous)
+	}
+	if c.busyTimeout > 0 {
+		params = append(params, fmt.Sprintf("_busy_timeout=%d", c.busyTimeout/time.Millisecond))
+	}
+	sep := "?"
+	if strings.Contains(urn, "?") {
+		sep = "&"
+	}
+	return urn + sep + strings.Join(params, "&")
+}
@@ -0,0 +1,543 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// TOTP is a user's enrollment in two-factor authentication with time-based
+// one-time passwords. It's enabled once the user confirms it with a code.
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64 // of the last code used, so that codes can't be replayed
+}
+
+// Challenge is a login whose pass has been checked, which is completed by
+// a TOTP or recovery code.
+type Challenge struct {
+	ID      string
+	User    string
+	Expires time.Time
+}
+
+const (
+	// totpIssuer names this service in authenticator apps.
+	totpIssuer = "gattaca"
+
+	// challengeTTL is how long users have to enter a code after their pass.
+	challengeTTL = 5 * time.Minute
+
+	// recoveryCodeCount is how many recovery codes users get.
+	recoveryCodeCount = 10
+)
+
+// newChallenge returns a challenge for the user, which expires challengeTTL
+// after now.
+func newChallenge(user string, now time.Time) (Challenge, error) {
+	id, err := randomHex(16)
+	if err != nil {
+		return Challenge{}, err
+	}
+	return Challenge{ID: id, User: user, Expires: now.Add(challengeTTL)}, nil
+}
+
+// newRecoveryCodes returns recovery codes, formatted like 1a2b3-c4d5e, and
+// their hashes.
+func newRecoveryCodes() (codes, hashes []string, err error) {
+	for i := 0; i < recoveryCodeCount; i++ {
+		code, err := randomHex(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code = code[:5] + "-" + code[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode returns the hash of a recovery code, which is what
+// repositories store. Case and dashes are ignored, as users type codes in.
+func hashRecoveryCode(code string) string {
+	return hashSecret(strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1)))
+}
+
+// CheckPass checks the user's pass, without logging them in.
+func (r *SQLiteRepository) CheckPass(ctx context.Context, user, pass string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var want string
+	err := r.rdb.QueryRowContext(ctx, `SELECT pass FROM credentials WHERE user = ? AND user NOT IN (SELECT user FROM disabled_users)`, user).Scan(&want)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "error reading credentials from repository")
+	}
+	if !checkPass(want, pass) {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// TOTP returns the user's TOTP enrollment, or nil if they aren't enrolled.
+func (r *SQLiteRepository) TOTP(ctx context.Context, user string) (*TOTP, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var t TOTP
+	err := r.rdb.QueryRowContext(ctx, `SELECT secret, enabled, last_step FROM totp WHERE user = ?`, user).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading TOTP from repository")
+	}
+	return &t, nil
+}
+
+// SetTOTP saves the user's TOTP enrollment, replacing any existing one.
+func (r *SQLiteRepository) SetTOTP(ctx context.Context, user string, t TOTP) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO totp (user, secret, enabled, last_step) SELECT user, ?, ?, ? FROM credentials WHERE user = ?
+		ON CONFLICT(user) DO UPDATE SET secret = excluded.secret, enabled = excluded.enabled, last_step = excluded.last_step
+	`, t.Secret, t.Enabled, t.LastStep, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// UseTOTPStep records that the user has used the code of the time step, if
+// their TOTP is enabled, and they haven't used a code of that or a later
+// step. Otherwise, it returns ErrBadAuth.
+func (r *SQLiteRepository) UseTOTPStep(ctx context.Context, user string, step int64) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `UPDATE totp SET last_step = ? WHERE user = ? AND enabled AND last_step < ?`, step, user, step)
+	if err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	} else if n == 0 {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// DeleteTOTP deletes the user's TOTP enrollment and recovery codes.
+func (r *SQLiteRepository) DeleteTOTP(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting TOTP transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error deleting TOTP")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error deleting recovery codes")
+	}
+	return errors.Wrap(tx.Commit(), "error committing TOTP transaction")
+}
+
+// SetRecoveryCodes replaces the user's recovery codes with the hashes.
+func (r *SQLiteRepository) SetRecoveryCodes(ctx context.Context, user string, hashes []string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting recovery codes transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error deleting recovery codes")
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes (user, hash) VALUES (?, ?)`, user, hash); err != nil {
+			return errors.Wrap(err, "error saving recovery codes")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing recovery codes transaction")
+}
+
+// UseRecoveryCode deletes the user's recovery code with the hash, or returns
+// ErrBadAuth if they have none.
+func (r *SQLiteRepository) UseRecoveryCode(ctx context.Context, user, hash string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE user = ? AND hash = ?`, user, hash)
+	if err != nil {
+		return errors.Wrap(err, "error using recovery code")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error using recovery code")
+	} else if n == 0 {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// CreateChallenge saves the challenge, and deletes expired ones.
+func (r *SQLiteRepository) CreateChallenge(ctx context.Context, c Challenge) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM challenges WHERE expires <= ?`, time.Now().Unix()); err != nil {
+		return errors.Wrap(err, "error deleting expired challenges")
+	}
+	if _, err := r.db.ExecContext(ctx, `INSERT INTO challenges (id, user, expires) VALUES (?, ?, ?)`, c.ID, c.User, c.Expires.Unix()); err != nil {
+		return errors.Wrap(err, "error saving challenge to repository")
+	}
+	return nil
+}
+
+// ConsumeChallenge deletes the user's challenge, or returns ErrBadAuth if
+// they have no such challenge, or it expired before now.
+func (r *SQLiteRepository) ConsumeChallenge(ctx context.Context, id, user string, now time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM challenges WHERE id = ? AND user = ? AND expires > ?`, id, user, now.Unix())
+	if err != nil {
+		return errors.Wrap(err, "error consuming challenge")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error consuming challenge")
+	} else if n == 0 {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// CheckPass checks the user's pass, without logging them in.
+func (r *MemoryRepository) CheckPass(ctx context.Context, user, pass string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if !checkPass(r.passHash(user), pass) {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// TOTP returns the user's TOTP enrollment, or nil if they aren't enrolled.
+func (r *MemoryRepository) TOTP(ctx context.Context, user string) (*TOTP, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	t, ok := r.totp[user]
+	if !ok {
+		return nil, nil
+	}
+	return &t, nil
+}
+
+// SetTOTP saves the user's TOTP enrollment, replacing any existing one.
+func (r *MemoryRepository) SetTOTP(ctx context.Context, user string, t TOTP) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	r.totp[user] = t
+	return nil
+}
+
+// UseTOTPStep records that the user has used the code of the time step, if
+// their TOTP is enabled, and they haven't used a code of that or a later
+// step. Otherwise, it returns ErrBadAuth.
+func (r *MemoryRepository) UseTOTPStep(ctx context.Context, user string, step int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	t, ok := r.totp[user]
+	if !ok || !t.Enabled || t.LastStep >= step {
+		return ErrBadAuth
+	}
+	t.LastStep = step
+	r.totp[user] = t
+	return nil
+}
+
+// DeleteTOTP deletes the user's TOTP enrollment and recovery codes.
+func (r *MemoryRepository) DeleteTOTP(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.totp, user)
+	delete(r.recovery, user)
+	return nil
+}
+
+// SetRecoveryCodes replaces the user's recovery codes with the hashes.
+func (r *MemoryRepository) SetRecoveryCodes(ctx context.Context, user string, hashes []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	codes := make(map[string]bool, len(hashes))
+	for _, hash := range hashes {
+		codes[hash] = true
+	}
+	r.recovery[user] = codes
+	return nil
+}
+
+// UseRecoveryCode deletes the user's recovery code with the hash, or returns
+// ErrBadAuth if they have none.
+func (r *MemoryRepository) UseRecoveryCode(ctx context.Context, user, hash string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if !r.recovery[user][hash] {
+		return ErrBadAuth
+	}
+	delete(r.recovery[user], hash)
+	return nil
+}
+
+// CreateChallenge saves the challenge, and deletes expired ones.
+func (r *MemoryRepository) CreateChallenge(ctx context.Context, c Challenge) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	for id, existing := range r.challenges {
+		if !existing.Expires.After(now) {
+			delete(r.challenges, id)
+		}
+	}
+	r.challenges[c.ID] = c
+	return nil
+}
+
+// ConsumeChallenge deletes the user's challenge, or returns ErrBadAuth if
+// they have no such challenge, or it expired before now.
+func (r *MemoryRepository) ConsumeChallenge(ctx context.Context, id, user string, now time.Time) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	c, ok := r.challenges[id]
+	if !ok || c.User != user || !c.Expires.After(now) {
+		return ErrBadAuth
+	}
+	delete(r.challenges, id)
+	return nil
+}
+
+// CheckPass checks the user's pass, without logging them in.
+func (r *PostgresRepository) CheckPass(ctx context.Context, user, pass string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var want string
+	err := r.db.QueryRowContext(ctx, `SELECT pass FROM credentials WHERE "user" = $1 AND "user" NOT IN (SELECT "user" FROM disabled_users)`, user).Scan(&want)
+	if err != nil && err != sql.ErrNoRows {
+		return errors.Wrap(err, "error reading credentials from repository")
+	}
+	if !checkPass(want, pass) {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// TOTP returns the user's TOTP enrollment, or nil if they aren't enrolled.
+func (r *PostgresRepository) TOTP(ctx context.Context, user string) (*TOTP, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var t TOTP
+	err := r.db.QueryRowContext(ctx, `SELECT secret, enabled, last_step FROM totp WHERE "user" = $1`, user).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading TOTP from repository")
+	}
+	return &t, nil
+}
+
+// SetTOTP saves the user's TOTP enrollment, replacing any existing one.
+func (r *PostgresRepository) SetTOTP(ctx context.Context, user string, t TOTP) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `
+		INSERT INTO totp ("user", secret, enabled, last_step) SELECT "user", $1, $2, $3 FROM credentials WHERE "user" = $4
+		ON CONFLICT ("user") DO UPDATE SET secret = EXCLUDED.secret, enabled = EXCLUDED.enabled, last_step = EXCLUDED.last_step
+	`, t.Secret, t.Enabled, t.LastStep, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	} else if n == 0 {
+		return ErrUnknownUser
+	}
+	return nil
+}
+
+// UseTOTPStep records that the user has used the code of the time step, if
+// their TOTP is enabled, and they haven't used a code of that or a later
+// step. Otherwise, it returns ErrBadAuth.
+func (r *PostgresRepository) UseTOTPStep(ctx context.Context, user string, step int64) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `UPDATE totp SET last_step = $1 WHERE "user" = $2 AND enabled AND last_step < $1`, step, user)
+	if err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error saving TOTP to repository")
+	} else if n == 0 {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// DeleteTOTP deletes the user's TOTP enrollment and recovery codes.
+func (r *PostgresRepository) DeleteTOTP(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting TOTP transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM totp WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error deleting TOTP")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error deleting recovery codes")
+	}
+	return errors.Wrap(tx.Commit(), "error committing TOTP transaction")
+}
+
+// SetRecoveryCodes replaces the user's recovery codes with the hashes.
+func (r *PostgresRepository) SetRecoveryCodes(ctx context.Context, user string, hashes []string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting recovery codes transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM recovery_codes WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error deleting recovery codes")
+	}
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO recovery_codes ("user", hash) VALUES ($1, $2)`, user, hash); err != nil {
+			return errors.Wrap(err, "error saving recovery codes")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing recovery codes transaction")
+}
+
+// UseRecoveryCode deletes the user's recovery code with the hash, or returns
+// ErrBadAuth if they have none.
+func (r *PostgresRepository) UseRecoveryCode(ctx context.Context, user, hash string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM recovery_codes WHERE "user" = $1 AND hash = $2`, user, hash)
+	if err != nil {
+		return errors.Wrap(err, "error using recovery code")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error using recovery code")
+	} else if n == 0 {
+		return ErrBadAuth
+	}
+	return nil
+}
+
+// CreateChallenge saves the challenge, and deletes expired ones.
+func (r *PostgresRepository) CreateChallenge(ctx context.Context, c Challenge) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM challenges WHERE expires <= $1`, time.Now().Unix()); err != nil {
+		return errors.Wrap(err, "error deleting expired challenges")
+	}
+	if _, err := r.db.ExecContext(ctx, `INSERT INTO challenges (id, "user", expires) VALUES ($1, $2, $3)`, c.ID, c.User, c.Expires.Unix()); err != nil {
+		return errors.Wrap(err, "error saving challenge to repository")
+	}
+	return nil
+}
+
+// ConsumeChallenge deletes the user's challenge, or returns ErrBadAuth if
+// they have no such challenge, or it expired before now.
+func (r *PostgresRepository) ConsumeChallenge(ctx context.Context, id, user string, now time.Time) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	result, err := r.db.ExecContext(ctx, `DELETE FROM challenges WHERE id = $1 AND "user" = $2 AND expires > $3`, id, user, now.Unix())
+	if err != nil {
+		return errors.Wrap(err, "error consuming challenge")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error consuming challenge")
+	} else if n == 0 {
+		return ErrBadAuth
+	}
+	return nil
+}
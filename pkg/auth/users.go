@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+	"github.com/pkg/errors"
+)
+
+// UserSummary is a user's account status, as listed by Users.
+type UserSummary struct {
+	User      string    `json:"user"`
+	Role      rbac.Role `json:"role"`
+	Disabled  bool      `json:"disabled"`
+	Sessions  int       `json:"sessions"`
+	TwoFactor bool      `json:"two_factor"`
+}
+
+const (
+	// defaultPageSize is the number of users listed by Users when the
+	// limit isn't given.
+	defaultPageSize = 100
+
+	// maxPageSize is the most users listed by Users at once.
+	maxPageSize = 1000
+)
+
+// Users returns up to limit users, sorted by name, after the given user,
+// which may be empty to start from the beginning.
+func (r *SQLiteRepository) Users(ctx context.Context, after string, limit int) ([]UserSummary, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.rdb.QueryContext(ctx, `
+		SELECT c.user, r.role,
+			EXISTS (SELECT 1 FROM disabled_users WHERE user = c.user),
+			(SELECT count(*) FROM sessions WHERE user = c.user),
+			EXISTS (SELECT 1 FROM totp WHERE user = c.user AND enabled)
+		FROM credentials c LEFT JOIN roles r ON r.user = c.user
+		WHERE c.user > ? ORDER BY c.user LIMIT ?
+	`, after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading users from repository")
+	}
+	users, err := scanUserSummaries(rows)
+	return users, errors.Wrap(err, "error reading users from repository")
+}
+
+// SetDisabled disables or enables the user. Disabled users are logged out,
+// and can't log in, or use their API keys, until they're enabled again.
+func (r *SQLiteRepository) SetDisabled(ctx context.Context, user string, disabled bool) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting disable transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM credentials WHERE user = ?)`, user).Scan(&exists); err != nil {
+		return errors.Wrap(err, "error reading credentials from repository")
+	}
+	if !exists {
+		return ErrUnknownUser
+	}
+	if !disabled {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM disabled_users WHERE user = ?`, user); err != nil {
+			return errors.Wrap(err, "error enabling user")
+		}
+		return errors.Wrap(tx.Commit(), "error committing disable transaction")
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO disabled_users (user) VALUES (?) ON CONFLICT(user) DO NOTHING`, user); err != nil {
+		return errors.Wrap(err, "error disabling user")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing sessions from repository")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM challenges WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing challenges from repository")
+	}
+	return errors.Wrap(tx.Commit(), "error committing disable transaction")
+}
+
+// DeauthAll logs the user out of every session, and abandons their logins
+// awaiting a two-factor code. Their API keys remain valid.
+func (r *SQLiteRepository) DeauthAll(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting deauth transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM credentials WHERE user = ?)`, user).Scan(&exists); err != nil {
+		return errors.Wrap(err, "error reading credentials from repository")
+	}
+	if !exists {
+		return ErrUnknownUser
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing sessions from repository")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM challenges WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error removing challenges from repository")
+	}
+	return errors.Wrap(tx.Commit(), "error committing deauth transaction")
+}
+
+// Users returns up to limit users, sorted by name, after the given user,
+// which may be empty to start from the beginning.
+func (r *MemoryRepository) Users(ctx context.Context, after string, limit int) ([]UserSummary, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var names []string
+	for user := range r.creds {
+		if user > after {
+			names = append(names, user)
+		}
+	}
+	sort.Strings(names)
+	if len(names) > limit {
+		names = names[:limit]
+	}
+
+	var users []UserSummary
+	for _, user := range names {
+		s := UserSummary{
+			User:      user,
+			Role:      rbac.User,
+			Disabled:  r.disabled[user],
+			TwoFactor: r.totp[user].Enabled,
+		}
+		if role, ok := r.roles[user]; ok {
+			s.Role = role
+		}
+		s.Sessions = r.sessionsOf(user)
+		users = append(users, s)
+	}
+	return users, nil
+}
+
+// SetDisabled disables or enables the user. Disabled users are logged out,
+// and can't log in, or use their API keys, until they're enabled again.
+func (r *MemoryRepository) SetDisabled(ctx context.Context, user string, disabled bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	if !disabled {
+		delete(r.disabled, user)
+		return nil
+	}
+	r.disabled[user] = true
+	r.deauthAll(user)
+	return nil
+}
+
+// DeauthAll logs the user out of every session, and abandons their logins
+// awaiting a two-factor code. Their API keys remain valid.
+func (r *MemoryRepository) DeauthAll(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if _, ok := r.creds[user]; !ok {
+		return ErrUnknownUser
+	}
+	r.deauthAll(user)
+	return nil
+}
+
+// deauthAll ends the user's sessions, and removes their challenges. It must
+// be called with the mutex held.
+func (r *MemoryRepository) deauthAll(user string) {
+	r.endSessions(user)
+	for id, c := range r.challenges {
+		if c.User == user {
+			delete(r.challenges, id)
+		}
+	}
+}
+
+// Users returns up to limit users, sorted by name, after the given user,
+// which may be empty to start from the beginning.
+func (r *PostgresRepository) Users(ctx context.Context, after string, limit int) ([]UserSummary, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT c."user", r.role,
+			EXISTS (SELECT 1 FROM disabled_users WHERE "user" = c."user"),
+			(SELECT count(*) FROM sessions WHERE "user" = c."user"),
+			EXISTS (SELECT 1 FROM totp WHERE "user" = c."user" AND enabled)
+		FROM credentials c LEFT JOIN roles r ON r."user" = c."user"
+		WHERE c."user" COLLATE "C" > $1 ORDER BY c."user" COLLATE "C" LIMIT $2
+	`, after, limit)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading users from repository")
+	}
+	users, err := scanUserSummaries(rows)
+	return users, errors.Wrap(err, "error reading users from repository")
+}
+
+// SetDisabled disables or enables the user. Disabled users are logged out,
+// and can't log in, or use their API keys, until they're enabled again.
+func (r *PostgresRepository) SetDisabled(ctx context.Context, user string, disabled bool) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting disable transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM credentials WHERE "user" = $1)`, user).Scan(&exists); err != nil {
+		return errors.Wrap(err, "error reading credentials from repository")
+	}
+	if !exists {
+		return ErrUnknownUser
+	}
+	if !disabled {
+		if _, err := tx.ExecContext(ctx, `DELETE FROM disabled_users WHERE "user" = $1`, user); err != nil {
+			return errors.Wrap(err, "error enabling user")
+		}
+		return errors.Wrap(tx.Commit(), "error committing disable transaction")
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO disabled_users ("user") VALUES ($1) ON CONFLICT ("user") DO NOTHING`, user); err != nil {
+		return errors.Wrap(err, "error disabling user")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error removing sessions from repository")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM challenges WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error removing challenges from repository")
+	}
+	return errors.Wrap(tx.Commit(), "error committing disable transaction")
+}
+
+// DeauthAll logs the user out of every session, and abandons their logins
+// awaiting a two-factor code. Their API keys remain valid.
+func (r *PostgresRepository) DeauthAll(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting deauth transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM credentials WHERE "user" = $1)`, user).Scan(&exists); err != nil {
+		return errors.Wrap(err, "error reading credentials from repository")
+	}
+	if !exists {
+		return ErrUnknownUser
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM sessions WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error removing sessions from repository")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM challenges WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error removing challenges from repository")
+	}
+	return errors.Wrap(tx.Commit(), "error committing deauth transaction")
+}
+
+// scanUserSummaries reads rows of user, role, disabled, sessions, and
+// two-factor.
+func scanUserSummaries(rows *sql.Rows) ([]UserSummary, error) {
+	defer rows.Close()
+
+	var users []UserSummary
+	for rows.Next() {
+		var (
+			s    UserSummary
+			role sql.NullString
+		)
+		if err := rows.Scan(&s.User, &role, &s.Disabled, &s.Sessions, &s.TwoFactor); err != nil {
+			return nil, err
+		}
+		s.Role = roleOrDefault(role)
+		users = append(users, s)
+	}
+	return users, rows.Err()
+}
@@ -0,0 +1,134 @@
+// Package backup takes, verifies, and keeps scheduled backups of the
+// repositories of a service, and serves an admin API to take them on demand.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/pkg/errors"
+)
+
+// Backuper is implemented by repositories which can write a consistent
+// snapshot of themselves to a new file while they remain in use.
+type Backuper interface {
+	Backup(ctx context.Context, filename string) error
+}
+
+// Source is a repository to back up.
+type Source struct {
+	Name     string // e.g. "auth", used as the prefix of backup files
+	Backuper Backuper
+	Verify   func(ctx context.Context, filename string) error
+}
+
+// timeFormat sorts lexically in chronological order.
+const timeFormat = "20060102T150405.000Z"
+
+// Run backs up each source to a new file in dir, and verifies it. It
+// returns the names of the files, in the order of the sources. Backups
+// which fail verification are removed.
+func Run(ctx context.Context, dir string, sources ...Source) ([]string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrap(err, "error creating backup directory")
+	}
+
+	var (
+		now       = time.Now().UTC().Format(timeFormat)
+		filenames = make([]string, 0, len(sources))
+	)
+	for _, s := range sources {
+		filename := filepath.Join(dir, fmt.Sprintf("%s-%s.db", s.Name, now))
+		if err := s.Backuper.Backup(ctx, filename); err != nil {
+			return filenames, errors.Wrapf(err, "error backing up %s", s.Name)
+		}
+		if err := s.Verify(ctx, filename); err != nil {
+			os.Remove(filename)
+			return filenames, errors.Wrapf(err, "error verifying %s backup", s.Name)
+		}
+		filenames = append(filenames, filename)
+	}
+	return filenames, nil
+}
+
+// List returns the names of the backup files of the source in dir, oldest
+// first.
+func List(dir, name string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading backup directory")
+	}
+
+	var filenames []string
+	for _, info := range infos {
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		stamp := strings.TrimPrefix(info.Name(), name+"-")
+		if stamp == info.Name() || !strings.HasSuffix(stamp, ".db") {
+			continue
+		}
+		if _, err := time.Parse(timeFormat, strings.TrimSuffix(stamp, ".db")); err != nil {
+			continue // not one of ours
+		}
+		filenames = append(filenames, filepath.Join(dir, info.Name()))
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// Prune removes all but the newest keep backup files of each source in dir.
+// It returns the names of the removed files.
+func Prune(dir string, keep int, sources ...Source) ([]string, error) {
+	var removed []string
+	for _, s := range sources {
+		filenames, err := List(dir, s.Name)
+		if err != nil {
+			return removed, err
+		}
+		for len(filenames) > keep {
+			if err := os.Remove(filenames[0]); err != nil {
+				return removed, errors.Wrap(err, "error removing backup")
+			}
+			removed = append(removed, filenames[0])
+			filenames = filenames[1:]
+		}
+	}
+	return removed, nil
+}
+
+// Schedule runs backups of the sources to dir at every interval, keeping
+// the newest keep backups of each, until the context is canceled. Failures
+// are logged, and retried at the next interval. It's designed to be run as
+// a run.Group actor.
+func Schedule(ctx context.Context, dir string, interval time.Duration, keep int, logger log.Logger, sources ...Source) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			filenames, err := Run(ctx, dir, sources...)
+			if err != nil {
+				logger.Log("during", "backup", "err", err)
+				continue
+			}
+			removed, err := Prune(dir, keep, sources...)
+			if err != nil {
+				logger.Log("during", "prune", "err", err)
+			}
+			logger.Log("component", "backup", "created", strings.Join(filenames, ","), "removed", len(removed))
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunAndPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sources := []Source{
+		{Name: "a", Backuper: fileBackuper("a"), Verify: verifyContents("a")},
+		{Name: "b", Backuper: fileBackuper("b"), Verify: verifyContents("b")},
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		filenames, err := Run(ctx, dir, sources...)
+		if err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+		if want, have := 2, len(filenames); want != have {
+			t.Fatalf("Run: want %d files, have %d", want, have)
+		}
+		time.Sleep(2 * time.Millisecond) // backup files are named by time
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a-notes.db"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := List(dir, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 3, len(before); want != have {
+		t.Fatalf("List: want %d, have %d (%v)", want, have, before)
+	}
+
+	removed, err := Prune(dir, 1, sources...)
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+	if want, have := 4, len(removed); want != have {
+		t.Errorf("Prune: want %d removed, have %d", want, have)
+	}
+	after, err := List(dir, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []string{before[2]}, after; len(have) != 1 || want[0] != have[0] {
+		t.Errorf("List after Prune: want %v, have %v", want, have)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a-notes.db")); err != nil {
+		t.Errorf("Prune removed a file that isn't a backup: %v", err)
+	}
+}
+
+func TestRunVerifyFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := Source{Name: "a", Backuper: fileBackuper("corrupt"), Verify: verifyContents("a")}
+	if _, err := Run(context.Background(), dir, source); err == nil {
+		t.Fatalf("Run: want error, have none")
+	}
+	if filenames, _ := List(dir, "a"); len(filenames) != 0 {
+		t.Errorf("List after failed verification: want none, have %v", filenames)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	server := httptest.NewServer(NewHTTPServer(dir, 7, Source{Name: "a", Backuper: fileBackuper("a"), Verify: verifyContents("a")}))
+	defer server.Close()
+
+	resp, err := http.Post(server.URL+"/backups", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created map[string]string
+	json.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if want, have := http.StatusCreated, resp.StatusCode; want != have {
+		t.Fatalf("POST /backups: want %d, have %d", want, have)
+	}
+
+	resp, err = http.Get(server.URL + "/backups")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var listed map[string][]string
+	json.NewDecoder(resp.Body).Decode(&listed)
+	resp.Body.Close()
+	if want, have := []string{created["a"]}, listed["a"]; len(have) != 1 || want[0] != have[0] {
+		t.Errorf("GET /backups: want %v, have %v", want, have)
+	}
+}
+
+// fileBackuper writes its contents to the backup file.
+type fileBackuper string
+
+func (b fileBackuper) Backup(ctx context.Context, filename string) error {
+	return ioutil.WriteFile(filename, []byte(b), 0600)
+}
+
+func verifyContents(want string) func(context.Context, string) error {
+	return func(ctx context.Context, filename string) error {
+		have, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+		if string(have) != want {
+			return errors.New("corrupt backup")
+		}
+		return nil
+	}
+}
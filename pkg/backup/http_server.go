@@ -0,0 +1,87 @@
+package backup
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"sync"
+)
+
+// HTTPServer is the admin API for backups. It should only be reachable by
+// operators, e.g. by listening on a private address.
+type HTTPServer struct {
+	dir     string
+	keep    int
+	sources []Source
+	mtx     sync.Mutex // one backup at a time
+}
+
+// NewHTTPServer returns an HTTPServer which backs up the sources to dir,
+// keeping the newest keep backups of each.
+//
+//	POST /backups    take a backup of every source now
+//	GET  /backups    list the backups of every source
+func NewHTTPServer(dir string, keep int, sources ...Source) *HTTPServer {
+	return &HTTPServer{
+		dir:     dir,
+		keep:    keep,
+		sources: sources,
+	}
+}
+
+// ServeHTTP implements http.Handler.
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/backups" {
+		http.NotFound(w, r)
+		return
+	}
+	switch r.Method {
+	case "POST":
+		s.handleBackup(w, r)
+	case "GET":
+		s.handleList(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *HTTPServer) handleBackup(w http.ResponseWriter, r *http.Request) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	filenames, err := Run(r.Context(), s.dir, s.sources...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := Prune(s.dir, s.keep, s.sources...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := map[string]string{}
+	for i, filename := range filenames {
+		response[s.sources[i].Name] = filepath.Base(filename)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *HTTPServer) handleList(w http.ResponseWriter, r *http.Request) {
+	response := map[string][]string{}
+	for _, source := range s.sources {
+		filenames, err := List(s.dir, source.Name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response[source.Name] = []string{}
+		for _, filename := range filenames {
+			response[source.Name] = append(response[source.Name], filepath.Base(filename))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,260 @@
+package dna
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/audit"
+)
+
+// NewAuditedService returns a service which records every read of DNA, and
+// every change to DNA or to who may access it, to the audit log, with the
+// owner of the DNA and the outcome, and otherwise behaves like next. If an
+// event can't be recorded, the call fails, even though next may have done
+// it.
+func NewAuditedService(next Service, log *audit.Log) Service {
+	return auditedService{Service: next, log: log}
+}
+
+type auditedService struct {
+	Service
+	log *audit.Log
+}
+
+func (s auditedService) Add(ctx context.Context, user, token, sequence string) error {
+	err := s.Service.Add(ctx, user, token, sequence)
+	if rerr := s.log.Record(ctx, audit.NewEvent("dna.add", user, user, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Check(ctx context.Context, user, token, owner, subsequence string) error {
+	err := s.Service.Check(ctx, user, token, owner, subsequence)
+	e := audit.NewEvent("dna.check", user, owner, err)
+	if err == ErrSubsequenceNotFound {
+		e.Outcome = audit.Success // the check itself succeeded
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Slice(ctx context.Context, user, token string, start, end int, strand Strand, w io.Writer) error {
+	detail := fmt.Sprintf("region %d-%d", start, end)
+	aw := newAuditedWriter(ctx, s.log, w, audit.Event{Action: "dna.slice", User: user, Sample: user, Outcome: audit.Success, Detail: detail})
+	err := s.Service.Slice(ctx, user, token, start, end, strand, aw)
+	if aw.recorded && err == nil {
+		return nil
+	}
+	e := audit.NewEvent("dna.slice", user, user, err)
+	if err == nil {
+		e.Detail = detail
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Update(ctx context.Context, user, token, sequence string, version int) (newVersion int, err error) {
+	newVersion, err = s.Service.Update(ctx, user, token, sequence, version)
+	if rerr := s.log.Record(ctx, audit.NewEvent("dna.update", user, user, err)); rerr != nil {
+		return 0, rerr
+	}
+	return newVersion, err
+}
+
+func (s auditedService) Append(ctx context.Context, user, token, sequence string, version int) (newVersion int, err error) {
+	newVersion, err = s.Service.Append(ctx, user, token, sequence, version)
+	if rerr := s.log.Record(ctx, audit.NewEvent("dna.append", user, user, err)); rerr != nil {
+		return 0, rerr
+	}
+	return newVersion, err
+}
+
+func (s auditedService) Delete(ctx context.Context, user, token string, version int) error {
+	err := s.Service.Delete(ctx, user, token, version)
+	if rerr := s.log.Record(ctx, audit.NewEvent("dna.delete", user, user, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Diff(ctx context.Context, user, token, reference string) ([]Variant, error) {
+	variants, err := s.Service.Diff(ctx, user, token, reference)
+	e := audit.NewEvent("dna.diff", user, user, err)
+	if err == nil {
+		e.Detail = "reference " + reference
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return nil, rerr
+	}
+	return variants, err
+}
+
+func (s auditedService) Digest(ctx context.Context, user, token string, enzymes []string) (Digestion, error) {
+	d, err := s.Service.Digest(ctx, user, token, enzymes)
+	e := audit.NewEvent("dna.digest", user, user, err)
+	if err == nil {
+		e.Detail = "enzymes " + strings.Join(enzymes, ",")
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return Digestion{}, rerr
+	}
+	return d, err
+}
+
+func (s auditedService) SetTopology(ctx context.Context, user, token string, topology Topology, version int) (newVersion int, err error) {
+	newVersion, err = s.Service.SetTopology(ctx, user, token, topology, version)
+	if rerr := s.log.Record(ctx, audit.NewEvent("dna.set_topology", user, user, err)); rerr != nil {
+		return 0, rerr
+	}
+	return newVersion, err
+}
+
+func (s auditedService) Sample(ctx context.Context, user, token, owner string, w io.Writer) error {
+	aw := newAuditedWriter(ctx, s.log, w, audit.NewEvent("dna.sample", user, owner, nil))
+	err := s.Service.Sample(ctx, user, token, owner, aw)
+	if aw.recorded && err == nil {
+		return nil
+	}
+	if rerr := s.log.Record(ctx, audit.NewEvent("dna.sample", user, owner, err)); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Search(ctx context.Context, user, token, subsequence string) (owners []string, err error) {
+	owners, err = s.Service.Search(ctx, user, token, subsequence)
+	e := audit.NewEvent("dna.search", user, "", err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("owners matched: %d", len(owners))
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return nil, rerr
+	}
+	return owners, err
+}
+
+func (s auditedService) Share(ctx context.Context, user, token string, grant Grant) error {
+	err := s.Service.Share(ctx, user, token, grant)
+	e := audit.NewEvent("dna.share", user, user, err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("%s access for %s", grant.Access, describeGrantee(grant.Grantee, grant.Group))
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Unshare(ctx context.Context, user, token, grantee string, group bool) error {
+	err := s.Service.Unshare(ctx, user, token, grantee, group)
+	e := audit.NewEvent("dna.unshare", user, user, err)
+	if err == nil {
+		e.Detail = "no access for " + describeGrantee(grantee, group)
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) AddMember(ctx context.Context, user, token, group, member string) error {
+	err := s.Service.AddMember(ctx, user, token, group, member)
+	e := audit.NewEvent("dna.add_member", user, user, err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("%s joined group %s", member, group)
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) RemoveMember(ctx context.Context, user, token, group, member string) error {
+	err := s.Service.RemoveMember(ctx, user, token, group, member)
+	e := audit.NewEvent("dna.remove_member", user, user, err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("%s left group %s", member, group)
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return rerr
+	}
+	return err
+}
+
+func (s auditedService) Invite(ctx context.Context, user, token, invitee string, access Access, ttl time.Duration) (Invitation, error) {
+	inv, err := s.Service.Invite(ctx, user, token, invitee, access, ttl)
+	e := audit.NewEvent("dna.invite", user, user, err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("%s access for user %s", access, invitee)
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return Invitation{}, rerr
+	}
+	return inv, err
+}
+
+func (s auditedService) Accept(ctx context.Context, user, token, code string) (Invitation, error) {
+	inv, err := s.Service.Accept(ctx, user, token, code)
+	e := audit.NewEvent("dna.accept", user, inv.Owner, err)
+	if err == nil {
+		e.Detail = fmt.Sprintf("%s access", inv.Access)
+	}
+	if rerr := s.log.Record(ctx, e); rerr != nil {
+		return Invitation{}, rerr
+	}
+	return inv, err
+}
+
+// AuditedExport returns a function which exports everything the repository
+// holds about a user, for a subject access request, and records the read
+// to the audit log. If the event can't be recorded, nothing is returned.
+func AuditedExport(repo Repository, log *audit.Log) func(ctx context.Context, user string) (*UserData, error) {
+	return func(ctx context.Context, user string) (*UserData, error) {
+		data, err := repo.Export(ctx, user)
+		if rerr := log.Record(ctx, audit.NewEvent("dna.export", user, user, err)); rerr != nil {
+			return nil, rerr
+		}
+		return data, err
+	}
+}
+
+// auditedWriter records a successful read before the first write to w, so
+// that no DNA is written unless the read is recorded. If the read fails
+// after that, the failure is recorded too.
+type auditedWriter struct {
+	ctx      context.Context
+	log      *audit.Log
+	w        io.Writer
+	e        audit.Event
+	recorded bool
+}
+
+func newAuditedWriter(ctx context.Context, log *audit.Log, w io.Writer, e audit.Event) *auditedWriter {
+	return &auditedWriter{ctx: ctx, log: log, w: w, e: e}
+}
+
+func (w *auditedWriter) Write(p []byte) (int, error) {
+	if !w.recorded {
+		if err := w.log.Record(w.ctx, w.e); err != nil {
+			return 0, err
+		}
+		w.recorded = true
+	}
+	return w.w.Write(p)
+}
+
+// describeGrantee describes the grantee of a grant, in audit events.
+func describeGrantee(name string, group bool) string {
+	if group {
+		return "group " + name
+	}
+	return "user " + name
+}
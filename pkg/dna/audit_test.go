@@ -0,0 +1,140 @@
+package dna
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/peterbourgon/gattaca/pkg/audit"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestAuditedService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := audit.NewFileSink(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := audit.NewLog(context.Background(), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx   = audit.ContextWithClientIP(context.Background(), "192.0.2.1")
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("ann", "a", "bob", "b", "ana", "c")
+		s     = NewAuditedService(NewDefaultService(repo, valid), l)
+	)
+	valid.roles["ana"] = rbac.Analyst
+
+	if err := s.Add(ctx, "ann", "a", "gattaca"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Check(ctx, "ann", "a", "ann", "ccc"); err != ErrSubsequenceNotFound {
+		t.Fatalf("Check: want %v, have %v", ErrSubsequenceNotFound, err)
+	}
+	if err := s.Check(ctx, "bob", "b", "ann", "gat"); err != ErrForbidden {
+		t.Fatalf("Check another's: want %v, have %v", ErrForbidden, err)
+	}
+	if err := s.Sample(ctx, "bob", "b", "ann", ioutil.Discard); err != ErrForbidden {
+		t.Fatalf("Sample another's: want %v, have %v", ErrForbidden, err)
+	}
+	if _, err := s.Search(ctx, "ana", "c", "gat"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Slice(ctx, "ann", "a", 0, 4, Forward, ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Append(ctx, "ann", "a", "ca", 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Share(ctx, "ann", "a", Grant{Grantee: "bob", Access: ReadAccess}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Sample(ctx, "bob", "b", "ann", ioutil.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unshare(ctx, "ann", "a", "bob", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AuditedExport(repo, l)(ctx, "ann"); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := l.Events(ctx, audit.Filter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []audit.Event{
+		{Action: "dna.add", User: "ann", Sample: "ann", Outcome: audit.Success},
+		{Action: "dna.check", User: "ann", Sample: "ann", Outcome: audit.Success, Detail: ErrSubsequenceNotFound.Error()},
+		{Action: "dna.check", User: "bob", Sample: "ann", Outcome: audit.Failure, Detail: ErrForbidden.Error()},
+		{Action: "dna.sample", User: "bob", Sample: "ann", Outcome: audit.Failure, Detail: ErrForbidden.Error()},
+		{Action: "dna.search", User: "ana", Outcome: audit.Success, Detail: "owners matched: 1"},
+		{Action: "dna.slice", User: "ann", Sample: "ann", Outcome: audit.Success, Detail: "region 0-4"},
+		{Action: "dna.append", User: "ann", Sample: "ann", Outcome: audit.Success},
+		{Action: "dna.share", User: "ann", Sample: "ann", Outcome: audit.Success, Detail: "read access for user bob"},
+		{Action: "dna.sample", User: "bob", Sample: "ann", Outcome: audit.Success},
+		{Action: "dna.unshare", User: "ann", Sample: "ann", Outcome: audit.Success, Detail: "no access for user bob"},
+		{Action: "dna.export", User: "ann", Sample: "ann", Outcome: audit.Success},
+	}
+	if len(want) != len(events) {
+		t.Fatalf("want %d events, have %d", len(want), len(events))
+	}
+	for i, e := range events {
+		want[i].IP = "192.0.2.1"
+		e.Seq, e.Time, e.PrevHash, e.Hash = 0, want[i].Time, "", ""
+		if want, have := want[i], e; want != have {
+			t.Errorf("event %d: want %+v, have %+v", i+1, want, have)
+		}
+	}
+}
+
+func TestAuditedServiceRecordsBeforeWriting(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sink, err := audit.NewFileSink(filepath.Join(dir, "audit.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := audit.NewLog(context.Background(), sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx   = context.Background()
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("ann", "a")
+		s     = NewAuditedService(NewDefaultService(repo, valid), l)
+	)
+	if err := s.Add(ctx, "ann", "a", "gattaca"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once events can't be recorded, no DNA is written.
+	sink.Close()
+	var buf bytes.Buffer
+	if err := s.Sample(ctx, "ann", "a", "ann", &buf); err == nil {
+		t.Errorf("Sample: want error, have none")
+	}
+	if err := s.Slice(ctx, "ann", "a", 0, 4, Forward, &buf); err == nil {
+		t.Errorf("Slice: want error, have none")
+	}
+	if want, have := "", buf.String(); want != have {
+		t.Errorf("want %q written, have %q", want, have)
+	}
+}
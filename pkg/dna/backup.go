@@ -0,0 +1,279 @@
+package dna
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
+	"github.com/peterbourgon/gattaca/pkg/internal/sqlitebackup"
+	"github.com/pkg/errors"
+)
+
+// Backup writes a consistent snapshot of the repository to a new backup
+// file, with the SQLite online backup API. The repository remains usable
+// throughout.
+func (r *SQLiteRepository) Backup(ctx context.Context, filename string) error {
+	return sqlitebackup.ToFile(ctx, r.rdb, filename)
+}
+
+// Backup writes a snapshot of the repository to a new backup file.
+// Deleted sequences which haven't been purged are included.
+func (r *MemoryRepository) Backup(ctx context.Context, filename string) error {
+	r.mtx.Lock()
+	rows := make([]backupRow, 0, len(r.sequences))
+	for user, s := range r.sequences {
+		row := backupRow{user: user, sequence: s.sequence, version: s.version, topology: s.topology}
+		if !s.deleted.IsZero() {
+			row.deleted = sql.NullInt64{Int64: s.deleted.Unix(), Valid: true}
+		}
+		rows = append(rows, row)
+	}
+	var sharing backupSharing
+	for owner, acl := range r.grants {
+		for k, access := range acl {
+			sharing.grants = append(sharing.grants, backupGrant{owner, Grant{Grantee: k.grantee, Group: k.group, Access: access}})
+		}
+	}
+	for group, owner := range r.groups {
+		sharing.groups = append(sharing.groups, [2]string{group, owner})
+		for member := range r.members[group] {
+			sharing.members = append(sharing.members, [2]string{group, member})
+		}
+	}
+	for _, inv := range r.invitations {
+		sharing.invitations = append(sharing.invitations, inv)
+	}
+	r.mtx.Unlock()
+
+	return writeBackup(ctx, filename, rows, sharing)
+}
+
+// Backup writes a consistent snapshot of the repository to a new backup
+// file, reading from a single read-only transaction. Deleted sequences
+// which haven't been purged are included.
+func (r *PostgresRepository) Backup(ctx context.Context, filename string) error {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return errors.Wrap(err, "error starting backup transaction")
+	}
+	defer tx.Rollback() // read-only
+
+	rows, err := tx.QueryContext(ctx, `SELECT "user", sequence, version, deleted, topology FROM dna`)
+	if err != nil {
+		return errors.Wrap(err, "error reading sequences")
+	}
+	defer rows.Close()
+
+	var snapshot []backupRow
+	for rows.Next() {
+		var row backupRow
+		if err := rows.Scan(&row.user, &row.sequence, &row.version, &row.deleted, &row.topology); err != nil {
+			return errors.Wrap(err, "error reading sequences")
+		}
+		snapshot = append(snapshot, row)
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error reading sequences")
+	}
+
+	sharing, err := readSharing(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	return writeBackup(ctx, filename, snapshot, sharing)
+}
+
+// readSharing reads every grant, group, and invitation in the transaction.
+func readSharing(ctx context.Context, tx *sql.Tx) (sharing backupSharing, err error) {
+	if err := query(ctx, tx, func(rows *sql.Rows) error {
+		var g backupGrant
+		if err := rows.Scan(&g.owner, &g.Grantee, &g.Group, &g.Access); err != nil {
+			return err
+		}
+		sharing.grants = append(sharing.grants, g)
+		return nil
+	}, `SELECT owner, grantee, is_group, access FROM grants`); err != nil {
+		return backupSharing{}, errors.Wrap(err, "error reading grants")
+	}
+	if err := query(ctx, tx, func(rows *sql.Rows) error {
+		var pair [2]string
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			return err
+		}
+		sharing.groups = append(sharing.groups, pair)
+		return nil
+	}, `SELECT name, owner FROM share_groups`); err != nil {
+		return backupSharing{}, errors.Wrap(err, "error reading groups")
+	}
+	if err := query(ctx, tx, func(rows *sql.Rows) error {
+		var pair [2]string
+		if err := rows.Scan(&pair[0], &pair[1]); err != nil {
+			return err
+		}
+		sharing.members = append(sharing.members, pair)
+		return nil
+	}, `SELECT name, member FROM share_members`); err != nil {
+		return backupSharing{}, errors.Wrap(err, "error reading group members")
+	}
+	if err := query(ctx, tx, func(rows *sql.Rows) error {
+		var (
+			inv     Invitation
+			expires int64
+		)
+		if err := rows.Scan(&inv.Code, &inv.Owner, &inv.Invitee, &inv.Access, &expires); err != nil {
+			return err
+		}
+		inv.Expires = time.Unix(expires, 0)
+		sharing.invitations = append(sharing.invitations, inv)
+		return nil
+	}, `SELECT code, owner, invitee, access, expires FROM invitations`); err != nil {
+		return backupSharing{}, errors.Wrap(err, "error reading invitations")
+	}
+	return sharing, nil
+}
+
+// VerifyBackup checks that the file is an intact backup, which can be
+// restored by this version of the package. Backups are SQLite DB files with
+// the schema of SQLiteRepository, whichever repository they were taken from.
+func VerifyBackup(ctx context.Context, filename string) error {
+	db, err := sqlitebackup.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if err := sqlitebackup.Check(ctx, db); err != nil {
+		return err
+	}
+	version, err := migrate.Current(ctx, db, sqliteMigrations)
+	if err != nil {
+		return errors.Wrap(err, "error reading schema version")
+	}
+	if version == 0 {
+		return errors.Errorf("%s isn't a DNA backup", filename)
+	}
+	return nil
+}
+
+// RestoreBackup verifies the backup file, and restores it into the SQLite
+// DB represented by URN, which must be fresh, i.e. have no tables. The DB
+// is then migrated to the latest schema version.
+func RestoreBackup(ctx context.Context, filename, urn string) error {
+	if urn == "memory:" || strings.HasPrefix(urn, "postgres://") || strings.HasPrefix(urn, "postgresql://") {
+		return errors.New("backups can only be restored into SQLite")
+	}
+	if err := VerifyBackup(ctx, filename); err != nil {
+		return errors.Wrap(err, "error verifying backup")
+	}
+
+	src, err := sqlitebackup.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return errors.Wrap(err, "error opening DB")
+	}
+	defer dst.Close()
+
+	if empty, err := sqlitebackup.Empty(ctx, dst); err != nil {
+		return err
+	} else if !empty {
+		return errors.New("refusing to restore into a DB which already has tables")
+	}
+	if err := sqlitebackup.Copy(ctx, dst, src); err != nil {
+		return errors.Wrap(err, "error restoring backup")
+	}
+	if _, _, err := migrate.Migrate(ctx, dst, sqliteMigrations, -1); err != nil {
+		return errors.Wrap(err, "error migrating restored DB")
+	}
+	return nil
+}
+
+type backupRow struct {
+	user     string
+	sequence string
+	version  int
+	deleted  sql.NullInt64 // Unix time
+	topology Topology
+}
+
+// backupSharing is every grant, group, and invitation in a repository.
+type backupSharing struct {
+	grants      []backupGrant
+	groups      [][2]string // name, owner
+	members     [][2]string // name, member
+	invitations []Invitation
+}
+
+type backupGrant struct {
+	owner string
+	Grant
+}
+
+// writeBackup writes the rows, and what they're shared with, to a new
+// backup file.
+func writeBackup(ctx context.Context, filename string, rows []backupRow, sharing backupSharing) (err error) {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return errors.Errorf("%s already exists", filename)
+	}
+
+	r, err := NewSQLiteRepository("file:" + filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		r.db.Close()
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting backup transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	for _, row := range rows {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO dna (user, sequence, version, deleted, topology) VALUES (?, ?, ?, ?, ?)`,
+			row.user, row.sequence, row.version, row.deleted, string(row.topology),
+		); err != nil {
+			return errors.Wrap(err, "error writing sequences")
+		}
+	}
+	for _, g := range sharing.grants {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO grants (owner, grantee, is_group, access) VALUES (?, ?, ?, ?)`,
+			g.owner, g.Grantee, g.Group, string(g.Access),
+		); err != nil {
+			return errors.Wrap(err, "error writing grants")
+		}
+	}
+	for _, pair := range sharing.groups {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO share_groups (name, owner) VALUES (?, ?)`, pair[0], pair[1]); err != nil {
+			return errors.Wrap(err, "error writing groups")
+		}
+	}
+	for _, pair := range sharing.members {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO share_members (name, member) VALUES (?, ?)`, pair[0], pair[1]); err != nil {
+			return errors.Wrap(err, "error writing group members")
+		}
+	}
+	for _, inv := range sharing.invitations {
+		if _, err := tx.ExecContext(ctx,
+			`INSERT INTO invitations (code, owner, invitee, access, expires) VALUES (?, ?, ?, ?, ?)`,
+			inv.Code, inv.Owner, inv.Invitee, string(inv.Access), inv.Expires.Unix(),
+		); err != nil {
+			return errors.Wrap(err, "error writing invitations")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing backup")
+}
@@ -0,0 +1,200 @@
+package dna
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackupSQLite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewSQLiteRepository("file:"+filepath.Join(dir, "dna.db"),
+		WithJournalMode("WAL"),
+		WithBusyTimeout(5*time.Second),
+		WithReadPool(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	if err := r.Insert(ctx, "alpha", "ACGT"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep writing throughout the backup.
+	var (
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := r.Insert(ctx, fmt.Sprintf("user-%d", i), "GATTACA"); err != nil {
+				t.Errorf("Insert during backup: %v", err)
+				return
+			}
+		}
+	}()
+
+	filename := filepath.Join(dir, "backup.db")
+	err = r.Backup(ctx, filename)
+	close(done)
+	wg.Wait()
+	if err != nil {
+		t.Fatalf("Backup: %v", err)
+	}
+
+	if want, have := error(nil), VerifyBackup(ctx, filename); want != have {
+		t.Fatalf("VerifyBackup: want %v, have %v", want, have)
+	}
+	if err := r.Backup(ctx, filename); err == nil {
+		t.Errorf("Backup to existing file: want error, have none")
+	}
+
+	restored := "file:" + filepath.Join(dir, "restored.db")
+	if want, have := error(nil), RestoreBackup(ctx, filename, restored); want != have {
+		t.Fatalf("RestoreBackup: want %v, have %v", want, have)
+	}
+	rr, err := NewSQLiteRepository(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence, err := rr.Select(ctx, "alpha"); err != nil || sequence != "ACGT" {
+		t.Errorf("Select after restore: want %q, have %q (%v)", "ACGT", sequence, err)
+	}
+}
+
+func TestBackupMemory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var (
+		ctx = context.Background()
+		r   = NewMemoryRepository()
+	)
+	if err := r.Insert(ctx, "alpha", "ACGT"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.SetTopology(ctx, "alpha", Circular, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Insert(ctx, "beta", "GATTACA"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete(ctx, "beta", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "backup.db")
+	if want, have := error(nil), r.Backup(ctx, filename); want != have {
+		t.Fatalf("Backup: want %v, have %v", want, have)
+	}
+
+	restored := "file:" + filepath.Join(dir, "restored.db")
+	if want, have := error(nil), RestoreBackup(ctx, filename, restored); want != have {
+		t.Fatalf("RestoreBackup: want %v, have %v", want, have)
+	}
+	rr, err := NewSQLiteRepository(restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, err := rr.Version(ctx, "alpha"); err != nil || version != 2 {
+		t.Errorf("Version after restore: want %d, have %d (%v)", 2, version, err)
+	}
+	if topology, err := rr.Topology(ctx, "alpha"); err != nil || topology != Circular {
+		t.Errorf("Topology after restore: want %v, have %v (%v)", Circular, topology, err)
+	}
+	if _, err := rr.Select(ctx, "beta"); err != ErrInvalidUser {
+		t.Errorf("Select deleted after restore: want %v, have %v", ErrInvalidUser, err)
+	}
+	if n, err := rr.Purge(ctx, time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("Purge after restore: want %d, have %d (%v)", 1, n, err)
+	}
+}
+
+func TestRestoreBackupNotEmpty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ctx := context.Background()
+	filename := filepath.Join(dir, "backup.db")
+	if err := NewMemoryRepository().Backup(ctx, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	existing := "file:" + filepath.Join(dir, "existing.db")
+	r, err := NewSQLiteRepository(existing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Insert(ctx, "alpha", "ACGT"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RestoreBackup(ctx, filename, existing); err == nil {
+		t.Fatalf("RestoreBackup into existing DB: want error, have none")
+	}
+	if sequence, err := r.Select(ctx, "alpha"); err != nil || sequence != "ACGT" {
+		t.Errorf("Select after refused restore: want %q, have %q (%v)", "ACGT", sequence, err)
+	}
+	if err := RestoreBackup(ctx, filename, "memory:"); err == nil {
+		t.Errorf("RestoreBackup into memory: want error, have none")
+	}
+}
+
+func TestVerifyBackupInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	garbage := filepath.Join(dir, "garbage.db")
+	if err := ioutil.WriteFile(garbage, []byte("this is not a SQLite DB"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	other := filepath.Join(dir, "other.db")
+	db, err := sql.Open("sqlite3", "file:"+other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE TABLE t (a INTEGER)`); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	for name, filename := range map[string]string{
+		"missing":    filepath.Join(dir, "missing.db"),
+		"garbage":    garbage,
+		"not backup": other,
+	} {
+		if err := VerifyBackup(context.Background(), filename); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package dna
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnknownEnzyme is returned by Digest for an enzyme not in the catalogue.
+var ErrUnknownEnzyme = errors.New("unknown enzyme")
+
+// Enzyme is a restriction enzyme. Site is its recognition sequence in IUPAC
+// notation, 5' to 3' on the top strand. Cut and ComplementCut are where it
+// cuts the top and bottom strands, as offsets from the start of the site in
+// top strand coordinates, as in REBASE: EcoRI, G^AATTC, cuts at 1 and 5.
+// Cuts may fall outside of the site, e.g. BsaI, GGTCTC(1/5), cuts at 7 and
+// 11.
+type Enzyme struct {
+	Name          string
+	Site          string
+	Cut           int
+	ComplementCut int
+}
+
+// Enzymes is the built-in catalogue of restriction enzymes, by name.
+var Enzymes = map[string]Enzyme{}
+
+func init() {
+	for _, e := range []Enzyme{
+		{"AluI", "AGCT", 2, 2},
+		{"ApoI", "RAATTY", 1, 5},
+		{"AvaI", "CYCGRG", 1, 5},
+		{"BamHI", "GGATCC", 1, 5},
+		{"BglII", "AGATCT", 1, 5},
+		{"BsaI", "GGTCTC", 7, 11},
+		{"BsmBI", "CGTCTC", 7, 11},
+		{"BstNI", "CCWGG", 2, 3},
+		{"DpnII", "GATC", 0, 4},
+		{"EcoRI", "GAATTC", 1, 5},
+		{"EcoRV", "GATATC", 3, 3},
+		{"HaeIII", "GGCC", 2, 2},
+		{"HincII", "GTYRAC", 3, 3},
+		{"HindIII", "AAGCTT", 1, 5},
+		{"HinfI", "GANTC", 1, 4},
+		{"KpnI", "GGTACC", 5, 1},
+		{"MboI", "GATC", 0, 4},
+		{"NcoI", "CCATGG", 1, 5},
+		{"NdeI", "CATATG", 2, 4},
+		{"NotI", "GCGGCCGC", 2, 6},
+		{"PstI", "CTGCAG", 5, 1},
+		{"SacI", "GAGCTC", 5, 1},
+		{"SalI", "GTCGAC", 1, 5},
+		{"Sau3AI", "GATC", 0, 4},
+		{"SfiI", "GGCCNNNNNGGCC", 8, 5},
+		{"SmaI", "CCCGGG", 3, 3},
+		{"SpeI", "ACTAGT", 1, 5},
+		{"StyI", "CCWWGG", 1, 5},
+		{"TaqI", "TCGA", 1, 3},
+		{"XbaI", "TCTAGA", 1, 5},
+		{"XhoI", "CTCGAG", 1, 5},
+	} {
+		Enzymes[e.Name] = e
+	}
+}
+
+// Cut is a position where an enzyme cuts the top strand of a sequence,
+// i.e. between the bases at Position-1 and Position.
+type Cut struct {
+	Enzyme   string
+	Position int
+}
+
+// Digestion is the result of digesting a sequence with some enzymes.
+type Digestion struct {
+	Cuts      []Cut // ordered by position
+	Fragments []int // lengths, from the start of the sequence, or first cut if circular
+}
+
+// digest simulates cutting sequence with the enzymes. If circular is true,
+// sites spanning the origin are found, and the fragment spanning the
+// origin is reported last.
+func digest(sequence string, enzymes []Enzyme, circular bool) Digestion {
+	var cuts []Cut
+	for _, e := range enzymes {
+		for _, position := range cutPositions(sequence, e, circular) {
+			cuts = append(cuts, Cut{Enzyme: e.Name, Position: position})
+		}
+	}
+	sort.SliceStable(cuts, func(i, j int) bool { return cuts[i].Position < cuts[j].Position })
+
+	// Enzymes with the same cut position yield a single cut.
+	var positions []int
+	for _, c := range cuts {
+		if len(positions) == 0 || positions[len(positions)-1] != c.Position {
+			positions = append(positions, c.Position)
+		}
+	}
+
+	var fragments []int
+	switch {
+	case len(positions) == 0:
+		fragments = []int{len(sequence)}
+	case circular:
+		for i := 1; i < len(positions); i++ {
+			fragments = append(fragments, positions[i]-positions[i-1])
+		}
+		fragments = append(fragments, len(sequence)-positions[len(positions)-1]+positions[0])
+	default:
+		prev := 0
+		for _, position := range positions {
+			fragments = append(fragments, position-prev)
+			prev = position
+		}
+		fragments = append(fragments, len(sequence)-prev)
+	}
+
+	return Digestion{Cuts: cuts, Fragments: fragments}
+}
+
+// cutPositions returns the top strand cut positions of the enzyme in the
+// sequence. Sites that aren't palindromic are searched for on both strands.
+func cutPositions(sequence string, e Enzyme, circular bool) []int {
+	var (
+		n        = len(sequence)
+		site     = strings.ToLower(e.Site)
+		rcsite   = reverseComplementIUPAC(site)
+		width    = len(site)
+		haystack = sequence
+	)
+	if circular {
+		// Sites may span the origin; cuts are then wrapped around.
+		haystack = circularize(sequence, width-1)
+	}
+
+	var positions []int
+	add := func(position int) {
+		if circular && n > 0 {
+			positions = append(positions, ((position%n)+n)%n)
+		} else if position > 0 && position < n {
+			positions = append(positions, position) // a cut at either end doesn't cut
+		}
+	}
+	for i := 0; i+width <= len(haystack) && i < n; i++ {
+		window := haystack[i : i+width]
+		if matchIUPAC(site, window) {
+			add(i + e.Cut)
+		}
+		if rcsite != site && matchIUPAC(rcsite, window) {
+			// The enzyme's bottom strand cut is our top strand cut.
+			add(i + width - e.ComplementCut)
+		}
+	}
+	return positions
+}
+
+// iupac maps IUPAC nucleotide codes to the bases they match.
+var iupac = map[byte]string{
+	'a': "a", 'c': "c", 'g': "g", 't': "t",
+	'r': "ag", 'y': "ct", 's': "cg", 'w': "at", 'k': "gt", 'm': "ac",
+	'b': "cgt", 'd': "agt", 'h': "act", 'v': "acg",
+	'n': "acgt",
+}
+
+// iupacComplement maps IUPAC nucleotide codes to their complements.
+var iupacComplement = map[byte]byte{
+	'a': 't', 'c': 'g', 'g': 'c', 't': 'a',
+	'r': 'y', 'y': 'r', 's': 's', 'w': 'w', 'k': 'm', 'm': 'k',
+	'b': 'v', 'd': 'h', 'h': 'd', 'v': 'b',
+	'n': 'n',
+}
+
+func matchIUPAC(pattern, bases string) bool {
+	for i := 0; i < len(pattern); i++ {
+		if !strings.ContainsRune(iupac[pattern[i]], rune(bases[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func reverseComplementIUPAC(pattern string) string {
+	p := make([]byte, len(pattern))
+	for i := 0; i < len(pattern); i++ {
+		p[len(p)-1-i] = iupacComplement[pattern[i]]
+	}
+	return string(p)
+}
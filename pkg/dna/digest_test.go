@@ -0,0 +1,118 @@
+package dna
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestDigest(t *testing.T) {
+	for _, testcase := range []struct {
+		name      string
+		sequence  string
+		enzymes   []string
+		circular  bool
+		cuts      []Cut
+		fragments []int
+	}{
+		{
+			name:      "no sites",
+			sequence:  "aaaaaaaaaa",
+			enzymes:   []string{"EcoRI"},
+			fragments: []int{10},
+		},
+		{
+			name:      "EcoRI",
+			sequence:  "ccgaattcgg",
+			enzymes:   []string{"EcoRI"},
+			cuts:      []Cut{{"EcoRI", 3}},
+			fragments: []int{3, 7},
+		},
+		{
+			name:      "EcoRI and BamHI",
+			sequence:  "ccgaattcggggatccaa",
+			enzymes:   []string{"BamHI", "EcoRI"},
+			cuts:      []Cut{{"EcoRI", 3}, {"BamHI", 11}},
+			fragments: []int{3, 8, 7},
+		},
+		{
+			name:      "ambiguous site",
+			sequence:  "ttgactctt",
+			enzymes:   []string{"HinfI"},
+			cuts:      []Cut{{"HinfI", 3}},
+			fragments: []int{3, 6},
+		},
+		{
+			name:      "non-palindromic site, top strand",
+			sequence:  "ggtctcaaaaaaaa",
+			enzymes:   []string{"BsaI"},
+			cuts:      []Cut{{"BsaI", 7}},
+			fragments: []int{7, 7},
+		},
+		{
+			name:      "non-palindromic site, bottom strand",
+			sequence:  "cccccccccagagacctt",
+			enzymes:   []string{"BsaI"},
+			cuts:      []Cut{{"BsaI", 5}},
+			fragments: []int{5, 13},
+		},
+		{
+			name:      "site spanning origin, linear",
+			sequence:  "aattcccccg",
+			enzymes:   []string{"EcoRI"},
+			fragments: []int{10},
+		},
+		{
+			name:      "site spanning origin, circular",
+			sequence:  "aattcccccg",
+			enzymes:   []string{"EcoRI"},
+			circular:  true,
+			cuts:      []Cut{{"EcoRI", 0}},
+			fragments: []int{10},
+		},
+		{
+			name:      "two sites, circular",
+			sequence:  "aattcccgaattcccccg",
+			enzymes:   []string{"EcoRI"},
+			circular:  true,
+			cuts:      []Cut{{"EcoRI", 0}, {"EcoRI", 8}},
+			fragments: []int{8, 10},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			var (
+				repo  = NewMemoryRepository()
+				valid = newMockValidator("vincent", "some_token")
+				s     = NewDefaultService(repo, valid)
+			)
+			repo.Insert(context.Background(), "vincent", testcase.sequence)
+			if testcase.circular {
+				repo.SetTopology(context.Background(), "vincent", Circular, 0)
+			}
+
+			d, err := s.Digest(context.Background(), "vincent", "some_token", testcase.enzymes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, have := testcase.cuts, d.Cuts; !reflect.DeepEqual(want, have) {
+				t.Errorf("cuts: want %v, have %v", want, have)
+			}
+			if want, have := testcase.fragments, d.Fragments; !reflect.DeepEqual(want, have) {
+				t.Errorf("fragments: want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestDigestUnknownEnzyme(t *testing.T) {
+	var (
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("vincent", "some_token")
+		s     = NewDefaultService(repo, valid)
+	)
+	repo.Insert(context.Background(), "vincent", "gattaca")
+
+	if _, err := s.Digest(context.Background(), "vincent", "some_token", []string{"EcoRI", "FooI"}); err != ErrUnknownEnzyme {
+		t.Errorf("want %v, have %v", ErrUnknownEnzyme, err)
+	}
+}
@@ -0,0 +1,609 @@
+// Package dnatest provides a conformance suite for implementations of
+// dna.Repository, so that third-party backends can be checked against the
+// behavior of the built-in ones.
+package dnatest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/pkg/errors"
+)
+
+// Concurrency is the number of goroutines used by the concurrent tests.
+// Implementations must tolerate at least this many simultaneous callers.
+var Concurrency = 8
+
+// TestRepository runs the conformance suite against r, which should be
+// empty, and usable only by the suite for the duration of the test.
+//
+//	func TestMyRepository(t *testing.T) {
+//		r := newMyRepository(t)
+//		dnatest.TestRepository(t, r)
+//	}
+func TestRepository(t *testing.T, r dna.Repository) {
+	t.Run("Insert", func(t *testing.T) { testInsert(t, r) })
+	t.Run("MissingUser", func(t *testing.T) { testMissingUser(t, r) })
+	t.Run("SelectRange", func(t *testing.T) { testSelectRange(t, r) })
+	t.Run("Writes", func(t *testing.T) { testWrites(t, r) })
+	t.Run("Topology", func(t *testing.T) { testTopology(t, r) })
+	t.Run("ConcurrentWrites", func(t *testing.T) { testConcurrentWrites(t, r) })
+	t.Run("Cancel", func(t *testing.T) { testCancel(t, r) })
+	t.Run("ExportAndErase", func(t *testing.T) { testExportAndErase(t, r) })
+	t.Run("Users", func(t *testing.T) { testUsers(t, r) })
+	t.Run("Sharing", func(t *testing.T) { testSharing(t, r) })
+	t.Run("DeleteAndPurge", func(t *testing.T) { testDeleteAndPurge(t, r) }) // last, as it purges everything deleted
+}
+
+func testInsert(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if want, have := error(nil), r.Insert(ctx, "insert", "gattaca"); want != have {
+		t.Fatalf("Insert: want %v, have %v", want, have)
+	}
+	if want, have := dna.ErrSequenceExists, r.Insert(ctx, "insert", "gattaca"); want != have {
+		t.Errorf("Insert duplicate: want %v, have %v", want, have)
+	}
+	if want, have := dna.ErrSequenceExists, r.Insert(ctx, "insert", "cat"); want != have {
+		t.Errorf("Insert duplicate with other sequence: want %v, have %v", want, have)
+	}
+
+	// The duplicate doesn't change anything.
+	if sequence, err := r.Select(ctx, "insert"); err != nil || sequence != "gattaca" {
+		t.Errorf("Select: want %q, have %q (%v)", "gattaca", sequence, err)
+	}
+	if version, err := r.Version(ctx, "insert"); err != nil || version != 1 {
+		t.Errorf("Version: want %d, have %d (%v)", 1, version, err)
+	}
+	if topology, err := r.Topology(ctx, "insert"); err != nil || topology != dna.Linear {
+		t.Errorf("Topology: want %v, have %v (%v)", dna.Linear, topology, err)
+	}
+
+	// Users are case sensitive, and empty sequences are fine.
+	if want, have := error(nil), r.Insert(ctx, "INSERT", ""); want != have {
+		t.Errorf("Insert with different case: want %v, have %v", want, have)
+	}
+	if length, err := r.Length(ctx, "INSERT"); err != nil || length != 0 {
+		t.Errorf("Length of empty sequence: want %d, have %d (%v)", 0, length, err)
+	}
+}
+
+func testMissingUser(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if _, err := r.Select(ctx, "nobody"); err != dna.ErrInvalidUser {
+		t.Errorf("Select: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.SelectRange(ctx, "nobody", 0, 1); err != dna.ErrInvalidUser {
+		t.Errorf("SelectRange: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Length(ctx, "nobody"); err != dna.ErrInvalidUser {
+		t.Errorf("Length: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Version(ctx, "nobody"); err != dna.ErrInvalidUser {
+		t.Errorf("Version: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Topology(ctx, "nobody"); err != dna.ErrInvalidUser {
+		t.Errorf("Topology: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Update(ctx, "nobody", "cat", 0); err != dna.ErrInvalidUser {
+		t.Errorf("Update: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Append(ctx, "nobody", "cat", 0, 0); err != dna.ErrInvalidUser {
+		t.Errorf("Append: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.SetTopology(ctx, "nobody", dna.Circular, 0); err != dna.ErrInvalidUser {
+		t.Errorf("SetTopology: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if err := r.Delete(ctx, "nobody", 0); err != dna.ErrInvalidUser {
+		t.Errorf("Delete: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+}
+
+func testSelectRange(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if err := r.Insert(ctx, "range", "gattaca"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	for _, testcase := range []struct {
+		start, end int
+		want       string
+	}{
+		{0, 7, "gattaca"},
+		{1, 4, "att"},
+		{5, 10, "ca"},
+		{3, 3, ""},
+		{7, 7, ""},
+		{8, 10, ""},
+		{-2, 3, "gat"},
+		{4, 2, ""},
+	} {
+		if have, err := r.SelectRange(ctx, "range", testcase.start, testcase.end); err != nil || have != testcase.want {
+			t.Errorf("SelectRange(%d, %d): want %q, have %q (%v)", testcase.start, testcase.end, testcase.want, have, err)
+		}
+	}
+}
+
+func testWrites(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if err := r.Insert(ctx, "writes", "gatt"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	version, err := r.Version(ctx, "writes")
+	if err != nil {
+		t.Fatalf("Version: %v", err)
+	}
+
+	newVersion, err := r.Append(ctx, "writes", "aca", version, 0)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Append: want %v, have %v", want, have)
+	}
+	if want, have := version+1, newVersion; want != have {
+		t.Errorf("Append: want version %d, have %d", want, have)
+	}
+	if sequence, err := r.Select(ctx, "writes"); err != nil || sequence != "gattaca" {
+		t.Errorf("Select after Append: want %q, have %q (%v)", "gattaca", sequence, err)
+	}
+	if length, err := r.Length(ctx, "writes"); err != nil || length != 7 {
+		t.Errorf("Length after Append: want %d, have %d (%v)", 7, length, err)
+	}
+
+	if _, err := r.Update(ctx, "writes", "cat", version); err != dna.ErrVersionMismatch {
+		t.Errorf("Update with stale version: want %v, have %v", dna.ErrVersionMismatch, err)
+	}
+	if _, err := r.Append(ctx, "writes", "cat", version, 0); err != dna.ErrVersionMismatch {
+		t.Errorf("Append with stale version: want %v, have %v", dna.ErrVersionMismatch, err)
+	}
+	if err := r.Delete(ctx, "writes", version); err != dna.ErrVersionMismatch {
+		t.Errorf("Delete with stale version: want %v, have %v", dna.ErrVersionMismatch, err)
+	}
+	if sequence, err := r.Select(ctx, "writes"); err != nil || sequence != "gattaca" {
+		t.Errorf("Select after stale writes: want %q, have %q (%v)", "gattaca", sequence, err)
+	}
+
+	newVersion, err = r.Update(ctx, "writes", "cat", newVersion)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Update: want %v, have %v", want, have)
+	}
+	if want, have := version+2, newVersion; want != have {
+		t.Errorf("Update: want version %d, have %d", want, have)
+	}
+	if _, err := r.Update(ctx, "writes", "gattaca", 0); err != nil {
+		t.Errorf("Update with any version: want %v, have %v", nil, err)
+	}
+	if sequence, err := r.Select(ctx, "writes"); err != nil || sequence != "gattaca" {
+		t.Errorf("Select after Update: want %q, have %q (%v)", "gattaca", sequence, err)
+	}
+}
+
+func testTopology(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if err := r.Insert(ctx, "topology", "gattaca"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if topology, err := r.Topology(ctx, "topology"); err != nil || topology != dna.Linear {
+		t.Errorf("Topology: want %v, have %v (%v)", dna.Linear, topology, err)
+	}
+
+	version, err := r.SetTopology(ctx, "topology", dna.Circular, 1)
+	if err != nil {
+		t.Fatalf("SetTopology: %v", err)
+	}
+	if want, have := 2, version; want != have {
+		t.Errorf("SetTopology: want version %d, have %d", want, have)
+	}
+	if topology, err := r.Topology(ctx, "topology"); err != nil || topology != dna.Circular {
+		t.Errorf("Topology: want %v, have %v (%v)", dna.Circular, topology, err)
+	}
+	if _, err := r.SetTopology(ctx, "topology", dna.Linear, 1); err != dna.ErrVersionMismatch {
+		t.Errorf("SetTopology with stale version: want %v, have %v", dna.ErrVersionMismatch, err)
+	}
+
+	// Changing the sequence keeps the topology.
+	if _, err := r.Append(ctx, "topology", "a", 0, 0); err != nil {
+		t.Fatalf("Append: %v", err)
+	}
+	if topology, err := r.Topology(ctx, "topology"); err != nil || topology != dna.Circular {
+		t.Errorf("Topology after Append: want %v, have %v (%v)", dna.Circular, topology, err)
+	}
+}
+
+func testConcurrentWrites(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	for _, user := range []string{"append", "update", "capped"} {
+		if err := r.Insert(ctx, user, ""); err != nil {
+			t.Fatalf("Insert(%s): %v", user, err)
+		}
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		updated int
+		capped  = Concurrency / 2
+		tooLong int
+	)
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Appends against any version all succeed, and are all kept...
+			if _, err := r.Append(ctx, "append", "a", 0, 0); err != nil {
+				t.Errorf("Append: %v", err)
+			}
+
+			// ...while only one of the updates against the same version wins.
+			switch _, err := r.Update(ctx, "update", "gattaca", 1); err {
+			case nil:
+				mtx.Lock()
+				updated++
+				mtx.Unlock()
+			case dna.ErrVersionMismatch:
+			default:
+				t.Errorf("Update: %v", err)
+			}
+
+			// Appends past the maximum length fail, however they interleave.
+			switch _, err := r.Append(ctx, "capped", "a", 0, capped); err {
+			case nil:
+			case dna.ErrTooLong:
+				mtx.Lock()
+				tooLong++
+				mtx.Unlock()
+			default:
+				t.Errorf("Append up to %d: %v", capped, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sequence, err := r.Select(ctx, "append"); err != nil || sequence != strings.Repeat("a", Concurrency) {
+		t.Errorf("Select after concurrent Append: want %d bases, have %d (%v)", Concurrency, len(sequence), err)
+	}
+	if version, err := r.Version(ctx, "append"); err != nil || version != Concurrency+1 {
+		t.Errorf("Version after concurrent Append: want %d, have %d (%v)", Concurrency+1, version, err)
+	}
+	if want, have := 1, updated; want != have {
+		t.Errorf("concurrent Update of the same version: want %d success, have %d", want, have)
+	}
+	if length, err := r.Length(ctx, "capped"); err != nil || length != capped {
+		t.Errorf("Length after concurrent Append up to %d: want %d, have %d (%v)", capped, capped, length, err)
+	}
+	if want, have := Concurrency-capped, tooLong; want != have {
+		t.Errorf("concurrent Append up to %d: want %d %v, have %d", capped, want, dna.ErrTooLong, have)
+	}
+
+	// Concurrent inserts of different users all succeed.
+	for i := 0; i < Concurrency; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := r.Insert(ctx, fmt.Sprintf("concurrent-%d", i), "gattaca"); err != nil {
+				t.Errorf("Insert(concurrent-%d): %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func testCancel(t *testing.T, r dna.Repository) {
+	if err := r.Insert(context.Background(), "cancel", "gattaca"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for name, f := range map[string]func() error{
+		"Insert":      func() error { return r.Insert(ctx, "canceled", "gattaca") },
+		"Select":      func() error { _, err := r.Select(ctx, "cancel"); return err },
+		"SelectRange": func() error { _, err := r.SelectRange(ctx, "cancel", 0, 1); return err },
+		"Length":      func() error { _, err := r.Length(ctx, "cancel"); return err },
+		"Version":     func() error { _, err := r.Version(ctx, "cancel"); return err },
+		"Topology":    func() error { _, err := r.Topology(ctx, "cancel"); return err },
+		"Update":      func() error { _, err := r.Update(ctx, "cancel", "cat", 0); return err },
+		"Append":      func() error { _, err := r.Append(ctx, "cancel", "cat", 0, 0); return err },
+		"SetTopology": func() error { _, err := r.SetTopology(ctx, "cancel", dna.Circular, 0); return err },
+		"Delete":      func() error { return r.Delete(ctx, "cancel", 0) },
+		"Purge":       func() error { _, err := r.Purge(ctx, time.Now().Add(time.Hour)); return err },
+	} {
+		if err := f(); errors.Cause(err) != context.Canceled {
+			t.Errorf("%s with canceled context: want %v, have %v", name, context.Canceled, err)
+		}
+	}
+
+	// None of it took effect.
+	if _, err := r.Select(context.Background(), "canceled"); err != dna.ErrInvalidUser {
+		t.Errorf("Select after canceled Insert: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if sequence, err := r.Select(context.Background(), "cancel"); err != nil || sequence != "gattaca" {
+		t.Errorf("Select after canceled writes: want %q, have %q (%v)", "gattaca", sequence, err)
+	}
+	if version, err := r.Version(context.Background(), "cancel"); err != nil || version != 1 {
+		t.Errorf("Version after canceled writes: want %d, have %d (%v)", 1, version, err)
+	}
+}
+
+func testUsers(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	for _, user := range []string{"users-b", "users-a", "users-c"} {
+		if err := r.Insert(ctx, user, "gattaca"); err != nil {
+			t.Fatalf("Insert(%s): %v", user, err)
+		}
+	}
+	if err := r.Delete(ctx, "users-c", 0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+
+	users, err := r.Users(ctx)
+	if err != nil {
+		t.Fatalf("Users: %v", err)
+	}
+	if !sort.StringsAreSorted(users) {
+		t.Errorf("Users: want sorted, have %v", users)
+	}
+	listed := map[string]bool{}
+	for _, user := range users {
+		listed[user] = true
+	}
+	for user, want := range map[string]bool{"users-a": true, "users-b": true, "users-c": false} {
+		if have := listed[user]; want != have {
+			t.Errorf("Users: %s: want listed %v, have %v", user, want, have)
+		}
+	}
+	// Leave nothing deleted for DeleteAndPurge.
+	if err := r.Erase(ctx, "users-c"); err != nil {
+		t.Errorf("Erase: %v", err)
+	}
+}
+
+func testSharing(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	access := func(user string) dna.Access {
+		t.Helper()
+		a, err := r.Access(ctx, "sharing", user)
+		if err != nil {
+			t.Fatalf("Access(%s): %v", user, err)
+		}
+		return a
+	}
+
+	if want, have := dna.Access(""), access("sharing-a"); want != have {
+		t.Errorf("Access before Share: want %q, have %q", want, have)
+	}
+	if err := r.Share(ctx, "sharing", dna.Grant{Grantee: "sharing-a", Access: dna.SearchAccess}); err != nil {
+		t.Fatalf("Share: %v", err)
+	}
+	if want, have := dna.SearchAccess, access("sharing-a"); want != have {
+		t.Errorf("Access after Share: want %q, have %q", want, have)
+	}
+
+	// Groups are owned by whoever creates them.
+	for _, member := range []string{"sharing-a", "sharing-b"} {
+		if err := r.AddMember(ctx, "sharing", "sharing-team", member); err != nil {
+			t.Fatalf("AddMember(%s): %v", member, err)
+		}
+	}
+	if want, have := dna.ErrForbidden, r.AddMember(ctx, "sharing-x", "sharing-team", "sharing-x"); want != have {
+		t.Errorf("AddMember to another's group: want %v, have %v", want, have)
+	}
+	if want, have := dna.ErrForbidden, r.RemoveMember(ctx, "sharing-x", "sharing-team", "sharing-a"); want != have {
+		t.Errorf("RemoveMember from another's group: want %v, have %v", want, have)
+	}
+	if want, have := dna.ErrForbidden, r.Share(ctx, "sharing-x", dna.Grant{Grantee: "sharing-team", Group: true, Access: dna.ReadAccess}); want != have {
+		t.Errorf("Share with another's group: want %v, have %v", want, have)
+	}
+
+	// Sharing with a group claims it, so nobody else can add themselves.
+	if err := r.Share(ctx, "sharing", dna.Grant{Grantee: "sharing-lab", Group: true, Access: dna.ReadAccess}); err != nil {
+		t.Fatalf("Share with new group: %v", err)
+	}
+	if want, have := dna.ErrForbidden, r.AddMember(ctx, "sharing-x", "sharing-lab", "sharing-x"); want != have {
+		t.Errorf("AddMember to shared group: want %v, have %v", want, have)
+	}
+	if want, have := dna.Access(""), access("sharing-x"); want != have {
+		t.Errorf("Access via shared group: want %q, have %q", want, have)
+	}
+	if err := r.Unshare(ctx, "sharing", "sharing-lab", true); err != nil {
+		t.Fatalf("Unshare: %v", err)
+	}
+	if err := r.Share(ctx, "sharing", dna.Grant{Grantee: "sharing-team", Group: true, Access: dna.ReadAccess}); err != nil {
+		t.Fatalf("Share with group: %v", err)
+	}
+	for user, want := range map[string]dna.Access{"sharing-a": dna.ReadAccess, "sharing-b": dna.ReadAccess, "sharing-x": ""} {
+		if have := access(user); want != have {
+			t.Errorf("Access(%s) via group: want %q, have %q", user, want, have)
+		}
+	}
+	grants, err := r.Grants(ctx, "sharing")
+	if err != nil {
+		t.Fatalf("Grants: %v", err)
+	}
+	if want, have := []dna.Grant{
+		{Grantee: "sharing-a", Access: dna.SearchAccess},
+		{Grantee: "sharing-team", Group: true, Access: dna.ReadAccess},
+	}, grants; !reflect.DeepEqual(want, have) {
+		t.Errorf("Grants: want %+v, have %+v", want, have)
+	}
+
+	if err := r.RemoveMember(ctx, "sharing", "sharing-team", "sharing-b"); err != nil {
+		t.Fatalf("RemoveMember: %v", err)
+	}
+	if want, have := dna.Access(""), access("sharing-b"); want != have {
+		t.Errorf("Access after RemoveMember: want %q, have %q", want, have)
+	}
+	if err := r.Unshare(ctx, "sharing", "sharing-team", true); err != nil {
+		t.Fatalf("Unshare: %v", err)
+	}
+	if want, have := dna.SearchAccess, access("sharing-a"); want != have {
+		t.Errorf("Access after Unshare of group: want %q, have %q", want, have)
+	}
+
+	// Invitations are accepted once, by the invitee, before they expire.
+	now := time.Now()
+	inv := dna.Invitation{Code: "sharing-code", Owner: "sharing", Invitee: "sharing-c", Access: dna.ReadAccess, Expires: now.Add(time.Hour)}
+	if err := r.Invite(ctx, inv); err != nil {
+		t.Fatalf("Invite: %v", err)
+	}
+	if _, err := r.Accept(ctx, "sharing-code", "sharing-x", now); err != dna.ErrInvalidInvitation {
+		t.Errorf("Accept by someone else: want %v, have %v", dna.ErrInvalidInvitation, err)
+	}
+	if _, err := r.Accept(ctx, "sharing-code", "sharing-c", now.Add(2*time.Hour)); err != dna.ErrInvalidInvitation {
+		t.Errorf("Accept after expiry: want %v, have %v", dna.ErrInvalidInvitation, err)
+	}
+	accepted, err := r.Accept(ctx, "sharing-code", "sharing-c", now)
+	if err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	if want, have := "sharing", accepted.Owner; want != have {
+		t.Errorf("Accept: want owner %q, have %q", want, have)
+	}
+	if want, have := dna.ReadAccess, access("sharing-c"); want != have {
+		t.Errorf("Access after Accept: want %q, have %q", want, have)
+	}
+	if _, err := r.Accept(ctx, "sharing-code", "sharing-c", now); err != dna.ErrInvalidInvitation {
+		t.Errorf("Accept again: want %v, have %v", dna.ErrInvalidInvitation, err)
+	}
+
+	// Erasing a grantee removes them from ACLs; erasing an owner removes
+	// their ACL and groups.
+	if err := r.Erase(ctx, "sharing-c"); err != nil {
+		t.Fatalf("Erase grantee: %v", err)
+	}
+	if want, have := dna.Access(""), access("sharing-c"); want != have {
+		t.Errorf("Access after Erase of grantee: want %q, have %q", want, have)
+	}
+	if data, err := r.Export(ctx, "sharing"); err != nil || data == nil || len(data.Grants) != 1 {
+		t.Errorf("Export owner: want 1 grant, have %+v (%v)", data, err)
+	}
+	if err := r.Erase(ctx, "sharing"); err != nil {
+		t.Fatalf("Erase owner: %v", err)
+	}
+	if data, err := r.Export(ctx, "sharing"); err != nil || data != nil {
+		t.Errorf("Export after Erase of owner: want nil, have %+v (%v)", data, err)
+	}
+	if err := r.AddMember(ctx, "sharing-x", "sharing-team", "sharing-x"); err != nil {
+		t.Errorf("AddMember to erased owner's group: %v", err)
+	}
+}
+
+func testDeleteAndPurge(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if err := r.Insert(ctx, "delete", "gattaca"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := r.SetTopology(ctx, "delete", dna.Circular, 0); err != nil {
+		t.Fatalf("SetTopology: %v", err)
+	}
+
+	if want, have := error(nil), r.Delete(ctx, "delete", 0); want != have {
+		t.Fatalf("Delete: want %v, have %v", want, have)
+	}
+	if _, err := r.Select(ctx, "delete"); err != dna.ErrInvalidUser {
+		t.Errorf("Select after Delete: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Version(ctx, "delete"); err != dna.ErrInvalidUser {
+		t.Errorf("Version after Delete: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if err := r.Delete(ctx, "delete", 0); err != dna.ErrInvalidUser {
+		t.Errorf("Delete again: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+	if _, err := r.Append(ctx, "delete", "a", 0, 0); err != dna.ErrInvalidUser {
+		t.Errorf("Append after Delete: want %v, have %v", dna.ErrInvalidUser, err)
+	}
+
+	n, err := r.Purge(ctx, time.Now().Add(-time.Hour))
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Purge: want %v, have %v", want, have)
+	}
+	if want, have := 0, n; want != have {
+		t.Errorf("Purge within retention: want %d, have %d", want, have)
+	}
+
+	// Re-adding within the retention window replaces the deleted sequence,
+	// and starts it out linear again.
+	if want, have := error(nil), r.Insert(ctx, "delete", "cat"); want != have {
+		t.Fatalf("Insert after Delete: want %v, have %v", want, have)
+	}
+	if sequence, err := r.Select(ctx, "delete"); err != nil || sequence != "cat" {
+		t.Errorf("Select after re-Insert: want %q, have %q (%v)", "cat", sequence, err)
+	}
+	if topology, err := r.Topology(ctx, "delete"); err != nil || topology != dna.Linear {
+		t.Errorf("Topology after re-Insert: want %v, have %v (%v)", dna.Linear, topology, err)
+	}
+	if want, have := error(nil), r.Delete(ctx, "delete", 0); want != have {
+		t.Fatalf("Delete: want %v, have %v", want, have)
+	}
+
+	n, err = r.Purge(ctx, time.Now().Add(time.Hour))
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Purge: want %v, have %v", want, have)
+	}
+	if want, have := 1, n; want != have {
+		t.Errorf("Purge after retention: want %d, have %d", want, have)
+	}
+	if want, have := error(nil), r.Insert(ctx, "delete", "gattaca"); want != have {
+		t.Errorf("Insert after Purge: want %v, have %v", want, have)
+	}
+	if _, err := r.Select(ctx, "insert"); err != nil {
+		t.Errorf("Select other user after Purge: %v", err)
+	}
+}
+
+func testExportAndErase(t *testing.T, r dna.Repository) {
+	ctx := context.Background()
+
+	if data, err := r.Export(ctx, "erase"); err != nil || data != nil {
+		t.Errorf("Export missing user: want nil, have %+v (%v)", data, err)
+	}
+
+	if err := r.Insert(ctx, "erase", "GATTACA"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := r.SetTopology(ctx, "erase", dna.Circular, 0); err != nil {
+		t.Fatalf("SetTopology: %v", err)
+	}
+	data, err := r.Export(ctx, "erase")
+	if err != nil {
+		t.Fatalf("Export: %v", err)
+	}
+	if want, have := (dna.UserData{User: "erase", Sequence: "GATTACA", Version: 2, Topology: dna.Circular}), *data; !reflect.DeepEqual(want, have) {
+		t.Errorf("Export: want %+v, have %+v", want, have)
+	}
+
+	// Deleted sequences are still held until they're purged.
+	if err := r.Delete(ctx, "erase", 0); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if data, err := r.Export(ctx, "erase"); err != nil || data == nil || data.Sequence != "GATTACA" || data.Deleted == nil {
+		t.Errorf("Export after Delete: want deleted sequence, have %+v (%v)", data, err)
+	}
+
+	if want, have := error(nil), r.Erase(ctx, "erase"); want != have {
+		t.Fatalf("Erase: want %v, have %v", want, have)
+	}
+	if data, err := r.Export(ctx, "erase"); err != nil || data != nil {
+		t.Errorf("Export after Erase: want nil, have %+v (%v)", data, err)
+	}
+	if want, have := error(nil), r.Erase(ctx, "erase"); want != have {
+		t.Errorf("Erase again: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), r.Insert(ctx, "erase", "ACGT"); want != have {
+		t.Errorf("Insert after Erase: want %v, have %v", want, have)
+	}
+}
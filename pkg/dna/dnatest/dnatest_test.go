@@ -0,0 +1,130 @@
+package dnatest
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/dna"
+	"github.com/peterbourgon/gattaca/pkg/internal/pgtest"
+)
+
+func TestMemoryRepository(t *testing.T) {
+	r, err := dna.NewRepository("memory:", dna.PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.(*dna.MemoryRepository); !ok {
+		t.Fatalf("NewRepository(memory:): want %T, have %T", &dna.MemoryRepository{}, r)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteRepository(t *testing.T) {
+	// A single connection, as concurrent writers to an in-memory DB with a
+	// shared cache fail with SQLITE_LOCKED rather than waiting. The DB is
+	// named uniquely, as it outlives the test when run with -count.
+	urn := fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", t.Name(), time.Now().UnixNano())
+	r, err := dna.NewRepository(urn, dna.PoolConfig{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteRepositoryWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := dna.NewSQLiteRepository("file:"+filepath.Join(dir, "dna.db"),
+		dna.WithJournalMode("WAL"),
+		dna.WithBusyTimeout(5*time.Second),
+		dna.WithReadPool(true),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteRepositoryEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnatest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring, err := dna.NewKeyring(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := dna.NewSQLiteRepository("file:"+filepath.Join(dir, "dna.db"),
+		dna.WithJournalMode("WAL"),
+		dna.WithBusyTimeout(5*time.Second),
+		dna.WithReadPool(true),
+		dna.WithKeyring(keyring),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestSQLiteIntegration(t *testing.T) {
+	var (
+		filevar  = "DNA_INTEGRATION_TEST_FILE"
+		filename = os.Getenv(filevar)
+	)
+	if filename == "" {
+		// If a test will write to disk, make it opt-in.
+		t.Skipf("skipping; set %s to run this test", filevar)
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatalf("%s: %v", filename, err)
+	}
+
+	defer func() {
+		if err := os.Remove(filename); err != nil {
+			t.Errorf("rm %s: %v", filename, err)
+		}
+	}()
+
+	r, err := dna.NewRepository("file:"+filename, dna.PoolConfig{MaxOpenConns: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	TestRepository(t, r)
+}
+
+func TestPostgresRepository(t *testing.T) {
+	urn, stop := pgtest.Start(t)
+	defer stop()
+
+	r, err := dna.NewPostgresRepository(urn, dna.PoolConfig{MaxOpenConns: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		db, err := sql.Open("postgres", urn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		db.Exec(`DROP TABLE dna`)
+	}()
+
+	TestRepository(t, r)
+}
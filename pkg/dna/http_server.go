@@ -1,9 +1,13 @@
 package dna
 
 import (
+	"bytes"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // HTTPServer wraps a Service and implements http.Handler.
@@ -28,7 +32,7 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case method == "POST" && first == "add":
 		var (
 			user     = r.URL.Query().Get("user")
-			token    = r.URL.Query().Get("token")
+			token    = extractToken(r)
 			sequence = r.URL.Query().Get("sequence")
 		)
 		err := s.service.Add(r.Context(), user, token, sequence)
@@ -37,6 +41,8 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, "Add OK")
 		case err == ErrBadAuth:
 			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case err == ErrQuotaExceeded:
+			http.Error(w, err.Error(), http.StatusForbidden)
 		case err != nil:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
@@ -44,10 +50,14 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case method == "GET" && first == "check":
 		var (
 			user        = r.URL.Query().Get("user")
-			token       = r.URL.Query().Get("token")
+			token       = extractToken(r)
 			subsequence = r.URL.Query().Get("subsequence")
+			owner       = r.URL.Query().Get("owner")
 		)
-		err := s.service.Check(r.Context(), user, token, subsequence)
+		if owner == "" {
+			owner = user
+		}
+		err := s.service.Check(r.Context(), user, token, owner, subsequence)
 		switch {
 		case err == nil:
 			fmt.Fprintln(w, "Subsequence found")
@@ -55,15 +65,556 @@ func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusNotFound)
 		case err == ErrBadAuth:
 			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case err == ErrForbidden:
+			http.Error(w, err.Error(), http.StatusForbidden)
 		default:
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 		}
 
+	case first == "sequences" && extractPathToken(r.URL.Path, 1) != "":
+		var (
+			id     = extractPathToken(r.URL.Path, 1)
+			second = extractPathToken(r.URL.Path, 2)
+		)
+		switch {
+		case method == "GET" && second == "":
+			s.handleSlice(w, r, id)
+		case method == "PUT" && second == "":
+			s.handleUpdate(w, r, id)
+		case method == "POST" && second == "append":
+			s.handleAppend(w, r, id)
+		case method == "DELETE" && second == "":
+			s.handleDelete(w, r, id)
+		case method == "GET" && second == "variants":
+			s.handleVariants(w, r, id)
+		case method == "GET" && second == "digest":
+			s.handleDigest(w, r, id)
+		case method == "PUT" && second == "topology":
+			s.handleSetTopology(w, r, id)
+		case method == "GET" && second == "sample":
+			s.handleSample(w, r, id)
+		case method == "GET" && second == "grants":
+			s.handleGrants(w, r, id)
+		case method == "PUT" && second == "grants":
+			s.handleShare(w, r, id)
+		case method == "DELETE" && second == "grants":
+			s.handleUnshare(w, r, id)
+		case method == "POST" && second == "invitations":
+			s.handleInvite(w, r, id)
+		default:
+			http.NotFound(w, r)
+		}
+
+	case method == "GET" && first == "search":
+		s.handleSearch(w, r)
+
+	case method == "GET" && first == "usage":
+		s.handleUsage(w, r)
+
+	case method == "POST" && first == "invitations" && extractPathToken(r.URL.Path, 2) == "accept":
+		s.handleAccept(w, r, extractPathToken(r.URL.Path, 1))
+
+	case first == "groups" && extractPathToken(r.URL.Path, 2) == "members" && extractPathToken(r.URL.Path, 3) != "":
+		var (
+			group  = extractPathToken(r.URL.Path, 1)
+			member = extractPathToken(r.URL.Path, 3)
+		)
+		switch method {
+		case "PUT":
+			s.handleAddMember(w, r, group, member)
+		case "DELETE":
+			s.handleRemoveMember(w, r, group, member)
+		default:
+			http.NotFound(w, r)
+		}
+
+	case method == "GET" && first == "enzymes":
+		names := make([]string, 0, len(Enzymes))
+		for name := range Enzymes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			e := Enzymes[name]
+			fmt.Fprintf(w, "%s\t%s\t%d/%d\n", e.Name, e.Site, e.Cut, e.ComplementCut)
+		}
+
 	default:
 		http.NotFound(w, r)
 	}
 }
 
+func (s *HTTPServer) handleSlice(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+		base  = r.URL.Query().Get("base")
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	start, err := strconv.Atoi(r.URL.Query().Get("start"))
+	if err != nil {
+		http.Error(w, "invalid start", http.StatusBadRequest)
+		return
+	}
+	end, err := strconv.Atoi(r.URL.Query().Get("end"))
+	if err != nil {
+		http.Error(w, "invalid end", http.StatusBadRequest)
+		return
+	}
+	switch base {
+	case "", "0":
+	case "1":
+		start, end = start-1, end-1
+	default:
+		http.Error(w, "invalid base", http.StatusBadRequest)
+		return
+	}
+	strand, err := parseStrand(r.URL.Query().Get("strand"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Read the version before the bases: if there's a concurrent write, the
+	// client gets a stale ETag, and their next write fails safely.
+	version, err := s.service.Version(r.Context(), user, token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", formatETag(version))
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	sw := &streamWriter{w: w}
+	if err := s.service.Slice(r.Context(), user, token, start, end, strand, sw); err != nil {
+		sw.fail(err)
+		return
+	}
+	fmt.Fprintln(sw)
+	sw.flush()
+}
+
+func (s *HTTPServer) handleUpdate(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user     = r.URL.Query().Get("user")
+		token    = extractToken(r)
+		sequence = r.URL.Query().Get("sequence")
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	version, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newVersion, err := s.service.Update(r.Context(), user, token, sequence, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", formatETag(newVersion))
+	fmt.Fprintln(w, "Update OK")
+}
+
+func (s *HTTPServer) handleAppend(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user     = r.URL.Query().Get("user")
+		token    = extractToken(r)
+		sequence = r.URL.Query().Get("sequence")
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	version, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newVersion, err := s.service.Append(r.Context(), user, token, sequence, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", formatETag(newVersion))
+	fmt.Fprintln(w, "Append OK")
+}
+
+func (s *HTTPServer) handleDelete(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	version, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.service.Delete(r.Context(), user, token, version); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "Delete OK")
+}
+
+func (s *HTTPServer) handleVariants(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user      = r.URL.Query().Get("user")
+		token     = extractToken(r)
+		reference = r.URL.Query().Get("reference")
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	variants, err := s.service.Diff(r.Context(), user, token, reference)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := WriteVCF(&buf, reference, variants); err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/vcf")
+	buf.WriteTo(w)
+}
+
+func (s *HTTPServer) handleSetTopology(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user     = r.URL.Query().Get("user")
+		token    = extractToken(r)
+		topology = Topology(r.URL.Query().Get("topology"))
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	version, err := parseIfMatch(r.Header.Get("If-Match"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newVersion, err := s.service.SetTopology(r.Context(), user, token, topology, version)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("ETag", formatETag(newVersion))
+	fmt.Fprintln(w, "SetTopology OK")
+}
+
+// handleDigest writes a line per cut, with the enzyme and the 0-based
+// position before which it cuts, and then a line per fragment length.
+func (s *HTTPServer) handleDigest(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		enzymes = strings.Split(r.URL.Query().Get("enzymes"), ",")
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	d, err := s.service.Digest(r.Context(), user, token, enzymes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, c := range d.Cuts {
+		fmt.Fprintf(w, "cut\t%s\t%d\n", c.Enzyme, c.Position)
+	}
+	for _, length := range d.Fragments {
+		fmt.Fprintf(w, "fragment\t%d\n", length)
+	}
+}
+
+// handleSample writes the whole of the sequence with the given id, which
+// needn't be the user's own, if they're permitted to read it. The sequence
+// is streamed as it's read, so an error part way through can only cut the
+// response short.
+func (s *HTTPServer) handleSample(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	sw := &streamWriter{w: w}
+	if err := s.service.Sample(r.Context(), user, token, id, sw); err != nil {
+		sw.fail(err)
+		return
+	}
+	fmt.Fprintln(sw)
+	sw.flush()
+}
+
+// handleSearch writes a line per user whose sequence contains the
+// subsequence.
+func (s *HTTPServer) handleSearch(w http.ResponseWriter, r *http.Request) {
+	var (
+		user        = r.URL.Query().Get("user")
+		token       = extractToken(r)
+		subsequence = r.URL.Query().Get("subsequence")
+	)
+	owners, err := s.service.Search(r.Context(), user, token, subsequence)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, owner := range owners {
+		fmt.Fprintln(w, owner)
+	}
+}
+
+// handleUsage writes a line each for the bases and samples the owner stores,
+// with the amount used and the quota, where 0 is unlimited. The owner
+// defaults to the user.
+func (s *HTTPServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+		owner = r.URL.Query().Get("owner")
+	)
+	if owner == "" {
+		owner = user
+	}
+	u, err := s.service.Usage(r.Context(), user, token, owner)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "bases\t%d\t%d\n", u.Bases, u.Quota.MaxBases)
+	fmt.Fprintf(w, "samples\t%d\t%d\n", u.Samples, u.Quota.MaxSamples)
+}
+
+// handleGrants writes a line per grant in the ACL of the user's sequence,
+// with the kind of grantee, the grantee, and the access.
+func (s *HTTPServer) handleGrants(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	grants, err := s.service.Grants(r.Context(), user, token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	for _, g := range grants {
+		kind := "user"
+		if g.Group {
+			kind = "group"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", kind, g.Grantee, g.Access)
+	}
+}
+
+func (s *HTTPServer) handleShare(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+		grant = Grant{
+			Grantee: r.URL.Query().Get("grantee"),
+			Group:   r.URL.Query().Get("group") == "true",
+			Access:  Access(r.URL.Query().Get("access")),
+		}
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := s.service.Share(r.Context(), user, token, grant); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "Share OK")
+}
+
+func (s *HTTPServer) handleUnshare(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		grantee = r.URL.Query().Get("grantee")
+		group   = r.URL.Query().Get("group") == "true"
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := s.service.Unshare(r.Context(), user, token, grantee, group); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "Unshare OK")
+}
+
+// handleInvite writes the invitation's code and expiry. The TTL defaults to
+// a week.
+func (s *HTTPServer) handleInvite(w http.ResponseWriter, r *http.Request, id string) {
+	var (
+		user    = r.URL.Query().Get("user")
+		token   = extractToken(r)
+		invitee = r.URL.Query().Get("invitee")
+		access  = Access(r.URL.Query().Get("access"))
+		ttl     = 7 * 24 * time.Hour
+	)
+	if id != user {
+		http.Error(w, ErrBadAuth.Error(), http.StatusUnauthorized)
+		return
+	}
+	if v := r.URL.Query().Get("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			http.Error(w, "invalid ttl", http.StatusBadRequest)
+			return
+		}
+	}
+	inv, err := s.service.Invite(r.Context(), user, token, invitee, access, ttl)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "%s\t%s\n", inv.Code, inv.Expires.Format(time.RFC3339))
+}
+
+func (s *HTTPServer) handleAccept(w http.ResponseWriter, r *http.Request, code string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	inv, err := s.service.Accept(r.Context(), user, token, code)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Accept OK: %s access to %s\n", inv.Access, inv.Owner)
+}
+
+func (s *HTTPServer) handleAddMember(w http.ResponseWriter, r *http.Request, group, member string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	if err := s.service.AddMember(r.Context(), user, token, group, member); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "AddMember OK")
+}
+
+func (s *HTTPServer) handleRemoveMember(w http.ResponseWriter, r *http.Request, group, member string) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = extractToken(r)
+	)
+	if err := s.service.RemoveMember(r.Context(), user, token, group, member); err != nil {
+		writeError(w, err)
+		return
+	}
+	fmt.Fprintln(w, "RemoveMember OK")
+}
+
+// writeError maps errors returned by the service to HTTP status codes.
+func writeError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrBadAuth:
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+	case ErrForbidden, ErrQuotaExceeded:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case ErrInvalidUser, ErrInvalidInvitation:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case ErrInvalidRange, ErrInvalidSequence, ErrInvalidReference, ErrTooDivergent, ErrUnknownEnzyme, ErrInvalidTopology, ErrInvalidAccess:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case ErrVersionMismatch:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// streamWriter holds back the start of a streamed response, up to a chunk
+// of bases, so that an error before any of it is sent is still written with
+// its status code. Once the response is sent, it can't be changed, so an
+// error aborts it, and the client sees it cut short.
+type streamWriter struct {
+	w    http.ResponseWriter
+	buf  bytes.Buffer
+	sent bool
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	if sw.sent {
+		return sw.w.Write(p)
+	}
+	sw.buf.Write(p)
+	if sw.buf.Len() >= sliceChunkSize {
+		return len(p), sw.flush()
+	}
+	return len(p), nil
+}
+
+// flush sends whatever is held back.
+func (sw *streamWriter) flush() error {
+	sw.sent = true
+	_, err := sw.buf.WriteTo(sw.w)
+	return err
+}
+
+// fail writes the error, if none of the response is sent, and otherwise
+// aborts the response.
+func (sw *streamWriter) fail(err error) {
+	if !sw.sent {
+		writeError(sw.w, err)
+		return
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func formatETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// parseIfMatch returns the version in an If-Match header, as produced by
+// formatETag. An empty header, or "*", returns version 0, which matches any
+// version.
+func parseIfMatch(header string) (version int, err error) {
+	header = strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	if header == "" || header == "*" {
+		return 0, nil
+	}
+	version, err = strconv.Atoi(strings.Trim(header, `"`))
+	if err != nil || version <= 0 {
+		return 0, fmt.Errorf("invalid If-Match %q", header)
+	}
+	return version, nil
+}
+
+// parseStrand accepts "+" or "forward", and "-" or "reverse". Note that an
+// unescaped "+" in a query string decodes to a space, so that's accepted too.
+func parseStrand(s string) (Strand, error) {
+	switch strings.TrimSpace(s) {
+	case "", "+", "forward":
+		return Forward, nil
+	case "-", "reverse":
+		return Reverse, nil
+	default:
+		return 0, fmt.Errorf("invalid strand %q", s)
+	}
+}
+
 func extractPathToken(path string, position int) string {
 	toks := strings.Split(strings.Trim(path, "/ "), "/")
 	if len(toks) <= position {
@@ -71,3 +622,16 @@ func extractPathToken(path string, position int) string {
 	}
 	return toks[position]
 }
+
+// extractToken returns the token query parameter or, if it's absent, the
+// bearer token in the Authorization header, which is how machine clients
+// should pass API keys.
+func extractToken(r *http.Request) string {
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token
+	}
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return strings.TrimPrefix(h, "Bearer ")
+	}
+	return ""
+}
@@ -0,0 +1,218 @@
+package dna
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrNoKeyring is returned when a repository without a keyring reads or
+// writes a sequence which is encrypted.
+var ErrNoKeyring = errors.New("sequence is encrypted, but there's no keyring")
+
+// Keyring holds the master keys which wrap the data key of each user. Each
+// user's sequence is encrypted with their data key, with AES-GCM, in chunks
+// which can be decrypted independently.
+//
+// The last master key is current: it wraps new data keys, and RotateKeys
+// re-wraps existing data keys with it. Older master keys only unwrap data
+// keys, until they've all been re-wrapped.
+type Keyring struct {
+	ids   []string
+	aeads map[string]cipher.AEAD
+}
+
+// NewKeyring returns a keyring of the given master keys, oldest first.
+// Each key must be 32 bytes, for AES-256.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("keyring needs at least one master key")
+	}
+	k := &Keyring{aeads: map[string]cipher.AEAD{}}
+	for i, key := range keys {
+		if len(key) != 32 {
+			return nil, errors.Errorf("master key %d is %d bytes; want 32", i+1, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:8])
+		k.ids = append(k.ids, id)
+		k.aeads[id] = aead
+	}
+	return k, nil
+}
+
+// LoadKeyring reads a keyfile, with one base64-encoded master key per line,
+// oldest first. Blank lines, and lines starting with #, are ignored.
+func LoadKeyring(filename string) (*Keyring, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var (
+		keys [][]byte
+		s    = bufio.NewScanner(f)
+	)
+	for line := 1; s.Scan(); line++ {
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(text)
+		if err != nil {
+			return nil, errors.Wrapf(err, "%s:%d", filename, line)
+		}
+		keys = append(keys, key)
+	}
+	if err := s.Err(); err != nil {
+		return nil, errors.Wrapf(err, "error reading %s", filename)
+	}
+
+	return NewKeyring(keys...)
+}
+
+// GenerateMasterKey returns a new random master key, base64-encoded for a
+// keyfile.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", errors.Wrap(err, "error generating master key")
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+func (k *Keyring) current() string {
+	return k.ids[len(k.ids)-1]
+}
+
+// newDataKey returns a new data key for the user, and the key wrapped by the
+// current master key.
+func (k *Keyring) newDataKey(user string) (key []byte, master string, wrapped []byte, err error) {
+	key = make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, "", nil, errors.Wrap(err, "error generating data key")
+	}
+	master = k.current()
+	wrapped, err = seal(k.aeads[master], user, key)
+	return key, master, wrapped, err
+}
+
+// unwrap the user's data key, which was wrapped by the master key.
+func (k *Keyring) unwrap(user, master string, wrapped []byte) ([]byte, error) {
+	aead, ok := k.aeads[master]
+	if !ok {
+		return nil, errors.Errorf("data key of %s is wrapped by master key %s, which isn't in the keyring", user, master)
+	}
+	key, err := open(aead, user, wrapped)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error unwrapping data key of %s", user)
+	}
+	return key, nil
+}
+
+// encryptionOverhead is the number of bytes seal adds to the plaintext.
+const encryptionOverhead = 12 + 16 // nonce, tag
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext with a random nonce, which is prepended to the
+// ciphertext. The user is authenticated too, so that ciphertexts can't be
+// swapped between users.
+func seal(aead cipher.AEAD, user string, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "error generating nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(user)), nil
+}
+
+// open decrypts a ciphertext produced by seal for the same user.
+func open(aead cipher.AEAD, user string, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(user))
+}
+
+// chunkSize is the number of bases in each chunk of an encrypted sequence,
+// so that a region of it can be read by decrypting only the chunks which
+// hold the region.
+const chunkSize = 4096
+
+// sealedChunkSize is the size of each sealed chunk but the last, which may
+// be shorter.
+const sealedChunkSize = chunkSize + encryptionOverhead
+
+// sealChunks encrypts the plaintext in chunks of chunkSize bases, each with
+// its own nonce, and returns them concatenated. The chunks are numbered from
+// first, which is 0 unless the plaintext continues an existing sequence.
+// Each chunk's number is authenticated, and whether it's the last chunk, so
+// that chunks can't be reordered, and the sequence can't be truncated.
+func sealChunks(aead cipher.AEAD, user string, plaintext []byte, first int) ([]byte, error) {
+	sealed := make([]byte, 0, len(plaintext)+(len(plaintext)/chunkSize+1)*encryptionOverhead)
+	for i := first; ; i++ {
+		n := chunkSize
+		if n > len(plaintext) {
+			n = len(plaintext)
+		}
+		last := n == len(plaintext)
+		chunk, err := seal(aead, chunkData(user, i, last), plaintext[:n])
+		if err != nil {
+			return nil, err
+		}
+		sealed, plaintext = append(sealed, chunk...), plaintext[n:]
+		if last {
+			return sealed, nil
+		}
+	}
+}
+
+// openChunks decrypts consecutive chunks produced by sealChunks, the first
+// of which is numbered first, of a sequence with total chunks in all.
+func openChunks(aead cipher.AEAD, user string, sealed []byte, first, total int) ([]byte, error) {
+	plaintext := make([]byte, 0, len(sealed))
+	for i := first; len(sealed) > 0; i++ {
+		n := sealedChunkSize
+		if n > len(sealed) {
+			n = len(sealed)
+		}
+		chunk, err := open(aead, chunkData(user, i, i == total-1), sealed[:n])
+		if err != nil {
+			return nil, err
+		}
+		plaintext, sealed = append(plaintext, chunk...), sealed[n:]
+	}
+	return plaintext, nil
+}
+
+// chunkCount returns the number of chunks in a sealed sequence of size n.
+func chunkCount(n int) int {
+	return (n + sealedChunkSize - 1) / sealedChunkSize
+}
+
+// chunkData returns the additional data authenticated with a chunk.
+func chunkData(user string, i int, last bool) string {
+	return fmt.Sprintf("%s\x00%d\x00%t", user, i, last)
+}
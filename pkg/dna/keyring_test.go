@@ -0,0 +1,274 @@
+package dna
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadKeyring(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := GenerateMasterKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(dir, "keyfile")
+	if err := ioutil.WriteFile(filename, []byte("# oldest first\n"+first+"\n\n"+second+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	k, err := LoadKeyring(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(k.ids); want != have {
+		t.Fatalf("keys: want %d, have %d", want, have)
+	}
+	secondKey, _ := base64.StdEncoding.DecodeString(second)
+	if want, have := mustKeyring(t, secondKey).current(), k.current(); want != have {
+		t.Errorf("current: want %s, have %s", want, have)
+	}
+
+	for name, contents := range map[string]string{
+		"empty":     "# no keys\n",
+		"not b64":   "not base64!\n",
+		"too short": base64.StdEncoding.EncodeToString([]byte("short")) + "\n",
+	} {
+		if err := ioutil.WriteFile(filename, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeyring(filename); err == nil {
+			t.Errorf("%s: want error, have none", name)
+		}
+	}
+}
+
+func TestSQLiteEncryption(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		urn     = memoryURN(t)
+		keyring = mustKeyring(t, bytes.Repeat([]byte{1}, 32))
+	)
+
+	r, err := NewSQLiteRepository(urn, WithKeyring(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Insert(ctx, "alpha", "GATTACA"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Append(ctx, "alpha", "ACGT", 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored []byte
+	if err := r.db.QueryRow(`SELECT sequence FROM dna WHERE user = 'alpha'`).Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("GATTACA")) {
+		t.Errorf("sequence is stored in cleartext: %q", stored)
+	}
+	if length, err := r.Length(ctx, "alpha"); err != nil || length != 11 {
+		t.Errorf("Length: want %d, have %d (%v)", 11, length, err)
+	}
+	if subsequence, err := r.SelectRange(ctx, "alpha", 4, 100); err != nil || subsequence != "ACAACGT" {
+		t.Errorf("SelectRange: want %q, have %q (%v)", "ACAACGT", subsequence, err)
+	}
+
+	// Without the keyring, the sequence can't be read or appended to.
+	plain, err := NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := plain.Select(ctx, "alpha"); err != ErrNoKeyring {
+		t.Errorf("Select without keyring: want %v, have %v", ErrNoKeyring, err)
+	}
+	if _, err := plain.Append(ctx, "alpha", "A", 0, 0); err != ErrNoKeyring {
+		t.Errorf("Append without keyring: want %v, have %v", ErrNoKeyring, err)
+	}
+
+	// With another keyring, it can't be read either.
+	other, err := NewSQLiteRepository(urn, WithKeyring(mustKeyring(t, bytes.Repeat([]byte{2}, 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Select(ctx, "alpha"); err == nil || !strings.Contains(err.Error(), "isn't in the keyring") {
+		t.Errorf("Select with another keyring: want error, have %v", err)
+	}
+
+	if _, err := NewRepository("memory:", PoolConfig{}, WithKeyring(keyring)); err == nil {
+		t.Errorf("NewRepository(memory:) with keyring: want error, have none")
+	}
+}
+
+func TestSQLiteEncryptionChunks(t *testing.T) {
+	var (
+		ctx      = context.Background()
+		urn      = memoryURN(t)
+		keyring  = mustKeyring(t, bytes.Repeat([]byte{1}, 32))
+		sequence = strings.Repeat("GATTACA", chunkSize/2) // several chunks
+	)
+
+	r, err := NewSQLiteRepository(urn, WithKeyring(keyring))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Insert(ctx, "alpha", sequence[:chunkSize]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Append(ctx, "alpha", sequence[chunkSize:chunkSize+10], 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Append(ctx, "alpha", sequence[chunkSize+10:], 0, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if length, err := r.Length(ctx, "alpha"); err != nil || length != len(sequence) {
+		t.Errorf("Length: want %d, have %d (%v)", len(sequence), length, err)
+	}
+	if have, err := r.Select(ctx, "alpha"); err != nil || have != sequence {
+		t.Errorf("Select: want %d bases, have %d (%v)", len(sequence), len(have), err)
+	}
+	for _, region := range [][2]int{
+		{0, 10},
+		{chunkSize - 5, chunkSize + 5},
+		{chunkSize, 2 * chunkSize},
+		{2*chunkSize + 1, len(sequence) + 100},
+		{len(sequence) + 1, len(sequence) + 100},
+	} {
+		start, end := region[0], region[1]
+		var want string
+		if start < len(sequence) && end < len(sequence) {
+			want = sequence[start:end]
+		} else if start < len(sequence) {
+			want = sequence[start:]
+		}
+		if have, err := r.SelectRange(ctx, "alpha", start, end); err != nil || want != have {
+			t.Errorf("SelectRange(%d, %d): want %d bases, have %d (%v)", start, end, len(want), len(have), err)
+		}
+	}
+
+	// Truncating the sequence to whole chunks is detected.
+	if _, err := r.db.Exec(`UPDATE dna SET sequence = substr(sequence, 1, ?) WHERE user = 'alpha'`, sealedChunkSize); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Select(ctx, "alpha"); err == nil {
+		t.Errorf("Select after truncation: want error, have none")
+	}
+}
+
+func TestSQLiteRotateKeys(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		urn    = memoryURN(t)
+		first  = bytes.Repeat([]byte{1}, 32)
+		second = bytes.Repeat([]byte{2}, 32)
+	)
+
+	// A sequence written before encryption was enabled.
+	plain, err := NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.Insert(ctx, "cleartext", "ACGT"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewSQLiteRepository(urn, WithKeyring(mustKeyring(t, first)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence, err := r.Select(ctx, "cleartext"); err != nil || sequence != "ACGT" {
+		t.Errorf("Select cleartext: want %q, have %q (%v)", "ACGT", sequence, err)
+	}
+	if err := r.Insert(ctx, "alpha", "GATTACA"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err = NewSQLiteRepository(urn, WithKeyring(mustKeyring(t, first, second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rewrapped, encrypted, err := r.RotateKeys(ctx)
+	if err != nil {
+		t.Fatalf("RotateKeys: %v", err)
+	}
+	if want, have := 1, rewrapped; want != have {
+		t.Errorf("RotateKeys: want %d rewrapped, have %d", want, have)
+	}
+	if want, have := 1, encrypted; want != have {
+		t.Errorf("RotateKeys: want %d encrypted, have %d", want, have)
+	}
+
+	// The old master key is no longer needed.
+	r, err = NewSQLiteRepository(urn, WithKeyring(mustKeyring(t, second)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for user, want := range map[string]string{"alpha": "GATTACA", "cleartext": "ACGT"} {
+		if have, err := r.Select(ctx, user); err != nil || want != have {
+			t.Errorf("Select(%s) after rotation: want %q, have %q (%v)", user, want, have, err)
+		}
+	}
+	if _, err := plain.Select(ctx, "cleartext"); err != ErrNoKeyring {
+		t.Errorf("Select(cleartext) without keyring after rotation: want %v, have %v", ErrNoKeyring, err)
+	}
+}
+
+func TestSQLiteShred(t *testing.T) {
+	var (
+		ctx = context.Background()
+		urn = memoryURN(t)
+	)
+
+	r, err := NewSQLiteRepository(urn, WithKeyring(mustKeyring(t, bytes.Repeat([]byte{1}, 32))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"alpha", "beta"} {
+		if err := r.Insert(ctx, user, "GATTACA"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want, have := error(nil), r.Shred(ctx, "alpha"); want != have {
+		t.Fatalf("Shred: want %v, have %v", want, have)
+	}
+	if _, err := r.Select(ctx, "alpha"); err != ErrInvalidUser {
+		t.Errorf("Select after Shred: want %v, have %v", ErrInvalidUser, err)
+	}
+	if want, have := ErrInvalidUser, r.Shred(ctx, "alpha"); want != have {
+		t.Errorf("Shred again: want %v, have %v", want, have)
+	}
+
+	var n int
+	if err := r.db.QueryRow(`SELECT count(*) FROM data_keys WHERE user = 'alpha'`).Scan(&n); err != nil || n != 0 {
+		t.Errorf("data keys after Shred: want 0, have %d (%v)", n, err)
+	}
+	if sequence, err := r.Select(ctx, "beta"); err != nil || sequence != "GATTACA" {
+		t.Errorf("Select(beta) after Shred(alpha): want %q, have %q (%v)", "GATTACA", sequence, err)
+	}
+}
+
+func mustKeyring(t *testing.T, keys ...[]byte) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
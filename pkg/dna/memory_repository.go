@@ -0,0 +1,274 @@
+package dna
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRepository keeps DNA sequences in memory. It's safe for concurrent
+// use, and behaves like SQLiteRepository, which makes it suitable for tests
+// and for ephemeral development runs. Nothing is persisted. Like the
+// DB-backed repositories, it fails with the context's error if the context
+// is done.
+type MemoryRepository struct {
+	mtx         sync.Mutex
+	sequences   map[string]*memorySequence
+	grants      map[string]map[grantKey]Access // owner: grantee: access
+	groups      map[string]string              // group: owner
+	members     map[string]map[string]bool     // group: members
+	invitations map[string]Invitation          // code: invitation
+}
+
+type grantKey struct {
+	grantee string
+	group   bool
+}
+
+type memorySequence struct {
+	sequence string
+	version  int
+	topology Topology
+	deleted  time.Time // zero if not deleted
+}
+
+// NewMemoryRepository returns an empty MemoryRepository.
+func NewMemoryRepository() *MemoryRepository {
+	return &MemoryRepository{
+		sequences:   map[string]*memorySequence{},
+		grants:      map[string]map[grantKey]Access{},
+		groups:      map[string]string{},
+		members:     map[string]map[string]bool{},
+		invitations: map[string]Invitation{},
+	}
+}
+
+// Insert a user's DNA sequence to the repository. If the user's previous
+// sequence was deleted, but not yet purged, it's replaced.
+func (r *MemoryRepository) Insert(ctx context.Context, user, sequence string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, ok := r.sequences[user]
+	if !ok {
+		r.sequences[user] = &memorySequence{sequence: sequence, version: 1, topology: Linear}
+		return nil
+	}
+	if s.deleted.IsZero() {
+		return ErrSequenceExists
+	}
+	s.sequence, s.version, s.topology, s.deleted = sequence, s.version+1, Linear, time.Time{}
+	return nil
+}
+
+// Select a user's DNA sequence from the repository.
+func (r *MemoryRepository) Select(ctx context.Context, user string) (sequence string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, err := r.get(user)
+	if err != nil {
+		return "", err
+	}
+	return s.sequence, nil
+}
+
+// SelectRange selects the bases of a user's DNA sequence in the half-open,
+// 0-based region [start, end). The region is clamped to the length of the
+// sequence.
+func (r *MemoryRepository) SelectRange(ctx context.Context, user string, start, end int) (subsequence string, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, err := r.get(user)
+	if err != nil {
+		return "", err
+	}
+	if end > len(s.sequence) {
+		end = len(s.sequence)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > end {
+		start = end
+	}
+	return s.sequence[start:end], nil
+}
+
+// Length returns the number of bases in a user's DNA sequence.
+func (r *MemoryRepository) Length(ctx context.Context, user string) (length int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, err := r.get(user)
+	if err != nil {
+		return 0, err
+	}
+	return len(s.sequence), nil
+}
+
+// Version returns the current version of a user's DNA sequence.
+// It's incremented by every Update and Append.
+func (r *MemoryRepository) Version(ctx context.Context, user string) (version int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, err := r.get(user)
+	if err != nil {
+		return 0, err
+	}
+	return s.version, nil
+}
+
+// Update replaces a user's DNA sequence, if version matches the current
+// version of the sequence. A version of 0 matches any version.
+func (r *MemoryRepository) Update(ctx context.Context, user, sequence string, version int) (newVersion int, err error) {
+	return r.write(ctx, user, version, func(s *memorySequence) error {
+		s.sequence = sequence
+		s.version++
+		return nil
+	})
+}
+
+// Append bases to the end of a user's DNA sequence, if version matches the
+// current version of the sequence. A version of 0 matches any version. If
+// maxLength is positive, and the sequence would grow longer, it fails with
+// ErrTooLong.
+func (r *MemoryRepository) Append(ctx context.Context, user, sequence string, version, maxLength int) (newVersion int, err error) {
+	return r.write(ctx, user, version, func(s *memorySequence) error {
+		if maxLength > 0 && len(s.sequence)+len(sequence) > maxLength {
+			return ErrTooLong
+		}
+		s.sequence += sequence
+		s.version++
+		return nil
+	})
+}
+
+// Delete a user's DNA sequence, if version matches the current version of
+// the sequence. A version of 0 matches any version. The sequence is only
+// marked as deleted; it's removed for good by Purge.
+func (r *MemoryRepository) Delete(ctx context.Context, user string, version int) error {
+	_, err := r.write(ctx, user, version, func(s *memorySequence) error {
+		s.deleted = time.Now()
+		return nil
+	})
+	return err
+}
+
+// Topology returns whether a user's DNA sequence is linear or circular.
+func (r *MemoryRepository) Topology(ctx context.Context, user string) (topology Topology, err error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, err := r.get(user)
+	if err != nil {
+		return "", err
+	}
+	return s.topology, nil
+}
+
+// SetTopology sets whether a user's DNA sequence is linear or circular, if
+// version matches the current version of the sequence. A version of 0
+// matches any version.
+func (r *MemoryRepository) SetTopology(ctx context.Context, user string, topology Topology, version int) (newVersion int, err error) {
+	return r.write(ctx, user, version, func(s *memorySequence) error {
+		s.topology = topology
+		s.version++
+		return nil
+	})
+}
+
+// Users returns the users with a current sequence, in order.
+func (r *MemoryRepository) Users(ctx context.Context) (users []string, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for user, s := range r.sequences {
+		if s.deleted.IsZero() {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	return users, nil
+}
+
+// Purge removes sequences that were deleted before the given time.
+func (r *MemoryRepository) Purge(ctx context.Context, before time.Time) (n int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for user, s := range r.sequences {
+		if !s.deleted.IsZero() && s.deleted.Before(before) {
+			delete(r.sequences, user)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// get returns the user's current sequence. The caller must hold the mutex.
+func (r *MemoryRepository) get(user string) (*memorySequence, error) {
+	s, ok := r.sequences[user]
+	if !ok || !s.deleted.IsZero() {
+		return nil, ErrInvalidUser
+	}
+	return s, nil
+}
+
+// write applies f to the user's current sequence, after checking the
+// version, and returns the new version, or the error returned by f.
+func (r *MemoryRepository) write(ctx context.Context, user string, version int, f func(*memorySequence) error) (newVersion int, err error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	s, err := r.get(user)
+	if err != nil {
+		return 0, err
+	}
+	if version != 0 && version != s.version {
+		return 0, ErrVersionMismatch
+	}
+	if err := f(s); err != nil {
+		return 0, err
+	}
+	return s.version, nil
+}
@@ -0,0 +1,187 @@
+package dna
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
+	"github.com/pkg/errors"
+)
+
+// sqliteMigrations evolve the schema of SQLiteRepository. Once released,
+// a migration must never be changed; add a new one instead.
+var sqliteMigrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create dna table",
+		Up:          `CREATE TABLE IF NOT EXISTS dna (user STRING NOT NULL PRIMARY KEY, sequence STRING NOT NULL)`,
+		Down:        `DROP TABLE dna`,
+	},
+	{
+		Version:     2,
+		Description: "add version and soft-delete columns",
+		Up: `
+			ALTER TABLE dna ADD COLUMN version INTEGER NOT NULL DEFAULT 1;
+			ALTER TABLE dna ADD COLUMN deleted INTEGER;
+		`,
+		Down: `
+			ALTER TABLE dna DROP COLUMN deleted;
+			ALTER TABLE dna DROP COLUMN version;
+		`,
+	},
+	{
+		Version:     3,
+		Description: "add topology column",
+		Up:          `ALTER TABLE dna ADD COLUMN topology STRING NOT NULL DEFAULT 'linear'`,
+		Down:        `ALTER TABLE dna DROP COLUMN topology`,
+	},
+	{
+		Version:     4,
+		Description: "add encryption column and data_keys table",
+		Up: `
+			ALTER TABLE dna ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0;
+			CREATE TABLE data_keys (user TEXT NOT NULL PRIMARY KEY, master TEXT NOT NULL, key BLOB NOT NULL);
+		`,
+		Down: `
+			DROP TABLE data_keys;
+			ALTER TABLE dna DROP COLUMN encrypted;
+		`,
+	},
+	{
+		Version:     5,
+		Description: "create sharing tables",
+		Up: `
+			CREATE TABLE grants (owner TEXT NOT NULL, grantee TEXT NOT NULL, is_group INTEGER NOT NULL, access TEXT NOT NULL, PRIMARY KEY (owner, grantee, is_group));
+			CREATE TABLE share_groups (name TEXT NOT NULL PRIMARY KEY, owner TEXT NOT NULL);
+			CREATE TABLE share_members (name TEXT NOT NULL, member TEXT NOT NULL, PRIMARY KEY (name, member));
+			CREATE INDEX share_members_member ON share_members (member);
+			CREATE TABLE invitations (code TEXT NOT NULL PRIMARY KEY, owner TEXT NOT NULL, invitee TEXT NOT NULL, access TEXT NOT NULL, expires INTEGER NOT NULL);
+		`,
+		Down: `
+			DROP TABLE invitations;
+			DROP TABLE share_members;
+			DROP TABLE share_groups;
+			DROP TABLE grants;
+		`,
+	},
+}
+
+// postgresMigrations evolve the schema of PostgresRepository. Once
+// released, a migration must never be changed; add a new one instead.
+var postgresMigrations = []migrate.Migration{
+	{
+		Version:     1,
+		Description: "create dna table",
+		Up: `
+			CREATE TABLE dna (
+				"user"   TEXT    NOT NULL PRIMARY KEY,
+				sequence TEXT    NOT NULL,
+				version  INTEGER NOT NULL DEFAULT 1,
+				deleted  BIGINT,
+				topology TEXT    NOT NULL DEFAULT 'linear'
+			);
+		`,
+		Down: `DROP TABLE dna;`,
+	},
+	{
+		Version:     2,
+		Description: "create sharing tables",
+		Up: `
+			CREATE TABLE grants (owner TEXT NOT NULL, grantee TEXT NOT NULL, is_group BOOLEAN NOT NULL, access TEXT NOT NULL, PRIMARY KEY (owner, grantee, is_group));
+			CREATE TABLE share_groups (name TEXT NOT NULL PRIMARY KEY, owner TEXT NOT NULL);
+			CREATE TABLE share_members (name TEXT NOT NULL, member TEXT NOT NULL, PRIMARY KEY (name, member));
+			CREATE INDEX share_members_member ON share_members (member);
+			CREATE TABLE invitations (code TEXT NOT NULL PRIMARY KEY, owner TEXT NOT NULL, invitee TEXT NOT NULL, access TEXT NOT NULL, expires BIGINT NOT NULL);
+		`,
+		Down: `
+			DROP TABLE invitations;
+			DROP TABLE share_members;
+			DROP TABLE share_groups;
+			DROP TABLE grants;
+		`,
+	},
+}
+
+// MigrateSQLite migrates the SQLite DB represented by URN to the target
+// schema version, and returns the version it was migrated from and to.
+// A target of -1 means the latest version. NewSQLiteRepository always
+// migrates to the latest version; this is useful to revert migrations,
+// or to migrate ahead of a deploy.
+func MigrateSQLite(ctx context.Context, urn string, target int) (from, to int, err error) {
+	db, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	return migrate.Migrate(ctx, db, sqliteMigrations, target)
+}
+
+// SQLiteSchemaVersion returns the current schema version of the SQLite DB
+// represented by URN, and the latest version known to this package.
+func SQLiteSchemaVersion(ctx context.Context, urn string) (current, latest int, err error) {
+	db, err := sql.Open("sqlite3", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	current, err = migrate.Current(ctx, db, sqliteMigrations)
+	return current, migrate.Latest(sqliteMigrations), err
+}
+
+// MigratePostgres migrates the PostgreSQL DB represented by URN to the
+// target schema version, and returns the version it was migrated from and
+// to. A target of -1 means the latest version. NewPostgresRepository always
+// migrates to the latest version.
+func MigratePostgres(ctx context.Context, urn string, target int) (from, to int, err error) {
+	db, err := sql.Open("postgres", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	return migrate.Migrate(ctx, db, postgresMigrations, target)
+}
+
+// PostgresSchemaVersion returns the current schema version of the
+// PostgreSQL DB represented by URN, and the latest version known to this
+// package.
+func PostgresSchemaVersion(ctx context.Context, urn string) (current, latest int, err error) {
+	db, err := sql.Open("postgres", urn)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error opening DB")
+	}
+	defer db.Close()
+
+	current, err = migrate.Current(ctx, db, postgresMigrations)
+	return current, migrate.Latest(postgresMigrations), err
+}
+
+// Migrate migrates the SQLite or PostgreSQL DB represented by URN, as
+// NewRepository would interpret it, to the target schema version. See
+// MigrateSQLite and MigratePostgres.
+func Migrate(ctx context.Context, urn string, target int) (from, to int, err error) {
+	switch {
+	case urn == "memory:":
+		return 0, 0, errors.New("in-memory DBs have no schema to migrate")
+	case isPostgres(urn):
+		return MigratePostgres(ctx, urn, target)
+	default:
+		return MigrateSQLite(ctx, urn, target)
+	}
+}
+
+// SchemaVersion returns the current schema version of the SQLite or
+// PostgreSQL DB represented by URN, and the latest version known to this
+// package.
+func SchemaVersion(ctx context.Context, urn string) (current, latest int, err error) {
+	switch {
+	case urn == "memory:":
+		return 0, 0, errors.New("in-memory DBs have no schema version")
+	case isPostgres(urn):
+		return PostgresSchemaVersion(ctx, urn)
+	default:
+		return SQLiteSchemaVersion(ctx, urn)
+	}
+}
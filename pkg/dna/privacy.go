@@ -0,0 +1,289 @@
+package dna
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// UserData is what a repository holds about a user, including a sequence
+// which has been deleted, but not yet purged, and what it's shared with.
+// Invitations are exported without their codes.
+type UserData struct {
+	User        string       `json:"user"`
+	Sequence    string       `json:"sequence"`
+	Version     int          `json:"version"`
+	Topology    Topology     `json:"topology"`
+	Deleted     *time.Time   `json:"deleted,omitempty"`
+	Grants      []Grant      `json:"grants,omitempty"`
+	Groups      []string     `json:"groups,omitempty"`      // that the user is a member of
+	Invitations []Invitation `json:"invitations,omitempty"` // sent or received
+}
+
+func (d *UserData) empty() bool {
+	return d.Version == 0 && len(d.Grants) == 0 && len(d.Groups) == 0 && len(d.Invitations) == 0
+}
+
+// Export returns what the repository holds about the user, or nil if it
+// holds nothing. Encrypted sequences are decrypted.
+func (r *SQLiteRepository) Export(ctx context.Context, user string) (*UserData, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var (
+		data      = UserData{User: user}
+		value     []byte
+		encrypted bool
+		master    sql.NullString
+		wrapped   []byte
+		deleted   sql.NullInt64
+	)
+	if err := r.rdb.QueryRowContext(ctx, `
+		SELECT d.sequence, d.encrypted, k.master, k.key, d.version, d.topology, d.deleted
+		FROM dna d LEFT JOIN data_keys k ON k.user = d.user
+		WHERE d.user = ?
+	`, user).Scan(&value, &encrypted, &master, &wrapped, &data.Version, &data.Topology, &deleted); err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "error reading from repository")
+	}
+	value, err := r.decrypt(user, encrypted, value, master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	data.Sequence = string(value)
+	if deleted.Valid {
+		t := time.Unix(deleted.Int64, 0).UTC()
+		data.Deleted = &t
+	}
+
+	if data.Grants, err = r.Grants(ctx, user); err != nil {
+		return nil, err
+	}
+	if err := query(ctx, r.rdb, func(rows *sql.Rows) error {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return err
+		}
+		data.Groups = append(data.Groups, group)
+		return nil
+	}, `SELECT name FROM share_members WHERE member = ? ORDER BY name`, user); err != nil {
+		return nil, errors.Wrap(err, "error reading groups")
+	}
+	if err := query(ctx, r.rdb, scanInvitations(&data.Invitations),
+		`SELECT owner, invitee, access, expires FROM invitations WHERE owner = ? OR invitee = ? ORDER BY expires`, user, user,
+	); err != nil {
+		return nil, errors.Wrap(err, "error reading invitations")
+	}
+
+	if data.empty() {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// Erase the user's sequence, whether or not it's been deleted, along with
+// their data key, like Shred, and everything they've shared or been shared.
+// Groups they own are erased, too. It succeeds if there's nothing to erase.
+func (r *SQLiteRepository) Erase(ctx context.Context, user string) error {
+	if err := r.Shred(ctx, user); err != nil && err != ErrInvalidUser {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting erase transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	for _, q := range []string{
+		`DELETE FROM grants WHERE owner = ?1 OR (is_group = 0 AND grantee = ?1)`,
+		`DELETE FROM grants WHERE is_group = 1 AND grantee IN (SELECT name FROM share_groups WHERE owner = ?1)`,
+		`DELETE FROM share_members WHERE member = ?1 OR name IN (SELECT name FROM share_groups WHERE owner = ?1)`,
+		`DELETE FROM share_groups WHERE owner = ?1`,
+		`DELETE FROM invitations WHERE owner = ?1 OR invitee = ?1`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, user); err != nil {
+			return errors.Wrap(err, "error erasing sharing")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing erase transaction")
+}
+
+// Export returns what the repository holds about the user, or nil if it
+// holds nothing.
+func (r *MemoryRepository) Export(ctx context.Context, user string) (*UserData, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	data := &UserData{User: user}
+	if s, ok := r.sequences[user]; ok {
+		data.Sequence, data.Version, data.Topology = s.sequence, s.version, s.topology
+		if !s.deleted.IsZero() {
+			t := s.deleted.UTC().Truncate(time.Second)
+			data.Deleted = &t
+		}
+	}
+	data.Grants = r.acl(user)
+	for group, members := range r.members {
+		if members[user] {
+			data.Groups = append(data.Groups, group)
+		}
+	}
+	sort.Strings(data.Groups)
+	for _, inv := range r.invitations {
+		if inv.Owner == user || inv.Invitee == user {
+			inv.Code = ""
+			data.Invitations = append(data.Invitations, inv)
+		}
+	}
+	sort.Slice(data.Invitations, func(i, j int) bool { return data.Invitations[i].Expires.Before(data.Invitations[j].Expires) })
+
+	if data.empty() {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// Erase the user's sequence, whether or not it's been deleted, and
+// everything they've shared or been shared. Groups they own are erased, too.
+// It succeeds if there's nothing to erase.
+func (r *MemoryRepository) Erase(ctx context.Context, user string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.sequences, user)
+	delete(r.grants, user)
+	for group, owner := range r.groups {
+		if owner == user {
+			delete(r.groups, group)
+			delete(r.members, group)
+			for owner, acl := range r.grants {
+				delete(acl, grantKey{group, true})
+				if len(acl) == 0 {
+					delete(r.grants, owner)
+				}
+			}
+		}
+	}
+	for owner, acl := range r.grants {
+		delete(acl, grantKey{user, false})
+		if len(acl) == 0 {
+			delete(r.grants, owner)
+		}
+	}
+	for _, members := range r.members {
+		delete(members, user)
+	}
+	for code, inv := range r.invitations {
+		if inv.Owner == user || inv.Invitee == user {
+			delete(r.invitations, code)
+		}
+	}
+	return nil
+}
+
+// Export returns what the repository holds about the user, or nil if it
+// holds nothing.
+func (r *PostgresRepository) Export(ctx context.Context, user string) (*UserData, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var (
+		data    = UserData{User: user}
+		deleted sql.NullInt64
+	)
+	if err := r.db.QueryRowContext(ctx,
+		`SELECT sequence, version, topology, deleted FROM dna WHERE "user" = $1`, user,
+	).Scan(&data.Sequence, &data.Version, &data.Topology, &deleted); err != nil && err != sql.ErrNoRows {
+		return nil, errors.Wrap(err, "error reading from repository")
+	}
+	if deleted.Valid {
+		t := time.Unix(deleted.Int64, 0).UTC()
+		data.Deleted = &t
+	}
+
+	var err error
+	if data.Grants, err = r.Grants(ctx, user); err != nil {
+		return nil, err
+	}
+	if err := query(ctx, r.db, func(rows *sql.Rows) error {
+		var group string
+		if err := rows.Scan(&group); err != nil {
+			return err
+		}
+		data.Groups = append(data.Groups, group)
+		return nil
+	}, `SELECT name FROM share_members WHERE member = $1 ORDER BY name`, user); err != nil {
+		return nil, errors.Wrap(err, "error reading groups")
+	}
+	if err := query(ctx, r.db, scanInvitations(&data.Invitations),
+		`SELECT owner, invitee, access, expires FROM invitations WHERE owner = $1 OR invitee = $1 ORDER BY expires`, user,
+	); err != nil {
+		return nil, errors.Wrap(err, "error reading invitations")
+	}
+
+	if data.empty() {
+		return nil, nil
+	}
+	return &data, nil
+}
+
+// Erase the user's sequence, whether or not it's been deleted, and
+// everything they've shared or been shared. Groups they own are erased, too.
+// It succeeds if there's nothing to erase.
+func (r *PostgresRepository) Erase(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting erase transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM dna WHERE "user" = $1`, user); err != nil {
+		return errors.Wrap(err, "error erasing sequence")
+	}
+	for _, q := range []string{
+		`DELETE FROM grants WHERE owner = $1 OR (NOT is_group AND grantee = $1)`,
+		`DELETE FROM grants WHERE is_group AND grantee IN (SELECT name FROM share_groups WHERE owner = $1)`,
+		`DELETE FROM share_members WHERE member = $1 OR name IN (SELECT name FROM share_groups WHERE owner = $1)`,
+		`DELETE FROM share_groups WHERE owner = $1`,
+		`DELETE FROM invitations WHERE owner = $1 OR invitee = $1`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, user); err != nil {
+			return errors.Wrap(err, "error erasing sharing")
+		}
+	}
+	return errors.Wrap(tx.Commit(), "error committing erase transaction")
+}
+
+// scanInvitations returns a func for query, which appends invitations,
+// without their codes, to invs.
+func scanInvitations(invs *[]Invitation) func(*sql.Rows) error {
+	return func(rows *sql.Rows) error {
+		var (
+			inv     Invitation
+			expires int64
+		)
+		if err := rows.Scan(&inv.Owner, &inv.Invitee, &inv.Access, &expires); err != nil {
+			return err
+		}
+		inv.Expires = time.Unix(expires, 0).UTC()
+		*invs = append(*invs, inv)
+		return nil
+	}
+}
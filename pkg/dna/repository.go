@@ -2,61 +2,739 @@ package dna
 
 import (
 	"context"
+	"crypto/cipher"
 	"database/sql"
+	"math"
+	"strings"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3" // driver
+	"github.com/peterbourgon/gattaca/pkg/internal/migrate"
 	"github.com/pkg/errors"
 )
 
-// ErrInvalidUser is returned when an invalid user is passed to Select.
-var ErrInvalidUser = errors.New("invalid user")
+var (
+	// ErrInvalidUser is returned when an invalid user is passed to Select.
+	ErrInvalidUser = errors.New("invalid user")
+
+	// ErrSequenceExists is returned by Insert when the user already has a
+	// DNA sequence.
+	ErrSequenceExists = errors.New("user already exists")
+
+	// ErrVersionMismatch is returned when a write is made against a version
+	// of the sequence that's no longer current.
+	ErrVersionMismatch = errors.New("version mismatch")
+
+	// ErrTooLong is returned by Append when the sequence would grow past
+	// the maximum length given.
+	ErrTooLong = errors.New("sequence too long")
+)
+
+// NewRepository connects to the DB represented by URN. URNs with a
+// postgres:// or postgresql:// scheme yield a PostgresRepository, and the
+// URN memory: yields an empty MemoryRepository; anything else is taken to be
+// a SQLite DB, tuned by the options. Only SQLite supports encryption at rest.
+func NewRepository(urn string, pool PoolConfig, options ...SQLiteOption) (Repository, error) {
+	if urn == "memory:" || strings.HasPrefix(urn, "postgres://") || strings.HasPrefix(urn, "postgresql://") {
+		var c sqliteConfig
+		for _, option := range options {
+			option(&c)
+		}
+		if c.keyring != nil {
+			return nil, errors.New("encryption at rest is only supported for SQLite")
+		}
+	}
+	if urn == "memory:" {
+		return NewMemoryRepository(), nil
+	}
+	if isPostgres(urn) {
+		return NewPostgresRepository(urn, pool)
+	}
+	return NewSQLiteRepository(urn, append([]SQLiteOption{withPoolConfig(pool)}, options...)...)
+}
+
+// isPostgres returns true if URN represents a PostgreSQL DB.
+func isPostgres(urn string) bool {
+	return strings.HasPrefix(urn, "postgres://") || strings.HasPrefix(urn, "postgresql://")
+}
+
+// PoolConfig configures the pool of connections to the DB, and how long
+// each repository operation may use a connection for. Zero values leave
+// the database/sql defaults in place, and operations bounded only by the
+// context passed to them.
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	QueryTimeout    time.Duration
+}
+
+func (c PoolConfig) apply(db *sql.DB) {
+	if c.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.MaxOpenConns)
+	}
+	if c.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.MaxIdleConns)
+	}
+	if c.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	}
+}
+
+// withTimeout bounds ctx by timeout, unless it's zero.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, timeout)
+}
 
 // SQLiteRepository for persistence of the DNA sequences.
 type SQLiteRepository struct {
-	db *sql.DB
+	db      *sql.DB // for writes, and reads without a separate read pool
+	rdb     *sql.DB // for reads
+	keys    *Keyring
+	timeout time.Duration
 }
 
-// NewSQLiteRepository connects to the DB represented by URN.
-func NewSQLiteRepository(urn string) (*SQLiteRepository, error) {
-	db, err := sql.Open("sqlite3", urn)
+// NewSQLiteRepository connects to the DB represented by URN, and migrates
+// it to the latest schema version.
+func NewSQLiteRepository(urn string, options ...SQLiteOption) (*SQLiteRepository, error) {
+	var c sqliteConfig
+	for _, option := range options {
+		option(&c)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite3", c.writeDSN(urn))
 	if err != nil {
 		return nil, errors.Wrap(err, "error opening DB")
 	}
+	c.pool.apply(db)
 
-	if _, err := db.Query(`SELECT 1 FROM dna`); err != nil {
-		if _, err := db.Exec(`CREATE TABLE dna (user STRING NOT NULL PRIMARY KEY, sequence STRING NOT NULL)`); err != nil {
-			return nil, errors.Wrap(err, "error creating dna table")
-		}
-		for user, sequence := range map[string]string{
-			"alice": "attcgtattattttttgatatttttccacaaaaatacagactaaatacaactgaatacag",
-			"bob":   "tgcaaaattagatataaatgtaaacgaacataaaaacttttataagacaggattaagtta",
-		} {
-			if _, err := db.Exec(`INSERT INTO dna (user, sequence) VALUES (?, ?)`, user, sequence); err != nil {
-				return nil, errors.Wrap(err, "error populating initial sequences")
-			}
-		}
+	if _, _, err := migrate.Migrate(context.Background(), db, sqliteMigrations, -1); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error migrating DB")
+	}
+
+	r := &SQLiteRepository{
+		db:      db,
+		rdb:     db,
+		keys:    c.keyring,
+		timeout: c.pool.QueryTimeout,
+	}
+	if !c.readPool {
+		return r, nil
 	}
 
-	return &SQLiteRepository{
-		db: db,
-	}, nil
+	db.SetMaxOpenConns(1)
+	r.rdb, err = sql.Open("sqlite3", c.readDSN(urn))
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "error opening DB for reads")
+	}
+	c.pool.apply(r.rdb)
+	return r, nil
 }
 
-// Insert a user's DNA sequence to the repository.
+// Insert a user's DNA sequence to the repository. If the user's previous
+// sequence was deleted, but not yet purged, it's replaced, along with its
+// data key.
 func (r *SQLiteRepository) Insert(ctx context.Context, user, sequence string) error {
-	_, err := r.db.ExecContext(ctx, `INSERT INTO dna(user, sequence) VALUES(?, ?)`, user, sequence)
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
+		return errors.Wrap(err, "error starting write transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	stored, encrypted, err := r.encrypt(ctx, tx, user, []byte(sequence), true)
+	if err != nil {
+		return err
+	}
+	result, err := tx.ExecContext(ctx, `
+		INSERT INTO dna(user, sequence, version, topology, encrypted) VALUES(?, ?, 1, 'linear', ?)
+		ON CONFLICT(user) DO UPDATE SET sequence = excluded.sequence, version = version + 1, deleted = NULL, topology = 'linear', encrypted = excluded.encrypted
+		WHERE deleted IS NOT NULL
+	`, user, stored, encrypted)
+	if err != nil {
+		return errors.Wrap(err, "error writing to repository")
+	}
+	if n, err := result.RowsAffected(); err != nil {
 		return errors.Wrap(err, "error writing to repository")
+	} else if n == 0 {
+		return ErrSequenceExists
 	}
-	return nil
+	return errors.Wrap(tx.Commit(), "error committing write transaction")
 }
 
 // Select a user's DNA sequence from the repository.
 func (r *SQLiteRepository) Select(ctx context.Context, user string) (sequence string, err error) {
-	if err := r.db.QueryRowContext(ctx, `SELECT sequence FROM dna WHERE user = ?`, user).Scan(&sequence); err == sql.ErrNoRows {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	value, err := r.read(ctx, r.rdb, user, 0, -1)
+	return string(value), err
+}
+
+// SelectRange selects the bases of a user's DNA sequence in the half-open,
+// 0-based region [start, end). Only the requested bases are read out of the
+// database, or, if the sequence is encrypted, the chunks which hold them.
+// The region is clamped to the length of the sequence.
+func (r *SQLiteRepository) SelectRange(ctx context.Context, user string, start, end int) (subsequence string, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if start < 0 {
+		start = 0
+	}
+	if end < start {
+		end = start // an empty region, not the rest of the sequence
+	}
+	value, err := r.read(ctx, r.rdb, user, start, end)
+	return string(value), err
+}
+
+// Length returns the number of bases in a user's DNA sequence. Encrypted
+// sequences needn't be decrypted, as encryption adds a fixed overhead to
+// each chunk.
+func (r *SQLiteRepository) Length(ctx context.Context, user string) (length int, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	return r.length(ctx, r.rdb, user)
+}
+
+// length returns the number of bases in the user's current sequence.
+func (r *SQLiteRepository) length(ctx context.Context, q queryRower, user string) (length int, err error) {
+	var encrypted bool
+	if err := q.QueryRowContext(ctx, `SELECT length(sequence), encrypted FROM dna WHERE user = ? AND deleted IS NULL`, user).Scan(&length, &encrypted); err == sql.ErrNoRows {
+		return 0, ErrInvalidUser
+	} else if err != nil {
+		return 0, errors.Wrap(err, "error reading from repository")
+	}
+	if encrypted {
+		length -= chunkCount(length) * encryptionOverhead
+	}
+	return length, nil
+}
+
+// Version returns the current version of a user's DNA sequence.
+// It's incremented by every Update and Append.
+func (r *SQLiteRepository) Version(ctx context.Context, user string) (version int, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if err := r.rdb.QueryRowContext(ctx, `SELECT version FROM dna WHERE user = ? AND deleted IS NULL`, user).Scan(&version); err == sql.ErrNoRows {
+		return 0, ErrInvalidUser
+	} else if err != nil {
+		return 0, errors.Wrap(err, "error reading from repository")
+	}
+	return version, nil
+}
+
+// Update replaces a user's DNA sequence, if version matches the current
+// version of the sequence. A version of 0 matches any version.
+func (r *SQLiteRepository) Update(ctx context.Context, user, sequence string, version int) (newVersion int, err error) {
+	return r.write(ctx, user, version, func(ctx context.Context, tx *sql.Tx) error {
+		stored, encrypted, err := r.encrypt(ctx, tx, user, []byte(sequence), false)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE dna SET sequence = ?, encrypted = ?, version = version + 1 WHERE user = ?`, stored, encrypted, user)
+		return err
+	})
+}
+
+// Append bases to the end of a user's DNA sequence, if version matches the
+// current version of the sequence. A version of 0 matches any version. If
+// maxLength is positive, and the sequence would grow longer, it fails with
+// ErrTooLong.
+func (r *SQLiteRepository) Append(ctx context.Context, user, sequence string, version, maxLength int) (newVersion int, err error) {
+	return r.write(ctx, user, version, func(ctx context.Context, tx *sql.Tx) error {
+		if maxLength > 0 {
+			length, err := r.length(ctx, tx, user)
+			if err != nil {
+				return err
+			}
+			if length+len(sequence) > maxLength {
+				return ErrTooLong
+			}
+		}
+
+		if r.keys == nil {
+			result, err := tx.ExecContext(ctx, `UPDATE dna SET sequence = sequence || ?, version = version + 1 WHERE user = ? AND encrypted = 0`, sequence, user)
+			if err != nil {
+				return err
+			}
+			if n, err := result.RowsAffected(); err != nil {
+				return err
+			} else if n == 0 {
+				return ErrNoKeyring
+			}
+			return nil
+		}
+
+		var (
+			encrypted bool
+			value     []byte
+			master    sql.NullString
+			wrapped   []byte
+		)
+		if err := tx.QueryRowContext(ctx, `
+			SELECT d.encrypted, d.sequence, k.master, k.key
+			FROM dna d LEFT JOIN data_keys k ON k.user = d.user
+			WHERE d.user = ? AND d.deleted IS NULL
+		`, user).Scan(&encrypted, &value, &master, &wrapped); err != nil {
+			return err
+		}
+		if !encrypted {
+			stored, encrypted, err := r.encrypt(ctx, tx, user, append(value, sequence...), false)
+			if err != nil {
+				return err
+			}
+			_, err = tx.ExecContext(ctx, `UPDATE dna SET sequence = ?, encrypted = ?, version = version + 1 WHERE user = ?`, stored, encrypted, user)
+			return err
+		}
+
+		// Only the last chunk is decrypted, and sealed again with the
+		// appended bases; the chunks before it are kept as they are.
+		aead, err := r.dataKey(user, master, wrapped)
+		if err != nil {
+			return err
+		}
+		var (
+			total = chunkCount(len(value))
+			keep  = value[:(total-1)*sealedChunkSize]
+		)
+		last, err := openChunks(aead, user, value[len(keep):], total-1, total)
+		if err != nil {
+			return errors.Wrapf(err, "error decrypting sequence of %s", user)
+		}
+		tail, err := sealChunks(aead, user, append(last, sequence...), total-1)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, `UPDATE dna SET sequence = ?, version = version + 1 WHERE user = ?`, append(keep, tail...), user)
+		return err
+	})
+}
+
+// Delete a user's DNA sequence, if version matches the current version of
+// the sequence. A version of 0 matches any version. The sequence is only
+// marked as deleted; it's removed for good by Purge.
+func (r *SQLiteRepository) Delete(ctx context.Context, user string, version int) error {
+	_, err := r.write(ctx, user, version, exec(`UPDATE dna SET deleted = ? WHERE user = ?`, time.Now().Unix(), user))
+	return err
+}
+
+// Topology returns whether a user's DNA sequence is linear or circular.
+func (r *SQLiteRepository) Topology(ctx context.Context, user string) (topology Topology, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if err := r.rdb.QueryRowContext(ctx, `SELECT topology FROM dna WHERE user = ? AND deleted IS NULL`, user).Scan(&topology); err == sql.ErrNoRows {
 		return "", ErrInvalidUser
 	} else if err != nil {
 		return "", errors.Wrap(err, "error reading from repository")
 	}
-	return sequence, nil
+	return topology, nil
+}
+
+// SetTopology sets whether a user's DNA sequence is linear or circular, if
+// version matches the current version of the sequence. A version of 0
+// matches any version.
+func (r *SQLiteRepository) SetTopology(ctx context.Context, user string, topology Topology, version int) (newVersion int, err error) {
+	return r.write(ctx, user, version, exec(`UPDATE dna SET topology = ?, version = version + 1 WHERE user = ?`, string(topology), user))
+}
+
+// Users returns the users with a current sequence, in order.
+func (r *SQLiteRepository) Users(ctx context.Context) (users []string, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.rdb.QueryContext(ctx, `SELECT user FROM dna WHERE deleted IS NULL ORDER BY user`)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading from repository")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user string
+		if err := rows.Scan(&user); err != nil {
+			return nil, errors.Wrap(err, "error reading from repository")
+		}
+		users = append(users, user)
+	}
+	return users, errors.Wrap(rows.Err(), "error reading from repository")
+}
+
+// Purge removes sequences that were deleted before the given time, along
+// with their data keys.
+func (r *SQLiteRepository) Purge(ctx context.Context, before time.Time) (n int, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "error starting purge transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM dna WHERE deleted IS NOT NULL AND deleted < ?`, before.Unix())
+	if err != nil {
+		return 0, errors.Wrap(err, "error purging deleted sequences")
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return 0, errors.Wrap(err, "error purging deleted sequences")
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM data_keys WHERE user NOT IN (SELECT user FROM dna)`); err != nil {
+		return 0, errors.Wrap(err, "error purging data keys")
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, errors.Wrap(err, "error committing purge transaction")
+	}
+	return int(affected), nil
+}
+
+// Shred removes a user's sequence for good, whether or not it's been
+// deleted, along with their data key. Copies of the encrypted sequence which
+// may remain, e.g. in the WAL or free pages of the DB file, can no longer be
+// decrypted. Backups taken earlier still hold the data key, so they must be
+// expired, too.
+func (r *SQLiteRepository) Shred(ctx context.Context, user string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting shred transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM dna WHERE user = ?`, user)
+	if err != nil {
+		return errors.Wrap(err, "error shredding sequence")
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return errors.Wrap(err, "error shredding sequence")
+	} else if n == 0 {
+		return ErrInvalidUser
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM data_keys WHERE user = ?`, user); err != nil {
+		return errors.Wrap(err, "error shredding data key")
+	}
+	return errors.Wrap(tx.Commit(), "error committing shred transaction")
+}
+
+// RotateKeys re-wraps every data key with the current master key of the
+// keyring, and encrypts every sequence which was written without one. Once
+// it's done, older master keys may be removed from the keyring. Sequences
+// themselves aren't re-encrypted, as their data keys don't change.
+func (r *SQLiteRepository) RotateKeys(ctx context.Context) (rewrapped, encrypted int, err error) {
+	if r.keys == nil {
+		return 0, 0, errors.New("repository has no keyring")
+	}
+
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "error starting rotation transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	type dataKey struct {
+		user, master string
+		wrapped      []byte
+	}
+	var stale []dataKey
+	if err := query(ctx, tx, func(rows *sql.Rows) error {
+		var k dataKey
+		if err := rows.Scan(&k.user, &k.master, &k.wrapped); err != nil {
+			return err
+		}
+		stale = append(stale, k)
+		return nil
+	}, `SELECT user, master, key FROM data_keys WHERE master != ?`, r.keys.current()); err != nil {
+		return 0, 0, errors.Wrap(err, "error reading data keys")
+	}
+	for _, k := range stale {
+		key, err := r.keys.unwrap(k.user, k.master, k.wrapped)
+		if err != nil {
+			return 0, 0, err
+		}
+		wrapped, err := seal(r.keys.aeads[r.keys.current()], k.user, key)
+		if err != nil {
+			return 0, 0, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE data_keys SET master = ?, key = ? WHERE user = ?`, r.keys.current(), wrapped, k.user); err != nil {
+			return 0, 0, errors.Wrap(err, "error writing data key")
+		}
+	}
+
+	type cleartext struct {
+		user     string
+		sequence []byte
+	}
+	var plain []cleartext
+	if err := query(ctx, tx, func(rows *sql.Rows) error {
+		var c cleartext
+		if err := rows.Scan(&c.user, &c.sequence); err != nil {
+			return err
+		}
+		plain = append(plain, c)
+		return nil
+	}, `SELECT user, sequence FROM dna WHERE encrypted = 0`); err != nil {
+		return 0, 0, errors.Wrap(err, "error reading sequences")
+	}
+	for _, c := range plain {
+		stored, _, err := r.encrypt(ctx, tx, c.user, c.sequence, false)
+		if err != nil {
+			return 0, 0, err
+		}
+		if _, err := tx.ExecContext(ctx, `UPDATE dna SET sequence = ?, encrypted = 1 WHERE user = ?`, stored, c.user); err != nil {
+			return 0, 0, errors.Wrap(err, "error writing sequence")
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, 0, errors.Wrap(err, "error committing rotation transaction")
+	}
+	return len(stale), len(plain), nil
+}
+
+// write calls f with a transaction, after checking the version of the
+// user's current sequence, and returns the new version.
+func (r *SQLiteRepository) write(ctx context.Context, user string, version int, f func(context.Context, *sql.Tx) error) (newVersion int, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "error starting write transaction")
+	}
+
+	defer func() {
+		if err == nil {
+			if commitErr := tx.Commit(); commitErr != nil {
+				err = errors.Wrap(commitErr, "error committing write transaction")
+			}
+		} else {
+			tx.Rollback() // ignore error
+		}
+	}()
+
+	var current int
+	err = tx.QueryRowContext(ctx, `SELECT version FROM dna WHERE user = ? AND deleted IS NULL`, user).Scan(&current)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidUser
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading from repository")
+	}
+	if version != 0 && version != current {
+		return 0, ErrVersionMismatch
+	}
+
+	if err = f(ctx, tx); err == ErrNoKeyring || err == ErrTooLong {
+		return 0, err
+	} else if err != nil {
+		return 0, errors.Wrap(err, "error writing to repository")
+	}
+
+	if err = tx.QueryRowContext(ctx, `SELECT version FROM dna WHERE user = ?`, user).Scan(&newVersion); err != nil {
+		return 0, errors.Wrap(err, "error reading from repository")
+	}
+
+	return newVersion, nil
+}
+
+// exec returns a function for write, which executes the query.
+func exec(query string, args ...interface{}) func(context.Context, *sql.Tx) error {
+	return func(ctx context.Context, tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, query, args...)
+		return err
+	}
+}
+
+// query calls f for each row of the query.
+func query(ctx context.Context, q queryer, f func(*sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := f(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// queryer is satisfied by *sql.DB and *sql.Tx.
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryRower is implemented by *sql.DB and *sql.Tx.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// read returns the bases of the user's current sequence in the half-open,
+// 0-based region [start, end), clamped to its length. An end of -1 means
+// the end of the sequence. If the sequence is encrypted, only the chunks
+// which hold the region are read out of the database and decrypted.
+func (r *SQLiteRepository) read(ctx context.Context, q queryRower, user string, start, end int) ([]byte, error) {
+	if start < 0 {
+		start = 0
+	}
+	var (
+		length     int
+		textLength = int64(math.MaxInt64)
+		first      = start / chunkSize
+		sealedFrom = first*sealedChunkSize + 1
+		sealedLen  = int64(math.MaxInt64)
+	)
+	if end >= 0 {
+		if end < start {
+			end = start
+		}
+		textLength = int64(end - start)
+		sealedLen = int64(((end+chunkSize-1)/chunkSize - first) * sealedChunkSize)
+		if sealedLen < 0 {
+			sealedLen = 0
+		}
+	}
+
+	var (
+		encrypted bool
+		value     []byte
+		master    sql.NullString
+		wrapped   []byte
+	)
+	if err := q.QueryRowContext(ctx, `
+		SELECT
+			d.encrypted,
+			length(d.sequence),
+			CASE d.encrypted WHEN 0 THEN substr(d.sequence, ?, ?) ELSE substr(d.sequence, ?, ?) END,
+			k.master,
+			k.key
+		FROM dna d LEFT JOIN data_keys k ON k.user = d.user
+		WHERE d.user = ? AND d.deleted IS NULL
+	`, start+1, textLength, sealedFrom, sealedLen, user).Scan(&encrypted, &length, &value, &master, &wrapped); err == sql.ErrNoRows {
+		return nil, ErrInvalidUser
+	} else if err != nil {
+		return nil, errors.Wrap(err, "error reading from repository")
+	}
+	if !encrypted {
+		return value, nil
+	}
+
+	aead, err := r.dataKey(user, master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	if value, err = openChunks(aead, user, value, first, chunkCount(length)); err != nil {
+		return nil, errors.Wrapf(err, "error decrypting sequence of %s", user)
+	}
+	offset := start - first*chunkSize
+	if offset > len(value) {
+		offset = len(value)
+	}
+	value = value[offset:]
+	if end >= 0 && int64(len(value)) > textLength {
+		value = value[:textLength]
+	}
+	return value, nil
+}
+
+// decrypt the whole of a user's stored sequence with their data key, which
+// is wrapped by the master key. Sequences in cleartext are returned as they
+// are.
+func (r *SQLiteRepository) decrypt(user string, encrypted bool, value []byte, master sql.NullString, wrapped []byte) ([]byte, error) {
+	if !encrypted {
+		return value, nil
+	}
+	aead, err := r.dataKey(user, master, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := openChunks(aead, user, value, 0, chunkCount(len(value)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "error decrypting sequence of %s", user)
+	}
+	return plaintext, nil
+}
+
+// dataKey returns the cipher of the user's data key, which is wrapped by
+// the master key.
+func (r *SQLiteRepository) dataKey(user string, master sql.NullString, wrapped []byte) (cipher.AEAD, error) {
+	if r.keys == nil {
+		return nil, ErrNoKeyring
+	}
+	if !master.Valid {
+		return nil, errors.Errorf("data key of %s has been destroyed", user)
+	}
+	key, err := r.keys.unwrap(user, master.String, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	return newAEAD(key)
+}
+
+// encrypt the plaintext with the user's data key, which is created if it
+// doesn't exist, or if fresh is true. Without a keyring, the plaintext is
+// returned as it is. The returned value is to be stored in the sequence
+// column, and encrypted in the encrypted column.
+func (r *SQLiteRepository) encrypt(ctx context.Context, tx *sql.Tx, user string, plaintext []byte, fresh bool) (value interface{}, encrypted bool, err error) {
+	if r.keys == nil {
+		return string(plaintext), false, nil
+	}
+
+	var key []byte
+	if !fresh {
+		var (
+			master  string
+			wrapped []byte
+		)
+		switch err := tx.QueryRowContext(ctx, `SELECT master, key FROM data_keys WHERE user = ?`, user).Scan(&master, &wrapped); {
+		case err == sql.ErrNoRows:
+		case err != nil:
+			return nil, false, errors.Wrap(err, "error reading data key")
+		default:
+			if key, err = r.keys.unwrap(user, master, wrapped); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+	if key == nil {
+		newKey, master, wrapped, err := r.keys.newDataKey(user)
+		if err != nil {
+			return nil, false, err
+		}
+		if _, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO data_keys (user, master, key) VALUES (?, ?, ?)`, user, master, wrapped); err != nil {
+			return nil, false, errors.Wrap(err, "error writing data key")
+		}
+		key = newKey
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, false, err
+	}
+	ciphertext, err := sealChunks(aead, user, plaintext, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	return ciphertext, true, nil
 }
@@ -2,12 +2,25 @@ package dna
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 func TestSQLiteFixture(t *testing.T) {
-	r, err := NewSQLiteRepository("file:testdata/fixture.db")
+	filename, cleanup := copyFixture(t)
+	defer cleanup()
+
+	r, err := NewSQLiteRepository("file:" + filename)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -24,46 +37,285 @@ func TestSQLiteFixture(t *testing.T) {
 	if want, have := "aaaggactgcgcgccagttaagccctgttgtt", sequence; want != have {
 		t.Errorf("Select sequence: want %q, have %q", want, have)
 	}
+
+	length, err := r.Length(context.Background(), "charlie")
+	if want, have := error(nil), err; want != have {
+		t.Errorf("Length: want %v, have %v", want, have)
+	}
+	if want, have := len(sequence), length; want != have {
+		t.Errorf("Length: want %d, have %d", want, have)
+	}
+
+	subsequence, err := r.SelectRange(context.Background(), "charlie", 3, 10)
+	if want, have := error(nil), err; want != have {
+		t.Errorf("SelectRange: want %v, have %v", want, have)
+	}
+	if want, have := sequence[3:10], subsequence; want != have {
+		t.Errorf("SelectRange: want %q, have %q", want, have)
+	}
+
+	_, err = r.SelectRange(context.Background(), "invalid user", 0, 1)
+	if want, have := ErrInvalidUser, err; want != have {
+		t.Errorf("SelectRange with bad user: want %v, have %v", want, have)
+	}
 }
 
-func TestSQLiteIntegration(t *testing.T) {
+func TestSQLiteMigrations(t *testing.T) {
+	filename, cleanup := copyFixture(t)
+	defer cleanup()
+
 	var (
-		filevar  = "DNA_INTEGRATION_TEST_FILE"
-		filename = os.Getenv(filevar)
+		ctx = context.Background()
+		urn = "file:" + filename
 	)
-	if filename == "" {
-		// If a test will write to disk, make it opt-in.
-		t.Skipf("skipping; set %s to run this test", filevar)
+
+	// The fixture predates migrations.
+	current, latest, err := SQLiteSchemaVersion(ctx, urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 0, current; want != have {
+		t.Errorf("SQLiteSchemaVersion: want %d, have %d", want, have)
 	}
 
-	if _, err := os.Stat(filename); !os.IsNotExist(err) {
-		t.Fatalf("%s: %v", filename, err)
+	if from, to, err := MigrateSQLite(ctx, urn, -1); err != nil || from != 0 || to != latest {
+		t.Fatalf("MigrateSQLite: want 0 → %d, have %d → %d (%v)", latest, from, to, err)
 	}
 
-	defer func() {
-		if err := os.Remove(filename); err != nil {
-			t.Errorf("rm %s: %v", filename, err)
-		}
-	}()
+	r, err := NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sequence, err := r.Select(ctx, "charlie"); err != nil || sequence != "aaaggactgcgcgccagttaagccctgttgtt" {
+		t.Errorf("Select after migration: have %q (%v)", sequence, err)
+	}
+	if version, err := r.Version(ctx, "charlie"); err != nil || version != 1 {
+		t.Errorf("Version after migration: want 1, have %d (%v)", version, err)
+	}
+	if topology, err := r.Topology(ctx, "charlie"); err != nil || topology != Linear {
+		t.Errorf("Topology after migration: want %v, have %v (%v)", Linear, topology, err)
+	}
+	r.db.Close()
 
-	r, err := NewSQLiteRepository("file:" + filename)
+	// Reverting to the original schema keeps the data.
+	if from, to, err := MigrateSQLite(ctx, urn, 1); err != nil || from != latest || to != 1 {
+		t.Fatalf("MigrateSQLite down: want %d → 1, have %d → %d (%v)", latest, from, to, err)
+	}
+	if from, to, err := MigrateSQLite(ctx, urn, -1); err != nil || from != 1 || to != latest {
+		t.Fatalf("MigrateSQLite up again: want 1 → %d, have %d → %d (%v)", latest, from, to, err)
+	}
+
+	r, err = NewSQLiteRepository(urn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.db.Close()
+	if sequence, err := r.Select(ctx, "charlie"); err != nil || sequence != "aaaggactgcgcgccagttaagccctgttgtt" {
+		t.Errorf("Select after migrating down and up: have %q (%v)", sequence, err)
+	}
+}
+
+func TestSQLiteQueryTimeout(t *testing.T) {
+	var (
+		ctx = context.Background()
+		urn = memoryURN(t)
+	)
+
+	// Both repositories share the same in-memory DB.
+	unbounded, err := NewRepository(urn, PoolConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounded, err := NewRepository(urn, PoolConfig{QueryTimeout: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := bounded.Insert(ctx, "vincent", "gattaca"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Insert with timeout: want %v, have %v", context.DeadlineExceeded, err)
+	}
+	if _, err := unbounded.Select(ctx, "vincent"); err != ErrInvalidUser {
+		t.Errorf("Select after timed out Insert: want %v, have %v", ErrInvalidUser, err)
+	}
+
+	if err := unbounded.Insert(ctx, "vincent", "gattaca"); err != nil {
+		t.Fatalf("Insert: %v", err)
+	}
+	if _, err := bounded.Select(ctx, "vincent"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Select with timeout: want %v, have %v", context.DeadlineExceeded, err)
+	}
+	if _, err := bounded.Append(ctx, "vincent", "gattaca", 0, 0); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("Append with timeout: want %v, have %v", context.DeadlineExceeded, err)
+	}
+	if sequence, err := unbounded.Select(ctx, "vincent"); err != nil || sequence != "gattaca" {
+		t.Errorf("Select after timed out Append: want %q, have %q (%v)", "gattaca", sequence, err)
+	}
+}
+
+func TestSQLiteRequestCanceled(t *testing.T) {
+	r, err := NewSQLiteRepository(memoryURN(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The client goes away before the request is served.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var (
+		server = NewHTTPServer(NewDefaultService(r, newMockValidator("vincent", "some_token")))
+		req    = httptest.NewRequest("POST", "/add?user=vincent&token=some_token&sequence=gattaca", nil).WithContext(ctx)
+		rec    = httptest.NewRecorder()
+	)
+	server.ServeHTTP(rec, req)
+	if want, have := http.StatusInternalServerError, rec.Code; want != have {
+		t.Errorf("add: want %d, have %d", want, have)
+	}
+	if _, err := r.Select(context.Background(), "vincent"); err != ErrInvalidUser {
+		t.Errorf("Select after canceled add: want %v, have %v", ErrInvalidUser, err)
+	}
+}
+
+func TestSQLiteStress(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode")
+	}
+
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r, err := NewSQLiteRepository("file:"+filepath.Join(dir, "stress.db"),
+		WithJournalMode("WAL"),
+		WithSynchronous("NORMAL"),
+		WithBusyTimeout(5*time.Second),
+		WithReadPool(true),
+		WithMaxOpenConns(8),
+	)
 	if err != nil {
 		t.Fatal(err)
 	}
 
 	var (
-		user     = "vincent"
-		sequence = "gattaca"
+		ctx        = context.Background()
+		goroutines = 16
+		iterations = 25
+		wg         sync.WaitGroup
 	)
-	if want, have := error(nil), r.Insert(context.Background(), user, sequence); want != have {
-		t.Fatalf("Insert: want %v, have %v", want, have)
+	if err := r.Insert(ctx, "shared", ""); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(user string) {
+			defer wg.Done()
+			if err := r.Insert(ctx, user, "gattaca"); err != nil {
+				t.Errorf("Insert(%s): %v", user, err)
+				return
+			}
+			for j := 0; j < iterations; j++ {
+				if _, err := r.Append(ctx, "shared", "a", 0, 0); err != nil {
+					t.Errorf("Append(shared): %v", err)
+					return
+				}
+				if _, err := r.Select(ctx, "shared"); err != nil {
+					t.Errorf("Select(shared): %v", err)
+					return
+				}
+				if _, err := r.SelectRange(ctx, user, 1, 4); err != nil {
+					t.Errorf("SelectRange(%s): %v", user, err)
+					return
+				}
+			}
+		}(fmt.Sprintf("user-%d", i))
+	}
+	wg.Wait()
+
+	if length, err := r.Length(ctx, "shared"); err != nil || length != goroutines*iterations {
+		t.Errorf("Length: want %d, have %d (%v)", goroutines*iterations, length, err)
+	}
+
+	var mode string
+	if err := r.db.QueryRow(`PRAGMA journal_mode`).Scan(&mode); err != nil || mode != "wal" {
+		t.Errorf("journal_mode: want %q, have %q (%v)", "wal", mode, err)
+	}
+}
+
+func TestSQLiteAccessViaOthersGroup(t *testing.T) {
+	ctx := context.Background()
+	r, err := NewSQLiteRepository(memoryURN(t))
+	if err != nil {
+		t.Fatal(err)
 	}
 
-	selected, err := r.Select(context.Background(), user)
+	// Before groups were claimed by sharing, a grant could name a group
+	// which someone else went on to create.
+	if _, err := r.db.Exec(`INSERT INTO grants (owner, grantee, is_group, access) VALUES ('alice', 'lab', 1, 'read')`); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddMember(ctx, "mallory", "lab", "mallory"); err != nil {
+		t.Fatal(err)
+	}
+	access, err := r.Access(ctx, "alice", "mallory")
 	if want, have := error(nil), err; want != have {
-		t.Fatalf("Select: want %v, have %v", want, have)
+		t.Fatalf("Access: want %v, have %v", want, have)
+	}
+	if want, have := Access(""), access; want != have {
+		t.Errorf("Access via another's group: want %q, have %q", want, have)
+	}
+}
+
+func TestSQLiteOptions(t *testing.T) {
+	for _, option := range []SQLiteOption{
+		WithJournalMode("bogus"),
+		WithSynchronous("sometimes"),
+		WithBusyTimeout(-time.Second),
+	} {
+		if _, err := NewSQLiteRepository(memoryURN(t), option); err == nil {
+			t.Errorf("NewSQLiteRepository with invalid option: want error, have none")
+		}
+	}
+}
+
+// memoryURN returns the URN of a new, empty, in-memory DB, which is shared
+// by every connection to it. The DB is named uniquely, as it outlives the
+// test when run with -count.
+func memoryURN(t *testing.T) string {
+	return fmt.Sprintf("file:%s-%d?mode=memory&cache=shared", t.Name(), time.Now().UnixNano())
+}
+
+// copyFixture copies testdata/fixture.db to a temporary file, so that tests
+// which modify the DB (including its schema) leave the fixture intact.
+func copyFixture(t *testing.T) (filename string, cleanup func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "dna")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cleanup = func() { os.RemoveAll(dir) }
+
+	src, err := os.Open("testdata/fixture.db")
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
 	}
-	if want, have := sequence, selected; want != have {
-		t.Fatalf("Select: want %v, have %v", want, have)
+	defer src.Close()
+
+	filename = filepath.Join(dir, "fixture.db")
+	dst, err := os.Create(filename)
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
 	}
+	defer dst.Close()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+
+	return filename, cleanup
 }
@@ -0,0 +1,64 @@
+package dna
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// Seed is a set of DNA sequences to load into a repository, e.g. for
+// development or tests. Repositories start out empty; production DBs
+// shouldn't be seeded. It's the JSON structure of a seed file, which may
+// contain other sections for other services.
+//
+//	{"sequences": [{"user": "alice", "sequence": "gattaca"}]}
+type Seed struct {
+	Sequences []SeedSequence `json:"sequences"`
+}
+
+// SeedSequence is a user's DNA sequence. Topology is optional, and
+// defaults to linear.
+type SeedSequence struct {
+	User     string   `json:"user"`
+	Sequence string   `json:"sequence"`
+	Topology Topology `json:"topology,omitempty"`
+}
+
+// LoadSeed reads a seed file from r, and inserts its sequences in the repo.
+// Users that already have a sequence are skipped, so a seed file can be
+// loaded more than once.
+func LoadSeed(ctx context.Context, repo Repository, r io.Reader) (created, skipped int, err error) {
+	var seed Seed
+	if err := json.NewDecoder(r).Decode(&seed); err != nil {
+		return 0, 0, errors.Wrap(err, "error decoding seed file")
+	}
+
+	for _, s := range seed.Sequences {
+		if !validSequence(s.Sequence) {
+			return created, skipped, errors.Wrapf(ErrInvalidSequence, "user %s", s.User)
+		}
+		if s.Topology != "" && s.Topology != Linear && s.Topology != Circular {
+			return created, skipped, errors.Wrapf(ErrInvalidTopology, "user %s", s.User)
+		}
+
+		switch err := repo.Insert(ctx, s.User, s.Sequence); err {
+		case nil:
+			created++
+		case ErrSequenceExists:
+			skipped++
+			continue
+		default:
+			return created, skipped, errors.Wrapf(err, "error inserting sequence for user %s", s.User)
+		}
+
+		if s.Topology == Circular {
+			if _, err := repo.SetTopology(ctx, s.User, s.Topology, 0); err != nil {
+				return created, skipped, errors.Wrapf(err, "error setting topology for user %s", s.User)
+			}
+		}
+	}
+
+	return created, skipped, nil
+}
@@ -0,0 +1,56 @@
+package dna
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLoadSeed(t *testing.T) {
+	r := NewMemoryRepository()
+
+	// A new repository starts out empty.
+	if _, err := r.Select(context.Background(), "alice"); err != ErrInvalidUser {
+		t.Errorf("Select before LoadSeed: want %v, have %v", ErrInvalidUser, err)
+	}
+
+	for _, want := range []struct{ created, skipped int }{
+		{2, 0},
+		{0, 2}, // loading again is a no-op
+	} {
+		f, err := os.Open("testdata/seed.json")
+		if err != nil {
+			t.Fatal(err)
+		}
+		created, skipped, err := LoadSeed(context.Background(), r, f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("LoadSeed: %v", err)
+		}
+		if created != want.created || skipped != want.skipped {
+			t.Errorf("LoadSeed: want %d created %d skipped, have %d created %d skipped", want.created, want.skipped, created, skipped)
+		}
+	}
+
+	if _, err := r.Select(context.Background(), "alice"); err != nil {
+		t.Errorf("Select after LoadSeed: %v", err)
+	}
+}
+
+func TestLoadSeedTopology(t *testing.T) {
+	r := NewMemoryRepository()
+
+	seed := `{"sequences": [{"user": "pUC19", "sequence": "gattaca", "topology": "circular"}]}`
+	if _, _, err := LoadSeed(context.Background(), r, strings.NewReader(seed)); err != nil {
+		t.Fatalf("LoadSeed: %v", err)
+	}
+	if topology, _ := r.Topology(context.Background(), "pUC19"); topology != Circular {
+		t.Errorf("Topology: want %v, have %v", Circular, topology)
+	}
+
+	invalid := `{"sequences": [{"user": "vincent", "sequence": "metallica"}]}`
+	if _, _, err := LoadSeed(context.Background(), r, strings.NewReader(invalid)); err == nil {
+		t.Errorf("LoadSeed with invalid sequence: want error, have none")
+	}
+}
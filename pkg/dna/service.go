@@ -2,22 +2,50 @@ package dna
 
 import (
 	"context"
+	"io"
 	"strings"
+	"time"
 
+	"github.com/peterbourgon/gattaca/pkg/rbac"
 	"github.com/pkg/errors"
 )
 
 // Service describes the expected behavior of the DNA sequence service.
-// Users can add their DNA, and check if subsequences exist.
+// Users can add their DNA, check if subsequences exist, and extract
+// regions of what they've stored. They can also correct, extend, or
+// remove their DNA; those writes are guarded by the version of the
+// sequence they last read. Users can share their DNA with other users and
+// groups, directly or by invitation. Admins can read anyone's sample, and
+// analysts can search across every user's DNA.
 type Service interface {
 	Add(ctx context.Context, user, token, sequence string) error
-	Check(ctx context.Context, user, token, subsequence string) error
+	Check(ctx context.Context, user, token, owner, subsequence string) error
+	Slice(ctx context.Context, user, token string, start, end int, strand Strand, w io.Writer) error
+	Version(ctx context.Context, user, token string) (version int, err error)
+	Update(ctx context.Context, user, token, sequence string, version int) (newVersion int, err error)
+	Append(ctx context.Context, user, token, sequence string, version int) (newVersion int, err error)
+	Delete(ctx context.Context, user, token string, version int) error
+	Diff(ctx context.Context, user, token, reference string) ([]Variant, error)
+	Digest(ctx context.Context, user, token string, enzymes []string) (Digestion, error)
+	SetTopology(ctx context.Context, user, token string, topology Topology, version int) (newVersion int, err error)
+	Sample(ctx context.Context, user, token, owner string, w io.Writer) error
+	Search(ctx context.Context, user, token, subsequence string) (owners []string, err error)
+	Share(ctx context.Context, user, token string, grant Grant) error
+	Unshare(ctx context.Context, user, token, grantee string, group bool) error
+	Grants(ctx context.Context, user, token string) ([]Grant, error)
+	AddMember(ctx context.Context, user, token, group, member string) error
+	RemoveMember(ctx context.Context, user, token, group, member string) error
+	Invite(ctx context.Context, user, token, invitee string, access Access, ttl time.Duration) (Invitation, error)
+	Accept(ctx context.Context, user, token, code string) (Invitation, error)
+	Usage(ctx context.Context, user, token, owner string) (Usage, error)
 }
 
 // DefaultService provides our DNA sequence business logic.
 type DefaultService struct {
-	repo  Repository
-	valid Validator
+	repo       Repository
+	valid      Validator
+	references map[string]bool
+	quota      Quota
 }
 
 var (
@@ -27,34 +55,144 @@ var (
 	// ErrBadAuth is returned if a user validation check fails.
 	ErrBadAuth = errors.New("bad auth")
 
+	// ErrForbidden is returned if a validated user lacks the permission
+	// to access another user's DNA.
+	ErrForbidden = errors.New("forbidden")
+
 	// ErrInvalidSequence is returned if an invalid sequence is added.
 	ErrInvalidSequence = errors.New("invalid DNA sequence")
+
+	// ErrInvalidRange is returned by Slice if the region is out of bounds.
+	ErrInvalidRange = errors.New("invalid range")
+
+	// ErrInvalidReference is returned by Diff if the reference sequence
+	// doesn't exist, or isn't available as a reference.
+	ErrInvalidReference = errors.New("invalid reference")
+
+	// ErrTooDivergent is returned by Diff if the sequence and the reference
+	// are too long, or differ too much in length, to be aligned.
+	ErrTooDivergent = errors.New("sequences too divergent to align")
+
+	// ErrInvalidTopology is returned by SetTopology for an unknown topology.
+	ErrInvalidTopology = errors.New("invalid topology")
+
+	// ErrQuotaExceeded is returned by writes which would take the user's
+	// storage past their quota.
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
 )
 
+// Quota limits how much DNA each user may store. Zero values are unlimited.
+// Repositories hold one sample per user, so any MaxSamples allows it.
+type Quota struct {
+	MaxBases   int `json:"max_bases"`
+	MaxSamples int `json:"max_samples"`
+}
+
+// Usage is how much DNA a user stores, and their quota.
+type Usage struct {
+	Bases   int   `json:"bases"`
+	Samples int   `json:"samples"`
+	Quota   Quota `json:"quota"`
+}
+
+// Topology is the shape of a DNA sequence. Plasmids and mitochondrial
+// genomes are circular; the origin is wherever the stored sequence starts.
+type Topology string
+
+const (
+	// Linear sequences have two ends. It's the default.
+	Linear Topology = "linear"
+
+	// Circular sequences wrap around from their last base to their first.
+	Circular Topology = "circular"
+)
+
+// Strand selects which strand of the sequence Slice reads from.
+type Strand int
+
+const (
+	// Forward is the strand as it was stored.
+	Forward Strand = iota
+
+	// Reverse is the reverse complement of the stored strand.
+	Reverse
+)
+
+// sliceChunkSize is the number of bases Slice reads from the
+// repository at a time.
+const sliceChunkSize = 4096
+
 // Repository is a client-side interface, which models
 // the concrete e.g. SQLiteRepository.
 type Repository interface {
 	Insert(ctx context.Context, user, sequence string) error
 	Select(ctx context.Context, user string) (sequence string, err error)
+	SelectRange(ctx context.Context, user string, start, end int) (subsequence string, err error)
+	Length(ctx context.Context, user string) (int, error)
+	Version(ctx context.Context, user string) (version int, err error)
+	Update(ctx context.Context, user, sequence string, version int) (newVersion int, err error)
+	Append(ctx context.Context, user, sequence string, version, maxLength int) (newVersion int, err error)
+	Delete(ctx context.Context, user string, version int) error
+	Purge(ctx context.Context, before time.Time) (n int, err error)
+	Topology(ctx context.Context, user string) (Topology, error)
+	SetTopology(ctx context.Context, user string, topology Topology, version int) (newVersion int, err error)
+	Users(ctx context.Context) ([]string, error)
+	Share(ctx context.Context, owner string, grant Grant) error
+	Unshare(ctx context.Context, owner, grantee string, group bool) error
+	Grants(ctx context.Context, owner string) ([]Grant, error)
+	Access(ctx context.Context, owner, user string) (Access, error)
+	AddMember(ctx context.Context, owner, group, member string) error
+	RemoveMember(ctx context.Context, owner, group, member string) error
+	Invite(ctx context.Context, inv Invitation) error
+	Accept(ctx context.Context, code, user string, now time.Time) (Invitation, error)
+	Backup(ctx context.Context, filename string) error
+	Export(ctx context.Context, user string) (*UserData, error)
+	Erase(ctx context.Context, user string) error
 }
 
 // Validator is a client-side interface, which models
 // the parts of the auth service that we use.
 type Validator interface {
-	Validate(ctx context.Context, user, token string) error
+	Validate(ctx context.Context, user, token string) (rbac.Principal, error)
 }
 
 // NewDefaultService returns a usable service, wrapping a repository.
-func NewDefaultService(r Repository, v Validator) *DefaultService {
-	return &DefaultService{
-		repo:  r,
-		valid: v,
+func NewDefaultService(r Repository, v Validator, options ...Option) *DefaultService {
+	s := &DefaultService{
+		repo:       r,
+		valid:      v,
+		references: map[string]bool{},
+	}
+	for _, option := range options {
+		option(s)
+	}
+	return s
+}
+
+// Option configures a DefaultService.
+type Option func(*DefaultService)
+
+// WithReferences makes the sequences stored under the given names available
+// to every user as references for Diff. Other sequences remain private.
+func WithReferences(names ...string) Option {
+	return func(s *DefaultService) {
+		for _, name := range names {
+			s.references[name] = true
+		}
+	}
+}
+
+// WithQuota limits how much DNA each user may store. Writes which would
+// exceed it fail with ErrQuotaExceeded.
+func WithQuota(q Quota) Option {
+	return func(s *DefaultService) {
+		s.quota = q
 	}
 }
 
 // Add a user and their DNA sequence to the database.
 func (s *DefaultService) Add(ctx context.Context, user, token, sequence string) (err error) {
-	if err := s.valid.Validate(ctx, user, token); err != nil {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
 		return ErrBadAuth
 	}
 
@@ -62,6 +200,12 @@ func (s *DefaultService) Add(ctx context.Context, user, token, sequence string)
 		return ErrInvalidSequence
 	}
 
+	// Users have at most one sample, so the new sequence is all they'd
+	// store; if they already have one, Insert fails with ErrSequenceExists.
+	if !s.quota.allows(len(sequence), 1) {
+		return ErrQuotaExceeded
+	}
+
 	if err := s.repo.Insert(ctx, user, sequence); err != nil {
 		return errors.Wrap(err, "error adding new user")
 	}
@@ -69,24 +213,618 @@ func (s *DefaultService) Add(ctx context.Context, user, token, sequence string)
 	return nil
 }
 
-// Check returns true if the given subsequence is present in the user's DNA.
-func (s *DefaultService) Check(ctx context.Context, user, token, subsequence string) (err error) {
-	if err := s.valid.Validate(ctx, user, token); err != nil {
+// Check returns true if the given subsequence is present in the owner's
+// DNA. Users may check their own DNA, and that of owners who've granted them
+// access. If the DNA is circular, the subsequence may span the origin.
+func (s *DefaultService) Check(ctx context.Context, user, token, owner, subsequence string) (err error) {
+	p, err := s.valid.Validate(ctx, user, token)
+	if err != nil {
 		return ErrBadAuth
 	}
 
+	if err := s.authorize(ctx, p, owner, SearchAccess); err != nil {
+		return err
+	}
+
+	found, err := s.contains(ctx, owner, subsequence)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrSubsequenceNotFound
+	}
+
+	return nil
+}
+
+// contains returns true if the subsequence is present in the user's DNA.
+func (s *DefaultService) contains(ctx context.Context, user, subsequence string) (bool, error) {
 	sequence, err := s.repo.Select(ctx, user)
 	if err != nil {
-		return errors.Wrap(err, "error reading DNA sequence from repository")
+		return false, errors.Wrap(err, "error reading DNA sequence from repository")
 	}
 
-	if !strings.Contains(sequence, subsequence) {
-		return ErrSubsequenceNotFound
+	topology, err := s.repo.Topology(ctx, user)
+	if err != nil {
+		return false, errors.Wrap(err, "error reading DNA sequence topology from repository")
+	}
+
+	// On a circular sequence, the subsequence may span the origin.
+	if topology == Circular {
+		sequence = circularize(sequence, len(subsequence)-1)
+	}
+
+	return strings.Contains(sequence, subsequence), nil
+}
+
+// Slice writes the bases of the user's DNA in the half-open, 0-based
+// region [start, end) to w. The region is read from the repository in
+// chunks, so the whole sequence is never held in memory. If strand is
+// Reverse, the reverse complement of the region is written. If the
+// sequence is circular, end may be up to a full turn past start, so
+// regions spanning the origin can be read.
+func (s *DefaultService) Slice(ctx context.Context, user, token string, start, end int, strand Strand, w io.Writer) (err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return ErrBadAuth
+	}
+
+	length, err := s.repo.Length(ctx, user)
+	if err == ErrInvalidUser {
+		return ErrInvalidUser
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reading DNA sequence length from repository")
+	}
+
+	topology, err := s.repo.Topology(ctx, user)
+	if err != nil {
+		return errors.Wrap(err, "error reading DNA sequence topology from repository")
 	}
 
+	if strand != Forward && strand != Reverse {
+		return errors.Errorf("invalid strand %d", strand)
+	}
+
+	// A region of a circular sequence may run past the end of the sequence,
+	// around the origin, and on from the start.
+	limit := length
+	if topology == Circular && start < length {
+		limit = start + length
+	}
+	if start < 0 || end < start || end > limit {
+		return ErrInvalidRange
+	}
+
+	segments := [][2]int{{start, end}}
+	if end > length {
+		segments = [][2]int{{start, length}, {0, end - length}}
+	}
+
+	if strand == Reverse {
+		for i := len(segments) - 1; i >= 0; i-- {
+			if err := s.writeRange(ctx, user, segments[i][0], segments[i][1], strand, w); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, segment := range segments {
+		if err := s.writeRange(ctx, user, segment[0], segment[1], strand, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeRange writes the bases of the user's DNA in the region [start, end)
+// to w, reading them from the repository in chunks.
+func (s *DefaultService) writeRange(ctx context.Context, user string, start, end int, strand Strand, w io.Writer) error {
+	if strand == Forward {
+		for lo := start; lo < end; lo += sliceChunkSize {
+			hi := lo + sliceChunkSize
+			if hi > end {
+				hi = end
+			}
+			chunk, err := s.repo.SelectRange(ctx, user, lo, hi)
+			if err != nil {
+				return errors.Wrap(err, "error reading DNA sequence from repository")
+			}
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return errors.Wrap(err, "error writing DNA sequence")
+			}
+		}
+		return nil
+	}
+
+	for hi := end; hi > start; hi -= sliceChunkSize {
+		lo := hi - sliceChunkSize
+		if lo < start {
+			lo = start
+		}
+		chunk, err := s.repo.SelectRange(ctx, user, lo, hi)
+		if err != nil {
+			return errors.Wrap(err, "error reading DNA sequence from repository")
+		}
+		if _, err := io.WriteString(w, reverseComplement(chunk)); err != nil {
+			return errors.Wrap(err, "error writing DNA sequence")
+		}
+	}
 	return nil
 }
 
+// Version returns the current version of the user's DNA sequence. It should
+// be passed to Update, Append, or Delete, which fail with ErrVersionMismatch
+// if the sequence has changed in the meantime.
+func (s *DefaultService) Version(ctx context.Context, user, token string) (version int, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return 0, ErrBadAuth
+	}
+
+	version, err = s.repo.Version(ctx, user)
+	if err == ErrInvalidUser {
+		return 0, ErrInvalidUser
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading DNA sequence version from repository")
+	}
+
+	return version, nil
+}
+
+// Update replaces the user's DNA sequence. A version of 0 skips the check
+// against the current version.
+func (s *DefaultService) Update(ctx context.Context, user, token, sequence string, version int) (newVersion int, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return 0, ErrBadAuth
+	}
+
+	if !validSequence(sequence) {
+		return 0, ErrInvalidSequence
+	}
+
+	if !s.quota.allows(len(sequence), 1) {
+		return 0, ErrQuotaExceeded
+	}
+
+	newVersion, err = s.repo.Update(ctx, user, sequence, version)
+	switch {
+	case err == nil:
+		return newVersion, nil
+	case err == ErrInvalidUser, err == ErrVersionMismatch:
+		return 0, err
+	default:
+		return 0, errors.Wrap(err, "error updating DNA sequence")
+	}
+}
+
+// Append adds bases to the end of the user's DNA sequence, e.g. from an
+// incremental sequencing run. A version of 0 skips the check against the
+// current version.
+func (s *DefaultService) Append(ctx context.Context, user, token, sequence string, version int) (newVersion int, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return 0, ErrBadAuth
+	}
+
+	if !validSequence(sequence) {
+		return 0, ErrInvalidSequence
+	}
+
+	// The repository checks the length in the same transaction as the
+	// write, so concurrent appends can't together exceed the quota.
+	newVersion, err = s.repo.Append(ctx, user, sequence, version, s.quota.MaxBases)
+	switch {
+	case err == nil:
+		return newVersion, nil
+	case err == ErrInvalidUser, err == ErrVersionMismatch:
+		return 0, err
+	case err == ErrTooLong:
+		return 0, ErrQuotaExceeded
+	default:
+		return 0, errors.Wrap(err, "error appending to DNA sequence")
+	}
+}
+
+// Delete removes the user's DNA sequence. A version of 0 skips the check
+// against the current version. The sequence isn't purged from the
+// repository until its retention window has passed.
+func (s *DefaultService) Delete(ctx context.Context, user, token string, version int) (err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return ErrBadAuth
+	}
+
+	err = s.repo.Delete(ctx, user, version)
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrInvalidUser, err == ErrVersionMismatch:
+		return err
+	default:
+		return errors.Wrap(err, "error deleting DNA sequence")
+	}
+}
+
+// Diff aligns the user's DNA sequence against the named reference sequence,
+// and returns the SNVs and small indels that distinguish them. The reference
+// must be the user's own sequence, or one made available via WithReferences.
+func (s *DefaultService) Diff(ctx context.Context, user, token, reference string) (variants []Variant, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return nil, ErrBadAuth
+	}
+
+	if reference != user && !s.references[reference] {
+		return nil, ErrInvalidReference
+	}
+
+	sample, err := s.repo.Select(ctx, user)
+	if err == ErrInvalidUser {
+		return nil, ErrInvalidUser
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading DNA sequence from repository")
+	}
+
+	ref, err := s.repo.Select(ctx, reference)
+	if err == ErrInvalidUser {
+		return nil, ErrInvalidReference
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading reference sequence from repository")
+	}
+
+	return callVariants(ref, sample)
+}
+
+// Digest simulates a restriction digest of the user's DNA sequence with one
+// or more enzymes from the catalogue, returning where each enzyme cuts and
+// the lengths of the resulting fragments. If the sequence is circular, e.g.
+// a plasmid, sites may span the origin.
+func (s *DefaultService) Digest(ctx context.Context, user, token string, enzymes []string) (d Digestion, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return Digestion{}, ErrBadAuth
+	}
+
+	catalogued := make([]Enzyme, len(enzymes))
+	for i, name := range enzymes {
+		e, ok := Enzymes[name]
+		if !ok {
+			return Digestion{}, ErrUnknownEnzyme
+		}
+		catalogued[i] = e
+	}
+
+	sequence, err := s.repo.Select(ctx, user)
+	if err == ErrInvalidUser {
+		return Digestion{}, ErrInvalidUser
+	}
+	if err != nil {
+		return Digestion{}, errors.Wrap(err, "error reading DNA sequence from repository")
+	}
+
+	topology, err := s.repo.Topology(ctx, user)
+	if err != nil {
+		return Digestion{}, errors.Wrap(err, "error reading DNA sequence topology from repository")
+	}
+
+	return digest(sequence, catalogued, topology == Circular), nil
+}
+
+// SetTopology marks the user's DNA sequence as linear or circular. A version
+// of 0 skips the check against the current version.
+func (s *DefaultService) SetTopology(ctx context.Context, user, token string, topology Topology, version int) (newVersion int, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return 0, ErrBadAuth
+	}
+
+	if topology != Linear && topology != Circular {
+		return 0, ErrInvalidTopology
+	}
+
+	newVersion, err = s.repo.SetTopology(ctx, user, topology, version)
+	switch {
+	case err == nil:
+		return newVersion, nil
+	case err == ErrInvalidUser, err == ErrVersionMismatch:
+		return 0, err
+	default:
+		return 0, errors.Wrap(err, "error setting DNA sequence topology")
+	}
+}
+
+// Sample writes the owner's whole DNA sequence to w. Users may read their
+// own sample, and those of owners who've granted them read access; reading
+// anyone else's requires the rbac.ReadAny permission.
+func (s *DefaultService) Sample(ctx context.Context, user, token, owner string, w io.Writer) (err error) {
+	p, err := s.valid.Validate(ctx, user, token)
+	if err != nil {
+		return ErrBadAuth
+	}
+
+	if err := s.authorize(ctx, p, owner, ReadAccess); err != nil {
+		return err
+	}
+
+	length, err := s.repo.Length(ctx, owner)
+	if err == ErrInvalidUser {
+		return ErrInvalidUser
+	}
+	if err != nil {
+		return errors.Wrap(err, "error reading DNA sequence length from repository")
+	}
+
+	return s.writeRange(ctx, owner, 0, length, Forward, w)
+}
+
+// Search returns the users whose DNA contains the subsequence, in order.
+// It requires the rbac.SearchAll permission.
+func (s *DefaultService) Search(ctx context.Context, user, token, subsequence string) (owners []string, err error) {
+	p, err := s.valid.Validate(ctx, user, token)
+	if err != nil {
+		return nil, ErrBadAuth
+	}
+
+	if !p.Can(rbac.SearchAll) {
+		return nil, ErrForbidden
+	}
+
+	if !validSequence(subsequence) {
+		return nil, ErrInvalidSequence
+	}
+
+	users, err := s.repo.Users(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "error listing users from repository")
+	}
+
+	for _, candidate := range users {
+		found, err := s.contains(ctx, candidate, subsequence)
+		if errors.Cause(err) == ErrInvalidUser {
+			continue // deleted since listing
+		}
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			owners = append(owners, candidate)
+		}
+	}
+	return owners, nil
+}
+
+// Usage returns how much DNA the owner stores, and their quota. Users may
+// read their own usage; reading anyone else's requires the rbac.ReadAny
+// permission.
+func (s *DefaultService) Usage(ctx context.Context, user, token, owner string) (u Usage, err error) {
+	p, err := s.valid.Validate(ctx, user, token)
+	if err != nil {
+		return Usage{}, ErrBadAuth
+	}
+
+	if owner != p.User && !p.Can(rbac.ReadAny) {
+		return Usage{}, ErrForbidden
+	}
+
+	return s.usage(ctx, owner)
+}
+
+// usage returns how much DNA the user stores, and their quota.
+func (s *DefaultService) usage(ctx context.Context, user string) (Usage, error) {
+	length, err := s.repo.Length(ctx, user)
+	switch {
+	case err == ErrInvalidUser:
+		return Usage{Quota: s.quota}, nil
+	case err != nil:
+		return Usage{}, errors.Wrap(err, "error reading DNA sequence length from repository")
+	}
+	return Usage{Bases: length, Samples: 1, Quota: s.quota}, nil
+}
+
+// allows returns true if a user may store the given bases and samples.
+func (q Quota) allows(bases, samples int) bool {
+	if q.MaxBases > 0 && bases > q.MaxBases {
+		return false
+	}
+	if q.MaxSamples > 0 && samples > q.MaxSamples {
+		return false
+	}
+	return true
+}
+
+// authorize returns nil if the principal may access the owner's DNA as
+// wanted: because it's their own, their role permits it, or the owner's ACL
+// grants it. Otherwise it returns ErrForbidden.
+func (s *DefaultService) authorize(ctx context.Context, p rbac.Principal, owner string, want Access) error {
+	switch {
+	case owner == p.User:
+		return nil
+	case want == SearchAccess && p.Can(rbac.SearchAll):
+		return nil
+	case p.Can(rbac.ReadAny):
+		return nil
+	}
+
+	have, err := s.repo.Access(ctx, owner, p.User)
+	if err != nil {
+		return errors.Wrap(err, "error reading grants from repository")
+	}
+	if !have.allows(want) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Share adds the grant to the ACL of the user's DNA, replacing any grant to
+// the same user or group. Users may only share with groups they own, which
+// are created if they don't exist.
+func (s *DefaultService) Share(ctx context.Context, user, token string, grant Grant) (err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return ErrBadAuth
+	}
+
+	if !grant.Access.valid() {
+		return ErrInvalidAccess
+	}
+
+	err = s.repo.Share(ctx, user, grant)
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrForbidden:
+		return err
+	default:
+		return errors.Wrap(err, "error sharing DNA sequence")
+	}
+}
+
+// Unshare removes any grant to the user or group from the ACL of the user's
+// DNA.
+func (s *DefaultService) Unshare(ctx context.Context, user, token, grantee string, group bool) (err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return ErrBadAuth
+	}
+
+	if err := s.repo.Unshare(ctx, user, grantee, group); err != nil {
+		return errors.Wrap(err, "error unsharing DNA sequence")
+	}
+	return nil
+}
+
+// Grants returns the ACL of the user's DNA.
+func (s *DefaultService) Grants(ctx context.Context, user, token string) (grants []Grant, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return nil, ErrBadAuth
+	}
+
+	grants, err = s.repo.Grants(ctx, user)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading grants from repository")
+	}
+	return grants, nil
+}
+
+// AddMember adds the member to the group, which is created, owned by the
+// user, if it doesn't exist. Only the owner of a group may change it.
+func (s *DefaultService) AddMember(ctx context.Context, user, token, group, member string) (err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return ErrBadAuth
+	}
+
+	err = s.repo.AddMember(ctx, user, group, member)
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrForbidden:
+		return err
+	default:
+		return errors.Wrap(err, "error adding group member")
+	}
+}
+
+// RemoveMember removes the member from the group. Only the owner of a group
+// may change it.
+func (s *DefaultService) RemoveMember(ctx context.Context, user, token, group, member string) (err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return ErrBadAuth
+	}
+
+	err = s.repo.RemoveMember(ctx, user, group, member)
+	switch {
+	case err == nil:
+		return nil
+	case err == ErrForbidden:
+		return err
+	default:
+		return errors.Wrap(err, "error removing group member")
+	}
+}
+
+// Invite offers the invitee access to the user's DNA. The invitee gets the
+// access once they accept the invitation, which they must do within ttl.
+// The invitation's code should be passed to them out of band.
+func (s *DefaultService) Invite(ctx context.Context, user, token, invitee string, access Access, ttl time.Duration) (inv Invitation, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return Invitation{}, ErrBadAuth
+	}
+
+	if !access.valid() {
+		return Invitation{}, ErrInvalidAccess
+	}
+	if ttl <= 0 {
+		return Invitation{}, errors.Errorf("invalid invitation TTL %s", ttl)
+	}
+
+	code, err := newInvitationCode()
+	if err != nil {
+		return Invitation{}, err
+	}
+	inv = Invitation{
+		Code:    code,
+		Owner:   user,
+		Invitee: invitee,
+		Access:  access,
+		Expires: time.Now().Add(ttl).UTC().Truncate(time.Second),
+	}
+	if err := s.repo.Invite(ctx, inv); err != nil {
+		return Invitation{}, errors.Wrap(err, "error saving invitation")
+	}
+	return inv, nil
+}
+
+// Accept accepts an invitation addressed to the user, which grants them its
+// access to the owner's DNA.
+func (s *DefaultService) Accept(ctx context.Context, user, token, code string) (inv Invitation, err error) {
+	if _, err := s.valid.Validate(ctx, user, token); err != nil {
+		return Invitation{}, ErrBadAuth
+	}
+
+	inv, err = s.repo.Accept(ctx, code, user, time.Now())
+	switch {
+	case err == nil:
+		return inv, nil
+	case err == ErrInvalidInvitation:
+		return Invitation{}, err
+	default:
+		return Invitation{}, errors.Wrap(err, "error accepting invitation")
+	}
+}
+
+// circularize returns the sequence followed by its first extra bases, going
+// around again as many times as necessary, so that a search of the result
+// finds matches that span the origin of a circular sequence.
+func circularize(sequence string, extra int) string {
+	if sequence == "" || extra <= 0 {
+		return sequence
+	}
+	result := sequence
+	for len(result) < len(sequence)+extra {
+		result += sequence
+	}
+	return result[:len(sequence)+extra]
+}
+
+func reverseComplement(sequence string) string {
+	p := make([]byte, len(sequence))
+	for i := 0; i < len(sequence); i++ {
+		p[len(p)-1-i] = complement(sequence[i])
+	}
+	return string(p)
+}
+
+func complement(b byte) byte {
+	switch b {
+	case 'a':
+		return 't'
+	case 't':
+		return 'a'
+	case 'g':
+		return 'c'
+	case 'c':
+		return 'g'
+	default:
+		return b
+	}
+}
+
 func validSequence(sequence string) bool {
 	for _, r := range sequence {
 		switch r {
@@ -1,15 +1,23 @@
 package dna
 
 import (
+	"bytes"
 	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/peterbourgon/gattaca/pkg/rbac"
 	"github.com/pkg/errors"
 )
 
 func TestFlow(t *testing.T) {
 	var (
-		repo  = newMockRepo()
+		repo  = NewMemoryRepository()
 		user  = "vincent"
 		token = "some_token"
 		valid = newMockValidator(user, token)
@@ -33,7 +41,7 @@ func TestFlow(t *testing.T) {
 		"gata":     ErrSubsequenceNotFound,
 		"gattacaa": ErrSubsequenceNotFound,
 	} {
-		if have := s.Check(context.Background(), "vincent", "some_token", subsequence); want != have {
+		if have := s.Check(context.Background(), "vincent", "some_token", "vincent", subsequence); want != have {
 			t.Errorf("Check(%q): want %v, have %v", subsequence, want, have)
 		}
 	}
@@ -47,7 +55,7 @@ func TestValidSequences(t *testing.T) {
 		"metallica": ErrInvalidSequence,
 	} {
 		var (
-			repo  = newMockRepo()
+			repo  = NewMemoryRepository()
 			user  = "foo"
 			token = "bar"
 			valid = newMockValidator(user, token)
@@ -59,35 +67,463 @@ func TestValidSequences(t *testing.T) {
 	}
 }
 
-type mockRepo struct {
-	dna map[string]string
+func TestSlice(t *testing.T) {
+	var (
+		repo  = NewMemoryRepository()
+		user  = "vincent"
+		token = "some_token"
+		valid = newMockValidator(user, token)
+		s     = NewDefaultService(repo, valid)
+	)
+
+	if want, have := error(nil), s.Add(context.Background(), user, token, "gattaca"); want != have {
+		t.Fatalf("Add: want %v, have %v", want, have)
+	}
+
+	for _, testcase := range []struct {
+		start, end int
+		strand     Strand
+		want       string
+		err        error
+	}{
+		{0, 7, Forward, "gattaca", nil},
+		{1, 4, Forward, "att", nil},
+		{3, 3, Forward, "", nil},
+		{0, 7, Reverse, "tgtaatc", nil},
+		{1, 4, Reverse, "aat", nil},
+		{-1, 4, Forward, "", ErrInvalidRange},
+		{4, 1, Forward, "", ErrInvalidRange},
+		{0, 8, Forward, "", ErrInvalidRange},
+	} {
+		var buf bytes.Buffer
+		err := s.Slice(context.Background(), user, token, testcase.start, testcase.end, testcase.strand, &buf)
+		if want, have := testcase.err, err; want != have {
+			t.Errorf("Slice(%d, %d, %d): want error %v, have %v", testcase.start, testcase.end, testcase.strand, want, have)
+			continue
+		}
+		if want, have := testcase.want, buf.String(); want != have {
+			t.Errorf("Slice(%d, %d, %d): want %q, have %q", testcase.start, testcase.end, testcase.strand, want, have)
+		}
+	}
+
+	if want, have := ErrBadAuth, s.Slice(context.Background(), user, "invalid_token", 0, 1, Forward, &bytes.Buffer{}); want != have {
+		t.Errorf("Slice with bad token: want %v, have %v", want, have)
+	}
 }
 
-func newMockRepo() *mockRepo {
-	return &mockRepo{
-		dna: map[string]string{},
+func TestSliceChunks(t *testing.T) {
+	var (
+		repo     = NewMemoryRepository()
+		user     = "vincent"
+		token    = "some_token"
+		valid    = newMockValidator(user, token)
+		s        = NewDefaultService(repo, valid)
+		sequence = strings.Repeat("gattaca", sliceChunkSize/2) // several chunks
+	)
+
+	if want, have := error(nil), s.Add(context.Background(), user, token, sequence); want != have {
+		t.Fatalf("Add: want %v, have %v", want, have)
+	}
+
+	var forward bytes.Buffer
+	if want, have := error(nil), s.Slice(context.Background(), user, token, 1, len(sequence)-1, Forward, &forward); want != have {
+		t.Fatalf("Slice: want %v, have %v", want, have)
+	}
+	if want, have := sequence[1:len(sequence)-1], forward.String(); want != have {
+		t.Errorf("Slice Forward: mismatch (want %d bases, have %d)", len(want), len(have))
+	}
+
+	var reverse bytes.Buffer
+	if want, have := error(nil), s.Slice(context.Background(), user, token, 1, len(sequence)-1, Reverse, &reverse); want != have {
+		t.Fatalf("Slice: want %v, have %v", want, have)
+	}
+	if want, have := reverseComplement(sequence[1:len(sequence)-1]), reverse.String(); want != have {
+		t.Errorf("Slice Reverse: mismatch (want %d bases, have %d)", len(want), len(have))
 	}
 }
 
-func (r *mockRepo) Insert(ctx context.Context, user, sequence string) error {
-	if _, ok := r.dna[user]; ok {
-		return errors.New("user already exists")
+func TestStreamWriter(t *testing.T) {
+	// An error before a chunk is written keeps its status code.
+	rec := httptest.NewRecorder()
+	sw := &streamWriter{w: rec}
+	sw.Write([]byte("gat"))
+	sw.fail(ErrInvalidRange)
+	if want, have := http.StatusBadRequest, rec.Code; want != have {
+		t.Errorf("fail before a chunk: want %d, have %d", want, have)
+	}
+	if body := rec.Body.String(); strings.Contains(body, "gat") {
+		t.Errorf("fail before a chunk: bases written: %q", body)
 	}
 
-	r.dna[user] = sequence
-	return nil
+	// An error after a chunk is written aborts the response.
+	rec = httptest.NewRecorder()
+	sw = &streamWriter{w: rec}
+	sw.Write([]byte(strings.Repeat("a", sliceChunkSize)))
+	defer func() {
+		if want, have := interface{}(http.ErrAbortHandler), recover(); want != have {
+			t.Errorf("fail after a chunk: want panic %v, have %v", want, have)
+		}
+		if want, have := sliceChunkSize, rec.Body.Len(); want != have {
+			t.Errorf("fail after a chunk: want %d bytes, have %d", want, have)
+		}
+	}()
+	sw.fail(ErrInvalidRange)
 }
 
-func (r *mockRepo) Select(ctx context.Context, user string) (sequence string, err error) {
-	sequence, ok := r.dna[user]
-	if !ok {
-		return "", ErrInvalidUser
+func TestWrites(t *testing.T) {
+	var (
+		repo  = NewMemoryRepository()
+		user  = "vincent"
+		token = "some_token"
+		valid = newMockValidator(user, token)
+		s     = NewDefaultService(repo, valid)
+		ctx   = context.Background()
+	)
+
+	if want, have := error(nil), s.Add(ctx, user, token, "gatt"); want != have {
+		t.Fatalf("Add: want %v, have %v", want, have)
+	}
+
+	version, err := s.Version(ctx, user, token)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Version: want %v, have %v", want, have)
+	}
+
+	version, err = s.Append(ctx, user, token, "aca", version)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Append: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), s.Check(ctx, user, token, user, "gattaca"); want != have {
+		t.Errorf("Check after Append: want %v, have %v", want, have)
+	}
+
+	if _, err := s.Update(ctx, user, token, "cat", version-1); err != ErrVersionMismatch {
+		t.Errorf("Update with stale version: want %v, have %v", ErrVersionMismatch, err)
+	}
+	if _, err := s.Update(ctx, user, token, "xyz", version); err != ErrInvalidSequence {
+		t.Errorf("Update with invalid sequence: want %v, have %v", ErrInvalidSequence, err)
+	}
+	if _, err := s.Update(ctx, user, "invalid_token", "cat", version); err != ErrBadAuth {
+		t.Errorf("Update with bad token: want %v, have %v", ErrBadAuth, err)
+	}
+
+	version, err = s.Update(ctx, user, token, "cat", version)
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Update: want %v, have %v", want, have)
+	}
+	if want, have := ErrSubsequenceNotFound, s.Check(ctx, user, token, user, "gattaca"); want != have {
+		t.Errorf("Check after Update: want %v, have %v", want, have)
+	}
+
+	if want, have := ErrVersionMismatch, s.Delete(ctx, user, token, version+1); want != have {
+		t.Errorf("Delete with stale version: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), s.Delete(ctx, user, token, version); want != have {
+		t.Errorf("Delete: want %v, have %v", want, have)
+	}
+	if _, err := s.Version(ctx, user, token); err != ErrInvalidUser {
+		t.Errorf("Version after Delete: want %v, have %v", ErrInvalidUser, err)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("ann", "a", "bob", "b", "ada", "c")
+		quota = Quota{MaxBases: 8}
+		s     = NewDefaultService(repo, valid, WithQuota(quota))
+	)
+	valid.roles["ada"] = rbac.Admin
+
+	if want, have := ErrQuotaExceeded, s.Add(ctx, "ann", "a", "gattacaga"); want != have {
+		t.Errorf("Add over quota: want %v, have %v", want, have)
+	}
+	if want, have := error(nil), s.Add(ctx, "ann", "a", "gattaca"); want != have {
+		t.Fatalf("Add: want %v, have %v", want, have)
+	}
+	if _, err := s.Append(ctx, "ann", "a", "ga", 0); err != ErrQuotaExceeded {
+		t.Errorf("Append over quota: want %v, have %v", ErrQuotaExceeded, err)
+	}
+	if _, err := s.Append(ctx, "ann", "a", "g", 0); err != nil {
+		t.Errorf("Append up to quota: want %v, have %v", error(nil), err)
+	}
+	if _, err := s.Update(ctx, "ann", "a", "gattacaga", 0); err != ErrQuotaExceeded {
+		t.Errorf("Update over quota: want %v, have %v", ErrQuotaExceeded, err)
+	}
+
+	// An existing sample isn't counted again by another Add.
+	one := NewDefaultService(repo, valid, WithQuota(Quota{MaxSamples: 1}))
+	if want, have := ErrSequenceExists, errors.Cause(one.Add(ctx, "ann", "a", "gattaca")); want != have {
+		t.Errorf("Add of a second sample: want %v, have %v", want, have)
+	}
+
+	for _, testcase := range []struct {
+		user, token, owner string
+		want               Usage
+		err                error
+	}{
+		{"ann", "a", "ann", Usage{Bases: 8, Samples: 1, Quota: quota}, nil},
+		{"bob", "b", "bob", Usage{Quota: quota}, nil},
+		{"bob", "bad", "bob", Usage{}, ErrBadAuth},
+		{"bob", "b", "ann", Usage{}, ErrForbidden},
+		{"ada", "c", "ann", Usage{Bases: 8, Samples: 1, Quota: quota}, nil},
+	} {
+		u, err := s.Usage(ctx, testcase.user, testcase.token, testcase.owner)
+		if want, have := testcase.err, err; want != have {
+			t.Errorf("%s Usage(%s): want %v, have %v", testcase.user, testcase.owner, want, have)
+		}
+		if want, have := testcase.want, u; want != have {
+			t.Errorf("%s Usage(%s): want %+v, have %+v", testcase.user, testcase.owner, want, have)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	var (
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("vincent", "some_token", "jerome", "other_token")
+		s     = NewDefaultService(repo, valid, WithReferences("reference"))
+		ctx   = context.Background()
+	)
+
+	repo.Insert(ctx, "reference", "gattaca")
+	repo.Insert(ctx, "jerome", "gattaca")
+	repo.Insert(ctx, "vincent", "gatgaca")
+
+	variants, err := s.Diff(ctx, "vincent", "some_token", "reference")
+	if want, have := error(nil), err; want != have {
+		t.Fatalf("Diff: want %v, have %v", want, have)
+	}
+	if want, have := []Variant{{3, "t", "g"}}, variants; !reflect.DeepEqual(want, have) {
+		t.Errorf("Diff: want %v, have %v", want, have)
+	}
+
+	if _, err := s.Diff(ctx, "vincent", "some_token", "jerome"); err != ErrInvalidReference {
+		t.Errorf("Diff against private sequence: want %v, have %v", ErrInvalidReference, err)
+	}
+	if _, err := s.Diff(ctx, "vincent", "invalid_token", "reference"); err != ErrBadAuth {
+		t.Errorf("Diff with bad token: want %v, have %v", ErrBadAuth, err)
+	}
+}
+
+func TestCircular(t *testing.T) {
+	var (
+		repo  = NewMemoryRepository()
+		user  = "vincent"
+		token = "some_token"
+		valid = newMockValidator(user, token)
+		s     = NewDefaultService(repo, valid)
+		ctx   = context.Background()
+	)
+
+	// "acagatt" is "gattaca", rotated so the origin is mid-sequence.
+	if want, have := error(nil), s.Add(ctx, user, token, "acagatt"); want != have {
+		t.Fatalf("Add: want %v, have %v", want, have)
+	}
+	if want, have := ErrSubsequenceNotFound, s.Check(ctx, user, token, user, "gattaca"); want != have {
+		t.Errorf("Check linear: want %v, have %v", want, have)
+	}
+	if err := s.Slice(ctx, user, token, 3, 10, Forward, &bytes.Buffer{}); err != ErrInvalidRange {
+		t.Errorf("Slice linear across origin: want %v, have %v", ErrInvalidRange, err)
+	}
+
+	if _, err := s.SetTopology(ctx, user, token, "spiral", 0); err != ErrInvalidTopology {
+		t.Errorf("SetTopology spiral: want %v, have %v", ErrInvalidTopology, err)
+	}
+	if _, err := s.SetTopology(ctx, user, token, Circular, 0); err != nil {
+		t.Fatalf("SetTopology: %v", err)
+	}
+
+	for subsequence, want := range map[string]error{
+		"gattaca":         nil,
+		"ttacag":          nil,
+		"acagattacagatta": nil, // more than one turn
+		"gattacc":         ErrSubsequenceNotFound,
+	} {
+		if have := s.Check(ctx, user, token, user, subsequence); want != have {
+			t.Errorf("Check circular %q: want %v, have %v", subsequence, want, have)
+		}
+	}
+
+	for _, testcase := range []struct {
+		start, end int
+		strand     Strand
+		want       string
+		err        error
+	}{
+		{3, 10, Forward, "gattaca", nil},
+		{3, 10, Reverse, "tgtaatc", nil},
+		{0, 7, Forward, "acagatt", nil},
+		{3, 11, Forward, "", ErrInvalidRange},
+		{7, 8, Forward, "", ErrInvalidRange},
+	} {
+		var buf bytes.Buffer
+		err := s.Slice(ctx, user, token, testcase.start, testcase.end, testcase.strand, &buf)
+		if want, have := testcase.err, err; want != have {
+			t.Errorf("Slice(%d, %d, %d): want error %v, have %v", testcase.start, testcase.end, testcase.strand, want, have)
+			continue
+		}
+		if want, have := testcase.want, buf.String(); want != have {
+			t.Errorf("Slice(%d, %d, %d): want %q, have %q", testcase.start, testcase.end, testcase.strand, want, have)
+		}
+	}
+}
+
+func TestSampleAndSearch(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("ann", "a", "bob", "b", "ada", "c", "ana", "d")
+		s     = NewDefaultService(repo, valid)
+	)
+	valid.roles["ada"] = rbac.Admin
+	valid.roles["ana"] = rbac.Analyst
+
+	for user, sequence := range map[string]string{"ann": "gattaca", "bob": "tacgat", "ana": "cccc"} {
+		if err := repo.Insert(ctx, user, sequence); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := repo.SetTopology(ctx, "bob", Circular, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testcase := range []struct {
+		user, token, owner string
+		want               string
+		err                error
+	}{
+		{"ann", "a", "ann", "gattaca", nil},
+		{"ann", "bad", "ann", "", ErrBadAuth},
+		{"ann", "a", "bob", "", ErrForbidden},
+		{"ana", "d", "bob", "", ErrForbidden},
+		{"ada", "c", "bob", "tacgat", nil},
+		{"ada", "c", "nobody", "", ErrInvalidUser},
+	} {
+		var buf bytes.Buffer
+		err := s.Sample(ctx, testcase.user, testcase.token, testcase.owner, &buf)
+		if want, have := testcase.err, err; want != have {
+			t.Errorf("%s Sample(%s): want %v, have %v", testcase.user, testcase.owner, want, have)
+		}
+		if want, have := testcase.want, buf.String(); want != have {
+			t.Errorf("%s Sample(%s): want %q, have %q", testcase.user, testcase.owner, want, have)
+		}
+	}
+
+	for _, testcase := range []struct {
+		user, token, subsequence string
+		want                     []string
+		err                      error
+	}{
+		{"ann", "a", "gat", nil, ErrForbidden},
+		{"ana", "bad", "gat", nil, ErrBadAuth},
+		{"ana", "d", "gatx", nil, ErrInvalidSequence},
+		{"ana", "d", "gat", []string{"ann", "bob"}, nil},
+		{"ana", "d", "taca", []string{"ann"}, nil},
+		{"ana", "d", "gggg", nil, nil},
+		{"ada", "c", "atta", []string{"ann", "bob"}, nil}, // across bob's origin
+	} {
+		owners, err := s.Search(ctx, testcase.user, testcase.token, testcase.subsequence)
+		if want, have := testcase.err, err; want != have {
+			t.Errorf("%s Search(%s): want %v, have %v", testcase.user, testcase.subsequence, want, have)
+		}
+		if want, have := testcase.want, owners; !reflect.DeepEqual(want, have) {
+			t.Errorf("%s Search(%s): want %v, have %v", testcase.user, testcase.subsequence, want, have)
+		}
+	}
+}
+
+func TestSharing(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		repo  = NewMemoryRepository()
+		valid = newMockValidator("ann", "a", "bob", "b", "cat", "c")
+		s     = NewDefaultService(repo, valid)
+	)
+	if err := repo.Insert(ctx, "ann", "gattaca"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(user, token string, want error) {
+		t.Helper()
+		if have := s.Check(ctx, user, token, "ann", "tac"); want != have {
+			t.Errorf("%s Check(ann): want %v, have %v", user, want, have)
+		}
+	}
+	sample := func(user, token string, want error) {
+		t.Helper()
+		if have := s.Sample(ctx, user, token, "ann", ioutil.Discard); want != have {
+			t.Errorf("%s Sample(ann): want %v, have %v", user, want, have)
+		}
+	}
+
+	check("bob", "b", ErrForbidden)
+	if want, have := ErrInvalidAccess, s.Share(ctx, "ann", "a", Grant{Grantee: "bob", Access: "write"}); want != have {
+		t.Errorf("Share with bad access: want %v, have %v", want, have)
+	}
+	if err := s.Share(ctx, "ann", "a", Grant{Grantee: "bob", Access: SearchAccess}); err != nil {
+		t.Fatal(err)
+	}
+	check("bob", "b", nil)
+	sample("bob", "b", ErrForbidden)
+
+	if err := s.AddMember(ctx, "ann", "a", "lab", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := ErrForbidden, s.AddMember(ctx, "cat", "c", "lab", "cat"); want != have {
+		t.Errorf("AddMember to ann's group: want %v, have %v", want, have)
+	}
+	if err := s.Share(ctx, "ann", "a", Grant{Grantee: "lab", Group: true, Access: ReadAccess}); err != nil {
+		t.Fatal(err)
+	}
+	sample("bob", "b", nil)
+
+	// A group shared with before it has members can't be taken over.
+	if err := s.Share(ctx, "ann", "a", Grant{Grantee: "clinic", Group: true, Access: ReadAccess}); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := ErrForbidden, s.AddMember(ctx, "cat", "c", "clinic", "cat"); want != have {
+		t.Errorf("AddMember to ann's shared group: want %v, have %v", want, have)
+	}
+	if want, have := ErrForbidden, s.Share(ctx, "cat", "c", Grant{Grantee: "lab", Group: true, Access: ReadAccess}); want != have {
+		t.Errorf("Share with ann's group: want %v, have %v", want, have)
+	}
+	sample("cat", "c", ErrForbidden)
+	if err := s.Unshare(ctx, "ann", "a", "clinic", true); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unshare(ctx, "ann", "a", "lab", true); err != nil {
+		t.Fatal(err)
+	}
+	sample("bob", "b", ErrForbidden)
+
+	inv, err := s.Invite(ctx, "ann", "a", "cat", ReadAccess, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Accept(ctx, "bob", "b", inv.Code); err != ErrInvalidInvitation {
+		t.Errorf("bob Accept: want %v, have %v", ErrInvalidInvitation, err)
+	}
+	sample("cat", "c", ErrForbidden)
+	if _, err := s.Accept(ctx, "cat", "c", inv.Code); err != nil {
+		t.Fatal(err)
+	}
+	sample("cat", "c", nil)
+	check("cat", "c", nil)
+
+	grants, err := s.Grants(ctx, "ann", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := []Grant{{Grantee: "bob", Access: SearchAccess}, {Grantee: "cat", Access: ReadAccess}}, grants; !reflect.DeepEqual(want, have) {
+		t.Errorf("Grants: want %+v, have %+v", want, have)
 	}
-	return sequence, nil
 }
 
 type mockValidator struct {
 	tokens map[string]string
+	roles  map[string]rbac.Role // rbac.User if absent
 }
 
 func newMockValidator(usertokens ...string) *mockValidator {
@@ -97,12 +533,17 @@ func newMockValidator(usertokens ...string) *mockValidator {
 	}
 	return &mockValidator{
 		tokens: tokens,
+		roles:  map[string]rbac.Role{},
 	}
 }
 
-func (v *mockValidator) Validate(ctx context.Context, user, token string) error {
+func (v *mockValidator) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
 	if have, ok := v.tokens[user]; !ok || token != have {
-		return ErrBadAuth
+		return rbac.Principal{}, ErrBadAuth
+	}
+	role, ok := v.roles[user]
+	if !ok {
+		role = rbac.User
 	}
-	return nil
+	return rbac.NewPrincipal(user, role), nil
 }
@@ -0,0 +1,683 @@
+package dna
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidAccess is returned when sharing with an unknown access.
+	ErrInvalidAccess = errors.New("invalid access")
+
+	// ErrInvalidInvitation is returned when accepting an invitation which
+	// doesn't exist, has expired, or is addressed to someone else.
+	ErrInvalidInvitation = errors.New("invalid invitation")
+)
+
+// Access is what a grant allows others to do with an owner's sequence.
+type Access string
+
+const (
+	// SearchAccess allows checking whether subsequences are present.
+	SearchAccess Access = "search"
+
+	// ReadAccess allows reading the whole sample, as well as searching it.
+	ReadAccess Access = "read"
+)
+
+func (a Access) valid() bool {
+	return a == SearchAccess || a == ReadAccess
+}
+
+// allows returns true if a is at least as much access as want.
+func (a Access) allows(want Access) bool {
+	switch want {
+	case SearchAccess:
+		return a == SearchAccess || a == ReadAccess
+	case ReadAccess:
+		return a == ReadAccess
+	default:
+		return false
+	}
+}
+
+// Grant is an entry in the ACL of an owner's sequence. The grantee is a
+// user, or the name of a group, whose members are all granted the access.
+type Grant struct {
+	Grantee string `json:"grantee"`
+	Group   bool   `json:"group,omitempty"`
+	Access  Access `json:"access"`
+}
+
+// Invitation offers a grant to a user, who must accept it before it
+// expires. The code is a secret, which is consumed on acceptance.
+type Invitation struct {
+	Code    string    `json:"code"`
+	Owner   string    `json:"owner"`
+	Invitee string    `json:"invitee"`
+	Access  Access    `json:"access"`
+	Expires time.Time `json:"expires"`
+}
+
+func newInvitationCode() (string, error) {
+	p := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return "", errors.Wrap(err, "error generating invitation code")
+	}
+	return hex.EncodeToString(p), nil
+}
+
+// strongest returns the most access among the grants.
+func strongest(grants []Access) (access Access) {
+	for _, a := range grants {
+		if access == "" || a == ReadAccess {
+			access = a
+		}
+	}
+	return access
+}
+
+// Share adds the grant to the owner's ACL, replacing any grant to the same
+// grantee. A group grantee is created, with the owner as its owner, if it
+// doesn't exist; sharing with another's group fails with ErrForbidden.
+func (r *SQLiteRepository) Share(ctx context.Context, owner string, g Grant) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting grant transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if g.Group {
+		if err := r.claimGroup(ctx, tx, owner, g.Grantee); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO grants (owner, grantee, is_group, access) VALUES (?, ?, ?, ?)
+		ON CONFLICT(owner, grantee, is_group) DO UPDATE SET access = excluded.access
+	`, owner, g.Grantee, g.Group, string(g.Access)); err != nil {
+		return errors.Wrap(err, "error saving grant")
+	}
+	return errors.Wrap(tx.Commit(), "error committing grant transaction")
+}
+
+// Unshare removes any grant to the grantee from the owner's ACL.
+func (r *SQLiteRepository) Unshare(ctx context.Context, owner, grantee string, group bool) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM grants WHERE owner = ? AND grantee = ? AND is_group = ?`, owner, grantee, group); err != nil {
+		return errors.Wrap(err, "error removing grant")
+	}
+	return nil
+}
+
+// Grants returns the owner's ACL, ordered by grantee.
+func (r *SQLiteRepository) Grants(ctx context.Context, owner string) (grants []Grant, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.rdb.QueryContext(ctx, `SELECT grantee, is_group, access FROM grants WHERE owner = ? ORDER BY grantee, is_group`, owner)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading grants")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.Grantee, &g.Group, &g.Access); err != nil {
+			return nil, errors.Wrap(err, "error reading grants")
+		}
+		grants = append(grants, g)
+	}
+	return grants, errors.Wrap(rows.Err(), "error reading grants")
+}
+
+// Access returns the most access the owner's ACL grants the user, directly
+// or via the owner's groups they're a member of, or "" if it grants none.
+func (r *SQLiteRepository) Access(ctx context.Context, owner, user string) (Access, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.rdb.QueryContext(ctx, `
+		SELECT access FROM grants WHERE owner = ? AND (
+			(is_group = 0 AND grantee = ?) OR
+			(is_group = 1 AND grantee IN (
+				SELECT m.name FROM share_members m JOIN share_groups g ON g.name = m.name
+				WHERE m.member = ? AND g.owner = grants.owner
+			))
+		)
+	`, owner, user, user)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading grants")
+	}
+	defer rows.Close()
+
+	var grants []Access
+	for rows.Next() {
+		var a Access
+		if err := rows.Scan(&a); err != nil {
+			return "", errors.Wrap(err, "error reading grants")
+		}
+		grants = append(grants, a)
+	}
+	return strongest(grants), errors.Wrap(rows.Err(), "error reading grants")
+}
+
+// AddMember adds the member to the group, creating it if it doesn't exist,
+// with the owner as its owner. Only the owner of a group may add members.
+func (r *SQLiteRepository) AddMember(ctx context.Context, owner, group, member string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting group transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if err := r.claimGroup(ctx, tx, owner, group); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO share_members (name, member) VALUES (?, ?) ON CONFLICT(name, member) DO NOTHING`, group, member); err != nil {
+		return errors.Wrap(err, "error adding group member")
+	}
+	return errors.Wrap(tx.Commit(), "error committing group transaction")
+}
+
+// claimGroup creates the group, with the owner as its owner, if it doesn't
+// exist. It fails with ErrForbidden if the group is owned by someone else.
+func (r *SQLiteRepository) claimGroup(ctx context.Context, tx *sql.Tx, owner, group string) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO share_groups (name, owner) VALUES (?, ?) ON CONFLICT(name) DO NOTHING`, group, owner); err != nil {
+		return errors.Wrap(err, "error creating group")
+	}
+	var have string
+	if err := tx.QueryRowContext(ctx, `SELECT owner FROM share_groups WHERE name = ?`, group).Scan(&have); err != nil {
+		return errors.Wrap(err, "error reading group")
+	}
+	if have != owner {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// RemoveMember removes the member from the group. Only the owner of a group
+// may remove members.
+func (r *SQLiteRepository) RemoveMember(ctx context.Context, owner, group, member string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var have string
+	switch err := r.db.QueryRowContext(ctx, `SELECT owner FROM share_groups WHERE name = ?`, group).Scan(&have); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "error reading group")
+	case have != owner:
+		return ErrForbidden
+	}
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM share_members WHERE name = ? AND member = ?`, group, member); err != nil {
+		return errors.Wrap(err, "error removing group member")
+	}
+	return nil
+}
+
+// Invite stores the invitation, and forgets any which have expired.
+func (r *SQLiteRepository) Invite(ctx context.Context, inv Invitation) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting invitation transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM invitations WHERE expires < ?`, time.Now().Unix()); err != nil {
+		return errors.Wrap(err, "error removing expired invitations")
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO invitations (code, owner, invitee, access, expires) VALUES (?, ?, ?, ?, ?)`,
+		inv.Code, inv.Owner, inv.Invitee, string(inv.Access), inv.Expires.Unix(),
+	); err != nil {
+		return errors.Wrap(err, "error saving invitation")
+	}
+	return errors.Wrap(tx.Commit(), "error committing invitation transaction")
+}
+
+// Accept consumes the user's invitation, and adds its grant to the owner's
+// ACL. It fails with ErrInvalidInvitation if the invitation doesn't exist,
+// has expired by now, or is addressed to someone else.
+func (r *SQLiteRepository) Accept(ctx context.Context, code, user string, now time.Time) (Invitation, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Invitation{}, errors.Wrap(err, "error starting invitation transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var (
+		inv     = Invitation{Code: code}
+		expires int64
+	)
+	if err := tx.QueryRowContext(ctx,
+		`SELECT owner, invitee, access, expires FROM invitations WHERE code = ?`, code,
+	).Scan(&inv.Owner, &inv.Invitee, &inv.Access, &expires); err == sql.ErrNoRows {
+		return Invitation{}, ErrInvalidInvitation
+	} else if err != nil {
+		return Invitation{}, errors.Wrap(err, "error reading invitation")
+	}
+	inv.Expires = time.Unix(expires, 0).UTC()
+	if inv.Invitee != user || !now.Before(inv.Expires) {
+		return Invitation{}, ErrInvalidInvitation
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM invitations WHERE code = ?`, code); err != nil {
+		return Invitation{}, errors.Wrap(err, "error consuming invitation")
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO grants (owner, grantee, is_group, access) VALUES (?, ?, 0, ?)
+		ON CONFLICT(owner, grantee, is_group) DO UPDATE SET access = excluded.access
+	`, inv.Owner, inv.Invitee, string(inv.Access)); err != nil {
+		return Invitation{}, errors.Wrap(err, "error saving grant")
+	}
+	if err := tx.Commit(); err != nil {
+		return Invitation{}, errors.Wrap(err, "error committing invitation transaction")
+	}
+	return inv, nil
+}
+
+// Share adds the grant to the owner's ACL, replacing any grant to the same
+// grantee. A group grantee is created, with the owner as its owner, if it
+// doesn't exist; sharing with another's group fails with ErrForbidden.
+func (r *MemoryRepository) Share(ctx context.Context, owner string, g Grant) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if g.Group {
+		if have, ok := r.groups[g.Grantee]; ok && have != owner {
+			return ErrForbidden
+		}
+		r.groups[g.Grantee] = owner
+	}
+	acl, ok := r.grants[owner]
+	if !ok {
+		acl = map[grantKey]Access{}
+		r.grants[owner] = acl
+	}
+	acl[grantKey{g.Grantee, g.Group}] = g.Access
+	return nil
+}
+
+// Unshare removes any grant to the grantee from the owner's ACL.
+func (r *MemoryRepository) Unshare(ctx context.Context, owner, grantee string, group bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	delete(r.grants[owner], grantKey{grantee, group})
+	if len(r.grants[owner]) == 0 {
+		delete(r.grants, owner)
+	}
+	return nil
+}
+
+// Grants returns the owner's ACL, ordered by grantee.
+func (r *MemoryRepository) Grants(ctx context.Context, owner string) (grants []Grant, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.acl(owner), nil
+}
+
+// acl returns the owner's grants, ordered by grantee, users before groups.
+// The caller must hold the mutex.
+func (r *MemoryRepository) acl(owner string) (grants []Grant) {
+	for k, a := range r.grants[owner] {
+		grants = append(grants, Grant{Grantee: k.grantee, Group: k.group, Access: a})
+	}
+	sort.Slice(grants, func(i, j int) bool {
+		if grants[i].Grantee != grants[j].Grantee {
+			return grants[i].Grantee < grants[j].Grantee
+		}
+		return !grants[i].Group && grants[j].Group
+	})
+	return grants
+}
+
+// Access returns the most access the owner's ACL grants the user, directly
+// or via the owner's groups they're a member of, or "" if it grants none.
+func (r *MemoryRepository) Access(ctx context.Context, owner, user string) (Access, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	var grants []Access
+	for k, a := range r.grants[owner] {
+		if (!k.group && k.grantee == user) || (k.group && r.groups[k.grantee] == owner && r.members[k.grantee][user]) {
+			grants = append(grants, a)
+		}
+	}
+	return strongest(grants), nil
+}
+
+// AddMember adds the member to the group, creating it if it doesn't exist,
+// with the owner as its owner. Only the owner of a group may add members.
+func (r *MemoryRepository) AddMember(ctx context.Context, owner, group, member string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	if have, ok := r.groups[group]; ok && have != owner {
+		return ErrForbidden
+	}
+	r.groups[group] = owner
+	if r.members[group] == nil {
+		r.members[group] = map[string]bool{}
+	}
+	r.members[group][member] = true
+	return nil
+}
+
+// RemoveMember removes the member from the group. Only the owner of a group
+// may remove members.
+func (r *MemoryRepository) RemoveMember(ctx context.Context, owner, group, member string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	have, ok := r.groups[group]
+	if !ok {
+		return nil
+	}
+	if have != owner {
+		return ErrForbidden
+	}
+	delete(r.members[group], member)
+	return nil
+}
+
+// Invite stores the invitation, and forgets any which have expired.
+func (r *MemoryRepository) Invite(ctx context.Context, inv Invitation) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	now := time.Now()
+	for code, other := range r.invitations {
+		if other.Expires.Before(now) {
+			delete(r.invitations, code)
+		}
+	}
+	inv.Expires = inv.Expires.UTC().Truncate(time.Second)
+	r.invitations[inv.Code] = inv
+	return nil
+}
+
+// Accept consumes the user's invitation, and adds its grant to the owner's
+// ACL. It fails with ErrInvalidInvitation if the invitation doesn't exist,
+// has expired by now, or is addressed to someone else.
+func (r *MemoryRepository) Accept(ctx context.Context, code, user string, now time.Time) (Invitation, error) {
+	if err := ctx.Err(); err != nil {
+		return Invitation{}, err
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	inv, ok := r.invitations[code]
+	if !ok || inv.Invitee != user || !now.Before(inv.Expires) {
+		return Invitation{}, ErrInvalidInvitation
+	}
+	delete(r.invitations, code)
+	if r.grants[inv.Owner] == nil {
+		r.grants[inv.Owner] = map[grantKey]Access{}
+	}
+	r.grants[inv.Owner][grantKey{inv.Invitee, false}] = inv.Access
+	return inv, nil
+}
+
+// Share adds the grant to the owner's ACL, replacing any grant to the same
+// grantee. A group grantee is created, with the owner as its owner, if it
+// doesn't exist; sharing with another's group fails with ErrForbidden.
+func (r *PostgresRepository) Share(ctx context.Context, owner string, g Grant) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting grant transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if g.Group {
+		if err := r.claimGroup(ctx, tx, owner, g.Grantee); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO grants (owner, grantee, is_group, access) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (owner, grantee, is_group) DO UPDATE SET access = EXCLUDED.access
+	`, owner, g.Grantee, g.Group, string(g.Access)); err != nil {
+		return errors.Wrap(err, "error saving grant")
+	}
+	return errors.Wrap(tx.Commit(), "error committing grant transaction")
+}
+
+// Unshare removes any grant to the grantee from the owner's ACL.
+func (r *PostgresRepository) Unshare(ctx context.Context, owner, grantee string, group bool) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM grants WHERE owner = $1 AND grantee = $2 AND is_group = $3`, owner, grantee, group); err != nil {
+		return errors.Wrap(err, "error removing grant")
+	}
+	return nil
+}
+
+// Grants returns the owner's ACL, ordered by grantee.
+func (r *PostgresRepository) Grants(ctx context.Context, owner string) (grants []Grant, err error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, `SELECT grantee, is_group, access FROM grants WHERE owner = $1 ORDER BY grantee, is_group`, owner)
+	if err != nil {
+		return nil, errors.Wrap(err, "error reading grants")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var g Grant
+		if err := rows.Scan(&g.Grantee, &g.Group, &g.Access); err != nil {
+			return nil, errors.Wrap(err, "error reading grants")
+		}
+		grants = append(grants, g)
+	}
+	return grants, errors.Wrap(rows.Err(), "error reading grants")
+}
+
+// Access returns the most access the owner's ACL grants the user, directly
+// or via the owner's groups they're a member of, or "" if it grants none.
+func (r *PostgresRepository) Access(ctx context.Context, owner, user string) (Access, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT access FROM grants WHERE owner = $1 AND (
+			(NOT is_group AND grantee = $2) OR
+			(is_group AND grantee IN (
+				SELECT m.name FROM share_members m JOIN share_groups g ON g.name = m.name
+				WHERE m.member = $2 AND g.owner = grants.owner
+			))
+		)
+	`, owner, user)
+	if err != nil {
+		return "", errors.Wrap(err, "error reading grants")
+	}
+	defer rows.Close()
+
+	var grants []Access
+	for rows.Next() {
+		var a Access
+		if err := rows.Scan(&a); err != nil {
+			return "", errors.Wrap(err, "error reading grants")
+		}
+		grants = append(grants, a)
+	}
+	return strongest(grants), errors.Wrap(rows.Err(), "error reading grants")
+}
+
+// AddMember adds the member to the group, creating it if it doesn't exist,
+// with the owner as its owner. Only the owner of a group may add members.
+func (r *PostgresRepository) AddMember(ctx context.Context, owner, group, member string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting group transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if err := r.claimGroup(ctx, tx, owner, group); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `INSERT INTO share_members (name, member) VALUES ($1, $2) ON CONFLICT (name, member) DO NOTHING`, group, member); err != nil {
+		return errors.Wrap(err, "error adding group member")
+	}
+	return errors.Wrap(tx.Commit(), "error committing group transaction")
+}
+
+// claimGroup creates the group, with the owner as its owner, if it doesn't
+// exist. It fails with ErrForbidden if the group is owned by someone else.
+func (r *PostgresRepository) claimGroup(ctx context.Context, tx *sql.Tx, owner, group string) error {
+	if _, err := tx.ExecContext(ctx, `INSERT INTO share_groups (name, owner) VALUES ($1, $2) ON CONFLICT (name) DO NOTHING`, group, owner); err != nil {
+		return errors.Wrap(err, "error creating group")
+	}
+	var have string
+	if err := tx.QueryRowContext(ctx, `SELECT owner FROM share_groups WHERE name = $1 FOR UPDATE`, group).Scan(&have); err != nil {
+		return errors.Wrap(err, "error reading group")
+	}
+	if have != owner {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// RemoveMember removes the member from the group. Only the owner of a group
+// may remove members.
+func (r *PostgresRepository) RemoveMember(ctx context.Context, owner, group, member string) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	var have string
+	switch err := r.db.QueryRowContext(ctx, `SELECT owner FROM share_groups WHERE name = $1`, group).Scan(&have); {
+	case err == sql.ErrNoRows:
+		return nil
+	case err != nil:
+		return errors.Wrap(err, "error reading group")
+	case have != owner:
+		return ErrForbidden
+	}
+	if _, err := r.db.ExecContext(ctx, `DELETE FROM share_members WHERE name = $1 AND member = $2`, group, member); err != nil {
+		return errors.Wrap(err, "error removing group member")
+	}
+	return nil
+}
+
+// Invite stores the invitation, and forgets any which have expired.
+func (r *PostgresRepository) Invite(ctx context.Context, inv Invitation) error {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting invitation transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM invitations WHERE expires < $1`, time.Now().Unix()); err != nil {
+		return errors.Wrap(err, "error removing expired invitations")
+	}
+	if _, err := tx.ExecContext(ctx,
+		`INSERT INTO invitations (code, owner, invitee, access, expires) VALUES ($1, $2, $3, $4, $5)`,
+		inv.Code, inv.Owner, inv.Invitee, string(inv.Access), inv.Expires.Unix(),
+	); err != nil {
+		return errors.Wrap(err, "error saving invitation")
+	}
+	return errors.Wrap(tx.Commit(), "error committing invitation transaction")
+}
+
+// Accept consumes the user's invitation, and adds its grant to the owner's
+// ACL. It fails with ErrInvalidInvitation if the invitation doesn't exist,
+// has expired by now, or is addressed to someone else.
+func (r *PostgresRepository) Accept(ctx context.Context, code, user string, now time.Time) (Invitation, error) {
+	ctx, cancel := withTimeout(ctx, r.timeout)
+	defer cancel()
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Invitation{}, errors.Wrap(err, "error starting invitation transaction")
+	}
+	defer tx.Rollback() // no-op after Commit
+
+	var (
+		inv     = Invitation{Code: code}
+		expires int64
+	)
+	if err := tx.QueryRowContext(ctx,
+		`DELETE FROM invitations WHERE code = $1 AND invitee = $2 AND expires > $3 RETURNING owner, invitee, access, expires`,
+		code, user, now.Unix(),
+	).Scan(&inv.Owner, &inv.Invitee, &inv.Access, &expires); err == sql.ErrNoRows {
+		return Invitation{}, ErrInvalidInvitation
+	} else if err != nil {
+		return Invitation{}, errors.Wrap(err, "error consuming invitation")
+	}
+	inv.Expires = time.Unix(expires, 0).UTC()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO grants (owner, grantee, is_group, access) VALUES ($1, $2, FALSE, $3)
+		ON CONFLICT (owner, grantee, is_group) DO UPDATE SET access = EXCLUDED.access
+	`, inv.Owner, inv.Invitee, string(inv.Access)); err != nil {
+		return Invitation{}, errors.Wrap(err, "error saving grant")
+	}
+	if err := tx.Commit(); err != nil {
+		return Invitation{}, errors.Wrap(err, "error committing invitation transaction")
+	}
+	return inv, nil
+}
@@ -0,0 +1,250 @@
+package dna
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Variant is a difference between a sample and a reference sequence.
+// Indels are anchored to a neighboring reference base, as in VCF.
+type Variant struct {
+	Position int    // 0-based offset of Ref in the reference sequence
+	Ref      string // bases in the reference
+	Alt      string // bases in the sample
+}
+
+// Type returns "SNV", "INS", or "DEL".
+func (v Variant) Type() string {
+	switch {
+	case len(v.Ref) > len(v.Alt):
+		return "DEL"
+	case len(v.Ref) < len(v.Alt):
+		return "INS"
+	default:
+		return "SNV"
+	}
+}
+
+// Alignment scoring costs. A gap costs more than a mismatch, so that a
+// single substitution is never reported as an insertion plus a deletion.
+const (
+	mismatchCost = 1
+	gapCost      = 2
+)
+
+// diffBand is how far the alignment may wander from the main diagonal,
+// beyond the difference in length between the sequences. It bounds the
+// size of the indels that can be found.
+const diffBand = 64
+
+// maxAlignCells bounds the memory used by an alignment, which keeps an
+// operation for each cell of the band: the length of the reference, times
+// the width of the band, which grows with the difference in length between
+// the sequences. It's 64MiB, enough for sequences of similar length up to
+// about 500,000 bases.
+const maxAlignCells = 64 << 20
+
+// alignment operations, per column
+const (
+	opMatch  = 'M' // match or mismatch
+	opDelete = 'D' // base in reference, gap in sample
+	opInsert = 'I' // gap in reference, base in sample
+	opNone   = 0
+)
+
+// callVariants aligns sample against reference, and returns the SNVs and
+// indels required to turn the reference into the sample.
+func callVariants(reference, sample string) ([]Variant, error) {
+	path, err := align(reference, sample)
+	if err != nil {
+		return nil, err
+	}
+	return variantsFromAlignment(reference, sample, path), nil
+}
+
+// align computes a banded global alignment of sample against reference,
+// and returns the alignment operations from left to right. It fails with
+// ErrTooDivergent if the band would have more than maxAlignCells cells.
+func align(reference, sample string) ([]byte, error) {
+	var (
+		n  = len(reference)
+		m  = len(sample)
+		lo = -diffBand // lowest permitted j-i
+		hi = +diffBand // highest permitted j-i
+	)
+	if m < n {
+		lo -= n - m
+	} else {
+		hi += m - n
+	}
+	width := hi - lo + 1
+	if n+1 > maxAlignCells/width {
+		return nil, ErrTooDivergent
+	}
+
+	// Only the operations are kept for every cell; costs are kept for the
+	// previous and current row of the reference.
+	var (
+		inf  = (n + m + 1) * gapCost
+		prev = make([]int, width)
+		cur  = make([]int, width)
+		ops  = make([]byte, (n+1)*width)
+	)
+	inBand := func(i, j int) bool {
+		d := j - i
+		return j >= 0 && j <= m && d >= lo && d <= hi
+	}
+	costAt := func(row []int, i, j int) int {
+		if !inBand(i, j) {
+			return inf
+		}
+		return row[j-i-lo]
+	}
+
+	for i := 0; i <= n; i++ {
+		for d := lo; d <= hi; d++ {
+			j := i + d
+			if !inBand(i, j) {
+				cur[d-lo] = inf
+				continue
+			}
+			if i == 0 && j == 0 {
+				cur[d-lo], ops[d-lo] = 0, opNone
+				continue
+			}
+			best, op := inf, byte(opNone)
+			if i > 0 && j > 0 {
+				c := costAt(prev, i-1, j-1)
+				if reference[i-1] != sample[j-1] {
+					c += mismatchCost
+				}
+				best, op = c, opMatch
+			}
+			if i > 0 {
+				if c := costAt(prev, i-1, j) + gapCost; c < best {
+					best, op = c, opDelete
+				}
+			}
+			if j > 0 {
+				if c := costAt(cur, i, j-1) + gapCost; c < best {
+					best, op = c, opInsert
+				}
+			}
+			cur[d-lo], ops[i*width+d-lo] = best, op
+		}
+		prev, cur = cur, prev
+	}
+
+	// Trace back from the end. Preferring matches while tracing back pushes
+	// gaps as far left as possible, which is how VCF wants them normalized.
+	var path []byte
+	for i, j := n, m; i > 0 || j > 0; {
+		op := ops[i*width+j-i-lo]
+		path = append(path, op)
+		switch op {
+		case opMatch:
+			i, j = i-1, j-1
+		case opDelete:
+			i--
+		case opInsert:
+			j--
+		default:
+			return nil, errors.Errorf("invalid alignment at (%d, %d)", i, j)
+		}
+	}
+	for a, b := 0, len(path)-1; a < b; a, b = a+1, b-1 {
+		path[a], path[b] = path[b], path[a]
+	}
+	return path, nil
+}
+
+// variantsFromAlignment walks the alignment, emitting a variant for each
+// mismatch, and for each run of consecutive inserted or deleted bases.
+func variantsFromAlignment(reference, sample string, path []byte) []Variant {
+	var (
+		variants []Variant
+		i, j     int // offsets in reference, sample
+	)
+	for k := 0; k < len(path); {
+		switch path[k] {
+		case opMatch:
+			if reference[i] != sample[j] {
+				variants = append(variants, Variant{
+					Position: i,
+					Ref:      reference[i : i+1],
+					Alt:      sample[j : j+1],
+				})
+			}
+			i, j, k = i+1, j+1, k+1
+
+		case opDelete:
+			start := i
+			for ; k < len(path) && path[k] == opDelete; k++ {
+				i++
+			}
+			variants = append(variants, anchor(reference, start, reference[start:i], ""))
+
+		case opInsert:
+			start := j
+			for ; k < len(path) && path[k] == opInsert; k++ {
+				j++
+			}
+			variants = append(variants, anchor(reference, i, "", sample[start:j]))
+		}
+	}
+	return variants
+}
+
+// anchor builds an indel at reference offset pos, including the reference
+// base before it, or after it if the indel is at the start of the
+// reference.
+func anchor(reference string, pos int, ref, alt string) Variant {
+	switch {
+	case pos > 0:
+		base := reference[pos-1 : pos]
+		return Variant{Position: pos - 1, Ref: base + ref, Alt: base + alt}
+	case pos+len(ref) < len(reference):
+		base := reference[pos+len(ref) : pos+len(ref)+1]
+		return Variant{Position: pos, Ref: ref + base, Alt: alt + base}
+	default:
+		return Variant{Position: pos, Ref: ref, Alt: alt} // nothing to anchor to
+	}
+}
+
+// WriteVCF writes the variants in VCF format, as found against the named
+// reference sequence.
+func WriteVCF(w io.Writer, reference string, variants []Variant) error {
+	if _, err := fmt.Fprintf(w, "##fileformat=VCFv4.2\n##source=gattaca\n##reference=%s\n", reference); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "##INFO=<ID=TYPE,Number=1,Type=String,Description=\"SNV, INS, or DEL\">\n"); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\n"); err != nil {
+		return err
+	}
+	for _, v := range variants {
+		if _, err := fmt.Fprintf(w, "%s\t%d\t.\t%s\t%s\t.\tPASS\tTYPE=%s\n",
+			reference,
+			v.Position+1, // VCF is 1-based
+			vcfAllele(v.Ref),
+			vcfAllele(v.Alt),
+			v.Type(),
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vcfAllele returns bases in the uppercase VCF convention, or "." for an
+// allele with no bases at all.
+func vcfAllele(bases string) string {
+	if bases == "" {
+		return "."
+	}
+	return strings.ToUpper(bases)
+}
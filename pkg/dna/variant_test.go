@@ -0,0 +1,111 @@
+package dna
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCallVariants(t *testing.T) {
+	for _, testcase := range []struct {
+		name      string
+		reference string
+		sample    string
+		want      []Variant
+	}{
+		{
+			name:      "identical",
+			reference: "gattaca",
+			sample:    "gattaca",
+			want:      nil,
+		},
+		{
+			name:      "SNV",
+			reference: "gattaca",
+			sample:    "gatgaca",
+			want:      []Variant{{3, "t", "g"}},
+		},
+		{
+			name:      "two SNVs",
+			reference: "gattaca",
+			sample:    "cattacg",
+			want:      []Variant{{0, "g", "c"}, {6, "a", "g"}},
+		},
+		{
+			name:      "deletion",
+			reference: "gattaca",
+			sample:    "gaaca",
+			want:      []Variant{{1, "att", "a"}},
+		},
+		{
+			name:      "deletion in repeat is left-aligned",
+			reference: "gaaat",
+			sample:    "gaat",
+			want:      []Variant{{0, "ga", "g"}},
+		},
+		{
+			name:      "insertion",
+			reference: "gattaca",
+			sample:    "gattcccaca",
+			want:      []Variant{{3, "t", "tccc"}},
+		},
+		{
+			name:      "insertion at start",
+			reference: "gattaca",
+			sample:    "ccgattaca",
+			want:      []Variant{{0, "g", "ccg"}},
+		},
+		{
+			name:      "deletion at start",
+			reference: "gattaca",
+			sample:    "ttaca",
+			want:      []Variant{{0, "gat", "t"}},
+		},
+		{
+			name:      "long sequences",
+			reference: strings.Repeat("gattaca", 100) + "c" + strings.Repeat("gattaca", 100),
+			sample:    strings.Repeat("gattaca", 100) + strings.Repeat("gattaca", 100),
+			want:      []Variant{{699, "ac", "a"}},
+		},
+	} {
+		t.Run(testcase.name, func(t *testing.T) {
+			have, err := callVariants(testcase.reference, testcase.sample)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := testcase.want; !reflect.DeepEqual(want, have) {
+				t.Errorf("want %v, have %v", want, have)
+			}
+		})
+	}
+}
+
+func TestCallVariantsTooDivergent(t *testing.T) {
+	// The band would be as wide as the reference is long.
+	reference := strings.Repeat("gattaca", 2000)
+	if _, err := callVariants(reference, "g"); err != ErrTooDivergent {
+		t.Errorf("want %v, have %v", ErrTooDivergent, err)
+	}
+}
+
+func TestWriteVCF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := WriteVCF(&buf, "ref", []Variant{{3, "t", "g"}, {1, "att", "a"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var records []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			records = append(records, line)
+		}
+	}
+	want := []string{
+		"ref\t4\t.\tT\tG\t.\tPASS\tTYPE=SNV",
+		"ref\t2\t.\tATT\tA\t.\tPASS\tTYPE=DEL",
+	}
+	if !reflect.DeepEqual(want, records) {
+		t.Errorf("want %q, have %q", want, records)
+	}
+}
@@ -0,0 +1,166 @@
+// Package migrate applies versioned schema migrations to a SQLite or
+// PostgreSQL DB. Applied migrations are recorded in a schema_version table,
+// along with a checksum of their SQL, so that a migration which is edited
+// after it's been applied is detected rather than silently skipped.
+package migrate
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Migration is a single step in the evolution of a schema. Up applies it,
+// and Down reverts it. Versions start at 1 and increase by 1.
+type Migration struct {
+	Version     int
+	Description string
+	Up          string
+	Down        string
+}
+
+// Checksum of the migration's SQL.
+func (m Migration) Checksum() string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(m.Up+"\x00"+m.Down)))
+}
+
+// Latest returns the version of the last migration.
+func Latest(migrations []Migration) int {
+	if len(migrations) == 0 {
+		return 0
+	}
+	return migrations[len(migrations)-1].Version
+}
+
+// Current returns the schema version of the DB, which is 0 if no migrations
+// have been applied. It verifies the checksums of the applied migrations.
+func Current(ctx context.Context, db *sql.DB, migrations []Migration) (int, error) {
+	if err := ensureTable(ctx, db); err != nil {
+		return 0, err
+	}
+	return verify(ctx, db, migrations)
+}
+
+// Migrate the DB to the target version, applying Up migrations in order or
+// Down migrations in reverse order as necessary. Each migration is applied
+// in its own transaction. A target of -1 means the latest version. Several
+// processes may migrate a shared DB at once, e.g. replicas starting up; an
+// Up migration which fails because another process applied it first is
+// skipped.
+func Migrate(ctx context.Context, db *sql.DB, migrations []Migration, target int) (from, to int, err error) {
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return 0, 0, errors.Errorf("migration %d has version %d", i+1, m.Version)
+		}
+	}
+	if target < 0 {
+		target = Latest(migrations)
+	}
+	if target > Latest(migrations) {
+		return 0, 0, errors.Errorf("no migration to version %d", target)
+	}
+
+	if err := ensureTable(ctx, db); err != nil {
+		return 0, 0, err
+	}
+	from, err = verify(ctx, db, migrations)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for to = from; to < target; to++ {
+		m := migrations[to]
+		if err := apply(ctx, db, m.Up, `INSERT INTO schema_version (version, checksum, applied) VALUES ($1, $2, $3)`, m.Version, m.Checksum(), time.Now().Unix()); err != nil {
+			if current, verr := verify(ctx, db, migrations); verr == nil && current >= m.Version {
+				continue // applied by another process
+			}
+			return from, to, errors.Wrapf(err, "error applying migration %d (%s)", m.Version, m.Description)
+		}
+	}
+	for ; to > target; to-- {
+		m := migrations[to-1]
+		if err := apply(ctx, db, m.Down, `DELETE FROM schema_version WHERE version = $1`, m.Version); err != nil {
+			return from, to, errors.Wrapf(err, "error reverting migration %d (%s)", m.Version, m.Description)
+		}
+	}
+
+	return from, to, nil
+}
+
+// ensureTable creates the schema_version table, if it doesn't exist. In
+// PostgreSQL, concurrent CREATE TABLE IF NOT EXISTS statements can fail, so
+// a failure is retried once.
+func ensureTable(ctx context.Context, db *sql.DB) (err error) {
+	const create = `CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL PRIMARY KEY, checksum TEXT NOT NULL, applied BIGINT NOT NULL)`
+	for attempt := 0; attempt < 2; attempt++ {
+		if _, err = db.ExecContext(ctx, create); err == nil {
+			return nil
+		}
+	}
+	return errors.Wrap(err, "error creating schema_version table")
+}
+
+// verify returns the highest applied version, after checking that every
+// applied migration is known and unchanged.
+func verify(ctx context.Context, db *sql.DB, migrations []Migration) (current int, err error) {
+	rows, err := db.QueryContext(ctx, `SELECT version, checksum FROM schema_version ORDER BY version`)
+	if err != nil {
+		return 0, errors.Wrap(err, "error reading schema_version table")
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			version  int
+			checksum string
+		)
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return 0, errors.Wrap(err, "error reading schema_version table")
+		}
+		if version != current+1 {
+			return 0, errors.Errorf("schema_version table is missing version %d", current+1)
+		}
+		if version > len(migrations) {
+			return 0, errors.Errorf("DB has unknown schema version %d; latest known is %d", version, Latest(migrations))
+		}
+		if want := migrations[version-1].Checksum(); checksum != want {
+			return 0, errors.Errorf("checksum mismatch for applied migration %d: it's been changed since it was applied", version)
+		}
+		current = version
+	}
+	if err := rows.Err(); err != nil {
+		return 0, errors.Wrap(err, "error reading schema_version table")
+	}
+
+	return current, nil
+}
+
+func apply(ctx context.Context, db *sql.DB, statements, record string, args ...interface{}) (err error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "error starting migration transaction")
+	}
+
+	defer func() {
+		if err == nil {
+			if commitErr := tx.Commit(); commitErr != nil {
+				err = errors.Wrap(commitErr, "error committing migration transaction")
+			}
+		} else {
+			tx.Rollback() // ignore error
+		}
+	}()
+
+	if _, err = tx.ExecContext(ctx, statements); err != nil {
+		return err
+	}
+	if _, err = tx.ExecContext(ctx, record, args...); err != nil {
+		return errors.Wrap(err, "error updating schema_version table")
+	}
+
+	return nil
+}
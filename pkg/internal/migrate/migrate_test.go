@@ -0,0 +1,60 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3" // driver
+)
+
+func TestMigrate(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file:"+t.Name()+"?mode=memory&cache=shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var (
+		ctx        = context.Background()
+		migrations = []Migration{
+			{1, "create", `CREATE TABLE t (a INTEGER)`, `DROP TABLE t`},
+			{2, "alter", `ALTER TABLE t ADD COLUMN b INTEGER`, `ALTER TABLE t DROP COLUMN b`},
+		}
+	)
+
+	if from, to, err := Migrate(ctx, db, migrations, 1); err != nil || from != 0 || to != 1 {
+		t.Fatalf("Migrate to 1: want 0 → 1, have %d → %d (%v)", from, to, err)
+	}
+	if from, to, err := Migrate(ctx, db, migrations, -1); err != nil || from != 1 || to != 2 {
+		t.Fatalf("Migrate to latest: want 1 → 2, have %d → %d (%v)", from, to, err)
+	}
+	if _, err := db.Exec(`INSERT INTO t (a, b) VALUES (1, 2)`); err != nil {
+		t.Errorf("after Migrate to latest: %v", err)
+	}
+	if from, to, err := Migrate(ctx, db, migrations, 1); err != nil || from != 2 || to != 1 {
+		t.Fatalf("Migrate down to 1: want 2 → 1, have %d → %d (%v)", from, to, err)
+	}
+	if _, err := db.Exec(`INSERT INTO t (a, b) VALUES (1, 2)`); err == nil {
+		t.Errorf("after Migrate down to 1: column b still exists")
+	}
+	if _, _, err := Migrate(ctx, db, migrations, 3); err == nil {
+		t.Errorf("Migrate to unknown version: want error, have none")
+	}
+
+	// Changing an applied migration is detected.
+	changed := []Migration{
+		{1, "create", `CREATE TABLE t (a INTEGER, c INTEGER)`, `DROP TABLE t`},
+		migrations[1],
+	}
+	if _, err := Current(ctx, db, changed); err == nil {
+		t.Errorf("Current with changed migration: want error, have none")
+	}
+	if _, _, err := Migrate(ctx, db, changed, -1); err == nil {
+		t.Errorf("Migrate with changed migration: want error, have none")
+	}
+
+	if current, err := Current(ctx, db, migrations); err != nil || current != 1 {
+		t.Errorf("Current: want 1, have %d (%v)", current, err)
+	}
+}
@@ -0,0 +1,105 @@
+// Package pgtest starts throwaway PostgreSQL instances for tests.
+package pgtest
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq" // driver
+)
+
+// URNVar is the environment variable which, if set, names an existing
+// PostgreSQL database to use instead of starting a new instance. Tests
+// must clean up after themselves in that database.
+const URNVar = "POSTGRES_TEST_URN"
+
+// Start a local PostgreSQL instance in a temporary directory, and return a
+// URN for connecting to it, and a func to stop it and remove the directory.
+// If the PostgreSQL binaries (initdb, pg_ctl) aren't on the PATH, the test
+// is skipped.
+func Start(t *testing.T) (urn string, stop func()) {
+	t.Helper()
+
+	if urn := os.Getenv(URNVar); urn != "" {
+		return urn, func() {}
+	}
+
+	initdb, err := exec.LookPath("initdb")
+	if err != nil {
+		t.Skipf("skipping; initdb not found, and %s not set", URNVar)
+	}
+	pgctl, err := exec.LookPath("pg_ctl")
+	if err != nil {
+		t.Skipf("skipping; pg_ctl not found, and %s not set", URNVar)
+	}
+
+	dir, err := ioutil.TempDir("", "pgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		data = filepath.Join(dir, "data")
+		log  = filepath.Join(dir, "log")
+		port = freePort(t)
+	)
+
+	if output, err := exec.Command(initdb, "-D", data, "-U", "postgres", "-A", "trust").CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("initdb: %v: %s", err, output)
+	}
+
+	options := fmt.Sprintf("-p %d -k %s -c listen_addresses=127.0.0.1", port, dir)
+	if output, err := exec.Command(pgctl, "start", "-w", "-D", data, "-l", log, "-o", options).CombinedOutput(); err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("pg_ctl start: %v: %s", err, output)
+	}
+
+	stop = func() {
+		exec.Command(pgctl, "stop", "-w", "-m", "immediate", "-D", data).Run()
+		os.RemoveAll(dir)
+	}
+
+	urn = fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+	if err := waitReady(urn, 10*time.Second); err != nil {
+		stop()
+		t.Fatal(err)
+	}
+
+	return urn, stop
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func waitReady(urn string, timeout time.Duration) error {
+	db, err := sql.Open("postgres", urn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		err := db.Ping()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("postgres not ready after %s: %v", timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
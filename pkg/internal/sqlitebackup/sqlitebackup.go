@@ -0,0 +1,135 @@
+// Package sqlitebackup copies SQLite DBs with the online backup API, which
+// takes a consistent snapshot while the DB remains in use.
+package sqlitebackup
+
+import (
+	"context"
+	"database/sql"
+	"os"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/pkg/errors"
+)
+
+// busyWait is how long Copy waits before retrying, when the source or
+// destination is locked by another connection.
+const busyWait = 10 * time.Millisecond
+
+// Copy replaces the contents of dst with a snapshot of src.
+func Copy(ctx context.Context, dst, src *sql.DB) error {
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to source DB")
+	}
+	defer srcConn.Close()
+
+	dstConn, err := dst.Conn(ctx)
+	if err != nil {
+		return errors.Wrap(err, "error connecting to destination DB")
+	}
+	defer dstConn.Close()
+
+	return dstConn.Raw(func(d interface{}) error {
+		return srcConn.Raw(func(s interface{}) error {
+			dc, ok := d.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.Errorf("destination isn't a SQLite DB (%T)", d)
+			}
+			sc, ok := s.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.Errorf("source isn't a SQLite DB (%T)", s)
+			}
+
+			b, err := dc.Backup("main", sc, "main")
+			if err != nil {
+				return errors.Wrap(err, "error starting backup")
+			}
+			for {
+				done, err := b.Step(-1) // all pages at once, so writes don't restart it
+				if err != nil {
+					b.Finish()
+					return errors.Wrap(err, "error copying DB")
+				}
+				if done {
+					break
+				}
+				select {
+				case <-ctx.Done():
+					b.Finish()
+					return ctx.Err()
+				case <-time.After(busyWait):
+				}
+			}
+			return errors.Wrap(b.Finish(), "error finishing backup")
+		})
+	})
+}
+
+// ToFile writes a snapshot of src to a new DB file, which mustn't exist.
+func ToFile(ctx context.Context, src *sql.DB, filename string) error {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return errors.Errorf("%s already exists", filename)
+	}
+
+	dst, err := sql.Open("sqlite3", "file:"+filename)
+	if err != nil {
+		return errors.Wrap(err, "error creating backup file")
+	}
+	defer dst.Close()
+
+	if err := Copy(ctx, dst, src); err != nil {
+		dst.Close()
+		os.Remove(filename)
+		return err
+	}
+	return nil
+}
+
+// Open a DB file read-only, failing if it doesn't exist.
+func Open(filename string) (*sql.DB, error) {
+	if _, err := os.Stat(filename); err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("sqlite3", "file:"+filename+"?mode=ro")
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening backup file")
+	}
+	return db, nil
+}
+
+// Check the integrity of the DB.
+func Check(ctx context.Context, db *sql.DB) error {
+	rows, err := db.QueryContext(ctx, `PRAGMA integrity_check`)
+	if err != nil {
+		return errors.Wrap(err, "error checking integrity")
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var result string
+		if err := rows.Scan(&result); err != nil {
+			return errors.Wrap(err, "error checking integrity")
+		}
+		if result != "ok" {
+			problems = append(problems, result)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return errors.Wrap(err, "error checking integrity")
+	}
+	if len(problems) > 0 {
+		return errors.Errorf("integrity check failed: %v", problems)
+	}
+	return nil
+}
+
+// Empty returns true if the DB has no tables.
+func Empty(ctx context.Context, db *sql.DB) (bool, error) {
+	var n int
+	if err := db.QueryRowContext(ctx, `SELECT count(*) FROM sqlite_master WHERE type = 'table'`).Scan(&n); err != nil {
+		return false, errors.Wrap(err, "error reading schema")
+	}
+	return n == 0, nil
+}
@@ -0,0 +1,301 @@
+// Package oidc is a minimal OpenID Connect relying party, which signs users
+// in with an external identity provider by the authorization code flow with
+// PKCE. It supports providers which sign ID tokens with RS256, which all
+// conforming providers must.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidToken is returned when an ID token fails verification.
+var ErrInvalidToken = errors.New("invalid ID token")
+
+// Config identifies the relying party to the provider.
+type Config struct {
+	ClientID     string
+	ClientSecret string // empty for public clients
+	RedirectURL  string
+	Scopes       []string // in addition to openid
+}
+
+// Provider is an OpenID Connect identity provider, as described by its
+// discovery document.
+type Provider struct {
+	Issuer   string `json:"issuer"`
+	AuthURL  string `json:"authorization_endpoint"`
+	TokenURL string `json:"token_endpoint"`
+	JWKSURL  string `json:"jwks_uri"`
+
+	client *http.Client
+	mtx    sync.Mutex
+	keys   map[string]*rsa.PublicKey // kid: key
+}
+
+// Discover fetches the discovery document of the issuer.
+func Discover(ctx context.Context, client *http.Client, issuer string) (*Provider, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	p := &Provider{client: client}
+	if err := p.get(ctx, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", p); err != nil {
+		return nil, errors.Wrap(err, "error fetching discovery document")
+	}
+	if p.Issuer != issuer {
+		return nil, errors.Errorf("discovery document is for issuer %q, not %q", p.Issuer, issuer)
+	}
+	if p.AuthURL == "" || p.TokenURL == "" || p.JWKSURL == "" {
+		return nil, errors.New("discovery document is incomplete")
+	}
+	return p, nil
+}
+
+// NewVerifier returns a random PKCE code verifier, and its S256 challenge.
+func NewVerifier() (verifier, challenge string, err error) {
+	verifier, err = random(32)
+	if err != nil {
+		return "", "", err
+	}
+	return verifier, Challenge(verifier), nil
+}
+
+// Challenge returns the S256 PKCE challenge for the verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Random returns a random URL-safe string, e.g. for a state or nonce.
+func Random() (string, error) {
+	return random(16)
+}
+
+func random(n int) (string, error) {
+	p := make([]byte, n)
+	if _, err := rand.Read(p); err != nil {
+		return "", errors.Wrap(err, "error generating random value")
+	}
+	return base64.RawURLEncoding.EncodeToString(p), nil
+}
+
+// AuthCodeURL returns the URL to send the user to, to sign in with the
+// provider. The provider redirects them back to the config's RedirectURL
+// with the state, and a code to pass to Exchange.
+func (p *Provider) AuthCodeURL(c Config, state, nonce, challenge string) string {
+	v := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.ClientID},
+		"redirect_uri":          {c.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, c.Scopes...), " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		sep = "&"
+	}
+	return p.AuthURL + sep + v.Encode()
+}
+
+// Exchange redeems the code, with the PKCE verifier whose challenge was
+// passed to AuthCodeURL, and returns the raw ID token.
+func (p *Provider) Exchange(ctx context.Context, c Config, code, verifier string) (idToken string, err error) {
+	v := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.RedirectURL},
+		"client_id":     {c.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", p.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "error constructing token request")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if c.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.ClientID), url.QueryEscape(c.ClientSecret))
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrap(err, "error making token request")
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", errors.Wrapf(err, "error decoding token response (%s)", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("token request failed: %s (%s)", body.Error, resp.Status)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token response has no ID token")
+	}
+	return body.IDToken, nil
+}
+
+// Claims are the verified claims of an ID token.
+type Claims struct {
+	Subject string
+	Raw     map[string]interface{}
+}
+
+// String returns the named claim, if it's a string.
+func (c Claims) String(name string) string {
+	s, _ := c.Raw[name].(string)
+	return s
+}
+
+// clockSkew is how far the provider's clock may be ahead of ours.
+const clockSkew = time.Minute
+
+// Verify checks the ID token's signature, issuer, audience, expiry, and
+// nonce, and returns its claims. Any failure is ErrInvalidToken, except
+// failing to fetch the provider's keys.
+func (p *Provider) Verify(ctx context.Context, c Config, idToken, nonce string, now time.Time) (Claims, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return Claims{}, ErrInvalidToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil || header.Alg != "RS256" {
+		return Claims{}, ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	key, err := p.key(ctx, header.Kid)
+	if err != nil {
+		return Claims{}, err
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+
+	var raw map[string]interface{}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return Claims{}, ErrInvalidToken
+	}
+	claims := Claims{Raw: raw}
+	claims.Subject = claims.String("sub")
+	exp, _ := raw["exp"].(float64)
+	switch {
+	case claims.String("iss") != p.Issuer:
+	case !audience(raw["aud"], c.ClientID):
+	case claims.Subject == "":
+	case now.After(time.Unix(int64(exp), 0).Add(clockSkew)):
+	case claims.String("nonce") != nonce:
+	default:
+		return claims, nil
+	}
+	return Claims{}, ErrInvalidToken
+}
+
+// audience returns true if aud, a string or array of strings, includes the
+// client ID.
+func audience(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the provider's signing key with the ID. Providers rotate keys,
+// so an unknown ID causes the keys to be fetched again.
+func (p *Provider) key(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := p.get(ctx, p.JWKSURL, &jwks); err != nil {
+		return nil, errors.Wrap(err, "error fetching provider keys")
+	}
+	p.keys = map[string]*rsa.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			continue
+		}
+		p.keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+func (p *Provider) get(ctx context.Context, url string, v interface{}) error {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func decodeSegment(s string, v interface{}) error {
+	p, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(p, v)
+}
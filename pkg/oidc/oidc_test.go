@@ -0,0 +1,115 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/oidc/oidctest"
+)
+
+func TestFlow(t *testing.T) {
+	ctx := context.Background()
+	idp, err := oidctest.NewProvider("gattaca", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+	idp.AddUser("s-123", map[string]interface{}{"preferred_username": "ann"})
+
+	p, err := Discover(ctx, http.DefaultClient, idp.URL)
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	c := Config{ClientID: "gattaca", ClientSecret: "secret", RedirectURL: "http://localhost/callback"}
+
+	login := func(verifier, nonce string) (idToken string, err error) {
+		t.Helper()
+		state, err := Random()
+		if err != nil {
+			t.Fatal(err)
+		}
+		redirect, err := idp.Login(p.AuthCodeURL(c, state, nonce, Challenge("right verifier")), "s-123")
+		if err != nil {
+			t.Fatalf("Login: %v", err)
+		}
+		if want, have := state, redirect.Query().Get("state"); want != have {
+			t.Errorf("redirect: want state %q, have %q", want, have)
+		}
+		return p.Exchange(ctx, c, redirect.Query().Get("code"), verifier)
+	}
+
+	if _, err := login("wrong verifier", "n"); err == nil {
+		t.Errorf("Exchange with wrong verifier: want error, have none")
+	}
+
+	idToken, err := login("right verifier", "n-1")
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	if _, err := p.Verify(ctx, c, idToken, "n-2", time.Now()); err != ErrInvalidToken {
+		t.Errorf("Verify with wrong nonce: want %v, have %v", ErrInvalidToken, err)
+	}
+	if _, err := p.Verify(ctx, c, idToken, "n-1", time.Now().Add(2*oidctest.TTL)); err != ErrInvalidToken {
+		t.Errorf("Verify after expiry: want %v, have %v", ErrInvalidToken, err)
+	}
+	claims, err := p.Verify(ctx, c, idToken, "n-1", time.Now())
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if want, have := "s-123", claims.Subject; want != have {
+		t.Errorf("Verify: want subject %q, have %q", want, have)
+	}
+	if want, have := "ann", claims.String("preferred_username"); want != have {
+		t.Errorf("Verify: want preferred_username %q, have %q", want, have)
+	}
+
+	// Tampering breaks the signature.
+	tampered := idToken[:len(idToken)-4] + "AAAA"
+	if tampered == idToken {
+		tampered = idToken[:len(idToken)-4] + "BBBB"
+	}
+	if _, err := p.Verify(ctx, c, tampered, "n-1", time.Now()); err != ErrInvalidToken {
+		t.Errorf("Verify tampered: want %v, have %v", ErrInvalidToken, err)
+	}
+}
+
+func TestVerifyClaims(t *testing.T) {
+	ctx := context.Background()
+	idp, err := oidctest.NewProvider("gattaca", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idp.Close()
+
+	p, err := Discover(ctx, nil, idp.URL)
+	if err != nil {
+		t.Fatalf("Discover: %v", err)
+	}
+	var (
+		c   = Config{ClientID: "gattaca"}
+		exp = time.Now().Add(time.Hour).Unix()
+	)
+	for _, testcase := range []struct {
+		name   string
+		claims map[string]interface{}
+		valid  bool
+	}{
+		{"valid", map[string]interface{}{"iss": idp.URL, "sub": "s", "aud": "gattaca", "exp": exp, "nonce": "n"}, true},
+		{"audience list", map[string]interface{}{"iss": idp.URL, "sub": "s", "aud": []string{"other", "gattaca"}, "exp": exp, "nonce": "n"}, true},
+		{"other issuer", map[string]interface{}{"iss": "https://evil", "sub": "s", "aud": "gattaca", "exp": exp, "nonce": "n"}, false},
+		{"other audience", map[string]interface{}{"iss": idp.URL, "sub": "s", "aud": "other", "exp": exp, "nonce": "n"}, false},
+		{"no subject", map[string]interface{}{"iss": idp.URL, "aud": "gattaca", "exp": exp, "nonce": "n"}, false},
+		{"no expiry", map[string]interface{}{"iss": idp.URL, "sub": "s", "aud": "gattaca", "nonce": "n"}, false},
+	} {
+		idToken, err := idp.IDToken(testcase.claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = p.Verify(ctx, c, idToken, "n", time.Now())
+		if want, have := testcase.valid, err == nil; want != have {
+			t.Errorf("%s: want valid %v, have %v (%v)", testcase.name, want, have, err)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+// Package oidctest provides a stand-in OpenID Connect provider, so that
+// relying parties can be tested without a real identity provider. It serves
+// discovery, authorization, token, and JWKS endpoints, and signs ID tokens
+// with RS256.
+package oidctest
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Provider is a stand-in OpenID Connect provider, with a single client.
+// Users don't authenticate: the authorization endpoint signs in the user
+// whose subject is passed as the login_hint parameter, if it's been added.
+type Provider struct {
+	URL string // issuer
+
+	server       *httptest.Server
+	key          *rsa.PrivateKey
+	clientID     string
+	clientSecret string
+
+	mtx   sync.Mutex
+	users map[string]map[string]interface{} // subject: claims
+	codes map[string]grant                  // code: grant
+}
+
+type grant struct {
+	subject     string
+	redirectURL string
+	nonce       string
+	challenge   string
+}
+
+// TTL is how long ID tokens issued by the provider are valid.
+const TTL = time.Hour
+
+// NewProvider starts a provider for the client. If the secret isn't empty,
+// the client must authenticate with it to redeem codes. Close the provider
+// when done.
+func NewProvider(clientID, clientSecret string) (*Provider, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	p := &Provider{
+		key:          key,
+		clientID:     clientID,
+		clientSecret: clientSecret,
+		users:        map[string]map[string]interface{}{},
+		codes:        map[string]grant{},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	p.server = httptest.NewServer(mux)
+	p.URL = p.server.URL
+	return p, nil
+}
+
+// Close shuts the provider down.
+func (p *Provider) Close() {
+	p.server.Close()
+}
+
+// AddUser adds a user with the subject, and extra claims for their ID
+// tokens, e.g. preferred_username.
+func (p *Provider) AddUser(subject string, claims map[string]interface{}) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.users[subject] = claims
+}
+
+// IDToken returns an ID token with exactly the claims, signed by the
+// provider, e.g. to test how relying parties handle bad claims.
+func (p *Provider) IDToken(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "test"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// Login follows the URL returned by oidc.Provider.AuthCodeURL as the user
+// with the subject, and returns the URL the provider redirects them to.
+func (p *Provider) Login(authCodeURL, subject string) (*url.URL, error) {
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	resp, err := client.Get(authCodeURL + "&login_hint=" + url.QueryEscape(subject))
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		return nil, fmt.Errorf("authorize returned %s", resp.Status)
+	}
+	return resp.Location()
+}
+
+func (p *Provider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.URL,
+		"authorization_endpoint":                p.URL + "/authorize",
+		"token_endpoint":                        p.URL + "/token",
+		"jwks_uri":                              p.URL + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *Provider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	switch {
+	case q.Get("response_type") != "code":
+		http.Error(w, "unsupported response_type", http.StatusBadRequest)
+		return
+	case q.Get("client_id") != p.clientID:
+		http.Error(w, "unknown client_id", http.StatusBadRequest)
+		return
+	case q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "":
+		http.Error(w, "S256 code_challenge required", http.StatusBadRequest)
+		return
+	}
+	redirect, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirect.IsAbs() {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	p.mtx.Lock()
+	_, ok := p.users[q.Get("login_hint")]
+	p.mtx.Unlock()
+	v := redirect.Query()
+	v.Set("state", q.Get("state"))
+	if !ok {
+		v.Set("error", "access_denied")
+	} else {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		code := base64.RawURLEncoding.EncodeToString(b)
+		p.mtx.Lock()
+		p.codes[code] = grant{
+			subject:     q.Get("login_hint"),
+			redirectURL: q.Get("redirect_uri"),
+			nonce:       q.Get("nonce"),
+			challenge:   q.Get("code_challenge"),
+		}
+		p.mtx.Unlock()
+		v.Set("code", code)
+	}
+	redirect.RawQuery = v.Encode()
+	http.Redirect(w, r, redirect.String(), http.StatusFound)
+}
+
+func (p *Provider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if p.clientSecret != "" {
+		id, secret, _ := r.BasicAuth()
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+		if id != p.clientID || secret != p.clientSecret {
+			tokenError(w, http.StatusUnauthorized, "invalid_client")
+			return
+		}
+	}
+
+	p.mtx.Lock()
+	g, ok := p.codes[r.PostFormValue("code")]
+	delete(p.codes, r.PostFormValue("code")) // codes are single use
+	claims := p.users[g.subject]
+	p.mtx.Unlock()
+	switch {
+	case r.PostFormValue("grant_type") != "authorization_code":
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	case !ok, r.PostFormValue("client_id") != p.clientID, r.PostFormValue("redirect_uri") != g.redirectURL:
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	case challenge(r.PostFormValue("code_verifier")) != g.challenge:
+		tokenError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	all := map[string]interface{}{
+		"iss":   p.URL,
+		"sub":   g.subject,
+		"aud":   p.clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(TTL).Unix(),
+		"nonce": g.nonce,
+	}
+	for k, v := range claims {
+		all[k] = v
+	}
+	idToken, err := p.IDToken(all)
+	if err != nil {
+		tokenError(w, http.StatusInternalServerError, "server_error")
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": "unused",
+		"token_type":   "Bearer",
+		"expires_in":   int(TTL.Seconds()),
+		"id_token":     idToken,
+	})
+}
+
+func (p *Provider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test",
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+// challenge returns the S256 PKCE challenge for the verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func tokenError(w http.ResponseWriter, code int, err string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"error": err})
+}
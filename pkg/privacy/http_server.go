@@ -0,0 +1,88 @@
+package privacy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+// Validator authenticates users, e.g. auth.Service.
+type Validator interface {
+	Validate(ctx context.Context, user, token string) (rbac.Principal, error)
+}
+
+// HTTPServer lets users export and erase their own data.
+type HTTPServer struct {
+	router  *mux.Router
+	valid   Validator
+	journal *Journal
+	sources []Source
+}
+
+// NewHTTPServer returns an HTTPServer for the sources, which authenticates
+// users with the validator, and records erasures in the journal.
+func NewHTTPServer(valid Validator, journal *Journal, sources ...Source) *HTTPServer {
+	s := &HTTPServer{
+		valid:   valid,
+		journal: journal,
+		sources: sources,
+	}
+	r := mux.NewRouter()
+	{
+		r.Methods("GET").Path("/export").HandlerFunc(s.handleExport)
+		r.Methods("POST").Path("/erase").HandlerFunc(s.handleErase)
+	}
+	s.router = r
+	return s
+}
+
+// ServeHTTP implements http.Handler, delegating to the mux.Router.
+func (s *HTTPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+func (s *HTTPServer) handleExport(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = r.URL.Query().Get("token")
+	)
+	if _, err := s.valid.Validate(r.Context(), user, token); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := Export(r.Context(), &buf, user, s.sources...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", user+".zip"))
+	buf.WriteTo(w)
+}
+
+func (s *HTTPServer) handleErase(w http.ResponseWriter, r *http.Request) {
+	var (
+		user  = r.URL.Query().Get("user")
+		token = r.URL.Query().Get("token")
+	)
+	if _, err := s.valid.Validate(r.Context(), user, token); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Once it's begun, the erasure shouldn't be abandoned if the client goes
+	// away, which would leave it pending until Resume.
+	receipt, err := s.journal.Erase(context.Background(), user, s.sources...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(receipt)
+}
@@ -0,0 +1,192 @@
+package privacy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Receipt records an erasure, for audit.
+type Receipt struct {
+	ID        string    `json:"id"`
+	User      string    `json:"user"`
+	Sources   []string  `json:"sources"`
+	Requested time.Time `json:"requested"`
+	Completed time.Time `json:"completed"` // zero while pending
+}
+
+// Journal is an append-only file of erasures. Each erasure is recorded
+// before any source is erased, and again once every source has been, so
+// that an erasure interrupted part way through, e.g. by a crash, can be
+// completed by Resume. The journal is the record of receipts.
+type Journal struct {
+	mtx      sync.Mutex
+	filename string
+}
+
+// NewJournal returns a journal backed by the file, which is created if it
+// doesn't exist.
+func NewJournal(filename string) (*Journal, error) {
+	f, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening erasure journal")
+	}
+	f.Close()
+	return &Journal{filename: filename}, nil
+}
+
+type journalEntry struct {
+	Event   string  `json:"event"` // requested, completed
+	Receipt Receipt `json:"receipt"`
+}
+
+// Erase the user from every source, in order, and return the receipt.
+// Sources which may be used to authenticate the erasure should come last.
+func (j *Journal) Erase(ctx context.Context, user string, sources ...Source) (Receipt, error) {
+	id, err := newID()
+	if err != nil {
+		return Receipt{}, err
+	}
+	receipt := Receipt{ID: id, User: user, Requested: time.Now().UTC()}
+	for _, s := range sources {
+		receipt.Sources = append(receipt.Sources, s.Name)
+	}
+
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	if err := j.append(journalEntry{Event: "requested", Receipt: receipt}); err != nil {
+		return Receipt{}, err
+	}
+	return j.complete(ctx, receipt, sources)
+}
+
+// Resume completes every erasure that was requested but not completed,
+// with the sources of the same names, and returns their receipts.
+func (j *Journal) Resume(ctx context.Context, sources ...Source) ([]Receipt, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	receipts, err := j.read()
+	if err != nil {
+		return nil, err
+	}
+
+	byName := map[string]Source{}
+	for _, s := range sources {
+		byName[s.Name] = s
+	}
+
+	var completed []Receipt
+	for _, receipt := range receipts {
+		if !receipt.Completed.IsZero() {
+			continue
+		}
+		var pending []Source
+		for _, name := range receipt.Sources {
+			s, ok := byName[name]
+			if !ok {
+				return completed, errors.Errorf("erasure %s needs source %s", receipt.ID, name)
+			}
+			pending = append(pending, s)
+		}
+		receipt, err := j.complete(ctx, receipt, pending)
+		if err != nil {
+			return completed, err
+		}
+		completed = append(completed, receipt)
+	}
+	return completed, nil
+}
+
+// Receipts returns the receipts of every erasure in the journal, oldest
+// first, including those which are pending.
+func (j *Journal) Receipts() ([]Receipt, error) {
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+
+	return j.read()
+}
+
+// complete erases the user from the sources, and records the receipt as
+// completed. The caller must hold the mutex.
+func (j *Journal) complete(ctx context.Context, receipt Receipt, sources []Source) (Receipt, error) {
+	for _, s := range sources {
+		if err := s.Erase(ctx, receipt.User); err != nil {
+			return receipt, errors.Wrapf(err, "error erasing from %s", s.Name)
+		}
+	}
+	receipt.Completed = time.Now().UTC()
+	if err := j.append(journalEntry{Event: "completed", Receipt: receipt}); err != nil {
+		return receipt, err
+	}
+	return receipt, nil
+}
+
+// append writes the entry to the journal, and syncs it to disk.
+func (j *Journal) append(e journalEntry) error {
+	f, err := os.OpenFile(j.filename, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrap(err, "error opening erasure journal")
+	}
+	defer f.Close()
+
+	if err := json.NewEncoder(f).Encode(e); err != nil {
+		return errors.Wrap(err, "error writing erasure journal")
+	}
+	return errors.Wrap(f.Sync(), "error syncing erasure journal")
+}
+
+// read the receipts in the journal. The caller must hold the mutex.
+func (j *Journal) read() ([]Receipt, error) {
+	f, err := os.Open(j.filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening erasure journal")
+	}
+	defer f.Close()
+
+	var (
+		receipts []Receipt
+		index    = map[string]int{}
+		r        = bufio.NewReader(f)
+	)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break // an incomplete last line was never synced, so never acted on
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "error reading erasure journal")
+		}
+		var e journalEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, errors.Wrap(err, "error reading erasure journal")
+		}
+		switch i, ok := index[e.Receipt.ID]; {
+		case e.Event == "requested" && !ok:
+			index[e.Receipt.ID] = len(receipts)
+			receipts = append(receipts, e.Receipt)
+		case e.Event == "completed" && ok:
+			receipts[i] = e.Receipt
+		default:
+			return nil, errors.Errorf("erasure journal has unexpected %s event for %s", e.Event, e.Receipt.ID)
+		}
+	}
+	return receipts, nil
+}
+
+func newID() (string, error) {
+	p := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, p); err != nil {
+		return "", errors.Wrap(err, "error generating receipt ID")
+	}
+	return hex.EncodeToString(p), nil
+}
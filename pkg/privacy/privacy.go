@@ -0,0 +1,70 @@
+// Package privacy exports and erases everything the services hold about a
+// user, to honor subject access and erasure requests.
+package privacy
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Source is a repository which holds data about users.
+type Source struct {
+	Name string // e.g. "auth", used as the name of its file in the archive
+
+	// Export returns what the repository holds about the user, which must
+	// be encodable as JSON.
+	Export func(ctx context.Context, user string) (interface{}, error)
+
+	// Erase removes everything the repository holds about the user. It
+	// must succeed if there's nothing to remove, as it may be retried.
+	Erase func(ctx context.Context, user string) error
+}
+
+// Manifest describes an export archive.
+type Manifest struct {
+	User     string    `json:"user"`
+	Exported time.Time `json:"exported"`
+	Sources  []string  `json:"sources"`
+}
+
+// Export writes a zip archive of everything the sources hold about the user
+// to w. It contains manifest.json, and a JSON file for each source. Nothing
+// is written unless every source is exported successfully.
+func Export(ctx context.Context, w io.Writer, user string, sources ...Source) error {
+	manifest := Manifest{User: user, Exported: time.Now().UTC()}
+	data := make([]interface{}, len(sources))
+	for i, s := range sources {
+		v, err := s.Export(ctx, user)
+		if err != nil {
+			return errors.Wrapf(err, "error exporting from %s", s.Name)
+		}
+		manifest.Sources = append(manifest.Sources, s.Name)
+		data[i] = v
+	}
+
+	z := zip.NewWriter(w)
+	if err := writeJSON(z, "manifest.json", manifest); err != nil {
+		return err
+	}
+	for i, s := range sources {
+		if err := writeJSON(z, s.Name+".json", data[i]); err != nil {
+			return err
+		}
+	}
+	return errors.Wrap(z.Close(), "error writing archive")
+}
+
+func writeJSON(z *zip.Writer, name string, v interface{}) error {
+	f, err := z.Create(name)
+	if err != nil {
+		return errors.Wrap(err, "error writing archive")
+	}
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return errors.Wrapf(enc.Encode(v), "error writing %s", name)
+}
@@ -0,0 +1,244 @@
+package privacy
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestExport(t *testing.T) {
+	var (
+		a = newMapSource("a", map[string]string{"alice": "a's data"})
+		b = newMapSource("b", map[string]string{"alice": "b's data"})
+	)
+
+	var buf bytes.Buffer
+	if err := Export(context.Background(), &buf, "alice", a.Source(), b.Source()); err != nil {
+		t.Fatal(err)
+	}
+
+	files := readArchive(t, buf.Bytes())
+	var manifest Manifest
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if want, have := "alice", manifest.User; want != have {
+		t.Errorf("manifest user: want %q, have %q", want, have)
+	}
+	for name, want := range map[string]string{"a.json": "a's data", "b.json": "b's data"} {
+		var have string
+		if err := json.Unmarshal(files[name], &have); err != nil || want != have {
+			t.Errorf("%s: want %q, have %q (%v)", name, want, have, err)
+		}
+	}
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "privacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := NewJournal(filepath.Join(dir, "erasures.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		ctx = context.Background()
+		a   = newMapSource("a", map[string]string{"alice": "x", "bob": "x"})
+		b   = newMapSource("b", map[string]string{"alice": "x", "bob": "x"})
+	)
+	receipt, err := j.Erase(ctx, "alice", a.Source(), b.Source())
+	if err != nil {
+		t.Fatalf("Erase: %v", err)
+	}
+	if receipt.Completed.IsZero() {
+		t.Errorf("Erase: receipt isn't completed")
+	}
+	if a.has("alice") || b.has("alice") {
+		t.Errorf("Erase: alice wasn't erased from every source")
+	}
+
+	// An erasure which fails part way through is completed by Resume.
+	b.fail = true
+	if _, err := j.Erase(ctx, "bob", a.Source(), b.Source()); err == nil {
+		t.Fatalf("Erase with failing source: want error, have none")
+	}
+	if want, have := true, b.has("bob"); want != have {
+		t.Fatalf("bob in b: want %v, have %v", want, have)
+	}
+
+	// Reopen the journal, as after a restart.
+	j, err = NewJournal(filepath.Join(dir, "erasures.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.fail = false
+	resumed, err := j.Resume(ctx, a.Source(), b.Source())
+	if err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	if want, have := 1, len(resumed); want != have {
+		t.Fatalf("Resume: want %d receipt, have %d", want, have)
+	}
+	if a.has("bob") || b.has("bob") {
+		t.Errorf("Resume: bob wasn't erased from every source")
+	}
+
+	receipts, err := j.Receipts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, have := 2, len(receipts); want != have {
+		t.Fatalf("Receipts: want %d, have %d", want, have)
+	}
+	for _, r := range receipts {
+		if r.Completed.IsZero() {
+			t.Errorf("Receipts: %s (%s) isn't completed", r.ID, r.User)
+		}
+	}
+	if resumed, err := j.Resume(ctx, a.Source(), b.Source()); err != nil || len(resumed) != 0 {
+		t.Errorf("Resume again: want none, have %v (%v)", resumed, err)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "privacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	j, err := NewJournal(filepath.Join(dir, "erasures.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := newMapSource("a", map[string]string{"alice": "x"})
+	server := httptest.NewServer(NewHTTPServer(validator{"alice": "token"}, j, source.Source()))
+	defer server.Close()
+
+	query := func(user, token string) string {
+		return "?" + url.Values{"user": {user}, "token": {token}}.Encode()
+	}
+
+	resp, err := http.Get(server.URL + "/export" + query("alice", "bad token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if want, have := http.StatusUnauthorized, resp.StatusCode; want != have {
+		t.Errorf("export with bad token: want %d, have %d", want, have)
+	}
+
+	resp, err = http.Get(server.URL + "/export" + query("alice", "token"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if want, have := http.StatusOK, resp.StatusCode; want != have {
+		t.Fatalf("export: want %d, have %d", want, have)
+	}
+	if _, ok := readArchive(t, body)["a.json"]; !ok {
+		t.Errorf("export: archive has no a.json")
+	}
+
+	resp, err = http.Post(server.URL+"/erase"+query("alice", "token"), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var receipt Receipt
+	json.NewDecoder(resp.Body).Decode(&receipt)
+	resp.Body.Close()
+	if want, have := http.StatusOK, resp.StatusCode; want != have {
+		t.Fatalf("erase: want %d, have %d", want, have)
+	}
+	if want, have := "alice", receipt.User; want != have {
+		t.Errorf("erase receipt: want user %q, have %q", want, have)
+	}
+	if source.has("alice") {
+		t.Errorf("erase: alice wasn't erased")
+	}
+}
+
+type mapSource struct {
+	name string
+	mtx  sync.Mutex
+	data map[string]string
+	fail bool
+}
+
+func newMapSource(name string, data map[string]string) *mapSource {
+	return &mapSource{name: name, data: data}
+}
+
+func (s *mapSource) Source() Source {
+	return Source{
+		Name: s.name,
+		Export: func(ctx context.Context, user string) (interface{}, error) {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			return s.data[user], nil
+		},
+		Erase: func(ctx context.Context, user string) error {
+			s.mtx.Lock()
+			defer s.mtx.Unlock()
+			if s.fail {
+				return errors.New("source unavailable")
+			}
+			delete(s.data, user)
+			return nil
+		},
+	}
+}
+
+func (s *mapSource) has(user string) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok := s.data[user]
+	return ok
+}
+
+type validator map[string]string // user: token
+
+func (v validator) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	if want, ok := v[user]; !ok || token != want {
+		return rbac.Principal{}, errors.New("bad auth")
+	}
+	return rbac.NewPrincipal(user, rbac.User), nil
+}
+
+func readArchive(t *testing.T, p []byte) map[string][]byte {
+	t.Helper()
+	z, err := zip.NewReader(bytes.NewReader(p), int64(len(p)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range z.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
@@ -0,0 +1,252 @@
+// Package ratelimit limits how often each client may call an HTTP API, with
+// a token bucket per client. Every request is first limited per IP; those
+// with valid credentials are then limited per user, or per API key,
+// instead.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+// Validator authenticates users, e.g. auth.Service.
+type Validator interface {
+	Validate(ctx context.Context, user, token string) (rbac.Principal, error)
+}
+
+const (
+	// maxBuckets bounds the memory used to track clients.
+	maxBuckets = 100000
+
+	// evictTo is how many buckets are kept when they're evicted, so that
+	// evicting, which scans every bucket, happens once in many new clients.
+	evictTo = maxBuckets * 9 / 10
+)
+
+// Limiter is a set of token buckets, keyed by client. Each bucket holds up
+// to burst tokens, and refills at rate tokens per second; each request takes
+// a token. It's safe for concurrent use. Limits are tracked in memory, so
+// each instance of a service enforces its own.
+type Limiter struct {
+	rate  float64
+	burst float64
+
+	mtx     sync.Mutex
+	buckets map[string]*bucket
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter allowing each client rate requests per
+// second on average, and bursts of up to burst requests.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+	}
+}
+
+// Take takes a token from the client's bucket at now, and returns true, if
+// there's one to take. It also returns the tokens remaining and, if there
+// were none, how long until there's one.
+func (l *Limiter) Take(key string, now time.Time) (ok bool, remaining int, retryAfter time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxBuckets {
+			l.evict(now)
+		}
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	l.refill(b, now)
+
+	if b.tokens < 1 {
+		if l.rate <= 0 {
+			return false, 0, time.Duration(math.MaxInt64) // never refills
+		}
+		return false, 0, time.Duration(math.Ceil((1 - b.tokens) / l.rate * float64(time.Second)))
+	}
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// give returns a token taken from the client's bucket.
+func (l *Limiter) give(key string, now time.Time) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	if b, ok := l.buckets[key]; ok {
+		l.refill(b, now)
+		b.tokens = math.Min(l.burst, b.tokens+1)
+	}
+}
+
+// Burst returns the most requests a client may make at once.
+func (l *Limiter) Burst() int {
+	return int(l.burst)
+}
+
+// refill adds the tokens accrued since the bucket was last used. It must be
+// called with the mutex held.
+func (l *Limiter) refill(b *bucket, now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed.Seconds()*l.rate)
+		b.last = now
+	}
+}
+
+// evict forgets full buckets, as they're the same as new ones and then, if
+// there are still more than evictTo, the least recently used. It must be
+// called with the mutex held.
+func (l *Limiter) evict(now time.Time) {
+	type used struct {
+		key  string
+		last time.Time
+	}
+	var partial []used
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+			continue
+		}
+		partial = append(partial, used{key, b.last})
+	}
+	if len(partial) <= evictTo {
+		return
+	}
+	sort.Slice(partial, func(i, j int) bool { return partial[i].last.Before(partial[j].last) })
+	for _, u := range partial[:len(partial)-evictTo] {
+		delete(l.buckets, u.key)
+	}
+}
+
+// Handler returns a handler which calls next for requests within the
+// limits, and refuses others with 429 Too Many Requests, and a Retry-After
+// header. Every response says how many requests the client has left in the
+// X-RateLimit-Limit and X-RateLimit-Remaining headers.
+//
+// Every request counts against the IP it came from first, so that requests
+// with made-up credentials can't cost a validation each once the IP is
+// limited. Requests with credentials, i.e. a user and a token as query
+// parameters or a bearer token, which the IP's limit admits, are then
+// validated. If they're valid, the request counts against the user or, for
+// API keys, the key, instead of the IP. The validated principal is passed
+// to next in the request's context, for ReuseValidation.
+func (l *Limiter) Handler(valid Validator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var (
+			now                       = time.Now()
+			ip                        = "ip:" + clientIP(r)
+			ok, remaining, retryAfter = l.Take(ip, now)
+		)
+		if user, token := credentials(r); ok && token != "" {
+			if p, err := valid.Validate(r.Context(), user, token); err == nil {
+				l.give(ip, now)
+				ok, remaining, retryAfter = l.Take(principalKey(p), now)
+				r = r.WithContext(context.WithValue(r.Context(), validationKey{}, validation{user, token, p}))
+			}
+		}
+
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(l.Burst()))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+			http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// retryAfterSeconds rounds up to whole seconds, as Retry-After requires.
+func retryAfterSeconds(d time.Duration) int {
+	seconds := math.Ceil(d.Seconds())
+	switch {
+	case seconds < 1:
+		return 1
+	case seconds > math.MaxInt32:
+		return math.MaxInt32
+	default:
+		return int(seconds)
+	}
+}
+
+// credentials returns the user and token of the request, if any.
+func credentials(r *http.Request) (user, token string) {
+	token = r.URL.Query().Get("token")
+	if h := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	return r.URL.Query().Get("user"), token
+}
+
+// principalKey identifies a validated client: by its API key, if it used
+// one, so that each key has its own bucket, or else by its user, so that a
+// user's sessions share one.
+func principalKey(p rbac.Principal) string {
+	if p.Key != "" {
+		return "key:" + p.Key
+	}
+	return "user:" + p.User
+}
+
+// clientIP returns the IP the request came from. Forwarding headers aren't
+// trusted, as clients can forge them. IPv6 clients are identified by their
+// /64 network, as each is usually given a whole one.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.To4() != nil {
+		return host
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+type validationKey struct{}
+
+// validation is a principal validated by Handler, with the credentials it
+// was validated from.
+type validation struct {
+	user, token string
+	principal   rbac.Principal
+}
+
+// ReuseValidation returns a validator which, for requests which have passed
+// through Handler, returns the principal that Handler validated, if the user
+// and token are the same, rather than validating them again with next.
+func ReuseValidation(next Validator) Validator {
+	return reuseValidator{next}
+}
+
+type reuseValidator struct {
+	next Validator
+}
+
+func (v reuseValidator) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	if prior, ok := ctx.Value(validationKey{}).(validation); ok && prior.user == user && prior.token == token {
+		return prior.principal, nil
+	}
+	return v.next.Validate(ctx, user, token)
+}
@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/peterbourgon/gattaca/pkg/rbac"
+)
+
+func TestTake(t *testing.T) {
+	var (
+		l   = NewLimiter(2, 3)
+		now = time.Unix(1500000000, 0)
+	)
+
+	// A burst empties the bucket.
+	for i, want := range []int{2, 1, 0} {
+		ok, remaining, _ := l.Take("a", now)
+		if !ok || remaining != want {
+			t.Errorf("take %d: want ok with %d remaining, have %v with %d", i+1, want, ok, remaining)
+		}
+	}
+	ok, _, retryAfter := l.Take("a", now)
+	if ok {
+		t.Errorf("empty bucket: want refused, have allowed")
+	}
+	if want, have := 500*time.Millisecond, retryAfter; want != have {
+		t.Errorf("empty bucket: want retry after %s, have %s", want, have)
+	}
+
+	// Other clients have their own buckets.
+	if ok, _, _ := l.Take("b", now); !ok {
+		t.Errorf("other client: want allowed, have refused")
+	}
+
+	// Buckets refill at the rate, up to the burst.
+	if ok, _, _ := l.Take("a", now.Add(500*time.Millisecond)); !ok {
+		t.Errorf("after refill: want allowed, have refused")
+	}
+	if _, remaining, _ := l.Take("a", now.Add(time.Hour)); remaining != 2 {
+		t.Errorf("after long wait: want 2 remaining, have %d", remaining)
+	}
+}
+
+func TestEvict(t *testing.T) {
+	var (
+		l   = NewLimiter(1, 2)
+		now = time.Unix(1500000000, 0)
+	)
+	for i := 0; i < maxBuckets; i++ {
+		l.Take(strconv.Itoa(i), now.Add(time.Duration(i)))
+	}
+	l.Take("new", now.Add(maxBuckets))
+	if want, have := evictTo+1, len(l.buckets); want != have {
+		t.Fatalf("after eviction: want %d buckets, have %d", want, have)
+	}
+	if _, ok := l.buckets["0"]; ok {
+		t.Errorf("least recently used bucket: want evicted, have kept")
+	}
+	if _, ok := l.buckets[strconv.Itoa(maxBuckets-1)]; !ok {
+		t.Errorf("most recently used bucket: want kept, have evicted")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	var (
+		l     = NewLimiter(1, 1)
+		valid = mockValidator{
+			"t1": rbac.NewPrincipal("ann", rbac.User),
+			"t2": rbac.NewPrincipal("ann", rbac.User),
+			"k1": {User: "ann", Key: "key1"},
+		}
+		h = l.Handler(valid, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	)
+	for _, testcase := range []struct {
+		target string
+		header string
+		addr   string
+		want   int
+	}{
+		{"/search?user=ann&token=t1", "", "", http.StatusOK},
+		{"/search?user=ann&token=t1", "", "", http.StatusTooManyRequests},
+		{"/search?user=ann", "Bearer t1", "", http.StatusTooManyRequests},     // same token
+		{"/search?user=ann&token=t2", "", "", http.StatusTooManyRequests},     // same user
+		{"/search?user=ann&token=k1", "", "", http.StatusOK},                  // API key
+		{"/signup?user=cat", "", "", http.StatusOK},                           // by IP
+		{"/signup?user=dan", "", "", http.StatusTooManyRequests},              // same IP
+		{"/login?user=eve&token=made-up", "", "", http.StatusTooManyRequests}, // still the same IP
+		{"/signup?user=dan", "", "192.0.2.2:1234", http.StatusOK},             // other IP
+		{"/signup?user=dan", "", "[2001:db8::1]:1234", http.StatusOK},
+		{"/signup?user=dan", "", "[2001:db8::2]:1234", http.StatusTooManyRequests}, // same /64
+	} {
+		var (
+			req = httptest.NewRequest("GET", testcase.target, nil)
+			rec = httptest.NewRecorder()
+		)
+		if testcase.header != "" {
+			req.Header.Set("Authorization", testcase.header)
+		}
+		if testcase.addr != "" {
+			req.RemoteAddr = testcase.addr
+		}
+		h.ServeHTTP(rec, req)
+		if want, have := testcase.want, rec.Code; want != have {
+			t.Errorf("%s: want %d, have %d", testcase.target, want, have)
+			continue
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "1" {
+			t.Errorf("%s: want Retry-After 1, have %q", testcase.target, rec.Header().Get("Retry-After"))
+		}
+		if want, have := "1", rec.Header().Get("X-RateLimit-Limit"); want != have {
+			t.Errorf("%s: want X-RateLimit-Limit %s, have %s", testcase.target, want, have)
+		}
+	}
+}
+
+func TestHandlerLimitsIPFirst(t *testing.T) {
+	var (
+		valid = &countingValidator{Validator: mockValidator{"t1": rbac.NewPrincipal("ann", rbac.User)}}
+		h     = NewLimiter(1, 2).Handler(valid, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	)
+	for _, testcase := range []struct {
+		target    string
+		want      int
+		validated int
+	}{
+		{"/search?user=ann&token=t1", http.StatusOK, 1},                   // charged to the user, not the IP
+		{"/search?user=ann&token=made-up", http.StatusOK, 2},              // charged to the IP
+		{"/search?user=ann&token=made-up", http.StatusOK, 3},              // charged to the IP
+		{"/search?user=ann&token=made-up", http.StatusTooManyRequests, 3}, // not validated
+		{"/search?user=ann&token=t1", http.StatusTooManyRequests, 3},      // nor are valid credentials
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", testcase.target, nil))
+		if want, have := testcase.want, rec.Code; want != have {
+			t.Errorf("%s: want %d, have %d", testcase.target, want, have)
+		}
+		if want, have := testcase.validated, valid.n; want != have {
+			t.Errorf("%s: want %d validations, have %d", testcase.target, want, have)
+		}
+	}
+}
+
+func TestReuseValidation(t *testing.T) {
+	var (
+		valid  = mockValidator{"t1": rbac.NewPrincipal("ann", rbac.User)}
+		reused = ReuseValidation(mockValidator{}) // validates nothing itself
+		h      = NewLimiter(1, 1).Handler(valid, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, err := reused.Validate(r.Context(), "ann", "t1"); err != nil {
+				t.Errorf("same credentials: want reused, have %v", err)
+			}
+			if _, err := reused.Validate(r.Context(), "ann", "t2"); err == nil {
+				t.Errorf("other credentials: want error, have none")
+			}
+		}))
+	)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/search?user=ann&token=t1", nil))
+}
+
+type mockValidator map[string]rbac.Principal // token: principal
+
+func (v mockValidator) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	p, ok := v[token]
+	if !ok || p.User != user {
+		return rbac.Principal{}, errors.New("bad auth")
+	}
+	return p, nil
+}
+
+type countingValidator struct {
+	Validator
+	n int
+}
+
+func (v *countingValidator) Validate(ctx context.Context, user, token string) (rbac.Principal, error) {
+	v.n++
+	return v.Validator.Validate(ctx, user, token)
+}
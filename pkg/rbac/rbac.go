@@ -0,0 +1,137 @@
+// Package rbac defines the roles that auth assigns to users, the
+// permissions they carry, and the principal that auth returns when it
+// validates a token, which other services use to authorize requests.
+package rbac
+
+import (
+	"github.com/pkg/errors"
+)
+
+var (
+	// ErrInvalidRole is returned for a role that doesn't exist.
+	ErrInvalidRole = errors.New("invalid role")
+
+	// ErrInvalidPermission is returned for a permission that doesn't exist.
+	ErrInvalidPermission = errors.New("invalid permission")
+)
+
+// Role is a named set of permissions.
+type Role string
+
+const (
+	// User is the default role. Users may access only their own data,
+	// which needs no permission.
+	User Role = "user"
+
+	// Analyst may also search across every user's data.
+	Analyst Role = "analyst"
+
+	// Admin may do anything, including read any user's data, assign
+	// roles, manage other users' API keys, reset their two-factor
+	// authentication, unlock them, disable or delete them, and read the
+	// audit log.
+	Admin Role = "admin"
+)
+
+// Permission allows a principal to do something beyond accessing their own
+// data.
+type Permission string
+
+const (
+	// ReadAny allows reading any user's DNA sample.
+	ReadAny Permission = "dna:read:any"
+
+	// SearchAll allows searching across every user's DNA.
+	SearchAll Permission = "dna:search:all"
+
+	// ManageRoles allows assigning roles to users.
+	ManageRoles Permission = "auth:roles:manage"
+
+	// ManageKeys allows creating, listing, and revoking API keys for any
+	// user, e.g. service accounts.
+	ManageKeys Permission = "auth:keys:manage"
+
+	// ResetTwoFactor allows resetting any user's two-factor authentication,
+	// e.g. when they've lost their authenticator and recovery codes.
+	ResetTwoFactor Permission = "auth:2fa:reset"
+
+	// ManageLockouts allows viewing failed login attempts, and unlocking
+	// users who are locked out.
+	ManageLockouts Permission = "auth:lockouts:manage"
+
+	// ManageUsers allows listing users, viewing their accounts, disabling
+	// and enabling them, logging them out, and deleting them.
+	ManageUsers Permission = "auth:users:manage"
+
+	// ReadAudit allows querying and verifying the audit log.
+	ReadAudit Permission = "audit:read"
+)
+
+var permissions = map[Role][]Permission{
+	User:    nil,
+	Analyst: {SearchAll},
+	Admin:   {ReadAny, SearchAll, ManageRoles, ManageKeys, ResetTwoFactor, ManageLockouts, ManageUsers, ReadAudit},
+}
+
+// ParseRole returns the role with the name, or ErrInvalidRole.
+func ParseRole(name string) (Role, error) {
+	if _, ok := permissions[Role(name)]; !ok {
+		return "", ErrInvalidRole
+	}
+	return Role(name), nil
+}
+
+// ParsePermission returns the permission with the name, or
+// ErrInvalidPermission.
+func ParsePermission(name string) (Permission, error) {
+	for _, perm := range permissions[Admin] {
+		if perm == Permission(name) {
+			return perm, nil
+		}
+	}
+	return "", ErrInvalidPermission
+}
+
+// Permissions returns the permissions carried by the role.
+func (r Role) Permissions() []Permission {
+	return append([]Permission(nil), permissions[r]...)
+}
+
+// Principal is an authenticated user, and what they're allowed to do.
+// Principals authenticated by an API key have the key's ID, and claim only
+// the permissions in the key's scope.
+type Principal struct {
+	User   string       `json:"user"`
+	Role   Role         `json:"role"`
+	Claims []Permission `json:"claims"`
+	Key    string       `json:"key,omitempty"`
+}
+
+// NewPrincipal returns a principal for the user, with the claims of the
+// role.
+func NewPrincipal(user string, role Role) Principal {
+	return Principal{User: user, Role: role, Claims: role.Permissions()}
+}
+
+// Can returns true if the principal claims the permission.
+func (p Principal) Can(perm Permission) bool {
+	for _, c := range p.Claims {
+		if c == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Restrict returns a copy of the principal claiming only those of its
+// permissions which are in scope.
+func (p Principal) Restrict(scope []Permission) Principal {
+	claims := []Permission{}
+	for _, perm := range scope {
+		if p.Can(perm) {
+			claims = append(claims, perm)
+		}
+	}
+	p.Claims = claims
+	return p
+}
@@ -0,0 +1,69 @@
+package rbac
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseRole(t *testing.T) {
+	for _, name := range []string{"user", "analyst", "admin"} {
+		if role, err := ParseRole(name); err != nil || string(role) != name {
+			t.Errorf("ParseRole(%q): want %q, have %q (%v)", name, name, role, err)
+		}
+	}
+	for _, name := range []string{"", "root", "Admin"} {
+		if want, have := ErrInvalidRole, errorOf(ParseRole(name)); want != have {
+			t.Errorf("ParseRole(%q): want %v, have %v", name, want, have)
+		}
+	}
+}
+
+func TestPrincipal(t *testing.T) {
+	for _, testcase := range []struct {
+		role Role
+		perm Permission
+		want bool
+	}{
+		{User, ReadAny, false},
+		{User, SearchAll, false},
+		{Analyst, SearchAll, true},
+		{Analyst, ReadAny, false},
+		{Analyst, ManageRoles, false},
+		{Admin, ReadAny, true},
+		{Admin, SearchAll, true},
+		{Admin, ManageRoles, true},
+		{Admin, ManageKeys, true},
+		{Admin, ResetTwoFactor, true},
+		{Analyst, ResetTwoFactor, false},
+		{Admin, ManageLockouts, true},
+		{User, ManageLockouts, false},
+		{Admin, ManageUsers, true},
+		{Analyst, ManageUsers, false},
+		{Admin, ReadAudit, true},
+		{Analyst, ReadAudit, false},
+		{Role("unknown"), ReadAny, false},
+	} {
+		p := NewPrincipal("alice", testcase.role)
+		if want, have := testcase.want, p.Can(testcase.perm); want != have {
+			t.Errorf("%s Can(%s): want %v, have %v", testcase.role, testcase.perm, want, have)
+		}
+	}
+}
+
+func TestRestrict(t *testing.T) {
+	p := NewPrincipal("alice", Analyst).Restrict([]Permission{SearchAll, ReadAny})
+	if want, have := []Permission{SearchAll}, p.Claims; !reflect.DeepEqual(want, have) {
+		t.Errorf("Restrict: want %v, have %v", want, have)
+	}
+	if want, have := false, NewPrincipal("alice", Admin).Restrict(nil).Can(ReadAny); want != have {
+		t.Errorf("Restrict to nothing: want %v, have %v", want, have)
+	}
+	if _, err := ParsePermission("dna:write:any"); err != ErrInvalidPermission {
+		t.Errorf("ParsePermission: want %v, have %v", ErrInvalidPermission, err)
+	}
+	if perm, err := ParsePermission("dna:read:any"); err != nil || perm != ReadAny {
+		t.Errorf("ParsePermission: want %v, have %v (%v)", ReadAny, perm, err)
+	}
+}
+
+func errorOf(_ Role, err error) error { return err }
@@ -0,0 +1,71 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+func TestCode(t *testing.T) {
+	// The SHA1 test vectors of RFC 6238, truncated to 6 digits.
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for _, testcase := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		have, err := Code(secret, Step(time.Unix(testcase.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := testcase.want; want != have {
+			t.Errorf("Code at %d: want %s, have %s", testcase.unix, want, have)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	for _, testcase := range []struct {
+		offset time.Duration
+		ok     bool
+	}{
+		{0, true},
+		{-Period, true},
+		{Period, true},
+		{-2 * Period, false},
+		{2 * Period, false},
+	} {
+		code, err := Code(secret, Step(now.Add(testcase.offset)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Validate(secret, code, now)
+		if want, have := testcase.ok, ok; want != have {
+			t.Errorf("Validate code from %s: want %v, have %v", testcase.offset, want, have)
+		}
+		if ok && step != Step(now.Add(testcase.offset)) {
+			t.Errorf("Validate code from %s: want step %d, have %d", testcase.offset, Step(now.Add(testcase.offset)), step)
+		}
+	}
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Errorf("Validate short code: want false, have true")
+	}
+}
+
+func TestURI(t *testing.T) {
+	want := "otpauth://totp/gattaca:ann%20b?algorithm=SHA1&digits=6&issuer=gattaca&period=30&secret=JBSWY3DPEHPK3PXP"
+	if have := URI("gattaca", "ann b", "JBSWY3DPEHPK3PXP"); want != have {
+		t.Errorf("URI: want %s, have %s", want, have)
+	}
+}